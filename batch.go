@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fas-download/fasdownload"
+	"fas-download/fasdownload/metrics"
+)
+
+// errSkipped marks a download that never started because -fail-fast
+// stopped the batch
+var errSkipped = errors.New("skipped after an earlier failure")
+
+// DownloadEntry is one item of the config's downloads list. Its Checksum
+// is checked once the whole batch has downloaded, together with the other
+// entries' checksums.
+type DownloadEntry struct {
+	URL      string   `yaml:"url"`
+	Mirrors  []string `yaml:"mirrors"`
+	Output   string   `yaml:"output"`
+	Checksum string   `yaml:"checksum"`
+
+	// downloadChecksum is the config's top-level checksum, which only its
+	// own url is checked against as it downloads
+	downloadChecksum string
+}
+
+// entries returns the downloads described by the config: the single url,
+// followed by any downloads list entries. output overrides the filename of
+// a single download.
+func (c DownloadConfig) entries(output string) ([]DownloadEntry, error) {
+	var entries []DownloadEntry
+	if c.URL != "" {
+		entries = append(entries, DownloadEntry{URL: c.URL, Mirrors: c.Mirrors, downloadChecksum: c.Checksum})
+	}
+	entries = append(entries, c.Downloads...)
+
+	if len(entries) == 0 {
+		return nil, errors.New("URL is required in config")
+	}
+	for i, entry := range entries {
+		if entry.URL == "" {
+			return nil, fmt.Errorf("download %d has no url", i+1)
+		}
+	}
+	if output != "" {
+		if len(entries) > 1 {
+			return nil, errors.New("-output can only be used with a single download")
+		}
+		entries[0].Output = output
+	}
+	return entries, nil
+}
+
+// newEntryDownloader creates the downloader for one entry. Relative names
+// go in the output directory; an absolute output path wins over it.
+func newEntryDownloader(config DownloadConfig, opts *options, entry DownloadEntry) *fasdownload.AdaptiveDownloader {
+	filename := entryFilename(config, entry)
+	if dir := outputDir(config, opts); dir != "" && !filepath.IsAbs(filename) && filename != fasdownload.StdoutFilename {
+		filename = filepath.Join(dir, filename)
+	}
+
+	downloader := newDownloader(config, opts, entry.URL, filename)
+	downloader.AutoFilename = entry.Output == ""
+	downloader.Mirrors = entry.Mirrors
+	downloader.Checksum = entry.downloadChecksum
+	return downloader
+}
+
+// entryFilename returns the name an entry is saved as. Without an output
+// name the file is named after the URL, unless the server suggests a name
+// with Content-Disposition.
+func entryFilename(config DownloadConfig, entry DownloadEntry) string {
+	if entry.Output != "" {
+		return entry.Output
+	}
+	// A directory URL fetched as its index file is named after it
+	if fasdownload.IsDirectoryURL(entry.URL) && fasdownload.TrailingSlashMode(config.TrailingSlash) == fasdownload.TrailingSlashIndex {
+		if config.IndexFile != "" {
+			return filepath.Base(config.IndexFile)
+		}
+		return fasdownload.DefaultIndexFile
+	}
+	// Try to extract filename from URL; the server may name it after all
+	if name := fasdownload.FilenameFromURL(entry.URL); name != "" {
+		return name
+	}
+	return fasdownload.DefaultFilename
+}
+
+// outputDir returns the directory relative output names go in: -output-dir,
+// then output_dir, then the sandbox root; empty for the working directory
+func outputDir(config DownloadConfig, opts *options) string {
+	dir := config.OutputDir
+	if opts.set["output-dir"] {
+		dir = opts.outputDir
+	}
+	if dir == "" {
+		dir = opts.sandboxRoot
+	}
+	return dir
+}
+
+// batchResult is the outcome of one download in a batch
+type batchResult struct {
+	downloader *fasdownload.AdaptiveDownloader
+	duration   time.Duration
+	err        error
+}
+
+// runBatch downloads every entry, at most opts.parallel at a time, each with
+// its own downloader. A failure only stops the others under -fail-fast.
+// Entries with a checksum are verified once every download has finished,
+// and only then extracted.
+func runBatch(ctx context.Context, config DownloadConfig, opts *options, entries []DownloadEntry, deltaBlocks *fasdownload.BlockChecksums, collector *metrics.Collector, log *logger, stderr io.Writer) []batchResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var progress func(fasdownload.Progress)
+	if opts.json {
+		progress = jsonProgress(stderr)
+	} else if opts.parallel > 1 {
+		// Progress lines from several downloads would overwrite each other
+		progress = func(fasdownload.Progress) {}
+	}
+
+	results := make([]batchResult, len(entries))
+	// A failed extraction leaves the archive for the user to unpack
+	extract := func(r *batchResult) {
+		if r.err = extractDownload(r.downloader, opts.extractDir, log); r.err != nil {
+			if !opts.json {
+				log.logf(levelError, "Extraction failed, keeping %s: %v\n", r.downloader.Filename, r.err)
+			}
+			if opts.failFast {
+				cancel()
+			}
+		}
+	}
+	slots := make(chan struct{}, opts.parallel)
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		downloader := newEntryDownloader(config, opts, entry)
+		downloader.DeltaBlocks = deltaBlocks
+		downloader.ProgressFunc = progress
+		if !opts.json {
+			downloader.Output = log.downloaderOutput()
+		}
+		results[i].downloader = downloader
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			results[i].err = errSkipped
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *batchResult, checksum string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if !opts.json {
+				log.logf(levelInfo, "Downloading %s to %s\n", r.downloader.URL, r.downloader.Filename)
+			}
+
+			start := time.Now()
+			// Nothing, not even the directory, is created outside the sandbox
+			if r.downloader.Filename != fasdownload.StdoutFilename {
+				r.err = fasdownload.CheckSandbox(r.downloader.SandboxRoot, r.downloader.Filename)
+				if r.err == nil {
+					r.err = os.MkdirAll(filepath.Dir(r.downloader.Filename), 0755)
+				}
+			}
+			if r.err == nil {
+				untrack := trackDownload(collector, r.downloader)
+				r.err = r.downloader.Download(ctx)
+				untrack()
+			}
+			r.duration = time.Since(start)
+			if errors.Is(r.err, fasdownload.ErrNotModified) {
+				if !opts.json {
+					log.logf(levelInfo, "%s: file up to date\n", r.downloader.Filename)
+				}
+				r.err = nil
+				return
+			}
+			if errors.Is(r.err, fasdownload.ErrFileExists) {
+				r.err = fmt.Errorf("%s: %w, use -force to overwrite", r.downloader.Filename, fasdownload.ErrFileExists)
+			}
+
+			if r.err != nil {
+				if !opts.json {
+					if errors.Is(r.err, context.Canceled) {
+						log.logf(levelError, "\nDownload interrupted; partial data kept in %s\n", r.downloader.PartPath())
+					} else {
+						log.logf(levelError, "Download failed: %v\n", r.err)
+					}
+				}
+				if opts.failFast {
+					cancel()
+				}
+			}
+
+			if r.err == nil && opts.extract && checksum == "" {
+				extract(r)
+			}
+		}(&results[i], entry.Checksum)
+	}
+
+	wg.Wait()
+	verified := verifyBatch(ctx, config, opts, entries, results, log)
+	if opts.extract {
+		for _, r := range verified {
+			extract(r)
+		}
+	}
+	return results
+}
+
+// verifyBatch checks the files of the entries that downloaded against their
+// checksums, verify_workers at a time, marks the ones that don't match as
+// failed and returns those that do
+func verifyBatch(ctx context.Context, config DownloadConfig, opts *options, entries []DownloadEntry, results []batchResult, log *logger) []*batchResult {
+	var files []fasdownload.FileChecksum
+	var checked []*batchResult
+	for i, entry := range entries {
+		if entry.Checksum != "" && results[i].err == nil {
+			files = append(files, fasdownload.FileChecksum{Path: results[i].downloader.Filename, Checksum: entry.Checksum})
+			checked = append(checked, &results[i])
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	if !opts.json {
+		log.logf(levelInfo, "Verifying %d files\n", len(files))
+	}
+	// Each failure is reported with its download, so the total isn't needed
+	verifyResults, _ := fasdownload.VerifyFiles(ctx, files, config.VerifyWorkers)
+	var verified []*batchResult
+	for i, result := range verifyResults {
+		if result.Err != nil {
+			checked[i].err = fmt.Errorf("%s: %w", result.Path, result.Err)
+			if !opts.json {
+				log.logf(levelError, "Verification failed: %v\n", checked[i].err)
+			}
+			continue
+		}
+		verified = append(verified, checked[i])
+	}
+	return verified
+}
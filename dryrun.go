@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"fas-download/fasdownload"
+)
+
+// dryRun prints the plan for every entry without downloading anything and
+// returns the process exit code
+func dryRun(ctx context.Context, config DownloadConfig, opts *options, entries []DownloadEntry, stdout io.Writer) int {
+	code := 0
+	for i, entry := range entries {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+
+		downloader := newEntryDownloader(config, opts, entry)
+		plan, err := downloader.Plan(ctx)
+		if err != nil {
+			fmt.Fprintf(stdout, "Dry run for %s failed: %v\n", entry.URL, err)
+			code = 1
+			continue
+		}
+		printPlan(stdout, plan)
+	}
+	return code
+}
+
+// printPlan writes a download plan in human-readable form
+func printPlan(w io.Writer, plan *fasdownload.DownloadPlan) {
+	fmt.Fprintf(w, "URL: %s\n", plan.URL)
+	fmt.Fprintf(w, "Output: %s\n", plan.Filename)
+	if plan.FileSize >= 0 {
+		fmt.Fprintf(w, "File size: %d bytes\n", plan.FileSize)
+	} else {
+		fmt.Fprintf(w, "File size: unknown\n")
+	}
+	if plan.Protocol != "" {
+		fmt.Fprintf(w, "Protocol: %s\n", plan.Protocol)
+	}
+
+	if plan.SupportsRanges {
+		fmt.Fprintf(w, "Range requests: supported\n")
+	} else {
+		fmt.Fprintf(w, "Range requests: not supported\n")
+	}
+	// Only a parallel download is split into chunks
+	if plan.ChunkSize == 0 {
+		fmt.Fprintf(w, "Would download in a single connection\n")
+		return
+	}
+	if plan.Resumed > 0 {
+		fmt.Fprintf(w, "Resuming: %d bytes already on disk\n", plan.Resumed)
+	}
+	fmt.Fprintf(w, "Chunk size: %d bytes\n", plan.ChunkSize)
+	fmt.Fprintf(w, "Chunks: %d\n", plan.Chunks)
+	fmt.Fprintf(w, "Initial connections: %d\n", plan.Connections)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fas-download/fasdownload"
+)
+
+// archiveFormats maps the file name suffixes -extract unpacks to the
+// unpacker for each
+var archiveFormats = []struct {
+	suffix string
+	unpack func(path, dir string) error
+}{
+	{".zip", extractZip},
+	{".tar.gz", extractTarGz},
+	{".tgz", extractTarGz},
+}
+
+// archiveFormat returns filename without its archive suffix and the
+// unpacker for it, or a nil unpacker when it isn't an archive -extract
+// knows
+func archiveFormat(filename string) (stem string, unpack func(path, dir string) error) {
+	base := filepath.Base(filename)
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(strings.ToLower(base), format.suffix) {
+			return base[:len(base)-len(format.suffix)], format.unpack
+		}
+	}
+	return "", nil
+}
+
+// extractDownload unpacks a finished download that is an archive into dir,
+// or without one into a folder beside it named after it. Whatever happens,
+// the archive itself is left in place.
+func extractDownload(downloader *fasdownload.AdaptiveDownloader, dir string, log *logger) error {
+	stem, unpack := archiveFormat(downloader.Filename)
+	if unpack == nil {
+		log.logf(levelDebug, "%s is not a .zip, .tar.gz or .tgz archive; nothing to extract\n", downloader.Filename)
+		return nil
+	}
+	if dir == "" {
+		if stem == "" {
+			stem = "extracted"
+		}
+		dir = filepath.Join(filepath.Dir(downloader.Filename), stem)
+	}
+	if err := fasdownload.CheckSandbox(downloader.SandboxRoot, dir); err != nil {
+		return err
+	}
+
+	log.logf(levelInfo, "Extracting %s to %s\n", downloader.Filename, dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return unpack(downloader.Filename, dir)
+}
+
+// extractZip unpacks the zip archive at path into dir
+func extractZip(path, dir string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, f := range archive.File {
+		target, err := entryPath(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(target, 0755)
+		case mode&os.ModeSymlink != 0:
+			err = extractZipLink(dir, f, target)
+		case mode.IsRegular():
+			err = extractZipFile(f, target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractZipFile writes a zip entry's contents to target
+func extractZipFile(f *zip.File, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return writeEntry(target, rc, f.Mode().Perm())
+}
+
+// extractZipLink creates the symlink a zip entry holds; its contents are
+// the link's target
+func extractZipLink(dir string, f *zip.File, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	linkname, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return err
+	}
+	return writeSymlink(dir, f.Name, string(linkname), target)
+}
+
+// extractTarGz unpacks the gzipped tar archive at path into dir. Devices,
+// FIFOs and other special entries are skipped.
+func extractTarGz(path, dir string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := entryPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeEntry(target, tr, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			err = writeSymlink(dir, header.Name, header.Linkname, target)
+		case tar.TypeLink:
+			var source string
+			if source, err = entryPath(dir, header.Linkname); err == nil {
+				err = replace(target, func() error { return os.Link(source, target) })
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// entryPath returns where the archive entry name goes in dir. A name that
+// would land outside dir, such as one climbing out with "../" (zip slip),
+// or a path through a symlink the archive created is refused. A file or
+// link already at the path itself is replaced, not written through.
+func entryPath(dir, name string) (string, error) {
+	if name == "" || filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("archive entry %q is not a relative path", name)
+	}
+	rel, ok := inside(dir, name)
+	if !ok {
+		return "", fmt.Errorf("archive entry %q would be written outside %s", name, dir)
+	}
+	target := filepath.Join(dir, rel)
+
+	// Writing through a symlink could reach anywhere it points
+	path := dir
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %q would be written through the symlink %s", name, path)
+		}
+	}
+	return target, nil
+}
+
+// inside returns the relative path name leads to from dir, and whether
+// that is still within dir
+func inside(dir, name string) (string, bool) {
+	rel, err := filepath.Rel(dir, filepath.Join(dir, name))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// writeEntry writes an archive entry's contents to target
+func writeEntry(target string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return replace(target, func() error {
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm|0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, r); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+}
+
+// replace removes any file or link already at target, from an earlier
+// extraction, then creates target anew
+func replace(target string, create func() error) error {
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	return create()
+}
+
+// writeSymlink creates the symlink an archive entry named name holds, as
+// long as what it points to is inside dir too
+func writeSymlink(dir, name, linkname, target string) error {
+	if _, ok := inside(dir, filepath.Join(filepath.Dir(name), linkname)); !ok || filepath.IsAbs(linkname) {
+		return fmt.Errorf("archive entry %q links outside %s, to %s", name, dir, linkname)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return replace(target, func() error { return os.Symlink(linkname, target) })
+}
@@ -0,0 +1,168 @@
+package fasdownload
+
+import (
+	"context"
+	"time"
+)
+
+// defaultAdaptInterval is how often connections are re-evaluated when
+// AdaptInterval is not set
+const defaultAdaptInterval = 3 * time.Second
+
+// minThroughputGain is how much faster one connection count must measure
+// than another to count as better, so measurement noise doesn't make the
+// adaptive logic flap between neighbouring counts
+const minThroughputGain = 0.05
+
+// throughputDropTolerance is how far throughput may fall below what it was
+// when the search settled before the search starts over, for a network or
+// server whose capacity changed mid-download
+const throughputDropTolerance = 0.25
+
+// hillClimb searches for the connection count with the highest aggregate
+// throughput. Each interval's throughput is recorded against the count it
+// ran at; the search moves to a neighbouring count that measured faster,
+// keeps adding connections only while each one improves throughput, backs
+// off when the last one didn't help, and probes fewer connections only
+// once more have been shown to hurt. With neither neighbour better it
+// holds.
+type hillClimb struct {
+	started  bool
+	bytes    int64
+	at       time.Time
+	level    int // the connection count the current interval runs at
+	rates    map[int]float64
+	holding  bool
+	holdRate float64
+}
+
+// better reports whether the rate measured at count a beats the one at b
+// by more than the noise margin; an unmeasured count is never better
+func (c *hillClimb) better(a, b int) bool {
+	ra, okA := c.rates[a]
+	rb, okB := c.rates[b]
+	return okA && okB && ra > rb*(1+minThroughputGain)
+}
+
+// next returns the connection count to run the next interval at, given
+// the bounds and whether connections may be added
+func (c *hillClimb) next(n, lowest, highest int, canAdd bool) int {
+	up, down := n+1, n-1
+	upAllowed := canAdd && up <= highest
+	downAllowed := down >= lowest
+	_, upMeasured := c.rates[up]
+	_, downMeasured := c.rates[down]
+
+	switch {
+	// Move to a neighbour that already measured faster, the fastest if both did
+	case downAllowed && c.better(down, n) && !(upAllowed && c.better(up, down)):
+		return down
+	case upAllowed && c.better(up, n):
+		return up
+
+	// Keep climbing while the last connection added helped
+	case upAllowed && !upMeasured && (!downMeasured || c.better(n, down)):
+		return up
+
+	// The last connection added didn't help: give it back
+	case downAllowed && downMeasured && !c.better(n, down) && !c.better(up, n):
+		return down
+
+	// More connections hurt: try fewer
+	case downAllowed && !downMeasured && upMeasured && c.better(n, up):
+		return down
+	}
+	return n
+}
+
+// calculateOptimalConnections adapts the number of connections to the
+// aggregate throughput measured since it last ran, searching for the
+// count beyond which another connection no longer helps
+func (d *AdaptiveDownloader) calculateOptimalConnections() {
+	downloaded := d.Stats.Downloaded()
+	at := now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := &d.climb
+	n := d.CurrentConnections
+
+	// Start measuring, or start over when something else, such as the
+	// error burst breaker, changed the count mid-interval
+	if !c.started || c.level != n {
+		*c = hillClimb{started: true, bytes: downloaded, at: at, level: n, rates: make(map[int]float64)}
+		return
+	}
+	rate := averageSpeed(downloaded-c.bytes, at.Sub(c.at))
+	if rate <= 0 {
+		return // Not enough data yet
+	}
+	c.bytes, c.at = downloaded, at
+	c.rates[n] = rate
+
+	if c.holding {
+		if rate >= c.holdRate*(1-throughputDropTolerance) {
+			return
+		}
+		d.debugf("Throughput fell to %.2f MB/s; searching for a better connection count\n", rate/1024/1024)
+		c.rates = map[int]float64{n: rate}
+		c.holding = false
+	}
+
+	next := c.next(n, min(d.MinConnections, d.connectionLimit()), d.connectionLimit(), !d.burst.paused(at))
+	perConnection := rate / float64(n) / 1024 / 1024
+	switch {
+	case next > n:
+		d.debugf("Increasing connections to %d (%.2f MB/s, %.2f MB/s per connection)\n", next, rate/1024/1024, perConnection)
+	case next < n:
+		d.debugf("Decreasing connections to %d (%.2f MB/s, %.2f MB/s per connection)\n", next, rate/1024/1024, perConnection)
+	default:
+		d.debugf("Holding at %d connections (%.2f MB/s, %.2f MB/s per connection)\n", n, rate/1024/1024, perConnection)
+		c.holding, c.holdRate = true, rate
+		return
+	}
+
+	d.CurrentConnections = next
+	c.level = next
+
+	// Keep the live worker count in step with the new target
+	if d.pool != nil {
+		d.pool.resize(d.CurrentConnections)
+	}
+}
+
+// startAdapting runs calculateOptimalConnections every AdaptInterval in the
+// background and returns a func that stops it and waits for it to exit
+func (d *AdaptiveDownloader) startAdapting(ctx context.Context) func() {
+	interval := d.AdaptInterval
+	if interval <= 0 {
+		interval = defaultAdaptInterval
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticks, stop := currentClock().Tick(interval)
+		defer stop()
+
+		d.calculateOptimalConnections() // start measuring
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticks:
+				// A paused download's throughput says nothing about the
+				// connections
+				if !d.Paused() {
+					d.calculateOptimalConnections()
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
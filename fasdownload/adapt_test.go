@@ -0,0 +1,233 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// feedThroughput runs one adaptation interval: a second passes on clock
+// while the downloader receives rate bytes
+func feedThroughput(d *AdaptiveDownloader, clock *replayClock, rate float64) {
+	clock.advance(time.Second)
+	d.Stats.mu.Lock()
+	d.Stats.BytesDownloaded += int64(rate)
+	d.Stats.mu.Unlock()
+	d.calculateOptimalConnections()
+}
+
+func TestHillClimbConverges(t *testing.T) {
+	const mb = 1024 * 1024
+	t.Cleanup(func() { SetClock(nil) })
+
+	tests := []struct {
+		name  string
+		start int
+		max   int
+		curve func(n int) float64 // aggregate throughput at n connections
+		want  int
+	}{
+		{
+			name:  "peak in the middle",
+			start: 4, max: 16,
+			curve: func(n int) float64 { return float64(min(n, 6)*10-max(n-6, 0)*5) * mb },
+			want:  6,
+		},
+		{
+			name:  "more connections hurt",
+			start: 4, max: 16,
+			curve: func(n int) float64 { return float64(40-n*5) * mb },
+			want:  2,
+		},
+		{
+			name:  "keeps scaling",
+			start: 4, max: 8,
+			curve: func(n int) float64 { return float64(n*10) * mb },
+			want:  8,
+		},
+		{
+			name:  "flat",
+			start: 4, max: 16,
+			curve: func(n int) float64 { return 40 * mb },
+			want:  4,
+		},
+		{
+			name:  "diminishing returns",
+			start: 2, max: 16,
+			curve: func(n int) float64 { return []float64{0, 30, 50, 70, 80, 82, 83}[min(n, 6)] * mb },
+			want:  4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			SetClock(clock)
+
+			downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+			downloader.CurrentConnections = tt.start
+			downloader.MaxConnections = tt.max
+			downloader.calculateOptimalConnections() // start measuring
+
+			// Measurements alternate 1% either side of the curve, inside
+			// the noise margin
+			var counts []int
+			for i := 0; i < 40; i++ {
+				noise := 1.01
+				if i%2 == 1 {
+					noise = 0.99
+				}
+				feedThroughput(downloader, clock, tt.curve(downloader.CurrentConnections)*noise)
+				counts = append(counts, downloader.CurrentConnections)
+			}
+
+			for _, n := range counts[20:] {
+				if n != tt.want {
+					t.Fatalf("Expected to settle at %d connections, got %v", tt.want, counts)
+				}
+			}
+			changes := 0
+			for i := 1; i < len(counts); i++ {
+				if counts[i] != counts[i-1] {
+					changes++
+				}
+			}
+			if changes > 10 {
+				t.Errorf("Expected a direct search, got %d changes: %v", changes, counts)
+			}
+		})
+	}
+}
+
+func TestHillClimbRestartsWhenThroughputFalls(t *testing.T) {
+	const mb = 1024 * 1024
+	clock := &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	SetClock(clock)
+	t.Cleanup(func() { SetClock(nil) })
+
+	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+	downloader.calculateOptimalConnections()
+
+	// The server does best with 6 connections, then with 3
+	peak := 6
+	curve := func(n int) float64 { return float64(min(n, peak)*10-max(n-peak, 0)*5) * mb }
+	for i := 0; i < 20; i++ {
+		feedThroughput(downloader, clock, curve(downloader.CurrentConnections))
+	}
+	if downloader.CurrentConnections != 6 {
+		t.Fatalf("Expected 6 connections, got %d", downloader.CurrentConnections)
+	}
+
+	peak = 3
+	for i := 0; i < 20; i++ {
+		feedThroughput(downloader, clock, curve(downloader.CurrentConnections)/2)
+	}
+	if downloader.CurrentConnections != 3 {
+		t.Errorf("Expected the search to move to 3 connections, got %d", downloader.CurrentConnections)
+	}
+}
+
+// tickClock is a replayClock whose ticks the test sends by hand
+type tickClock struct {
+	*replayClock
+	ticks    chan time.Time
+	interval time.Duration
+}
+
+func (c *tickClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	c.interval = d
+	c.mu.Unlock()
+	return c.ticks, func() {}
+}
+
+func TestAdaptOnSchedule(t *testing.T) {
+	const mb = 1024 * 1024
+	clock := &tickClock{
+		replayClock: &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		ticks:       make(chan time.Time),
+	}
+	SetClock(clock)
+	t.Cleanup(func() { SetClock(nil) })
+
+	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+	downloader.AdaptInterval = 50 * time.Millisecond
+	stop := downloader.startAdapting(context.Background())
+	defer stop()
+
+	connections := func() (int, bool) {
+		downloader.mu.Lock()
+		defer downloader.mu.Unlock()
+		return downloader.CurrentConnections, downloader.climb.started
+	}
+	waitFor := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			n, started := connections()
+			if started && n == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d connections, got %d", want, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(4) // the first measurement has started
+
+	// Throughput keeps scaling, so every tick should add a connection
+	for want := 5; want <= 7; want++ {
+		clock.advance(time.Second)
+		downloader.Stats.mu.Lock()
+		downloader.Stats.BytesDownloaded += int64((want - 1) * 10 * mb)
+		downloader.Stats.mu.Unlock()
+		clock.ticks <- clock.Now()
+		waitFor(want)
+	}
+
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if clock.interval != 50*time.Millisecond {
+		t.Errorf("Expected ticks every 50ms, got %v", clock.interval)
+	}
+}
+
+// slowReader serves its content in small reads with a pause before each
+type slowReader struct {
+	*bytes.Reader
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	return r.Reader.Read(p[:min(len(p), 16*1024)])
+}
+
+func TestAdaptWithFewLargeChunks(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, slowReader{bytes.NewReader(payload)})
+	}))
+	defer server.Close()
+
+	// Two chunks take a few hundred milliseconds between them, long enough
+	// for several evaluations
+	var output bytes.Buffer
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.ChunkSize = 256 * 1024
+	downloader.AdaptInterval = 20 * time.Millisecond
+	downloader.Output = &output
+	downloader.Verbose = true
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if !strings.Contains(output.String(), "Increasing connections to 5") {
+		t.Errorf("Expected connections to adapt while the chunks downloaded, got:\n%s", output.String())
+	}
+}
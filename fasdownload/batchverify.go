@@ -0,0 +1,96 @@
+package fasdownload
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DefaultVerifyWorkers is the number of files VerifyFiles hashes at once
+// when no worker count is given. Hashing is mostly disk-bound, so a few
+// readers keep the disk busy without making it seek between many files.
+const DefaultVerifyWorkers = 4
+
+// FileChecksum names a file and the "algorithm:hexdigest" it must match
+type FileChecksum struct {
+	Path     string
+	Checksum string
+}
+
+// VerifyResult is the outcome of checking one file. Err is nil when the
+// file matched; Actual holds the computed digest whenever hashing succeeded.
+type VerifyResult struct {
+	Path     string
+	Checksum string
+	Actual   string
+	Err      error
+}
+
+// VerifyFiles checks the files against their checksums using up to workers
+// concurrent hashers (DefaultVerifyWorkers if workers <= 0). Results are
+// returned in input order; the error summarizes how many files failed.
+// Files are only read, never quarantined or removed.
+func VerifyFiles(ctx context.Context, files []FileChecksum, workers int) ([]VerifyResult, error) {
+	if workers <= 0 {
+		workers = DefaultVerifyWorkers
+	}
+	workers = min(workers, len(files))
+
+	results := make([]VerifyResult, len(files))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = verifyFile(ctx, files[i])
+			}
+		}()
+	}
+
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d files failed verification", failed, len(files))
+	}
+	return results, nil
+}
+
+// verifyFile hashes one file and compares it with its expected checksum
+func verifyFile(ctx context.Context, file FileChecksum) VerifyResult {
+	result := VerifyResult{Path: file.Path, Checksum: file.Checksum}
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	algorithm, expected, err := parseChecksum(file.Checksum)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	actual, err := hashFile(file.Path, algorithm, -1)
+	if err != nil {
+		result.Err = fmt.Errorf("failed to verify checksum: %w", err)
+		return result
+	}
+	result.Actual = actual
+
+	if actual != expected {
+		result.Err = &ChecksumMismatchError{Algorithm: algorithm, Expected: expected, Actual: actual}
+	}
+	return result
+}
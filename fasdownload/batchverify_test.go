@@ -0,0 +1,57 @@
+package fasdownload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	var files []FileChecksum
+	for i := 0; i < 6; i++ {
+		payload := testPayload(32*1024 + i)
+		path := filepath.Join(dir, fmt.Sprintf("file%d.bin", i))
+		if err := os.WriteFile(path, payload, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+
+		sum := sha256.Sum256(payload)
+		if i == 3 {
+			sum = sha256.Sum256([]byte("something else"))
+		}
+		files = append(files, FileChecksum{Path: path, Checksum: "sha256:" + hex.EncodeToString(sum[:])})
+	}
+
+	results, err := VerifyFiles(context.Background(), files, 3)
+	if err == nil || !strings.Contains(err.Error(), "1 of 6 files") {
+		t.Errorf("Expected an error reporting 1 of 6 files failed, got %v", err)
+	}
+
+	if len(results) != len(files) {
+		t.Fatalf("Expected %d results, got %d", len(files), len(results))
+	}
+	for i, result := range results {
+		if result.Path != files[i].Path {
+			t.Errorf("Result %d is for %s, expected %s", i, result.Path, files[i].Path)
+		}
+		if i == 3 {
+			if result.Err == nil || !strings.Contains(result.Err.Error(), "checksum mismatch") {
+				t.Errorf("Expected a checksum mismatch for %s, got %v", result.Path, result.Err)
+			}
+		} else if result.Err != nil {
+			t.Errorf("Expected %s to verify, got %v", result.Path, result.Err)
+		}
+	}
+
+	// Verification never disposes of files
+	if _, err := os.Stat(files[3].Path); err != nil {
+		t.Errorf("Expected mismatched file to be left in place: %v", err)
+	}
+}
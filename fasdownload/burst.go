@@ -0,0 +1,125 @@
+package fasdownload
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Defaults for backing off when the server answers with a burst of 5xx errors
+const (
+	DefaultErrorBurstThreshold = 5
+	DefaultErrorBurstWindow    = 2 * time.Second
+	DefaultErrorBurstPause     = 2 * time.Second
+)
+
+// errorBurst is a circuit breaker shared by every worker of a download.
+// Enough server errors within the window open it: requests pause, and the
+// downloader drops to its minimum connection count until the pause is over.
+type errorBurst struct {
+	threshold   int
+	window      time.Duration
+	pause       time.Duration
+	recent      []time.Time
+	pausedUntil time.Time
+	mu          sync.Mutex
+}
+
+// newErrorBurst returns a breaker using the defaults for zero values, or nil
+// when threshold is negative
+func newErrorBurst(threshold int, window, pause time.Duration) *errorBurst {
+	if threshold < 0 {
+		return nil
+	}
+	if threshold == 0 {
+		threshold = DefaultErrorBurstThreshold
+	}
+	if window <= 0 {
+		window = DefaultErrorBurstWindow
+	}
+	if pause <= 0 {
+		pause = DefaultErrorBurstPause
+	}
+	return &errorBurst{threshold: threshold, window: window, pause: pause}
+}
+
+// record notes a server error at now and reports whether it opened the
+// breaker. Errors while already paused are the tail of the same burst.
+func (b *errorBurst) record(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Before(b.pausedUntil) {
+		return false
+	}
+
+	cutoff := now.Add(-b.window)
+	kept := b.recent[:0]
+	for _, at := range b.recent {
+		if at.After(cutoff) {
+			kept = append(kept, at)
+		}
+	}
+	b.recent = append(kept, now)
+
+	if len(b.recent) < b.threshold {
+		return false
+	}
+	b.recent = b.recent[:0]
+	b.pausedUntil = now.Add(b.pause)
+	return true
+}
+
+// reset forgets recent errors and ends any pause, for when requests move
+// to a different server
+func (b *errorBurst) reset() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recent = b.recent[:0]
+	b.pausedUntil = time.Time{}
+}
+
+// paused reports whether the breaker is open at now
+func (b *errorBurst) paused(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.pausedUntil)
+}
+
+// wait blocks until the breaker closes or ctx is done
+func (b *errorBurst) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	delay := b.pausedUntil.Sub(now())
+	b.mu.Unlock()
+	return sleepContext(ctx, delay)
+}
+
+// backOff drops to MinConnections after a burst of server errors. The
+// adaptive logic ramps back up once the pause is over and chunks complete
+// quickly again.
+func (d *AdaptiveDownloader) backOff(pause time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.CurrentConnections = min(d.MinConnections, d.connectionLimit())
+	d.logf("Server error burst: dropping to %d connections and pausing for %v\n", d.CurrentConnections, pause)
+	if d.pool != nil {
+		d.pool.resize(d.CurrentConnections)
+	}
+}
@@ -0,0 +1,133 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestErrorBurst(t *testing.T) {
+	start := time.Unix(0, 0)
+	b := newErrorBurst(3, time.Second, 500*time.Millisecond)
+
+	// Errors spread wider than the window never add up to a burst
+	for i := 0; i < 5; i++ {
+		if b.record(start.Add(time.Duration(i) * 600 * time.Millisecond)) {
+			t.Fatalf("Error %d opened the breaker though errors were spread out", i+1)
+		}
+	}
+
+	now := start.Add(10 * time.Second)
+	b.record(now)
+	b.record(now.Add(100 * time.Millisecond))
+	if !b.record(now.Add(200 * time.Millisecond)) {
+		t.Fatal("Expected 3 errors within the window to open the breaker")
+	}
+	if !b.paused(now.Add(300 * time.Millisecond)) {
+		t.Error("Expected the breaker to be open during the pause")
+	}
+	if b.record(now.Add(400 * time.Millisecond)) {
+		t.Error("Expected errors during the pause not to reopen the breaker")
+	}
+	if b.paused(now.Add(800 * time.Millisecond)) {
+		t.Error("Expected the breaker to close after the pause")
+	}
+
+	if newErrorBurst(-1, 0, 0) != nil {
+		t.Error("Expected a negative threshold to disable the breaker")
+	}
+}
+
+func TestErrorBurstBacksOff(t *testing.T) {
+	const chunkSize = 16 * 1024
+	payload := testPayload(300 * chunkSize)
+
+	// A stretch of requests in the middle of the download all fail
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			if n := gets.Add(1); n > 40 && n <= 55 {
+				http.Error(w, "overloaded", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "burst.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = chunkSize
+	downloader.CurrentConnections = 6
+	downloader.MaxConnections = 8
+	downloader.RetryPolicy = &fixedRetryPolicy{max: 20, delay: 5 * time.Millisecond}
+	downloader.ErrorBurstThreshold = 5
+	downloader.ErrorBurstWindow = time.Second
+	downloader.ErrorBurstPause = 200 * time.Millisecond
+	downloader.AdaptInterval = 20 * time.Millisecond
+
+	// Sample the connection count while the download runs
+	var history []int
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			downloader.mu.Lock()
+			n := downloader.CurrentConnections
+			downloader.mu.Unlock()
+			if len(history) == 0 || history[len(history)-1] != n {
+				history = append(history, n)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	err := downloader.Download(context.Background())
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Downloaded file does not match payload")
+	}
+
+	// Connections fall to the minimum, then climb again
+	dropped := -1
+	for i, n := range history {
+		if n == downloader.MinConnections && i > 0 {
+			dropped = i
+			break
+		}
+	}
+	if dropped < 0 {
+		t.Fatalf("Expected connections to drop to %d, got %v", downloader.MinConnections, history)
+	}
+	recovered := false
+	for _, n := range history[dropped:] {
+		if n > downloader.MinConnections {
+			recovered = true
+		}
+	}
+	if !recovered {
+		t.Errorf("Expected connections to ramp back up after the pause, got %v", history)
+	}
+}
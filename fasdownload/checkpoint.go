@@ -0,0 +1,204 @@
+package fasdownload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SizeChangePolicy decides what happens when the server reports a different
+// size than the checkpoint of an interrupted download recorded
+type SizeChangePolicy string
+
+const (
+	// SizeChangeRestart discards the partial download and starts over
+	SizeChangeRestart SizeChangePolicy = "restart"
+	// SizeChangeFail fails the download, leaving the partial file alone
+	SizeChangeFail SizeChangePolicy = "fail"
+	// SizeChangeContinueIfLarger keeps the bytes already fetched and only
+	// downloads the new tail when the file grew, as an append-only log
+	// does; a file that shrank starts over
+	SizeChangeContinueIfLarger SizeChangePolicy = "continue-if-larger"
+)
+
+// checkpoint records which byte ranges of a .part file are already on disk
+// so an interrupted download can resume with any connection settings
+type checkpoint struct {
+	URL          string      `json:"url"`
+	FileSize     int64       `json:"file_size"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Completed    []byteRange `json:"completed"`
+}
+
+// statePath returns where the resume checkpoint is stored
+func (d *AdaptiveDownloader) statePath() string {
+	return d.PartPath() + ".state"
+}
+
+// loadCheckpoint returns the completed ranges from a previous run, or an
+// empty set when there is nothing compatible to resume. A changed ETag or,
+// without ETags, Last-Modified means the file changed, so it starts over;
+// a changed size without validators to tell is handled by OnSizeChange.
+// When it resumes, chunk requests carry the checkpoint's validator in
+// If-Range so a file that changes after the HEAD is caught too.
+func (d *AdaptiveDownloader) loadCheckpoint() (*rangeSet, error) {
+	completed := &rangeSet{}
+	d.ifRange = ""
+
+	// Files written in place have nowhere to keep a state file, so they
+	// always start over
+	if d.inPlace() {
+		return completed, nil
+	}
+
+	if _, err := os.Stat(d.PartPath()); err != nil {
+		return completed, nil
+	}
+
+	data, err := os.ReadFile(d.statePath())
+	if err != nil {
+		return completed, nil
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return completed, nil
+	}
+	if cp.URL != d.URL {
+		return completed, nil
+	}
+	if cp.ETag != "" && d.etag != "" && cp.ETag != d.etag {
+		d.logf("Remote file changed (ETag %s, was %s); restarting download\n", d.etag, cp.ETag)
+		return completed, nil
+	}
+	if (cp.ETag == "" || d.etag == "") && cp.LastModified != "" && d.lastModified != "" && cp.LastModified != d.lastModified {
+		d.logf("Remote file changed (modified %s, was %s); restarting download\n", d.lastModified, cp.LastModified)
+		return completed, nil
+	}
+	if cp.FileSize != d.FileSize {
+		switch {
+		case d.OnSizeChange == SizeChangeFail:
+			return nil, fmt.Errorf("remote file size changed from %d to %d bytes since the download was interrupted", cp.FileSize, d.FileSize)
+		case d.OnSizeChange == SizeChangeContinueIfLarger && d.FileSize > cp.FileSize:
+			d.logf("Remote file grew from %d to %d bytes; downloading the new tail\n", cp.FileSize, d.FileSize)
+		default:
+			d.logf("Remote file size changed from %d to %d bytes; restarting download\n", cp.FileSize, d.FileSize)
+			return completed, nil
+		}
+	}
+
+	for _, r := range cp.Completed {
+		completed.add(r.Start, r.End)
+	}
+	if completed.total() > 0 {
+		d.ifRange = ifRangeValidator(cp.ETag, cp.LastModified)
+	}
+	return completed, nil
+}
+
+// ifRangeValidator returns the If-Range value for a file with these
+// validators: the ETag when it is strong, since a weak one may not be used
+// there, otherwise the Last-Modified date; "" when there is neither
+func ifRangeValidator(etag, lastModified string) string {
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return lastModified
+}
+
+// restartChanged starts a resumed download over after a chunk request
+// found, through If-Range, that the remote file has changed since the
+// bytes on disk were fetched
+func (d *AdaptiveDownloader) restartChanged(ctx context.Context) error {
+	d.logf("\nRemote file changed since the download was interrupted; restarting download\n")
+	return d.restart(ctx)
+}
+
+// restartStale starts a resumed download over after a chunk request was
+// refused with 416, discarding the checkpoint whose size it planned with
+func (d *AdaptiveDownloader) restartStale(ctx context.Context, err error) error {
+	d.logf("\n%v; discarding the checkpoint and restarting download\n", err)
+	return d.restart(ctx)
+}
+
+// restart removes the partial download and its checkpoint and downloads
+// the file again from the start
+func (d *AdaptiveDownloader) restart(ctx context.Context) error {
+	os.Remove(d.statePath())
+	os.Remove(d.PartPath())
+	d.Stats.discard()
+
+	return d.Download(ctx)
+}
+
+// markCompleted records a finished chunk and flushes the checkpoint
+func (d *AdaptiveDownloader) markCompleted(chunk ChunkInfo) error {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+
+	d.completed.add(chunk.Start, chunk.End+1)
+	d.written = append(d.written, byteRange{chunk.Start, chunk.End + 1})
+	d.live.add(chunk.Start, chunk.End+1)
+	if d.inPlace() {
+		return nil
+	}
+
+	d.unsaved += chunk.End - chunk.Start + 1
+	if !d.checkpointDue() {
+		return nil
+	}
+	return d.saveCheckpoint()
+}
+
+// checkpointDue reports whether enough time or data has gone by since the
+// last checkpoint to write another; callers must hold d.stateMu
+func (d *AdaptiveDownloader) checkpointDue() bool {
+	if d.CheckpointInterval <= 0 && d.CheckpointBytes <= 0 {
+		return true
+	}
+	if d.CheckpointBytes > 0 && d.unsaved >= d.CheckpointBytes {
+		return true
+	}
+	return d.CheckpointInterval > 0 && since(d.lastCheckpoint) >= d.CheckpointInterval
+}
+
+// flushCheckpoint writes any chunks completed since the last checkpoint, so
+// a download that stops early can resume from everything it fetched
+func (d *AdaptiveDownloader) flushCheckpoint() error {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+
+	if d.inPlace() || d.unsaved == 0 {
+		return nil
+	}
+	return d.saveCheckpoint()
+}
+
+// saveCheckpoint writes the checkpoint atomically; callers must hold d.stateMu
+func (d *AdaptiveDownloader) saveCheckpoint() error {
+	data, err := json.Marshal(checkpoint{
+		URL:          d.URL,
+		FileSize:     d.FileSize,
+		ETag:         d.etag,
+		LastModified: d.lastModified,
+		Completed:    d.completed.ranges,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := d.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.statePath()); err != nil {
+		return err
+	}
+	d.unsaved = 0
+	d.lastCheckpoint = now()
+	d.checkpoints++
+	return nil
+}
@@ -0,0 +1,608 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResumeWithDifferentConnectionSettings(t *testing.T) {
+	payload := testPayload(640 * 1024)
+	half := int64(len(payload) / 2)
+
+	// While failing is set, ranges touching the second half of the file 500
+	var failing atomic.Bool
+	failing.Store(true)
+
+	var mu sync.Mutex
+	var requested []byteRange
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && r.Method == "GET" {
+			if failing.Load() && end >= half {
+				http.Error(w, "unavailable", http.StatusInternalServerError)
+				return
+			}
+			mu.Lock()
+			requested = append(requested, byteRange{start, end + 1})
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "resume.bin")
+
+	first := NewAdaptiveDownloader(server.URL, output)
+	first.ChunkSize = 64 * 1024
+	first.CurrentConnections = 1
+	first.RetryPolicy = DefaultRetryPolicy{} // fail on the first 500
+	if err := first.Download(context.Background()); err == nil {
+		t.Fatal("Expected first run to fail")
+	}
+
+	done, err := first.loadCheckpoint()
+	if err != nil {
+		t.Fatalf("loadCheckpoint() returned error: %v", err)
+	}
+	if done.total() == 0 {
+		t.Fatal("Expected first run to checkpoint some completed ranges")
+	}
+
+	// Resume with a different connection count and chunk size
+	failing.Store(false)
+	mu.Lock()
+	requested = nil
+	mu.Unlock()
+
+	second := NewAdaptiveDownloader(server.URL, output)
+	second.ChunkSize = 48 * 1024
+	second.CurrentConnections = 7
+	second.MaxConnections = 8
+	if err := second.Download(context.Background()); err != nil {
+		t.Fatalf("Resumed download failed: %v", err)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Resumed file does not match payload")
+	}
+
+	// Only bytes missing after the first run should have been fetched again
+	var refetched int64
+	for _, r := range requested {
+		for _, c := range done.ranges {
+			if r.Start < c.End && c.Start < r.End {
+				t.Errorf("Range %v overlaps already completed %v", r, c)
+			}
+		}
+		refetched += r.End - r.Start
+	}
+	if refetched != int64(len(payload))-done.total() {
+		t.Errorf("Expected %d bytes refetched, got %d", int64(len(payload))-done.total(), refetched)
+	}
+
+	if _, err := os.Stat(second.statePath()); !os.IsNotExist(err) {
+		t.Errorf("Expected checkpoint to be removed after success, stat returned: %v", err)
+	}
+}
+
+func TestResumeSplit(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	half := int64(len(payload) / 2)
+
+	// The first run can only fetch the first half of the file
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && failing.Load() && end >= half {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "resume.bin")
+	first := NewAdaptiveDownloader(server.URL, output)
+	first.ChunkSize = 64 * 1024
+	first.CurrentConnections = 1
+	first.RetryPolicy = DefaultRetryPolicy{}
+	if err := first.Download(context.Background()); err == nil {
+		t.Fatal("Expected first run to fail")
+	}
+	if result := first.Result(); result.BytesResumed != 0 || result.BytesDownloaded != half {
+		t.Errorf("Expected the first run to fetch %d bytes and resume none, got %+v", half, result)
+	}
+
+	failing.Store(false)
+	second := NewAdaptiveDownloader(server.URL, output)
+	second.ChunkSize = 64 * 1024
+	if err := second.Download(context.Background()); err != nil {
+		t.Fatalf("Resumed download failed: %v", err)
+	}
+
+	result := second.Result()
+	if result.BytesResumed != half {
+		t.Errorf("Expected %d bytes resumed, got %d", half, result.BytesResumed)
+	}
+	if result.BytesResumed+result.BytesDownloaded != int64(len(payload)) {
+		t.Errorf("Expected resumed %d + downloaded %d to add up to %d", result.BytesResumed, result.BytesDownloaded, len(payload))
+	}
+}
+
+func TestCheckpointInterval(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	const chunkSize = 16 * 1024 // 32 chunks
+
+	// Each chunk request takes 25ms of virtual time
+	clock := &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var failAt atomic.Int32
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			clock.advance(25 * time.Millisecond)
+			if n := gets.Add(1); n == failAt.Load() {
+				http.Error(w, "gone", http.StatusNotFound)
+				return
+			}
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+	SetClock(clock)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tests := []struct {
+		name        string
+		interval    time.Duration
+		bytes       int64
+		failAt      int32
+		checkpoints int
+	}{
+		{"every chunk", 0, 0, 0, 32},
+		{"every 100ms", 100 * time.Millisecond, 0, 0, 8},
+		{"every 4 chunks of bytes", 0, 4 * chunkSize, 0, 8},
+		{"whichever comes first", 200 * time.Millisecond, 2 * chunkSize, 0, 16},
+		{"flushed on failure", time.Hour, 0, 11, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gets.Store(0)
+			failAt.Store(tt.failAt)
+
+			output := filepath.Join(t.TempDir(), "payload.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.ChunkSize = chunkSize
+			downloader.MinConnections = 1
+			downloader.CurrentConnections = 1
+			downloader.MaxConnections = 1
+			downloader.CheckpointInterval = tt.interval
+			downloader.CheckpointBytes = tt.bytes
+
+			err := downloader.Download(context.Background())
+			if tt.failAt == 0 && err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			if tt.failAt != 0 {
+				if err == nil {
+					t.Fatal("Expected the download to fail")
+				}
+				// Every chunk before the failure survives for a resume
+				if got, _ := downloader.loadCheckpoint(); got.total() != int64(tt.failAt-1)*chunkSize {
+					t.Errorf("Expected %d bytes checkpointed, got %d", (tt.failAt-1)*chunkSize, got.total())
+				}
+			}
+			if downloader.checkpoints != tt.checkpoints {
+				t.Errorf("Expected %d checkpoints written, got %d", tt.checkpoints, downloader.checkpoints)
+			}
+		})
+	}
+}
+
+func TestResumeSizeChange(t *testing.T) {
+	original := testPayload(256 * 1024)
+	half := int64(len(original) / 2)
+	grown := append(append([]byte{}, original...), bytes.Repeat([]byte("appended "), 8*1024)...)
+	shrunk := original[:192*1024]
+
+	tests := []struct {
+		name    string
+		policy  SizeChangePolicy
+		changed []byte
+		wantErr bool
+		resumed bool
+	}{
+		{"restart on larger", SizeChangeRestart, grown, false, false},
+		{"restart on smaller", SizeChangeRestart, shrunk, false, false},
+		{"default restarts", "", grown, false, false},
+		{"fail on larger", SizeChangeFail, grown, true, false},
+		{"fail on smaller", SizeChangeFail, shrunk, true, false},
+		{"continue on larger", SizeChangeContinueIfLarger, grown, false, true},
+		{"continue on smaller restarts", SizeChangeContinueIfLarger, shrunk, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first run can only fetch the first half of the original
+			var served atomic.Pointer[[]byte]
+			served.Store(&original)
+			var failing atomic.Bool
+			failing.Store(true)
+			var fetched atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var start, end int64
+				if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && r.Method == "GET" {
+					if failing.Load() && end >= half {
+						http.Error(w, "unavailable", http.StatusInternalServerError)
+						return
+					}
+					fetched.Add(end - start + 1)
+				}
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(*served.Load()))
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "resume.bin")
+			first := NewAdaptiveDownloader(server.URL, output)
+			first.ChunkSize = 32 * 1024
+			first.CurrentConnections = 1
+			first.RetryPolicy = DefaultRetryPolicy{}
+			if err := first.Download(context.Background()); err == nil {
+				t.Fatal("Expected first run to fail")
+			}
+			done, _ := first.loadCheckpoint()
+			if done.total() == 0 {
+				t.Fatal("Expected first run to checkpoint some completed ranges")
+			}
+
+			failing.Store(false)
+			served.Store(&tt.changed)
+			fetched.Store(0)
+
+			second := NewAdaptiveDownloader(server.URL, output)
+			second.ChunkSize = 32 * 1024
+			second.OnSizeChange = tt.policy
+			err := second.Download(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected the size change to fail the download")
+				}
+				if _, err := os.Stat(second.PartPath()); err != nil {
+					t.Errorf("Expected the partial file to be kept, stat returned: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resumed download failed: %v", err)
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, tt.changed) {
+				t.Fatalf("Output does not match the changed file: got %d bytes, want %d", len(got), len(tt.changed))
+			}
+
+			want := int64(len(tt.changed))
+			if tt.resumed {
+				want -= done.total()
+			}
+			if fetched.Load() != want {
+				t.Errorf("Expected %d bytes fetched, got %d", want, fetched.Load())
+			}
+		})
+	}
+}
+
+func TestResumeAfterETagChange(t *testing.T) {
+	v1 := testPayload(256 * 1024)
+	v2 := bytes.Repeat([]byte("version two "), len(v1)/12+1)[:len(v1)]
+	half := int64(len(v1) / 2)
+
+	tests := []struct {
+		name      string
+		staleHead bool // HEAD still reports the old version
+		ifRange   bool // the change is only caught by If-Range
+	}{
+		{"changed before HEAD", false, false},
+		{"changed after HEAD", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changed, failing atomic.Bool
+			failing.Store(true)
+			var ifRanges atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				content, etag := v1, `"v1"`
+				if changed.Load() && (r.Method == "GET" || !tt.staleHead) {
+					content, etag = v2, `"v2"`
+				}
+				var start, end int64
+				if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && failing.Load() && end >= half {
+					http.Error(w, "unavailable", http.StatusInternalServerError)
+					return
+				}
+				if r.Header.Get("If-Range") != "" {
+					ifRanges.Add(1)
+				}
+				w.Header().Set("ETag", etag)
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(content))
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "resume.bin")
+			first := NewAdaptiveDownloader(server.URL, output)
+			first.ChunkSize = 32 * 1024
+			first.CurrentConnections = 1
+			first.RetryPolicy = DefaultRetryPolicy{}
+			if err := first.Download(context.Background()); err == nil {
+				t.Fatal("Expected first run to fail")
+			}
+
+			failing.Store(false)
+			changed.Store(true)
+
+			second := NewAdaptiveDownloader(server.URL, output)
+			second.ChunkSize = 32 * 1024
+			if err := second.Download(context.Background()); err != nil {
+				t.Fatalf("Resumed download failed: %v", err)
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, v2) {
+				t.Fatal("Expected the changed file to be downloaded from scratch, got a mix of versions")
+			}
+			if sent := ifRanges.Load() > 0; sent != tt.ifRange {
+				t.Errorf("Expected If-Range sent: %v, got %d requests with it", tt.ifRange, ifRanges.Load())
+			}
+		})
+	}
+}
+
+func TestRangeNotSatisfiable(t *testing.T) {
+	payload := testPayload(128 * 1024)
+	stale := int64(len(payload) + 64*1024)
+
+	tests := []struct {
+		name       string
+		checkpoint bool // resume from a checkpoint recording the stale size
+		staleHeads int32
+		wantErr    bool
+	}{
+		{"stale checkpoint restarts", true, 1, false},
+		{"wrong size fails", false, 100, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// HEAD reports the stale size the first staleHeads times; the
+			// GETs only have the real file to serve
+			var heads atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" && heads.Add(1) <= tt.staleHeads {
+					w.Header().Set("Accept-Ranges", "bytes")
+					w.Header().Set("Content-Length", fmt.Sprint(stale))
+					return
+				}
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			var output bytes.Buffer
+			downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+			downloader.ChunkSize = 32 * 1024
+			downloader.Output = &output
+			if tt.checkpoint {
+				downloader.FileSize = stale
+				downloader.completed = &rangeSet{}
+				downloader.completed.add(0, 32*1024)
+				if err := os.WriteFile(downloader.PartPath(), payload[:32*1024], 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := downloader.saveCheckpoint(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := downloader.Download(context.Background())
+			if tt.wantErr {
+				var unsatisfiable *RangeNotSatisfiableError
+				if !errors.As(err, &unsatisfiable) {
+					t.Fatalf("Expected a *RangeNotSatisfiableError, got %v", err)
+				}
+				// Any of the chunks past the real end may be the one to fail
+				if unsatisfiable.FileSize != stale || unsatisfiable.Start < int64(len(payload)) {
+					t.Errorf("Expected a range from %d on in a file of %d bytes, got %v", len(payload), stale, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			if !strings.Contains(output.String(), "not satisfiable") {
+				t.Errorf("Expected the 416 to be reported, got:\n%s", output.String())
+			}
+			got, err := os.ReadFile(downloader.Filename)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("Expected the payload after restarting: %v", err)
+			}
+		})
+	}
+}
+
+// adapterClock is the system clock, except that it counts how many of
+// the tickers started with interval are running at once
+type adapterClock struct {
+	systemClock
+	interval time.Duration
+
+	mu         sync.Mutex
+	live, most int
+}
+
+func (c *adapterClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticks, stop := c.systemClock.Tick(d)
+	if d != c.interval {
+		return ticks, stop
+	}
+	c.mu.Lock()
+	c.live++
+	c.most = max(c.most, c.live)
+	c.mu.Unlock()
+	return ticks, func() {
+		stop()
+		c.mu.Lock()
+		c.live--
+		c.mu.Unlock()
+	}
+}
+
+func TestRestartStopsAdapter(t *testing.T) {
+	payload := testPayload(128 * 1024)
+	stale := int64(len(payload) + 64*1024)
+	clock := &adapterClock{interval: 3 * time.Millisecond}
+	SetClock(clock)
+	t.Cleanup(func() { SetClock(nil) })
+
+	// The first HEAD agrees with the stale checkpoint, so the download
+	// restarts once its ranges past the real end fail
+	var heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" && heads.Add(1) == 1 {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprint(stale))
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.ChunkSize = 32 * 1024
+	downloader.AdaptInterval = clock.interval
+	downloader.FileSize = stale
+	downloader.completed = &rangeSet{}
+	downloader.completed.add(0, 32*1024)
+	if err := os.WriteFile(downloader.PartPath(), payload[:32*1024], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloader.saveCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if heads.Load() < 2 {
+		t.Fatal("Expected the download to restart")
+	}
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if clock.most != 1 || clock.live != 0 {
+		t.Errorf("Expected one adapter at a time, got %d at once and %d left running", clock.most, clock.live)
+	}
+}
+
+func TestResumeSingleConnection(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	size := int64(len(payload))
+	cut := int64(100000)
+
+	tests := []struct {
+		name        string
+		resumes     bool // the server honors an open-ended range
+		wantResumed int64
+	}{
+		{"server resumes", true, cut},
+		{"server sends the whole file", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Range support isn't advertised, and a bounded range such as
+			// the probe gets the whole file
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var from int64
+				ranged := r.Header.Get("Range")
+				if _, err := fmt.Sscanf(ranged, "bytes=%d-", &from); err == nil && tt.resumes && from > 0 && strings.HasSuffix(ranged, "-") {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, size-1, size))
+					w.Header().Set("Content-Length", fmt.Sprint(size-from))
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(payload[from:])
+					return
+				}
+				w.Header().Set("Content-Length", fmt.Sprint(size))
+				w.WriteHeader(http.StatusOK)
+				if r.Method == "GET" {
+					w.Write(payload)
+				}
+			}))
+			defer server.Close()
+
+			// The first run's connection drops part way through
+			output := filepath.Join(t.TempDir(), "single.bin")
+			first := NewAdaptiveDownloader(server.URL, output)
+			first.Transport = &faultTransport{next: http.DefaultTransport, faults: map[int]fault{2: {truncate: cut}}}
+			if err := first.Download(context.Background()); err == nil {
+				t.Fatal("Expected the first run to fail")
+			}
+			if !first.single {
+				t.Fatal("Expected a single-connection download")
+			}
+
+			transport := &faultTransport{next: http.DefaultTransport}
+			second := NewAdaptiveDownloader(server.URL, output)
+			second.Transport = transport
+			second.Hash = "sha256"
+			if err := second.Download(context.Background()); err != nil {
+				t.Fatalf("Resumed download failed: %v", err)
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatal("Downloaded file does not match payload")
+			}
+			requests := transport.requests()
+			if want := fmt.Sprintf("bytes=%d-", cut); requests[len(requests)-1] != want {
+				t.Errorf("Expected the download to ask for %q, got %q", want, requests)
+			}
+			result := second.Result()
+			if result.BytesResumed != tt.wantResumed || second.Stats.Downloaded() != size-tt.wantResumed {
+				t.Errorf("Expected %d bytes resumed and %d fetched, got %d and %d", tt.wantResumed, size-tt.wantResumed, result.BytesResumed, second.Stats.Downloaded())
+			}
+			if sum := sha256.Sum256(payload); second.Digest() != hex.EncodeToString(sum[:]) {
+				t.Errorf("Expected the digest to cover the resumed bytes too, got %s", second.Digest())
+			}
+			if _, err := os.Stat(second.statePath()); !os.IsNotExist(err) {
+				t.Error("Expected the checkpoint removed once the download finished")
+			}
+		})
+	}
+}
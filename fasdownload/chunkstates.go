@@ -0,0 +1,107 @@
+package fasdownload
+
+import "sync"
+
+// ChunkStatus is where a chunk is in the download
+type ChunkStatus uint8
+
+const (
+	// ChunkPending is a chunk not yet picked up, or one interrupted when
+	// the download stopped
+	ChunkPending ChunkStatus = iota
+	// ChunkActive is a chunk being fetched
+	ChunkActive
+	// ChunkDone is a chunk written in full
+	ChunkDone
+	// ChunkFailed is a chunk that failed once its retries ran out
+	ChunkFailed
+)
+
+func (s ChunkStatus) String() string {
+	switch s {
+	case ChunkPending:
+		return "pending"
+	case ChunkActive:
+		return "active"
+	case ChunkDone:
+		return "done"
+	case ChunkFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// ChunkState is one chunk's byte range and status, as ChunkStates reports
+type ChunkState struct {
+	Index  int
+	Start  int64
+	End    int64 // inclusive
+	Status ChunkStatus
+}
+
+// chunkTable holds the status of every chunk of the current download,
+// indexed by chunk number
+type chunkTable struct {
+	mu     sync.Mutex
+	chunks []ChunkInfo
+	status []ChunkStatus
+}
+
+// reset starts a new plan with every chunk pending
+func (t *chunkTable) reset(chunks []ChunkInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.chunks, t.status = nil, nil
+	for _, chunk := range chunks {
+		t.setLocked(chunk, ChunkPending)
+	}
+}
+
+// set records chunk's status, and its range in case a re-split changed it
+func (t *chunkTable) set(chunk ChunkInfo, status ChunkStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setLocked(chunk, status)
+}
+
+// requeue records the chunks still queued as pending, after a re-split
+// changed them. Holding mu while reading the queue means a chunk popped
+// meanwhile is only marked active after this.
+func (t *chunkTable) requeue(q *chunkQueue) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, chunk := range q.snapshot() {
+		t.setLocked(chunk, ChunkPending)
+	}
+}
+
+// setLocked is set for callers holding mu
+func (t *chunkTable) setLocked(chunk ChunkInfo, status ChunkStatus) {
+	for len(t.chunks) <= chunk.Index {
+		t.chunks = append(t.chunks, ChunkInfo{Index: len(t.chunks), Start: -1, End: -1})
+		t.status = append(t.status, ChunkPending)
+	}
+	t.chunks[chunk.Index] = chunk
+	t.status[chunk.Index] = status
+}
+
+// snapshot returns every chunk's state in index order
+func (t *chunkTable) snapshot() []ChunkState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make([]ChunkState, len(t.chunks))
+	for i, chunk := range t.chunks {
+		states[i] = ChunkState{Index: chunk.Index, Start: chunk.Start, End: chunk.End, Status: t.status[i]}
+	}
+	return states
+}
+
+// ChunkStates returns the state of every chunk of the running or last
+// download in index order, for drawing a segmented progress bar. It may be
+// called at any time, such as from ProgressFunc. Index order is file
+// order, except that pieces split off a chunk when a server caps range
+// lengths are numbered after the rest. Bytes resumed from an earlier run
+// belong to no chunk, and a download over a single connection has none.
+func (d *AdaptiveDownloader) ChunkStates() []ChunkState {
+	return d.chunkTable.snapshot()
+}
@@ -0,0 +1,100 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// statuses returns just the status of each chunk
+func statuses(states []ChunkState) []ChunkStatus {
+	out := make([]ChunkStatus, len(states))
+	for i, state := range states {
+		out[i] = state.Status
+	}
+	return out
+}
+
+func TestChunkStates(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	// The second chunk is held back until the test releases it
+	reached := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.Header.Get("Range") == "bytes=65536-131071" {
+			close(reached)
+			<-release
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.ChunkSize = 64 * 1024
+	downloader.MinConnections, downloader.CurrentConnections, downloader.MaxConnections = 1, 1, 1
+	done := make(chan error, 1)
+	go func() { done <- downloader.Download(context.Background()) }()
+
+	select {
+	case <-reached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the second chunk to be requested")
+	}
+	got := statuses(downloader.ChunkStates())
+	want := []ChunkStatus{ChunkDone, ChunkActive, ChunkPending, ChunkPending}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d chunks, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected states %v while the second chunk is held, got %v", want, got)
+		}
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	states := downloader.ChunkStates()
+	for i, state := range states {
+		if state.Status != ChunkDone {
+			t.Errorf("Expected chunk %d done, got %v", i, state.Status)
+		}
+		if state.Start != int64(i)*64*1024 || state.End != int64(i+1)*64*1024-1 {
+			t.Errorf("Expected chunk %d to cover its range, got %d-%d", i, state.Start, state.End)
+		}
+	}
+}
+
+func TestChunkStatesFailure(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.Header.Get("Range") == "bytes=131072-196607" {
+			http.Error(w, "gone", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.ChunkSize = 64 * 1024
+	downloader.MinConnections, downloader.CurrentConnections, downloader.MaxConnections = 1, 1, 1
+	downloader.RetryPolicy = DefaultRetryPolicy{}
+	if err := downloader.Download(context.Background()); err == nil {
+		t.Fatal("Expected the download to fail")
+	}
+
+	got := statuses(downloader.ChunkStates())
+	want := []ChunkStatus{ChunkDone, ChunkDone, ChunkFailed, ChunkPending}
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Fatalf("Expected states %v, got %v", want, got)
+		}
+	}
+}
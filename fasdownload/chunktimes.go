@@ -0,0 +1,44 @@
+package fasdownload
+
+import "time"
+
+// chunkTimeSamples is how many of the latest chunk durations are kept for
+// the percentiles and histogram, so a download of tens of thousands of
+// chunks holds no more than a small download does
+const chunkTimeSamples = 1024
+
+// durationRing keeps the last chunkTimeSamples durations added, overwriting
+// the oldest once full
+type durationRing struct {
+	samples []time.Duration
+	next    int // where the next sample goes once the ring is full
+}
+
+// add records d, dropping the oldest sample when the ring is full
+func (r *durationRing) add(d time.Duration) {
+	if len(r.samples) < chunkTimeSamples {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % len(r.samples)
+}
+
+// values returns a copy of the samples, oldest first
+func (r *durationRing) values() []time.Duration {
+	values := make([]time.Duration, 0, len(r.samples))
+	values = append(values, r.samples[r.next:]...)
+	return append(values, r.samples[:r.next]...)
+}
+
+// average returns the mean of the samples, or 0 without any
+func (r *durationRing) average() time.Duration {
+	if len(r.samples) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range r.samples {
+		total += d
+	}
+	return total / time.Duration(len(r.samples))
+}
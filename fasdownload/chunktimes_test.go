@@ -0,0 +1,43 @@
+package fasdownload
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChunkTimesKeepsLatest(t *testing.T) {
+	stats := &DownloadStats{}
+	if stats.AverageChunkDuration() != 0 || len(stats.ChunkDurations()) != 0 {
+		t.Fatal("Expected no samples before any chunk completes")
+	}
+
+	// Before the ring fills, every sample counts
+	for i := 1; i <= 10; i++ {
+		stats.recordChunkTime(time.Duration(i) * time.Millisecond)
+	}
+	if got := stats.AverageChunkDuration(); got != 5500*time.Microsecond {
+		t.Errorf("Expected an average of 5.5ms, got %v", got)
+	}
+
+	// Many times more chunks than the ring holds
+	const total = 10 * chunkTimeSamples
+	for i := 11; i <= total; i++ {
+		stats.recordChunkTime(time.Duration(i) * time.Millisecond)
+	}
+
+	got := stats.ChunkDurations()
+	if len(got) != chunkTimeSamples {
+		t.Fatalf("Expected %d samples kept, got %d", chunkTimeSamples, len(got))
+	}
+	for i, d := range got {
+		if want := time.Duration(total-chunkTimeSamples+1+i) * time.Millisecond; d != want {
+			t.Fatalf("Expected sample %d to be %v, got %v", i, want, d)
+		}
+	}
+
+	// The mean of the last chunkTimeSamples values of 1..total ms
+	want := time.Duration(2*total-chunkTimeSamples+1) * time.Millisecond / 2
+	if got := stats.AverageChunkDuration(); got != want {
+		t.Errorf("Expected an average of %v, got %v", want, got)
+	}
+}
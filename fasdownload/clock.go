@@ -0,0 +1,100 @@
+package fasdownload
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for a download's scheduling: retry backoff,
+// error burst pauses, the rate limiter, the chunk timings the connection
+// ramp-up is based on, and the progress interval. Network timeouts such as
+// ReadTimeout always run on real time.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, returning early with the context's error if it is
+	// cancelled first
+	Sleep(ctx context.Context, d time.Duration) error
+	// Tick delivers ticks every d until stop is called
+	Tick(d time.Duration) (ticks <-chan time.Time, stop func())
+}
+
+// systemClock is the Clock used unless SetClock replaces it
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (systemClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// The package-wide timing sources. They are swapped only between downloads,
+// so a chaos test can replay the exact same schedule.
+var (
+	timingMu sync.Mutex
+	clock    Clock = systemClock{}
+	jitter         = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// SetClock makes every download schedule its waits and measure its timings
+// with c; nil restores the system clock. It must not be called while a
+// download is running.
+func SetClock(c Clock) {
+	if c == nil {
+		c = systemClock{}
+	}
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	clock = c
+}
+
+// SetJitterSource makes retry jitter draw from src, so a seeded source
+// gives the same delays on every run; nil restores a time-seeded source
+func SetJitterSource(src rand.Source) {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	jitter = rand.New(src)
+}
+
+// currentClock returns the package clock
+func currentClock() Clock {
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	return clock
+}
+
+// now returns the current time on the package clock
+func now() time.Time {
+	return currentClock().Now()
+}
+
+// since returns the time elapsed on the package clock since t
+func since(t time.Time) time.Duration {
+	return now().Sub(t)
+}
+
+// randomFraction returns a number in [0, 1) from the jitter source
+func randomFraction() float64 {
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	return jitter.Float64()
+}
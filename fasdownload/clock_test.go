@@ -0,0 +1,132 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// replayClock is a virtual clock: sleeps return at once, moving time forward
+// by their length, and record the schedule they were asked for
+type replayClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *replayClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *replayClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+// advance moves virtual time forward without a sleep
+func (c *replayClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *replayClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	return nil, func() {}
+}
+
+func TestReplayedSchedule(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetJitterSource(nil)
+	})
+
+	// The same GETs fail on every run: three in a row trip the error burst
+	// breaker, the rest are one-off retries
+	failing := map[int32]bool{2: true, 3: true, 4: true, 6: true, 9: true}
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && failing[gets.Add(1)] {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	type run struct {
+		sleeps      []time.Duration
+		retries     int
+		connections int
+		elapsed     time.Duration
+	}
+	replay := func() run {
+		gets.Store(0)
+		clock := &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		SetClock(clock)
+		SetJitterSource(rand.NewSource(7))
+
+		output := filepath.Join(t.TempDir(), "payload.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		downloader.ChunkSize = 4 * 1024
+		downloader.MinConnections = 1
+		downloader.CurrentConnections = 1
+		downloader.MaxConnections = 4
+		downloader.ErrorBurstThreshold = 3
+		downloader.RetryPolicy = DefaultRetryPolicy{MaxRetries: 3, BaseDelay: 100 * time.Millisecond, Jitter: 0.5}
+
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("Downloaded file does not match payload")
+		}
+
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		return run{
+			sleeps:      clock.sleeps,
+			retries:     downloader.Stats.Retries,
+			connections: downloader.CurrentConnections,
+			elapsed:     clock.now.Sub(downloader.Stats.StartTime),
+		}
+	}
+
+	first := replay()
+	second := replay()
+
+	if first.retries != 5 {
+		t.Errorf("Expected 5 retries, got %d", first.retries)
+	}
+	// Three jittered retry delays, the rest of the burst pause, two more retries
+	if len(first.sleeps) != 6 {
+		t.Fatalf("Expected 6 sleeps, got %v", first.sleeps)
+	}
+	if d := first.sleeps[0]; d < 50*time.Millisecond || d >= 100*time.Millisecond {
+		t.Errorf("Expected the first delay to be jittered within [50ms, 100ms), got %v", d)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Replaying the schedule changed the outcome:\nfirst:  %+v\nsecond: %+v", first, second)
+	}
+}
@@ -0,0 +1,69 @@
+package fasdownload
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// statLocalCopy records the modification time of the file at Filename for
+// IfNewer to compare against
+func (d *AdaptiveDownloader) statLocalCopy() {
+	d.localModTime = time.Time{}
+	if !d.IfNewer || d.fileless() {
+		return
+	}
+	if info, err := os.Stat(d.Filename); err == nil && info.Mode().IsRegular() {
+		d.localModTime = info.ModTime()
+	}
+}
+
+// notModified reports whether the server's Last-Modified is no later than
+// the file on disk, for a server that ignores If-Modified-Since or an FTP
+// server, which has no such thing
+func (d *AdaptiveDownloader) notModified() bool {
+	if d.localModTime.IsZero() {
+		return false
+	}
+	modified, ok := parseHTTPTime(d.lastModified)
+	return ok && !modified.After(d.localModTime)
+}
+
+// applyModTime gives a finished file the server's Last-Modified time,
+// unless NoModTime is set
+func (d *AdaptiveDownloader) applyModTime() {
+	if d.NoModTime || d.fileless() || d.special {
+		return
+	}
+	modified, ok := parseHTTPTime(d.lastModified)
+	if !ok {
+		return
+	}
+	if err := os.Chtimes(d.Filename, modified, modified); err != nil {
+		d.logf("Failed to set the modification time of %s: %v\n", d.Filename, err)
+	}
+}
+
+// httpTimeFormats are the dates servers send that http.ParseTime doesn't
+// take: RFC 1123 with a numeric zone or a zone name other than GMT
+var httpTimeFormats = []string{time.RFC1123Z, time.RFC1123}
+
+// parseHTTPTime parses an HTTP date, such as a Last-Modified header. It
+// takes the RFC 1123, RFC 850 and asctime forms HTTP allows, and the RFC
+// 1123 variants with other zones some servers send anyway.
+func parseHTTPTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	for _, layout := range httpTimeFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
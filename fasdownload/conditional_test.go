@@ -0,0 +1,178 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIfNewer(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	serverTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		localTime   time.Time
+		honorsIMS   bool // the server answers If-Modified-Since itself
+		wantSkipped bool
+	}{
+		{"up to date", serverTime.Add(time.Hour), true, true},
+		{"same time", serverTime, true, true},
+		{"out of date", serverTime.Add(-time.Hour), true, false},
+		{"server ignores If-Modified-Since", serverTime.Add(time.Hour), false, true},
+		{"server ignores If-Modified-Since, out of date", serverTime.Add(-time.Hour), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gets atomic.Int32
+			var sentIMS atomic.Bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					gets.Add(1)
+				}
+				if r.Header.Get("If-Modified-Since") != "" {
+					sentIMS.Store(true)
+					if !tt.honorsIMS {
+						r.Header.Del("If-Modified-Since")
+					}
+				}
+				http.ServeContent(w, r, "payload.bin", serverTime, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "payload.bin")
+			old := []byte("an older copy")
+			if err := os.WriteFile(output, old, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(output, tt.localTime, tt.localTime); err != nil {
+				t.Fatal(err)
+			}
+
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.IfNewer = true
+			err := downloader.Download(context.Background())
+			if !sentIMS.Load() {
+				t.Error("Expected the HEAD request to carry If-Modified-Since")
+			}
+
+			got, readErr := os.ReadFile(output)
+			if readErr != nil {
+				t.Fatalf("Failed to read output: %v", readErr)
+			}
+			info, statErr := os.Stat(output)
+			if statErr != nil {
+				t.Fatal(statErr)
+			}
+
+			if tt.wantSkipped {
+				if !errors.Is(err, ErrNotModified) {
+					t.Fatalf("Expected ErrNotModified, got %v", err)
+				}
+				if n := gets.Load(); n != 0 {
+					t.Errorf("Expected no GET for an up-to-date file, got %d", n)
+				}
+				if !bytes.Equal(got, old) || !info.ModTime().Equal(tt.localTime) {
+					t.Error("Expected the up-to-date file left alone")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Error("Expected the out-of-date file replaced with the server's")
+			}
+			if !info.ModTime().Equal(serverTime) {
+				t.Errorf("Expected the modification time set to Last-Modified %v, got %v", serverTime, info.ModTime())
+			}
+		})
+	}
+}
+
+func TestIfNewerWithoutLocalFile(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	serverTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var sentIMS atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" {
+			sentIMS.Store(true)
+		}
+		http.ServeContent(w, r, "payload.bin", serverTime, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "payload.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.IfNewer = true
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if sentIMS.Load() {
+		t.Error("Expected no If-Modified-Since without a file to compare")
+	}
+	if info, err := os.Stat(output); err != nil || !info.ModTime().Equal(serverTime) {
+		t.Errorf("Expected the new file to take Last-Modified as its modification time: %v", err)
+	}
+}
+
+func TestModTime(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	modified := time.Date(2023, 11, 5, 8, 49, 37, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		lastModified string
+		noModTime    bool
+		wantModTime  bool
+	}{
+		{"RFC 1123", modified.Format(http.TimeFormat), false, true},
+		{"RFC 850", modified.Format(time.RFC850), false, true},
+		{"asctime", modified.Format(time.ANSIC), false, true},
+		{"numeric zone", modified.In(time.FixedZone("", 2*3600)).Format(time.RFC1123Z), false, true},
+		{"opted out", modified.Format(http.TimeFormat), true, false},
+		{"no header", "", false, false},
+		{"unparseable header", "yesterday", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.lastModified != "" {
+					w.Header().Set("Last-Modified", tt.lastModified)
+				}
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "payload.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.NoModTime = tt.noModTime
+			start := time.Now()
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+
+			info, err := os.Stat(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantModTime {
+				if diff := info.ModTime().Sub(modified).Abs(); diff > time.Second {
+					t.Errorf("Expected the modification time within a second of %v, got %v", modified, info.ModTime())
+				}
+			} else if info.ModTime().Before(start.Add(-time.Second)) {
+				t.Errorf("Expected the time the file was written, got %v", info.ModTime())
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package fasdownload
+
+import (
+	"context"
+	"sync"
+)
+
+// control is what Pause, Resume and Cancel act on from other goroutines
+// while Download runs
+type control struct {
+	mu sync.Mutex
+	// resumed is non-nil while paused and closed by Resume
+	resumed chan struct{}
+	// cancel stops the running Download, nil when none is running
+	cancel context.CancelFunc
+}
+
+// Pause holds a download where it is: chunk bodies stop being read and
+// workers pick up no new chunk until Resume, so no bandwidth is used,
+// while chunks already completed stay on disk and in the checkpoint. The
+// connections of interrupted chunks stay open; one the server drops in the
+// meantime is retried from where it stopped. Pausing before Download holds
+// it at its first read, and a paused download still counts towards
+// Deadline.
+func (d *AdaptiveDownloader) Pause() {
+	d.control.mu.Lock()
+	defer d.control.mu.Unlock()
+	if d.control.resumed == nil {
+		d.control.resumed = make(chan struct{})
+		d.logf("\nDownload paused\n")
+	}
+}
+
+// Resume lets a paused download carry on where it stopped
+func (d *AdaptiveDownloader) Resume() {
+	d.control.mu.Lock()
+	defer d.control.mu.Unlock()
+	if d.control.resumed != nil {
+		close(d.control.resumed)
+		d.control.resumed = nil
+		d.logf("Download resumed\n")
+	}
+}
+
+// Paused reports whether the download is paused
+func (d *AdaptiveDownloader) Paused() bool {
+	d.control.mu.Lock()
+	defer d.control.mu.Unlock()
+	return d.control.resumed != nil
+}
+
+// Cancel stops a running Download, paused or not, as cancelling its
+// context would: it returns an error matching context.Canceled once the
+// checkpoint is flushed, so a later Download resumes after the chunks
+// already completed. It does nothing when no download is running.
+func (d *AdaptiveDownloader) Cancel() {
+	d.control.mu.Lock()
+	defer d.control.mu.Unlock()
+	if d.control.cancel != nil {
+		d.control.cancel()
+	}
+}
+
+// setCancel records how Cancel stops the running Download
+func (d *AdaptiveDownloader) setCancel(cancel context.CancelFunc) {
+	d.control.mu.Lock()
+	defer d.control.mu.Unlock()
+	d.control.cancel = cancel
+}
+
+// waitResumed blocks while the download is paused, returning the
+// context's error if it is cancelled first
+func (d *AdaptiveDownloader) waitResumed(ctx context.Context) error {
+	d.control.mu.Lock()
+	resumed := d.control.resumed
+	d.control.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
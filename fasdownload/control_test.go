@@ -0,0 +1,125 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startPausable starts a rate-limited download of payload in the
+// background and returns it once bytes are arriving, with a channel that
+// receives Download's result
+func startPausable(t *testing.T, payload []byte) (*AdaptiveDownloader, string, <-chan error) {
+	t.Helper()
+	server := newPayloadServer(t, payload)
+	output := filepath.Join(t.TempDir(), "pause.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 64 * 1024
+	downloader.CurrentConnections = 4
+	downloader.MaxBytesPerSec = 2 * 1024 * 1024
+
+	done := make(chan error, 1)
+	go func() { done <- downloader.Download(context.Background()) }()
+	for downloader.Stats.Downloaded() == 0 {
+		select {
+		case err := <-done:
+			t.Fatalf("Download() finished before it could be paused: %v", err)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	return downloader, output, done
+}
+
+// pauseQuiet pauses d and checks no bytes arrive for a while after
+func pauseQuiet(t *testing.T, d *AdaptiveDownloader) int64 {
+	t.Helper()
+	d.Pause()
+	if !d.Paused() {
+		t.Fatal("Expected Paused() after Pause()")
+	}
+	// Let reads already past the gate land
+	time.Sleep(50 * time.Millisecond)
+	paused := d.Stats.Downloaded()
+	time.Sleep(300 * time.Millisecond)
+	if got := d.Stats.Downloaded(); got != paused {
+		t.Errorf("Expected no bytes while paused, got %d more", got-paused)
+	}
+	return paused
+}
+
+func TestPauseResume(t *testing.T) {
+	payload := testPayload(1024 * 1024)
+	downloader, output, done := startPausable(t, payload)
+
+	paused := pauseQuiet(t, downloader)
+	if paused >= int64(len(payload)) {
+		t.Fatal("Expected the pause to land mid-download")
+	}
+	downloader.Resume()
+	if downloader.Paused() {
+		t.Error("Expected Paused() false after Resume()")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download didn't finish after Resume()")
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Downloaded file does not match payload")
+	}
+	// Chunks carried on where they were, none started over
+	if downloader.Stats.Downloaded() != int64(len(payload)) || downloader.Stats.Redownloaded() != 0 {
+		t.Errorf("Expected every byte fetched once, got %d and %d again", downloader.Stats.Downloaded(), downloader.Stats.Redownloaded())
+	}
+}
+
+func TestCancelWhilePaused(t *testing.T) {
+	payload := testPayload(1024 * 1024)
+	downloader, output, done := startPausable(t, payload)
+
+	pauseQuiet(t, downloader)
+	downloader.Cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download didn't stop after Cancel()")
+	}
+	downloader.Resume()
+
+	// The checkpoint lets the next run pick up the completed chunks
+	if _, err := os.Stat(downloader.statePath()); err != nil {
+		t.Fatalf("Expected a checkpoint after Cancel(): %v", err)
+	}
+	resumed := NewAdaptiveDownloader(downloader.URL, output)
+	if err := resumed.Download(context.Background()); err != nil {
+		t.Fatalf("Resumed download failed: %v", err)
+	}
+	if resumed.Result().BytesResumed == 0 {
+		t.Error("Expected the resumed download to keep the chunks completed before Cancel()")
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Downloaded file does not match payload")
+	}
+
+	// Once Download has returned there is nothing to cancel
+	downloader.Cancel()
+}
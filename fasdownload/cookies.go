@@ -0,0 +1,38 @@
+package fasdownload
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// prepareCookies sets up the cookie jar every request of the download
+// shares: Jar when set, otherwise a fresh one, seeded with Cookies for URL's
+// host. Cookies the HEAD request or its redirects set, such as a session
+// from a login redirect, are then sent with the chunk requests too.
+func (d *AdaptiveDownloader) prepareCookies() error {
+	d.jar = d.Jar
+	if d.jar == nil {
+		jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+		if err != nil {
+			return err
+		}
+		d.jar = jar
+	}
+	if len(d.Cookies) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return err
+	}
+	cookies := make([]*http.Cookie, 0, len(d.Cookies))
+	for name, value := range d.Cookies {
+		cookies = append(cookies, &http.Cookie{Name: name, Value: value, Path: "/"})
+	}
+	d.jar.SetCookies(u, cookies)
+	return nil
+}
@@ -0,0 +1,79 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCookieSession(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	// /login hands out a session cookie and redirects to the file, which
+	// is only served to requests carrying it
+	var refused atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cret", Path: "/"})
+		http.Redirect(w, r, "/file.bin", http.StatusFound)
+	})
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s3cret" {
+			refused.Add(1)
+			http.Error(w, "log in first", http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	})
+	mux.HandleFunc("/seeded.bin", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("token"); err != nil || c.Value != "abc" {
+			refused.Add(1)
+			http.Error(w, "no token", http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "seeded.bin", time.Time{}, bytes.NewReader(payload))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		cookies map[string]string
+	}{
+		{"set by a login redirect", "/login", nil},
+		{"seeded from the config", "/seeded.bin", map[string]string{"token": "abc"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refused.Store(0)
+			output := filepath.Join(t.TempDir(), "file.bin")
+			downloader := NewAdaptiveDownloader(server.URL+tt.path, output)
+			downloader.ChunkSize = 32 * 1024
+			downloader.Cookies = tt.cookies
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("Downloaded file does not match payload: %v", err)
+			}
+			if downloader.Stats.ChunkCount() != 8 || refused.Load() != 0 {
+				t.Errorf("Expected 8 chunks with the cookie, got %d chunks and %d refused requests", downloader.Stats.ChunkCount(), refused.Load())
+			}
+		})
+	}
+
+	// Without the login there is no session
+	downloader := NewAdaptiveDownloader(server.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if err := downloader.Download(context.Background()); err == nil {
+		t.Error("Expected the download to fail without a session cookie")
+	}
+}
@@ -0,0 +1,79 @@
+package fasdownload
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression names a format the downloaded file is decompressed from
+type Compression string
+
+const (
+	// CompressionNone saves the file exactly as served
+	CompressionNone Compression = ""
+	// CompressionZstd decompresses a zstd (.zst) stream, checking its frame
+	// checksums as it goes
+	CompressionZstd Compression = "zstd"
+	// CompressionGzip decompresses a gzip (.gz) stream
+	CompressionGzip Compression = "gzip"
+	// CompressionDeflate decompresses a zlib stream, which is what HTTP
+	// calls deflate
+	CompressionDeflate Compression = "deflate"
+)
+
+// decompressor wraps r in a decoder for the configured compression. The
+// returned close function releases the decoder.
+func (d *AdaptiveDownloader) decompressor(r io.Reader) (io.Reader, func(), error) {
+	return newDecoder(r, d.Decompress)
+}
+
+// newDecoder wraps r in a decoder for compression c
+func newDecoder(r io.Reader, c Compression) (io.Reader, func(), error) {
+	switch c {
+	case CompressionNone:
+		return r, func() {}, nil
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return decoder, decoder.Close, nil
+	case CompressionGzip:
+		decoder, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return decoder, func() { decoder.Close() }, nil
+	case CompressionDeflate:
+		decoder, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return decoder, func() { decoder.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported compression: %s", c)
+	}
+}
+
+// contentEncoding returns the compression a response's body is encoded
+// with, or CompressionNone for the identity encoding. The transport has
+// already decoded a gzip response it asked for itself.
+func contentEncoding(resp *http.Response) Compression {
+	if resp.Uncompressed {
+		return CompressionNone
+	}
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return CompressionNone
+	case "x-gzip":
+		return CompressionGzip
+	default:
+		return Compression(encoding)
+	}
+}
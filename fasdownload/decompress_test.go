@@ -0,0 +1,180 @@
+package fasdownload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdCompress returns payload as a zstd stream with frame checksums
+func zstdCompress(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	encoder, err := zstd.NewWriter(&buf, zstd.WithEncoderCRC(true))
+	if err != nil {
+		t.Fatalf("Failed to create encoder: %v", err)
+	}
+	if _, err := encoder.Write(payload); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestZstdDownload(t *testing.T) {
+	// Half random, half repetitive, so it compresses but not to nothing
+	payload := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(payload)
+	payload = append(payload, bytes.Repeat([]byte("fas-download "), 64*1024)...)
+	compressed := zstdCompress(t, payload)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin.zst", time.Time{}, bytes.NewReader(compressed))
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var updates []Progress
+	sum := sha256.Sum256(payload)
+
+	output := filepath.Join(t.TempDir(), "payload.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.Decompress = CompressionZstd
+	downloader.Checksum = "sha256:" + hex.EncodeToString(sum[:])
+	downloader.MaxBytesPerSec = int64(len(compressed)) * 2 // stretch over several ticks
+	downloader.ProgressInterval = 20 * time.Millisecond
+	downloader.ProgressFunc = func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, p)
+	}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("Decompressed file does not match payload: got %d bytes, want %d", len(got), len(payload))
+	}
+
+	// Progress counts compressed bytes against the compressed size
+	if downloader.Stats.BytesDownloaded != int64(len(compressed)) {
+		t.Errorf("Expected %d compressed bytes downloaded, got %d", len(compressed), downloader.Stats.BytesDownloaded)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(updates) == 0 {
+		t.Fatal("Expected progress updates")
+	}
+	for _, p := range updates {
+		if p.Total != int64(len(compressed)) || p.Downloaded > p.Total {
+			t.Errorf("Expected progress within the compressed size %d, got %d/%d", len(compressed), p.Downloaded, p.Total)
+			break
+		}
+	}
+}
+
+func TestZstdCorruptStream(t *testing.T) {
+	compressed := zstdCompress(t, testPayload(64*1024))
+	compressed[len(compressed)/2] ^= 0xff
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin.zst", time.Time{}, bytes.NewReader(compressed))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "payload.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.Decompress = CompressionZstd
+
+	if err := downloader.Download(context.Background()); err == nil {
+		t.Fatal("Expected a corrupt zstd stream to fail")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Expected no output file for a corrupt stream, stat returned: %v", err)
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	encode := func(w io.WriteCloser) {
+		w.Write(payload)
+		w.Close()
+	}
+	var gzipped, deflated bytes.Buffer
+	encode(gzip.NewWriter(&gzipped))
+	encode(zlib.NewWriter(&deflated))
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		headers  map[string]string
+	}{
+		// The transport asks for gzip itself and decodes the response
+		{"gzip", "gzip", gzipped.Bytes(), nil},
+		// Asking explicitly leaves the response encoded for the downloader
+		{"gzip requested by the caller", "gzip", gzipped.Bytes(), map[string]string{"Accept-Encoding": "gzip"}},
+		{"deflate", "deflate", deflated.Bytes(), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every response is encoded, and Content-Length is the encoded size
+			var ranged atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					ranged.Add(1)
+				}
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.Header().Set("Content-Length", fmt.Sprint(len(tt.body)))
+				if r.Method == "GET" {
+					w.Write(tt.body)
+				}
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "payload.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.ChunkSize = 32 * 1024
+			downloader.Headers = tt.headers
+
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("Decoded file does not match payload: got %d bytes, want %d", len(got), len(payload))
+			}
+			if ranged.Load() != 0 {
+				t.Errorf("Expected no ranged requests for encoded content, got %d", ranged.Load())
+			}
+		})
+	}
+}
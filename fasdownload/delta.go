@@ -0,0 +1,98 @@
+package fasdownload
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// BlockChecksums lists the digests of a remote file's fixed-size blocks, in
+// order; the last block may be shorter than BlockSize. Given such a list,
+// a download only fetches the blocks where the local file differs.
+type BlockChecksums struct {
+	BlockSize int64    `json:"block_size"`
+	Algorithm string   `json:"algorithm"`
+	Sums      []string `json:"sums"`
+}
+
+// LoadBlockChecksums reads a block checksum list from a JSON file
+func LoadBlockChecksums(path string) (*BlockChecksums, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks BlockChecksums
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return nil, fmt.Errorf("invalid block checksum list %s: %w", path, err)
+	}
+	return &blocks, nil
+}
+
+// validate checks that the list describes a file of size bytes
+func (b *BlockChecksums) validate(size int64) error {
+	if b.BlockSize <= 0 {
+		return fmt.Errorf("invalid block size %d", b.BlockSize)
+	}
+	if _, err := newHash(b.Algorithm); err != nil {
+		return err
+	}
+	if want := (size + b.BlockSize - 1) / b.BlockSize; int64(len(b.Sums)) != want {
+		return fmt.Errorf("block checksum list has %d blocks, a %d byte file needs %d", len(b.Sums), size, want)
+	}
+	return nil
+}
+
+// detectDelta decides whether this download patches Filename in place:
+// DeltaBlocks must be set, the server must support ranges and the local
+// file must already exist
+func (d *AdaptiveDownloader) detectDelta(supportsRanges bool) {
+	d.delta = false
+	if d.DeltaBlocks == nil || !supportsRanges || d.FileSize <= 0 || d.fileless() {
+		return
+	}
+	if _, err := os.Stat(d.Filename); err == nil {
+		d.delta = true
+	}
+}
+
+// matchingBlocks hashes the local file block by block and returns the byte
+// ranges whose digest already matches the remote list
+func (d *AdaptiveDownloader) matchingBlocks() (*rangeSet, error) {
+	blocks := d.DeltaBlocks
+	if err := blocks.validate(d.FileSize); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(d.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	matched := &rangeSet{}
+	buffer := make([]byte, blocks.BlockSize)
+	for i, sum := range blocks.Sums {
+		start := int64(i) * blocks.BlockSize
+		end := min(start+blocks.BlockSize, d.FileSize)
+
+		n, err := file.ReadAt(buffer[:end-start], start)
+		if err == io.EOF || int64(n) < end-start {
+			// The local file is shorter; this and every later block differ
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		h, _ := newHash(blocks.Algorithm)
+		h.Write(buffer[:n])
+		if hex.EncodeToString(h.Sum(nil)) == strings.ToLower(sum) {
+			matched.add(start, end)
+		}
+	}
+	return matched, nil
+}
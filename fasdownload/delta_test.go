@@ -0,0 +1,136 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockSums builds the block checksum list for payload
+func blockSums(payload []byte, blockSize int) *BlockChecksums {
+	blocks := &BlockChecksums{BlockSize: int64(blockSize), Algorithm: "sha256"}
+	for start := 0; start < len(payload); start += blockSize {
+		sum := sha256.Sum256(payload[start:min(start+blockSize, len(payload))])
+		blocks.Sums = append(blocks.Sums, hex.EncodeToString(sum[:]))
+	}
+	return blocks
+}
+
+func TestDeltaUpdate(t *testing.T) {
+	const blockSize = 16 * 1024
+	payload := testPayload(16 * blockSize)
+
+	var mu sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			requested = append(requested, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	// The local copy differs in blocks 2, 3 and 9 and is missing the tail
+	// of the last block
+	local := append([]byte(nil), payload[:len(payload)-5000]...)
+	for _, block := range []int{2, 3, 9} {
+		local[block*blockSize+100] ^= 0xff
+	}
+	output := filepath.Join(t.TempDir(), "delta.bin")
+	if err := os.WriteFile(output, local, 0644); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.DeltaBlocks = blockSums(payload, blockSize)
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Patched file does not match payload")
+	}
+
+	want := []string{
+		fmt.Sprintf("bytes=%d-%d", 2*blockSize, 4*blockSize-1),
+		fmt.Sprintf("bytes=%d-%d", 9*blockSize, 10*blockSize-1),
+		fmt.Sprintf("bytes=%d-%d", 15*blockSize, 16*blockSize-1),
+	}
+	sort.Strings(requested)
+	sort.Strings(want)
+	if fmt.Sprint(requested) != fmt.Sprint(want) {
+		t.Errorf("Expected only the differing blocks %v to be fetched, got %v", want, requested)
+	}
+	if downloader.Stats.BytesDownloaded != 4*blockSize {
+		t.Errorf("Expected %d bytes fetched, got %d", 4*blockSize, downloader.Stats.BytesDownloaded)
+	}
+	if _, err := os.Stat(downloader.Filename + ".part"); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be patched in place without a .part file, stat returned: %v", err)
+	}
+}
+
+func TestDeltaBlockCountMismatch(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+
+	output := filepath.Join(t.TempDir(), "delta.bin")
+	if err := os.WriteFile(output, payload, 0644); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.DeltaBlocks = blockSums(payload[:32*1024], 16*1024)
+
+	if err := downloader.Download(context.Background()); err == nil {
+		t.Fatal("Expected an error for a block list that doesn't cover the remote file")
+	}
+}
+
+func TestDeltaPlanForSmallFile(t *testing.T) {
+	// Well under the small file threshold, which a delta update ignores
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+
+	output := filepath.Join(t.TempDir(), "delta.bin")
+	if err := os.WriteFile(output, payload[:60*1024], 0644); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.SmallFileThreshold = DefaultSmallFileThreshold
+	downloader.DeltaBlocks = blockSums(payload, 16*1024)
+	plan, err := downloader.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan() returned error: %v", err)
+	}
+	if plan.ChunkSize == 0 {
+		t.Error("Expected the plan to fetch the delta in ranged chunks")
+	}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if downloader.Result().SingleConnection {
+		t.Error("Expected the delta to be fetched in ranged chunks")
+	}
+	if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("Patched file does not match payload: %v", err)
+	}
+}
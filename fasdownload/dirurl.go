@@ -0,0 +1,83 @@
+package fasdownload
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TrailingSlashMode controls how a URL ending in "/", which servers usually
+// answer with a directory index page rather than a file, is handled
+type TrailingSlashMode string
+
+const (
+	// TrailingSlashAllow downloads the URL as it is
+	TrailingSlashAllow TrailingSlashMode = "allow"
+	// TrailingSlashError fails the download with ErrDirectoryURL
+	TrailingSlashError TrailingSlashMode = "error"
+	// TrailingSlashIndex appends IndexFile to the URL's path
+	TrailingSlashIndex TrailingSlashMode = "index"
+)
+
+// DefaultIndexFile is the name TrailingSlashIndex appends when IndexFile
+// is empty
+const DefaultIndexFile = "index.html"
+
+// ErrDirectoryURL reports a URL ending in "/" under TrailingSlashError
+var ErrDirectoryURL = errors.New("URL names a directory, not a file")
+
+// IsDirectoryURL reports whether rawURL's path ends in "/" or is empty,
+// as for a site's root
+func IsDirectoryURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return u.Path == "" || strings.HasSuffix(u.Path, "/")
+}
+
+// applyTrailingSlash carries out TrailingSlash for URL and each mirror
+func (d *AdaptiveDownloader) applyTrailingSlash() error {
+	source, err := d.directoryURL(d.URL)
+	if err != nil {
+		return err
+	}
+	// The caller's slice is left alone
+	mirrors := make([]string, len(d.Mirrors))
+	for i, mirror := range d.Mirrors {
+		if mirrors[i], err = d.directoryURL(mirror); err != nil {
+			return err
+		}
+	}
+
+	d.URL = source
+	if len(mirrors) > 0 {
+		d.Mirrors = mirrors
+	}
+	return nil
+}
+
+// directoryURL returns rawURL as TrailingSlash says to request it
+func (d *AdaptiveDownloader) directoryURL(rawURL string) (string, error) {
+	if !IsDirectoryURL(rawURL) {
+		return rawURL, nil
+	}
+
+	switch d.TrailingSlash {
+	case TrailingSlashError:
+		return "", fmt.Errorf("%w: %s", ErrDirectoryURL, rawURL)
+	case TrailingSlashIndex:
+		name := d.IndexFile
+		if name == "" {
+			name = DefaultIndexFile
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return "", err
+		}
+		u = u.JoinPath(name)
+		return u.String(), nil
+	}
+	return rawURL, nil
+}
@@ -0,0 +1,110 @@
+package fasdownload
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTrailingSlash(t *testing.T) {
+	files := map[string]string{
+		"/dir/":              "<html>directory listing</html>",
+		"/dir/index.html":    "index page",
+		"/dir/default.htm":   "default page",
+		"/":                  "<html>site root</html>",
+		"/index.html":        "root index page",
+		"/mirror/index.html": "index page",
+	}
+	var mu sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		path      string
+		mode      TrailingSlashMode
+		indexFile string
+		want      string // the file's content, "" for ErrDirectoryURL
+		wantURL   string
+	}{
+		{name: "allow by default", path: "/dir/", want: "<html>directory listing</html>", wantURL: "/dir/"},
+		{name: "allow", path: "/dir/", mode: TrailingSlashAllow, want: "<html>directory listing</html>", wantURL: "/dir/"},
+		{name: "error", path: "/dir/", mode: TrailingSlashError},
+		{name: "error on site root", path: "", mode: TrailingSlashError},
+		{name: "index", path: "/dir/", mode: TrailingSlashIndex, want: "index page", wantURL: "/dir/index.html"},
+		{name: "configured index", path: "/dir/", mode: TrailingSlashIndex, indexFile: "default.htm", want: "default page", wantURL: "/dir/default.htm"},
+		{name: "index on site root", path: "", mode: TrailingSlashIndex, want: "root index page", wantURL: "/index.html"},
+		{name: "file URL untouched", path: "/dir/index.html", mode: TrailingSlashError, want: "index page", wantURL: "/dir/index.html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			requested = nil
+			mu.Unlock()
+
+			output := filepath.Join(t.TempDir(), "out")
+			downloader := NewAdaptiveDownloader(server.URL+tt.path, output)
+			downloader.TrailingSlash = tt.mode
+			downloader.IndexFile = tt.indexFile
+			err := downloader.Download(context.Background())
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.want == "" {
+				if !errors.Is(err, ErrDirectoryURL) {
+					t.Fatalf("Expected ErrDirectoryURL, got %v", err)
+				}
+				if len(requested) != 0 {
+					t.Errorf("Expected no requests, got %v", requested)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("Expected %q, got %q (%v)", tt.want, got, err)
+			}
+			for _, path := range requested {
+				if path != tt.wantURL {
+					t.Errorf("Expected every request for %s, got %v", tt.wantURL, requested)
+					break
+				}
+			}
+		})
+	}
+
+	t.Run("mirrors", func(t *testing.T) {
+		mirrors := []string{server.URL + "/mirror/"}
+		downloader := NewAdaptiveDownloader(server.URL+"/dir/", "out")
+		downloader.Mirrors = mirrors
+		downloader.TrailingSlash = TrailingSlashIndex
+		if err := downloader.applyTrailingSlash(); err != nil {
+			t.Fatal(err)
+		}
+		if downloader.Mirrors[0] != server.URL+"/mirror/index.html" {
+			t.Errorf("Expected the mirror's index file, got %s", downloader.Mirrors[0])
+		}
+		if mirrors[0] != server.URL+"/mirror/" {
+			t.Errorf("Expected the caller's slice to be left alone, got %v", mirrors)
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package fasdownload
+
+import "path/filepath"
+
+// freeDiskSpace reports the bytes available to this user on the filesystem
+// holding dir. It is a variable so tests can stub the query.
+var freeDiskSpace = diskFree
+
+// checkDiskSpace fails fast when the filesystem that will hold path has
+// less than needed bytes free, rather than hitting ENOSPC halfway through
+// a download. If the filesystem can't be queried the check is skipped.
+func checkDiskSpace(path string, needed int64) error {
+	if needed <= 0 {
+		return nil
+	}
+
+	free, err := freeDiskSpace(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	if free < needed {
+		return &DiskSpaceError{Path: path, Needed: needed, Available: free}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || dragonfly || windows)
+
+package fasdownload
+
+import "errors"
+
+// diskFree is not implemented on this platform, so the disk space check
+// is skipped
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("disk space query not supported")
+}
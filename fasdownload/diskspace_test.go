@@ -0,0 +1,143 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// stubDiskSpace makes every free-space query return free and err
+func stubDiskSpace(t *testing.T, free int64, err error) {
+	t.Helper()
+	orig := freeDiskSpace
+	freeDiskSpace = func(string) (int64, error) { return free, err }
+	t.Cleanup(func() { freeDiskSpace = orig })
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	tests := []struct {
+		name    string
+		free    int64
+		err     error
+		needed  int64
+		wantErr string
+	}{
+		{"enough space", 1000, nil, 1000, ""},
+		{"not enough space", 999, nil, 1000, "insufficient disk space: need 1000, have 999"},
+		{"query fails", 0, errors.New("not supported"), 1000, ""},
+		{"nothing needed", 0, nil, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubDiskSpace(t, tt.free, tt.err)
+			err := checkDiskSpace(filepath.Join(t.TempDir(), "file.bin"), tt.needed)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("Expected %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDownloadFailsWithoutDiskSpace(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+	stubDiskSpace(t, 1024, nil)
+
+	output := filepath.Join(t.TempDir(), "full.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+
+	err := downloader.Download(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "insufficient disk space") {
+		t.Fatalf("Expected an insufficient disk space error, got %v", err)
+	}
+	if _, err := os.Stat(downloader.PartPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing written before the check, stat returned: %v", err)
+	}
+}
+
+func TestDiskFree(t *testing.T) {
+	free, err := diskFree(t.TempDir())
+	if err != nil {
+		t.Skipf("Disk space query not supported here: %v", err)
+	}
+	if free <= 0 {
+		t.Errorf("Expected positive free space, got %d", free)
+	}
+}
+
+// fullSink fails every write once limit bytes have been written, as a
+// filling disk does
+type fullSink struct {
+	WriterAtCloser
+	written atomic.Int64
+	limit   int64
+}
+
+func (s *fullSink) WriteAt(p []byte, off int64) error {
+	if s.written.Add(int64(len(p))) > s.limit {
+		return &os.PathError{Op: "write", Path: "full.bin.part", Err: syscall.ENOSPC}
+	}
+	return s.WriterAtCloser.WriteAt(p, off)
+}
+
+func TestDiskFullMidDownload(t *testing.T) {
+	payload := testPayload(8 * 1024 * 1024)
+	server := newPayloadServer(t, payload)
+
+	orig := newFileSink
+	newFileSink = func(file *os.File) WriterAtCloser {
+		return &fullSink{WriterAtCloser: fileSink{file}, limit: 3 * 1024 * 1024}
+	}
+	defer func() { newFileSink = orig }()
+
+	output := filepath.Join(t.TempDir(), "full.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 256 * 1024
+
+	err := downloader.Download(context.Background())
+	var full *DiskFullError
+	if !errors.As(err, &full) {
+		t.Fatalf("Expected a DiskFullError, got %v", err)
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected the error to match ENOSPC, got %v", err)
+	}
+	if full.Written == 0 || full.Written > 3*1024*1024 {
+		t.Errorf("Expected up to 3MB written before the disk filled, got %d", full.Written)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("disk full after %d bytes", full.Written)) {
+		t.Errorf("Expected the error to say how much was written, got %q", err)
+	}
+	if n := downloader.Stats.RetryCount(); n != 0 {
+		t.Errorf("Expected a full disk not to be retried, got %d retries", n)
+	}
+
+	// With space freed, the chunks written are kept
+	newFileSink = orig
+	resumed := NewAdaptiveDownloader(server.URL, output)
+	resumed.ChunkSize = 256 * 1024
+	if err := resumed.Download(context.Background()); err != nil {
+		t.Fatalf("Resumed Download() returned error: %v", err)
+	}
+	if got := resumed.Result().BytesResumed; got != full.Written {
+		t.Errorf("Expected %d bytes resumed, got %d", full.Written, got)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Resumed file does not match payload")
+	}
+}
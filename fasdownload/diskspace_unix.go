@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package fasdownload
+
+import "syscall"
+
+// diskFree returns the space available to unprivileged users on the
+// filesystem holding dir
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), nil
+}
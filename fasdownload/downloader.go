@@ -0,0 +1,1733 @@
+// Package fasdownload downloads files over HTTP using concurrent range
+// requests with adaptive connection management.
+package fasdownload
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BasicAuth holds credentials for HTTP basic authentication
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// ChunkInfo represents information about a file chunk to download
+type ChunkInfo struct {
+	Start int64
+	End   int64
+	Index int
+}
+
+// DownloadStats tracks download performance metrics. The fields are
+// updated while a download runs; read them through the accessors then.
+type DownloadStats struct {
+	BytesDownloaded int64
+	StartTime       time.Time
+	Chunks          int
+	Retries         int
+	Dials           int
+	mu              sync.Mutex
+
+	// ChunkRetries counts the retries of each chunk that needed any, by
+	// chunk index. BytesRedownloaded counts bytes fetched, then thrown
+	// away and fetched again when the download had to start over; a
+	// retried chunk resumes after the bytes it already has, so it adds
+	// none.
+	ChunkRetries      map[int]int
+	BytesRedownloaded int64
+
+	// chunkTimes holds the latest chunks' durations
+	chunkTimes durationRing
+}
+
+// Downloaded returns the bytes fetched so far
+func (s *DownloadStats) Downloaded() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.BytesDownloaded
+}
+
+// ChunkCount returns the number of chunks planned
+func (s *DownloadStats) ChunkCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Chunks
+}
+
+// RetryCount returns the number of chunk requests retried so far
+func (s *DownloadStats) RetryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Retries
+}
+
+// RetriesByChunk returns a copy of the retry counts of the chunks that
+// were retried, by chunk index; nil when none were
+func (s *DownloadStats) RetriesByChunk() map[int]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ChunkRetries) == 0 {
+		return nil
+	}
+	retries := make(map[int]int, len(s.ChunkRetries))
+	for index, n := range s.ChunkRetries {
+		retries[index] = n
+	}
+	return retries
+}
+
+// Redownloaded returns the bytes fetched again after a restart so far
+func (s *DownloadStats) Redownloaded() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.BytesRedownloaded
+}
+
+// recordChunkRetry counts a retry of the chunk at index
+func (s *DownloadStats) recordChunkRetry(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Retries++
+	if s.ChunkRetries == nil {
+		s.ChunkRetries = make(map[int]int)
+	}
+	s.ChunkRetries[index]++
+}
+
+// discard sets the bytes downloaded back to zero for a download starting
+// over, counting them as fetched again
+func (s *DownloadStats) discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.BytesRedownloaded += s.BytesDownloaded
+	s.BytesDownloaded = 0
+}
+
+// DialCount returns the number of TCP connections opened so far
+func (s *DownloadStats) DialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Dials
+}
+
+// ChunkDurations returns a copy of the durations of the last 1024
+// completed chunks, oldest first
+func (s *DownloadStats) ChunkDurations() []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chunkTimes.values()
+}
+
+// AverageChunkDuration returns the mean duration of the last 1024
+// completed chunks, or 0 before any completes
+func (s *DownloadStats) AverageChunkDuration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chunkTimes.average()
+}
+
+// recordChunkTime adds a completed chunk's duration
+func (s *DownloadStats) recordChunkTime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunkTimes.add(d)
+}
+
+// AdaptiveDownloader manages concurrent downloads with adaptive connection management
+type AdaptiveDownloader struct {
+	URL                string
+	Filename           string
+	MaxConnections     int
+	MinConnections     int
+	CurrentConnections int
+	ChunkSize          int64
+	FileSize           int64
+	Stats              *DownloadStats
+
+	// Socket buffer sizes in bytes (SO_RCVBUF/SO_SNDBUF); 0 keeps the OS default
+	SocketReceiveBuffer int
+	SocketSendBuffer    int
+
+	// Checksum is an optional "algorithm:hexdigest" the file must match.
+	// When verification fails the file is moved to QuarantineDir if set,
+	// otherwise deleted.
+	Checksum      string
+	QuarantineDir string
+
+	// Hash names an algorithm (md5, sha1, sha256 or sha512) whose digest
+	// of the file Digest reports once the download succeeds. Over a single
+	// connection the bytes are hashed as they are written; chunks arrive
+	// out of order, so their file is read once when it is complete. A
+	// Checksum of the same algorithm is checked against that digest rather
+	// than by reading the file again.
+	Hash string
+
+	// Redirect limits for the metadata phase (HEAD and range probe) and the
+	// download phase (GET), so a mirror that redirects one but not the other
+	// can be constrained independently
+	MaxHeadRedirects int
+	MaxGetRedirects  int
+
+	// AutoFilename lets the server's Content-Disposition filename replace
+	// Filename, or else the URL's last path element, or DefaultFilename
+	// with an extension for the Content-Type; set it when the user didn't
+	// choose an output name. Filename's directory is kept.
+	AutoFilename bool
+
+	// TrailingSlash decides what happens to a URL ending in "/", which
+	// usually serves a directory index page: TrailingSlashAllow (the
+	// default) downloads it as it is, TrailingSlashError refuses it, and
+	// TrailingSlashIndex requests IndexFile (DefaultIndexFile when empty)
+	// in that directory instead. Mirrors are treated the same way.
+	TrailingSlash TrailingSlashMode
+	IndexFile     string
+
+	// SandboxRoot, when set, is the directory every output path must stay
+	// within: Filename, whether configured, taken from Content-Disposition
+	// or returned by OnFilenameConflict, and QuarantineDir. A download to
+	// a path outside it fails with ErrOutsideSandbox before anything is
+	// written.
+	SandboxRoot string
+
+	// HistogramBuckets are the upper bounds for the chunk duration histogram
+	// in Result; DefaultHistogramBuckets is used when empty
+	HistogramBuckets []time.Duration
+
+	// MaxBytesPerSec caps the combined throughput of all connections;
+	// 0 means unlimited
+	MaxBytesPerSec int64
+
+	// Overwrite allows replacing an existing file at Filename. When it is
+	// false and the file exists, OnFilenameConflict decides: return a new path
+	// to download there instead, the same path to overwrite, or proceed=false
+	// to abort. Without a hook the download fails.
+	Overwrite          bool
+	OnFilenameConflict func(path string) (newPath string, proceed bool)
+
+	// IfNewer skips the download when the file at Filename is at least as
+	// new as the server's: the HEAD request carries If-Modified-Since with
+	// the file's modification time, and a 304 answer, or a Last-Modified
+	// no later than it, makes Download return ErrNotModified, leaving the
+	// file alone. An out-of-date file is replaced as if Overwrite were
+	// set, and like any download the new one takes Last-Modified as its
+	// modification time, so the next check compares the server's clock
+	// with itself.
+	IfNewer bool
+
+	// NoModTime leaves a finished file with the time it was written as its
+	// modification time. Otherwise it is given the server's Last-Modified,
+	// when the server sends one, as archiving and rsync-style tools expect.
+	NoModTime bool
+
+	// Headers, BasicAuth and BearerToken are sent with every request
+	Headers     map[string]string
+	BasicAuth   *BasicAuth
+	BearerToken string
+
+	// Jar holds the cookies every request of a download shares, so a
+	// session cookie set by the HEAD request or a login redirect is sent
+	// with the chunk requests; nil uses a fresh jar per download. Cookies
+	// seeds it for URL's host, for downloads gated behind cookie auth. A
+	// raw Cookie header can go in Headers instead.
+	Jar     http.CookieJar
+	Cookies map[string]string
+
+	// Timeout is a hard limit on each download request, body included;
+	// 0 means none. ReadTimeout is the one that catches a dead connection:
+	// a request fails once nothing has arrived for that long, so a slow
+	// chunk that keeps making progress is never cut off. DialTimeout,
+	// TLSHandshakeTimeout and IdleConnTimeout (how long an unused
+	// keep-alive connection stays open) configure the transport. Zero
+	// values use the Default* constants.
+	Timeout             time.Duration
+	ReadTimeout         time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	IdleConnTimeout     time.Duration
+
+	// StallTimeout is how long a chunk's body may go without data before
+	// the request is cancelled and the rest of the chunk retried on a new
+	// connection, catching a half-open one well before ReadTimeout would;
+	// 0 uses DefaultStallTimeout. It never lengthens ReadTimeout.
+	StallTimeout time.Duration
+
+	// Deadline bounds the whole of Download in wall-clock time, however
+	// much progress is being made; 0 means none. Running out fails the
+	// download with a *DeadlineError.
+	Deadline time.Duration
+
+	// IPFamily makes connections try IPv4 or IPv6 addresses first, racing
+	// the other family once the preferred one has had FallbackDelay to
+	// connect (Happy Eyeballs). IPFamilyAny keeps the system's order.
+	// FallbackDelay 0 uses DefaultFallbackDelay.
+	IPFamily      IPFamily
+	FallbackDelay time.Duration
+
+	// DialContext, when set, opens every TCP connection in place of the
+	// built-in dialer, for instance to route or observe them; DialTimeout
+	// and the socket buffer sizes don't apply to it
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Transport, when set, sends every HTTP request in place of the
+	// transport built from the dialer, proxy and TLS settings, none of
+	// which then apply; timeouts, redirect limits and cookies still do. It
+	// lets tests fail, delay or cut short chosen requests without a
+	// misbehaving server.
+	Transport http.RoundTripper
+
+	// CAFile is a PEM bundle of the certificate authorities trusted for
+	// HTTPS, in place of the system roots, for servers with a private CA.
+	// InsecureSkipVerify disables certificate verification altogether; it
+	// leaves the download open to interception and is meant for testing
+	// against self-signed servers only.
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// OnSizeChange decides what a resumed download does when the server
+	// reports a different size than when it was interrupted: restart (the
+	// default), fail, or continue-if-larger to fetch only the new tail.
+	OnSizeChange SizeChangePolicy
+
+	// CheckpointInterval and CheckpointBytes limit how often the resume
+	// state is written as chunks complete: once that much time has passed
+	// or that many bytes have completed since the last write, whichever
+	// comes first. Both 0 write it after every chunk. Whatever is unsaved
+	// is written when a download fails or is cancelled; only a crash loses
+	// it.
+	CheckpointInterval time.Duration
+	CheckpointBytes    int64
+
+	// MaxConnsPerHost caps the connections open to any one host, and so
+	// the connections the adaptive logic ever grows to, whatever
+	// MaxConnections allows; 0 means no cap. Over HTTP/2 it caps the TCP
+	// connections, not the streams multiplexed over them. See
+	// SetMaxConcurrentRequests for a cap across downloads.
+	MaxConnsPerHost int
+
+	// AdaptInterval is how often the adaptive logic measures throughput and
+	// adjusts CurrentConnections while chunks download, independent of how
+	// many chunks there are or the order they finish in
+	AdaptInterval time.Duration
+
+	// Proxy is the URL of an HTTP or HTTPS proxy for every request. When it
+	// is empty HTTP_PROXY and HTTPS_PROXY are used; NO_PROXY applies to both.
+	Proxy string
+
+	// Socks5 routes every connection, FTP included, through a SOCKS5 proxy
+	// at "host:port" or "user:pass@host:port", such as Tor or an SSH -D
+	// forward. It replaces Proxy and the environment's HTTP proxies, and
+	// host names are resolved by the proxy, so IPFamily doesn't apply.
+	Socks5 string
+
+	// HeadTimeout bounds the metadata requests (HEAD and range probe) so a
+	// hung server can't stall the start of a download indefinitely
+	HeadTimeout time.Duration
+
+	// Stream, when set, receives the file's bytes in order instead of them
+	// being written to Filename, which then only names the download. As
+	// with StdoutFilename, the file comes over a single connection, with
+	// no .part file, checkpoint or checksum verification.
+	Stream io.Writer
+
+	// Sink, when set, receives the download instead of Filename, which
+	// then only names it. Chunks are still fetched over parallel
+	// connections and written at their offsets, falling back to writes in
+	// order over one connection when the server can't serve ranges. There
+	// is no .part file, checkpoint or checksum verification. A sink that
+	// can only be written in order goes in Stream instead.
+	Sink WriterAtCloser
+
+	// Output receives human-readable status and progress messages;
+	// nil keeps the downloader silent. Verbose adds per-chunk timings,
+	// retry messages and connection adjustments.
+	Output  io.Writer
+	Verbose bool
+
+	// ProgressFunc, when set, is called every ProgressInterval with the bytes
+	// on disk so far, the total size, the speed and the estimated time
+	// remaining, instead of printing a progress line to Output
+	ProgressFunc     func(Progress)
+	ProgressInterval time.Duration
+
+	// RecordThroughput keeps a series of the speed over each
+	// ProgressInterval, for ThroughputSamples to return once the download
+	// is done; ThroughputFunc, when set, receives each sample as it is
+	// taken. The series holds at most MaxThroughputSamples (0 uses
+	// DefaultMaxThroughputSamples): when full, neighbouring samples are
+	// merged and later ones cover twice the time.
+	RecordThroughput     bool
+	ThroughputFunc       func(ThroughputSample)
+	MaxThroughputSamples int
+
+	// ETagCheck compares the file's MD5 with a strong ETag from the server
+	// when no checksum is known; weak ETags are skipped
+	ETagCheck ETagCheckMode
+
+	// RetryPolicy decides which failed chunk requests are retried and how
+	// long to wait; nil uses a DefaultRetryPolicy with 3 retries
+	RetryPolicy RetryPolicy
+
+	// MaxConcurrentHandshakes caps how many TLS handshakes run at once, so
+	// ramping up connections doesn't spike CPU or trip server anti-abuse
+	// limits; 0 means unlimited. Established connections don't count.
+	MaxConcurrentHandshakes int
+
+	// DeltaBlocks, when set and Filename already exists, turns the download
+	// into an in-place update: local blocks are hashed and only those that
+	// differ from the list are fetched
+	DeltaBlocks *BlockChecksums
+
+	// RangeCap decides what happens when a server answers a ranged request
+	// with only the first part of the range: RangeCapAdapt (the default)
+	// lowers ChunkSize to the server's limit and re-splits pending chunks,
+	// RangeCapFail treats it as an error
+	RangeCap RangeCapMode
+
+	// ErrorBurstThreshold 5xx responses within ErrorBurstWindow count as a
+	// burst: connections drop to MinConnections and new requests pause for
+	// ErrorBurstPause, after which the adaptive logic ramps back up. Zero
+	// values use the defaults; a negative threshold disables this.
+	ErrorBurstThreshold int
+	ErrorBurstWindow    time.Duration
+	ErrorBurstPause     time.Duration
+
+	// SmallFileThreshold is the size below which a file is fetched over a
+	// single connection even when the server supports ranges, since for a
+	// small file setting up several connections costs more time than it
+	// saves. 0 uses DefaultSmallFileThreshold; a negative value always
+	// splits the file into chunks.
+	SmallFileThreshold int64
+
+	// ChunkPriority sets the order chunks are fetched in: ChunkPriorityHead
+	// (the default), ChunkPriorityTail or ChunkPriorityEdges
+	ChunkPriority ChunkPriority
+
+	// Mirrors are alternate URLs serving the same file. When the HEAD
+	// request fails, or a chunk keeps failing after its retries, requests
+	// move to the next mirror that reports the same size.
+	Mirrors []string
+
+	// MirrorHashing spreads chunks across URL and every mirror reporting
+	// the same size instead of sending them all to one source, mapping
+	// each byte range to a source by consistent hashing. With mirrors that
+	// are CDN edges, repeated runs then ask the same edge for the same
+	// range and find it in its cache. A chunk whose source keeps failing
+	// moves to the current one.
+	MirrorHashing bool
+
+	// HTTP2Connections and HTTP2Streams set the concurrency model when the
+	// server negotiates HTTP/2: requests are multiplexed as HTTP2Streams
+	// concurrent streams over HTTP2Connections TCP connections instead of one
+	// connection per worker. 0 uses DefaultHTTP2Connections and
+	// DefaultHTTP2Streams.
+	HTTP2Connections int
+	HTTP2Streams     int
+
+	// ExpectedSize is the size the file should have, for servers that don't
+	// report one; 0 means unknown. An empty response to a download that
+	// should have content is retried instead of saved as an empty file.
+	ExpectedSize int64
+
+	// MaxFileSize is the largest size a server may report before the file
+	// is preallocated; a bigger one, which a bad or hostile Content-Length
+	// could claim, fails the download with a *FileTooLargeError. 0 uses
+	// DefaultMaxFileSize.
+	MaxFileSize int64
+
+	// MaxChunks bounds how many chunks a file is split into, so a huge
+	// file doesn't mean tens of thousands of requests and chunk timings:
+	// ChunkSize grows for the download as far as it takes. 0 uses
+	// DefaultMaxChunks. For a file too small to give each of
+	// MaxConnections a chunk, ChunkSize shrinks instead, but not below
+	// MinChunkSize (0 uses DefaultMinChunkSize). With ChunkSize 0 the size
+	// is picked from the file size alone, as small as MinChunkSize.
+	MaxChunks    int
+	MinChunkSize int64
+
+	// NoPreallocate skips sizing the .part file to FileSize before chunks
+	// are written, for filesystems that zero-fill a truncated file eagerly;
+	// chunk writes extend it instead. The file may end up more fragmented,
+	// and a full disk shows up part way through rather than at the start.
+	NoPreallocate bool
+
+	// ResolvedURL is where URL, or the mirror in use, redirected to; chunk
+	// requests go there directly. It is empty when there was no redirect.
+	ResolvedURL string
+
+	// Decompress names the compression of the served file, which is then
+	// written decompressed. It forces a single-connection download; progress
+	// and FileSize count compressed bytes, and Checksum applies to the
+	// decompressed file.
+	Decompress Compression
+
+	// CoalesceWrites collects each chunk's body in memory and writes it in
+	// one call instead of one per network read, for storage that handles
+	// small scattered writes poorly. MaxInFlightBytes caps the memory those
+	// buffers take across all connections, whatever the chunk size and
+	// connection count; a chunk larger than the cap is written in cap-sized
+	// pieces. 0 means no cap.
+	CoalesceWrites   bool
+	MaxInFlightBytes int64
+
+	// StrictChunkPlanning checks, before any chunk is fetched, that the
+	// chunks and the ranges resumed from disk cover the file exactly once,
+	// failing with a *ChunkPlanError that names each gap and overlap
+	// rather than leaving it to the check once the download is done
+	StrictChunkPlanning bool
+
+	// Protocol is the HTTP version the server negotiated, such as "HTTP/1.1"
+	// or "HTTP/2.0". It is set by the first request of a download.
+	Protocol string
+
+	etag       string
+	finished   time.Time
+	single     bool
+	tlsConfig  *tls.Config
+	handshakes chan struct{}
+	limiter    *rateLimiter
+	inFlight   *byteSemaphore
+	burst      *errorBurst
+	pool       *workerPool
+	completed  *rangeSet
+	written    []byteRange
+	resumed    int64
+	special    bool
+	encoded    bool
+	delta      bool
+	queue      *chunkQueue
+
+	// lastModified is the HEAD response's Last-Modified; ifRange is the
+	// validator chunk requests of a resumed download send in If-Range
+	lastModified string
+	ifRange      string
+
+	// localModTime is the modification time of the file IfNewer compares
+	// against, zero when there is none
+	localModTime time.Time
+
+	// control holds the state Pause, Resume and Cancel share with Download
+	control control
+
+	// climb is the adaptive logic's search state, guarded by mu
+	climb hillClimb
+
+	// socks is the parsed Socks5 setting, nil without one
+	socks *socksProxy
+
+	// ring maps chunks to sources under MirrorHashing, nil without it
+	ring *mirrorRing
+
+	// jar is the cookie jar of the current download: Jar or a fresh one
+	jar http.CookieJar
+
+	// chunkSize is the size chunks are planned at for this download,
+	// ChunkSize scaled by MaxChunks; guarded by mu once chunks download
+	chunkSize int64
+
+	// throughput is the series RecordThroughput keeps
+	throughput *throughputSeries
+
+	// live tracks the bytes written for WaitForRange and LiveReader
+	live liveRanges
+
+	// digest is the hex digest of the finished file by digestAlgorithm,
+	// "" until it is known
+	digest          string
+	digestAlgorithm string
+
+	// chunkTable tracks each chunk's status for ChunkStates
+	chunkTable chunkTable
+
+	// clients are shared by all chunk workers so connections are reused:
+	// one over HTTP/1.1, one per HTTP/2 connection
+	clients []*http.Client
+
+	// unsaved counts bytes completed since the last checkpoint was written;
+	// these are guarded by stateMu
+	unsaved        int64
+	lastCheckpoint time.Time
+	checkpoints    int
+	stateMu        sync.Mutex
+	mu             sync.Mutex
+
+	// source is the index of the URL requests go to: 0 for URL, i for
+	// Mirrors[i-1]
+	source   int
+	sourceMu sync.Mutex
+
+	// outputMu serializes writes to Output from the workers, the progress
+	// reporter and the adaptive logic
+	outputMu sync.Mutex
+}
+
+// logf writes a status message to Output, if set
+func (d *AdaptiveDownloader) logf(format string, args ...any) {
+	if d.Output != nil {
+		d.outputMu.Lock()
+		defer d.outputMu.Unlock()
+		fmt.Fprintf(d.Output, format, args...)
+	}
+}
+
+// debugf writes a detail message to Output when Verbose is set
+func (d *AdaptiveDownloader) debugf(format string, args ...any) {
+	if d.Verbose {
+		d.logf(format, args...)
+	}
+}
+
+// NewAdaptiveDownloader creates a new adaptive downloader
+func NewAdaptiveDownloader(url, filename string) *AdaptiveDownloader {
+	return &AdaptiveDownloader{
+		URL:                url,
+		Filename:           filename,
+		MaxConnections:     16,
+		MinConnections:     2,
+		CurrentConnections: 4,
+		ChunkSize:          1024 * 1024, // 1MB chunks
+		MaxHeadRedirects:   10,
+		MaxGetRedirects:    10,
+		HeadTimeout:        30 * time.Second,
+		ProgressInterval:   time.Second,
+		AdaptInterval:      defaultAdaptInterval,
+		Stats: &DownloadStats{
+			StartTime: now(),
+		},
+	}
+}
+
+// downloadChunk downloads a specific chunk of the file, consulting the retry
+// policy on failure. Retries resume from the last byte written.
+func (d *AdaptiveDownloader) downloadChunk(ctx context.Context, chunk ChunkInfo, sink WriterAtCloser) error {
+	start := now()
+	defer func() {
+		elapsed := since(start)
+		d.Stats.recordChunkTime(elapsed)
+		d.debugf("Chunk %d (%d bytes) took %v\n", chunk.Index, chunk.End-chunk.Start+1, elapsed)
+	}()
+
+	client := d.chunkClient(chunk)
+	target := d.chunkTarget(chunk)
+	offset := chunk.Start
+
+	for attempt := 1; ; attempt++ {
+		// Hold off while the server recovers from a burst of errors
+		if err := d.burst.wait(ctx); err != nil {
+			return err
+		}
+
+		source := d.sourceIndex()
+		n, err := d.fetchRange(ctx, client, target, offset, chunk.End, sink)
+		offset += n
+		if err == nil && offset <= chunk.End {
+			// A capped response isn't a failure: plan smaller chunks from
+			// now on and fetch the rest of this one
+			d.clampChunkSize(n)
+			attempt = 0
+			continue
+		}
+		if err == nil {
+			return nil
+		}
+		var rangeErr *RangeUnsupportedError
+		var unsatisfiable *RangeNotSatisfiableError
+		var writeErr *writeError
+		if ctx.Err() != nil || errors.As(err, &rangeErr) || errors.As(err, &unsatisfiable) || errors.Is(err, errContentChanged) || errors.As(err, &writeErr) {
+			return err
+		}
+
+		// A bad status reaches the policy as a response rather than an error
+		var resp *http.Response
+		reqErr := err
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) {
+			resp, reqErr = statusErr.resp, nil
+			if statusErr.StatusCode >= 500 && d.burst.record(now()) {
+				d.backOff(d.burst.pause)
+			}
+		}
+		retry, delay := d.retryPolicy().ShouldRetry(attempt, resp, reqErr)
+		if !retry {
+			if target != "" {
+				d.debugf("Retrying chunk %d against %s: %v\n", chunk.Index, d.sourceURL(), err)
+				target = ""
+				attempt = 0
+				continue
+			}
+			if d.failover(ctx, source) {
+				d.debugf("Retrying chunk %d against %s: %v\n", chunk.Index, d.sourceURL(), err)
+				attempt = 0
+				continue
+			}
+			return err
+		}
+
+		d.Stats.recordChunkRetry(chunk.Index)
+		d.debugf("Retrying chunk %d in %v: %v\n", chunk.Index, delay, err)
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// fetchRange makes one ranged request for bytes start..end (inclusive) to
+// target, or the current source when it is "", and writes the body at
+// start, returning how many bytes were written. A server that caps range
+// length may answer with fewer bytes and no error.
+func (d *AdaptiveDownloader) fetchRange(ctx context.Context, client *http.Client, target string, start, end int64, sink WriterAtCloser) (int64, error) {
+	// Bytes are read through a 32KB buffer written after every read, or
+	// with CoalesceWrites one as large as the range, written once full.
+	// Waiting for buffer memory happens before the request is made.
+	size := int64(32 * 1024)
+	if d.CoalesceWrites {
+		var err error
+		if size, err = d.inFlight.acquire(ctx, end-start+1); err != nil {
+			return 0, err
+		}
+		defer d.inFlight.release(size)
+	}
+
+	// Wait for room under the process-wide request cap
+	release, err := acquireRequestSlot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	// Give up on a response that stalls, however long a steady one takes
+	watch := d.watchIdle(ctx)
+	defer watch.stop()
+
+	var req *http.Request
+	if target == "" {
+		req, err = d.newRequest(watch.ctx, "GET")
+	} else {
+		req, err = d.newRequestTo(watch.ctx, "GET", target)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Set range header for partial content
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
+	req.Header.Set("Range", rangeHeader)
+	if d.ifRange != "" {
+		req.Header.Set("If-Range", d.ifRange)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, wrapTimeout("range request", watch.err("range request", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		if d.ifRange != "" {
+			return 0, errContentChanged
+		}
+		return 0, errRangeIgnored
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return 0, &RangeNotSatisfiableError{Start: start, End: end, FileSize: d.FileSize}
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, newHTTPStatusError(resp)
+	}
+
+	// A proxy that answers with a different range would have us write the
+	// wrong bytes at this offset
+	gotStart, gotEnd, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return 0, err
+	}
+	if gotStart != start || gotEnd > end {
+		return 0, fmt.Errorf("server returned range %d-%d, requested %d-%d", gotStart, gotEnd, start, end)
+	}
+	if gotEnd < end {
+		// The server caps range length; take what it sends and let the
+		// caller fetch the rest
+		if d.RangeCap == RangeCapFail {
+			return 0, &RangeUnsupportedError{Reason: fmt.Sprintf("server returned range %d-%d, requested %d-%d", gotStart, gotEnd, start, end)}
+		}
+		end = gotEnd
+	}
+
+	// The body is flowing; a connection that goes quiet now has stalled
+	watch.stall(d)
+
+	// offset is where the buffered bytes go; everything before it is on disk
+	buffer := make([]byte, size)
+	filled := 0
+	offset := start
+	flush := func() error {
+		if filled == 0 {
+			return nil
+		}
+		if err := sink.WriteAt(buffer[:filled], offset); err != nil {
+			return &writeError{err}
+		}
+		offset += int64(filled)
+		filled = 0
+		return nil
+	}
+
+	for offset+int64(filled) <= end {
+		n, err := resp.Body.Read(buffer[filled:])
+
+		// Never write past the requested range, whatever the server sends
+		n = int(min(int64(n), end-offset-int64(filled)+1))
+		if n > 0 {
+			filled += n
+
+			// Time spent under the rate limit or paused isn't the server
+			// stalling
+			watch.pause()
+			if waitErr := d.limiter.wait(ctx, n); waitErr != nil {
+				flush()
+				return offset - start, waitErr
+			}
+			if waitErr := d.waitResumed(ctx); waitErr != nil {
+				flush()
+				return offset - start, waitErr
+			}
+			watch.touch()
+
+			if !d.CoalesceWrites || filled == len(buffer) {
+				if writeErr := flush(); writeErr != nil {
+					return offset - start, writeErr
+				}
+			}
+
+			// Update stats
+			d.Stats.mu.Lock()
+			d.Stats.BytesDownloaded += int64(n)
+			d.Stats.mu.Unlock()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Keep what arrived so a retry resumes after it
+			if writeErr := flush(); writeErr != nil {
+				return offset - start, writeErr
+			}
+			return offset - start, wrapTimeout("range request", watch.err("range request", err))
+		}
+	}
+	if err := flush(); err != nil {
+		return offset - start, err
+	}
+
+	if offset <= end {
+		return offset - start, fmt.Errorf("response ended after %d of %d bytes: %w", offset-start, end-start+1, io.ErrUnexpectedEOF)
+	}
+	return offset - start, nil
+}
+
+// downloadSingleConnection downloads the file in a single connection (fallback for servers without range support)
+func (d *AdaptiveDownloader) downloadSingleConnection(ctx context.Context) error {
+	d.logf("Downloading file in single connection...\n")
+	d.single = true
+	d.Stats.mu.Lock()
+	d.Stats.Chunks = 1
+	d.Stats.mu.Unlock()
+
+	// Even a server without range support may resume a single open-ended
+	// range, so the .part prefix a previous run saved is kept
+	d.completed = &rangeSet{}
+	if d.singleResumable() {
+		completed, err := d.loadCheckpoint()
+		if err != nil {
+			return err
+		}
+		if len(completed.ranges) > 0 && completed.ranges[0].Start == 0 && completed.ranges[0].End < d.FileSize {
+			d.completed.add(0, completed.ranges[0].End)
+		}
+	}
+	d.resumed = d.completed.total()
+	if d.resumed > 0 {
+		d.logf("Resuming download: %d of %d bytes already on disk\n", d.resumed, d.FileSize)
+	}
+
+	if !d.special && !d.fileless() {
+		if err := checkDiskSpace(d.PartPath(), d.FileSize-d.resumed); err != nil {
+			return err
+		}
+	}
+
+	// Create output file, unless the download goes to a stream or sink
+	target := d.sequentialTarget()
+	var file *os.File
+	if target == nil {
+		var err error
+		if file, err = d.openTarget(d.resumed > 0); err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := file.Seek(d.resumed, io.SeekStart); err != nil {
+			return err
+		}
+		target = file
+	}
+
+	// Hash the bytes on their way to the file instead of reading it back;
+	// only a resumed prefix has to be read
+	hasher, algorithm := d.newDigest()
+	if hasher != nil {
+		if d.resumed > 0 {
+			if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, d.resumed)); err != nil {
+				return err
+			}
+		}
+		target = io.MultiWriter(target, hasher)
+	}
+
+	// A server that answers the resume with the whole file gets it written
+	// from the start
+	restart := func() error {
+		d.logf("\nServer can't resume. Downloading from the start.\n")
+		d.resumed = 0
+		d.completed = &rangeSet{}
+		if hasher != nil {
+			hasher.Reset()
+		}
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		_, err := file.Seek(0, io.SeekStart)
+		return err
+	}
+
+	// Create HTTP client
+	client := d.newClient(d.Timeout, d.MaxGetRedirects)
+
+	// Start progress reporter
+	stopProgress := d.startProgress(ctx)
+	defer stopProgress()
+
+	start := now()
+
+	// A flaky proxy may answer 200 with no body at all; that is retried
+	// rather than accepted as an empty file
+	for attempt := 1; ; attempt++ {
+		written, err := d.fetchWhole(ctx, client, target, d.resumed, restart)
+		if err == nil && written == 0 && d.expectedSize() > 0 {
+			err = errEmptyResponse
+		}
+		if !errors.Is(err, errEmptyResponse) || ctx.Err() != nil {
+			if err != nil {
+				d.saveSinglePrefix(d.resumed + written)
+				return err
+			}
+			break
+		}
+
+		retry, delay := d.retryPolicy().ShouldRetry(attempt, nil, err)
+		if !retry {
+			return err
+		}
+
+		d.Stats.mu.Lock()
+		d.Stats.Retries++
+		d.Stats.mu.Unlock()
+		d.debugf("Retrying download in %v: %v\n", delay, err)
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return cancellationError(ctx, err)
+		}
+	}
+
+	// Decoded content has no reported size; otherwise the stream must
+	// have been as long as HEAD said
+	if d.FileSize > 0 && !d.encoded {
+		if err := d.checkSize(file, d.resumed+d.Stats.Downloaded()); err != nil {
+			return err
+		}
+	}
+	if hasher != nil {
+		d.digest, d.digestAlgorithm = hex.EncodeToString(hasher.Sum(nil)), algorithm
+	}
+
+	if err := d.finalize(file); err != nil {
+		return err
+	}
+	if d.singleResumable() {
+		os.Remove(d.statePath())
+	}
+
+	duration := since(start)
+	actualFileSize := d.Stats.BytesDownloaded
+	speed := averageSpeed(actualFileSize, duration) / 1024 / 1024 // MB/s
+
+	d.logf("\nDownload completed!\n")
+	d.logf("Total time: %v\n", duration)
+	d.logf("File size: %d bytes\n", actualFileSize)
+	d.logf("Average speed: %.2f MB/s\n", speed)
+
+	return nil
+}
+
+// fetchWhole makes one plain GET and copies the body to w, decompressing
+// it if configured, and returns how many bytes were received. With from
+// above 0 it asks for the file from that byte on; a server that sends the
+// whole file instead has restart called before anything is written.
+func (d *AdaptiveDownloader) fetchWhole(ctx context.Context, client *http.Client, w io.Writer, from int64, restart func() error) (int64, error) {
+	watch := d.watchIdle(ctx)
+	defer watch.stop()
+
+	req, err := d.newRequest(watch.ctx, "GET")
+	if err != nil {
+		return 0, err
+	}
+	if from > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+		if d.ifRange != "" {
+			req.Header.Set("If-Range", d.ifRange)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, cancellationError(ctx, wrapTimeout("GET request", watch.err("GET request", err)))
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case from > 0 && resp.StatusCode == http.StatusPartialContent:
+		start, _, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, err
+		}
+		if start != from {
+			return 0, fmt.Errorf("server resumed at byte %d instead of %d", start, from)
+		}
+	case resp.StatusCode == http.StatusOK:
+		if from > 0 {
+			if err := restart(); err != nil {
+				return 0, err
+			}
+		}
+	default:
+		return 0, newHTTPStatusError(resp)
+	}
+
+	// Progress and the rate limit follow the bytes received, which differ
+	// from the bytes written when decoding. A Content-Encoding is undone
+	// first, then the file's own compression.
+	body := &meteredBody{d: d, ctx: ctx, body: resp.Body, watch: watch}
+	decoded, closeContent, err := newDecoder(body, contentEncoding(resp))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	defer closeContent()
+	src, closeDecoder, err := d.decompressor(decoded)
+	if err != nil {
+		return 0, err
+	}
+	defer closeDecoder()
+
+	// Copy the entire file
+	buffer := make([]byte, 32*1024) // 32KB buffer
+
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				return body.received, writeErr
+			}
+		}
+		if err == io.EOF {
+			return body.received, nil
+		}
+		if body.err != nil {
+			return body.received, cancellationError(ctx, wrapTimeout("GET request", watch.err("GET request", body.err)))
+		}
+		if err != nil {
+			return body.received, fmt.Errorf("failed to decompress: %w", err)
+		}
+	}
+}
+
+// singleResumable reports whether a single-connection download can keep
+// the start of its .part file for the next run: the bytes on disk have to
+// be the bytes the server sends, at a known size
+func (d *AdaptiveDownloader) singleResumable() bool {
+	return d.FileSize > 0 && !d.fileless() && !d.inPlace() && !d.encoded && d.Decompress == CompressionNone
+}
+
+// saveSinglePrefix checkpoints the first n bytes of a failed
+// single-connection download so the next run resumes after them
+func (d *AdaptiveDownloader) saveSinglePrefix(n int64) {
+	if n <= 0 || !d.singleResumable() {
+		return
+	}
+	d.stateMu.Lock()
+	d.completed.add(0, n)
+	d.unsaved = n
+	d.stateMu.Unlock()
+	if err := d.flushCheckpoint(); err != nil {
+		d.logf("\nFailed to save checkpoint: %v\n", err)
+	}
+}
+
+// meteredBody reads a response body under the rate limit, keeping the idle
+// watch and download stats up to date. err keeps the first read error so it
+// can be told apart from a decoder's.
+type meteredBody struct {
+	d        *AdaptiveDownloader
+	ctx      context.Context
+	body     io.Reader
+	watch    *idleWatch
+	received int64
+	err      error
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.watch.pause()
+		if waitErr := b.d.limiter.wait(b.ctx, n); waitErr != nil {
+			b.err = waitErr
+			return 0, waitErr
+		}
+		if waitErr := b.d.waitResumed(b.ctx); waitErr != nil {
+			b.err = waitErr
+			return 0, waitErr
+		}
+		b.watch.touch()
+
+		b.received += int64(n)
+		b.d.Stats.mu.Lock()
+		b.d.Stats.BytesDownloaded += int64(n)
+		b.d.Stats.mu.Unlock()
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// expectedSize returns the size the download should have: the size the
+// server reported, else ExpectedSize; 0 when neither is known
+func (d *AdaptiveDownloader) expectedSize() int64 {
+	if d.FileSize > 0 {
+		return d.FileSize
+	}
+	return max(d.ExpectedSize, 0)
+}
+
+// RangeCapMode controls how a server that caps range length is handled
+type RangeCapMode string
+
+const (
+	// RangeCapAdapt shrinks the chunk size to the server's limit
+	RangeCapAdapt RangeCapMode = "adapt"
+	// RangeCapFail fails the chunk instead
+	RangeCapFail RangeCapMode = "fail"
+)
+
+// clampChunkSize lowers ChunkSize to the longest range the server will
+// serve and re-splits the chunks that haven't started yet
+func (d *AdaptiveDownloader) clampChunkSize(limit int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if limit <= 0 || limit >= d.chunkSize {
+		return
+	}
+	d.logf("\nServer caps ranges at %d bytes; reducing chunk size from %d\n", limit, d.chunkSize)
+	d.ChunkSize = limit
+	d.chunkSize = limit
+
+	if d.queue != nil {
+		added := d.queue.resplit(limit)
+		d.chunkTable.requeue(d.queue)
+		d.Stats.mu.Lock()
+		d.Stats.Chunks += added
+		d.Stats.mu.Unlock()
+	}
+}
+
+// effectiveChunkSize returns the size to plan FileSize's chunks at:
+// ChunkSize, shrunk as far as MinChunkSize so a small file still gives
+// every one of MaxConnections a chunk, and grown to keep within MaxChunks.
+// With ChunkSize 0 it is the smallest size from MinChunkSize up that keeps
+// within MaxChunks.
+func (d *AdaptiveDownloader) effectiveChunkSize() int64 {
+	maxChunks := d.MaxChunks
+	if maxChunks <= 0 {
+		maxChunks = DefaultMaxChunks
+	}
+	floor := d.MinChunkSize
+	if floor <= 0 {
+		floor = DefaultMinChunkSize
+	}
+	target := d.ChunkSize
+	if target <= 0 {
+		target = floor
+	}
+	return computeChunkSize(d.FileSize, maxChunks, shrinkChunkSize(d.FileSize, d.MaxConnections, target, floor))
+}
+
+// resolveConflict checks that Filename is within SandboxRoot and whether it
+// already exists and, if so, whether to overwrite it, download elsewhere,
+// or abort
+func (d *AdaptiveDownloader) resolveConflict() error {
+	// Writing to a device or patching the file is the point, not a conflict
+	if d.inPlace() {
+		return d.checkSandbox()
+	}
+
+	for {
+		if err := d.checkSandbox(); err != nil {
+			return err
+		}
+		if _, err := os.Stat(d.Filename); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if d.Overwrite || !d.localModTime.IsZero() {
+			return nil
+		}
+		if d.OnFilenameConflict == nil {
+			return fmt.Errorf("%w: %s", ErrFileExists, d.Filename)
+		}
+
+		newPath, proceed := d.OnFilenameConflict(d.Filename)
+		if !proceed {
+			return fmt.Errorf("download aborted: %s already exists", d.Filename)
+		}
+		if newPath == "" || newPath == d.Filename {
+			return nil
+		}
+		d.logf("Downloading to %s instead\n", newPath)
+		d.Filename = newPath
+	}
+}
+
+// PartPath returns where data is written until the download completes.
+// Devices and delta updates are written in place, so for them it is
+// Filename itself.
+func (d *AdaptiveDownloader) PartPath() string {
+	if d.inPlace() {
+		return d.Filename
+	}
+	return d.Filename + ".part"
+}
+
+// inPlace reports whether data is written straight to Filename rather than
+// a .part file: for devices, files patched in delta mode, streams and sinks
+func (d *AdaptiveDownloader) inPlace() bool {
+	return d.special || d.delta || d.fileless()
+}
+
+// trimFile cuts a file that wasn't preallocated down to FileSize: chunk
+// writes extend it to exactly that, but a file patched in place may have
+// been longer to begin with
+func (d *AdaptiveDownloader) trimFile(file *os.File) error {
+	if !d.NoPreallocate || file == nil || d.special {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > d.FileSize {
+		return file.Truncate(d.FileSize)
+	}
+	return nil
+}
+
+// checkSize makes sure a download that reports success has all of the
+// FileSize bytes: received counts those resumed, patched around or fetched,
+// and the file written must be that long too. Devices, decompressed files
+// and streams are left out of the second check: their size is the device's,
+// the decompressed one, or not known, as is a sink's.
+func (d *AdaptiveDownloader) checkSize(file *os.File, received int64) error {
+	if d.FileSize < 0 {
+		return nil
+	}
+	if received != d.FileSize {
+		return &SizeMismatchError{Source: "received", Expected: d.FileSize, Actual: received}
+	}
+	if d.special || d.Decompress != CompressionNone || d.fileless() {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != d.FileSize {
+		return &SizeMismatchError{Source: "on disk", Expected: d.FileSize, Actual: info.Size()}
+	}
+	return nil
+}
+
+// finalize closes the part file and moves it to the final filename.
+// A file written in place is flushed instead, since there is nothing to
+// rename, and a sink is closed.
+func (d *AdaptiveDownloader) finalize(file *os.File) error {
+	if d.Sink != nil && !d.streamed() {
+		return d.Sink.Close()
+	}
+	if d.streamed() {
+		return nil
+	}
+	if d.inPlace() {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(d.PartPath(), d.Filename)
+}
+
+// cancellationError replaces err with the context's error once ctx is done,
+// so callers can match context.Canceled with errors.Is
+func cancellationError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("download cancelled: %w", ctx.Err())
+	}
+	return err
+}
+
+// prepare sets up the limiter, breaker, handshake semaphore and TLS
+// settings shared by every connection of a download
+func (d *AdaptiveDownloader) prepare() error {
+	d.limiter = newRateLimiter(d.MaxBytesPerSec)
+	d.inFlight = newByteSemaphore(d.MaxInFlightBytes)
+	d.burst = newErrorBurst(d.ErrorBurstThreshold, d.ErrorBurstWindow, d.ErrorBurstPause)
+	d.climb = hillClimb{}
+	d.throughput = nil
+	if d.RecordThroughput {
+		d.throughput = newThroughputSeries(d.MaxThroughputSamples)
+	}
+	d.ring = nil
+	if err := d.prepareCookies(); err != nil {
+		return err
+	}
+	d.socks = nil
+	if d.Socks5 != "" {
+		socks, err := parseSocks5(d.Socks5)
+		if err != nil {
+			return err
+		}
+		d.socks = socks
+	}
+	d.digest, d.digestAlgorithm = "", ""
+	if d.Hash != "" {
+		if _, err := newHash(d.Hash); err != nil {
+			return err
+		}
+	}
+	d.handshakes = nil
+	if d.MaxConcurrentHandshakes > 0 {
+		d.handshakes = make(chan struct{}, d.MaxConcurrentHandshakes)
+	}
+	return d.configureTLS()
+}
+
+// Download performs the concurrent download until it completes or ctx
+// is cancelled. Data goes to a ".part" file that is renamed to Filename only
+// on success, so an interrupted download never leaves a truncated file behind
+// under the final name.
+func (d *AdaptiveDownloader) Download(ctx context.Context) (err error) {
+	d.live.reset()
+	defer func() { d.live.finish(err) }()
+	d.chunkTable.reset(nil)
+
+	if d.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, d.Deadline, errDeadline)
+		defer cancel()
+		defer func() {
+			if err != nil && context.Cause(ctx) == errDeadline {
+				err = &DeadlineError{Deadline: d.Deadline, Downloaded: d.resumed + d.Stats.Downloaded(), Err: err}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d.setCancel(cancel)
+	defer d.setCancel(nil)
+
+	if err := d.prepare(); err != nil {
+		return err
+	}
+	if err := d.applyTrailingSlash(); err != nil {
+		return err
+	}
+	if d.fileless() && d.Checksum != "" {
+		return errStreamChecksum
+	}
+	d.finished = time.Time{}
+	d.single = false
+	defer func() { d.finished = now() }()
+
+	d.statLocalCopy()
+	defer func() {
+		if err == nil {
+			d.applyModTime()
+		}
+	}()
+
+	if d.isFTP() {
+		return d.downloadFTP(ctx)
+	}
+
+	// Get file size and check if server supports range requests
+	d.setSource(0)
+	supportsRanges, err := d.getFileSizeWithFailover(ctx)
+	if errors.Is(err, ErrNotModified) || err == nil && d.notModified() {
+		return ErrNotModified
+	}
+	if err != nil {
+		return cancellationError(ctx, fmt.Errorf("failed to get file info: %w", err))
+	}
+
+	if d.Decompress == CompressionNone {
+		d.live.setSize(d.FileSize)
+	}
+	d.detectSpecialTarget()
+	d.detectDelta(supportsRanges)
+	if err := d.resolveConflict(); err != nil {
+		return err
+	}
+
+	if d.FileSize > 0 {
+		d.logf("File size: %d bytes\n", d.FileSize)
+	} else {
+		d.logf("File size: unknown\n")
+	}
+
+	if d.singleConnection(supportsRanges) {
+		if d.streamed() {
+			d.logf("Writing to a stream. Downloading in single connection.\n")
+		} else if supportsRanges && d.Decompress == CompressionNone {
+			d.logf("File is smaller than %d bytes. Downloading in single connection.\n", d.smallFileThreshold())
+		} else if supportsRanges {
+			d.logf("A %s stream is decoded in order. Downloading in single connection.\n", d.Decompress)
+		} else {
+			d.logf("Server doesn't support range requests. Downloading in single connection.\n")
+		}
+		if err := d.downloadSingleConnection(ctx); err != nil {
+			return err
+		}
+		return d.verify()
+	}
+
+	d.configureConcurrency()
+	defer d.closeIdleConnections()
+	d.logf("Starting download with %d connections\n", d.CurrentConnections)
+	d.buildMirrorRing(ctx)
+
+	if d.delta {
+		// Keep the blocks the local file already has right
+		d.completed, err = d.matchingBlocks()
+		if err != nil {
+			return fmt.Errorf("delta update failed: %w", err)
+		}
+		d.resumed = d.completed.total()
+		d.logf("Delta update: %d of %d bytes unchanged\n", d.resumed, d.FileSize)
+	} else {
+		// Pick up where a previous run left off, if its checkpoint still matches
+		d.completed, err = d.loadCheckpoint()
+		if err != nil {
+			return err
+		}
+		d.resumed = d.completed.total()
+
+		if d.resumed > 0 {
+			d.logf("Resuming download: %d of %d bytes already on disk\n", d.resumed, d.FileSize)
+		}
+	}
+	// Only the bytes still to fetch need room; a device's size is checked
+	// when it is opened
+	if !d.special && d.Sink == nil {
+		if err := checkDiskSpace(d.PartPath(), d.FileSize-d.resumed); err != nil {
+			return err
+		}
+	}
+	if err := d.checkFileSize(d.FileSize); err != nil {
+		return err
+	}
+
+	sink := d.Sink
+	var file *os.File
+	if sink == nil {
+		file, err = d.openTarget(d.resumed > 0)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		sink = newFileSink(file)
+
+		// Pre-allocate file space; a device already has its size
+		if !d.special && !d.NoPreallocate {
+			if err := file.Truncate(d.FileSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Create chunks covering only the bytes not yet on disk
+	d.chunkSize = d.effectiveChunkSize()
+	if d.chunkSize != d.ChunkSize {
+		d.debugf("Chunk size: %d bytes\n", d.chunkSize)
+	}
+	chunks := planChunks(d.completed.missing(d.FileSize), d.chunkSize)
+	if d.StrictChunkPlanning {
+		if err := checkChunkPlan(d.FileSize, d.completed.ranges, chunks); err != nil {
+			return err
+		}
+	}
+	d.written = append([]byteRange(nil), d.completed.ranges...)
+	for _, r := range d.completed.ranges {
+		d.live.add(r.Start, r.End)
+	}
+	d.chunkTable.reset(chunks)
+	d.unsaved = 0
+	d.lastCheckpoint = now()
+
+	d.logf("Created %d chunks\n", len(chunks))
+	d.Stats.mu.Lock()
+	d.Stats.Chunks = len(chunks)
+	d.Stats.mu.Unlock()
+
+	// Download chunks concurrently from a queue that can still be re-split
+	queue := newChunkQueue(orderChunks(chunks, d.ChunkPriority))
+	d.mu.Lock()
+	d.queue = queue
+	d.mu.Unlock()
+	chunkChan := queue.feed(ctx)
+
+	// Start progress reporter
+	stopProgress := d.startProgress(ctx)
+	defer stopProgress()
+
+	// Dynamic worker management: the pool follows CurrentConnections as it adapts
+	// A failed chunk cancels the pool so the other workers stop promptly
+	pool := newWorkerPool(ctx, chunkChan, d.connectionLimit(), func(ctx context.Context, chunk ChunkInfo) error {
+		d.chunkTable.set(chunk, ChunkActive)
+		if err := d.downloadChunk(ctx, chunk, sink); err != nil {
+			// A chunk stopped because another failed isn't a failure itself
+			status := ChunkFailed
+			if ctx.Err() != nil {
+				status = ChunkPending
+			}
+			d.chunkTable.set(chunk, status)
+			return fmt.Errorf("chunk %d failed: %w", chunk.Index, err)
+		}
+		if err := d.markCompleted(chunk); err != nil {
+			d.chunkTable.set(chunk, ChunkFailed)
+			return fmt.Errorf("failed to save checkpoint: %w", err)
+		}
+		d.chunkTable.set(chunk, ChunkDone)
+		return nil
+	})
+
+	pool.hold = d.waitResumed
+
+	d.mu.Lock()
+	d.pool = pool
+	pool.start(d.CurrentConnections)
+	d.mu.Unlock()
+
+	// Adapt connections on a fixed schedule while the pool runs
+	stopAdapting := d.startAdapting(ctx)
+
+	// Wait for all chunks to complete; on any failure the .part file and its
+	// checkpoint stay behind for a later resume, never renamed into place
+	err = pool.wait()
+	// The adapter must be gone before a restart below plans the download
+	// again under it
+	stopAdapting()
+	if errors.Is(err, errContentChanged) && ctx.Err() == nil {
+		stopProgress()
+		file.Close()
+		return d.restartChanged(ctx)
+	}
+	var unsatisfiable *RangeNotSatisfiableError
+	if errors.As(err, &unsatisfiable) && ctx.Err() == nil && d.resumed > 0 && !d.delta {
+		// The size came from a stale checkpoint rather than the file the
+		// server has now
+		stopProgress()
+		file.Close()
+		return d.restartStale(ctx, err)
+	}
+	if errors.Is(err, errRangeIgnored) && ctx.Err() == nil && d.completed.total() == d.resumed {
+		// The server sent the whole file instead of the first range it was
+		// asked for, so the parallel plan is useless: start over in one stream
+		stopProgress()
+		file.Close()
+		return d.fallbackToSingleConnection(ctx)
+	}
+	if err != nil {
+		if flushErr := d.flushCheckpoint(); flushErr != nil {
+			d.logf("\nFailed to save checkpoint: %v\n", flushErr)
+		}
+		if errors.Is(err, syscall.ENOSPC) {
+			return &DiskFullError{Path: d.PartPath(), Written: d.completed.total(), Err: err}
+		}
+		return cancellationError(ctx, err)
+	}
+
+	// However the chunks were planned and re-split, the bytes on disk must
+	// cover the file exactly once before it is declared complete
+	if err := checkCoverage(d.FileSize, d.written); err != nil {
+		return err
+	}
+	if err := d.trimFile(file); err != nil {
+		return err
+	}
+	if err := d.checkSize(file, d.resumed+d.Stats.Downloaded()); err != nil {
+		return err
+	}
+
+	if err := d.finalize(file); err != nil {
+		return err
+	}
+	if !d.inPlace() {
+		os.Remove(d.statePath())
+	}
+
+	result := d.Result()
+	d.logf("\nDownload completed!\n")
+	d.logf("Total time: %v\n", result.Duration)
+	d.logf("Average speed: %.2f MB/s\n", result.AverageBytesPerSec/1024/1024)
+	d.logf("Final connections: %d\n", result.FinalConnections)
+	d.debugf("Connections opened: %d\n", result.ConnectionsOpened)
+	d.logf("Chunk times: p50 %v, p95 %v, p99 %v\n", result.P50, result.P95, result.P99)
+	if result.BytesResumed > 0 {
+		d.logf("Resumed %d bytes, downloaded %d bytes\n", result.BytesResumed, result.BytesDownloaded)
+	}
+
+	return d.verify()
+}
+
+// fallbackToSingleConnection abandons a parallel download whose server
+// ignored Range and fetches the whole file in one request instead
+func (d *AdaptiveDownloader) fallbackToSingleConnection(ctx context.Context) error {
+	d.logf("\nServer ignored the Range header. Downloading in single connection.\n")
+
+	if !d.inPlace() {
+		os.Remove(d.statePath())
+	}
+	// A single stream rewrites the whole file, so it goes via a .part file
+	d.delta = false
+	d.resumed = 0
+	d.completed = &rangeSet{}
+	d.Stats.discard()
+
+	if err := d.downloadSingleConnection(ctx); err != nil {
+		return err
+	}
+	return d.verify()
+}
+
+// startProgress runs reportProgress in the background and returns a func
+// that stops it and waits for it to exit
+func (d *AdaptiveDownloader) startProgress(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.reportProgress(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// reportProgress shows download progress until ctx is done
+func (d *AdaptiveDownloader) reportProgress(ctx context.Context) {
+	interval := d.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticks, stop := currentClock().Tick(interval)
+	defer stop()
+
+	d.Stats.mu.Lock()
+	recent := &speedWindow{span: etaWindow}
+	lastAt, lastFetched := now(), d.Stats.BytesDownloaded
+	recent.add(lastAt, lastFetched)
+	d.Stats.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		}
+
+		d.Stats.mu.Lock()
+		fetched := d.Stats.BytesDownloaded
+		d.Stats.mu.Unlock()
+
+		// Bytes resumed from disk count toward progress but not speed
+		downloaded := d.resumed + fetched
+		complete := d.FileSize > 0 && downloaded >= d.FileSize
+
+		speed := averageSpeed(fetched, since(d.Stats.StartTime))
+
+		at := now()
+		recent.add(at, fetched)
+		d.recordThroughput(ThroughputSample{Time: at, BytesPerSec: averageSpeed(fetched-lastFetched, at.Sub(lastAt))})
+		lastAt, lastFetched = at, fetched
+
+		progress := Progress{Downloaded: downloaded, Total: d.FileSize, BytesPerSec: speed}
+		if d.FileSize > 0 {
+			progress.ETA = estimateETA(d.FileSize-downloaded, recent.rate())
+		}
+
+		if d.ProgressFunc != nil {
+			d.ProgressFunc(progress)
+		} else if !complete {
+			d.printProgress(progress)
+		}
+
+		if complete {
+			return
+		}
+	}
+}
+
+// printProgress writes the progress line to Output
+func (d *AdaptiveDownloader) printProgress(p Progress) {
+	mbps := p.BytesPerSec / 1024 / 1024
+	if p.Total > 0 {
+		percent := float64(p.Downloaded) / float64(p.Total) * 100
+		line := fmt.Sprintf("\rProgress: %.1f%% (%d/%d bytes) Speed: %.2f MB/s",
+			percent, p.Downloaded, p.Total, mbps)
+		if p.ETA > 0 {
+			line += fmt.Sprintf(" ETA: %v", p.ETA.Round(time.Second))
+		}
+		d.logf("%s", line)
+	} else {
+		d.logf("\rDownloaded: %d bytes Speed: %.2f MB/s", p.Downloaded, mbps)
+	}
+}
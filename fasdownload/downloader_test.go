@@ -0,0 +1,649 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMain turns the small file threshold off: most tests use payloads of
+// well under 2MB to exercise ranged downloads. Tests of the threshold set
+// it themselves.
+func TestMain(m *testing.M) {
+	defaultSmallFileThreshold = -1
+	os.Exit(m.Run())
+}
+
+// testPayload returns n bytes of deterministic, non-repeating-looking content
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i*7 + i/251)
+	}
+	return payload
+}
+
+// newPayloadServer serves payload with full HEAD and Range support
+func newPayloadServer(t *testing.T, payload []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewAdaptiveDownloader(t *testing.T) {
+	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+
+	if downloader.URL != "https://example.com/file.zip" {
+		t.Errorf("Expected URL to be 'https://example.com/file.zip', got %s", downloader.URL)
+	}
+
+	if downloader.Filename != "test.zip" {
+		t.Errorf("Expected filename to be 'test.zip', got %s", downloader.Filename)
+	}
+
+	if downloader.MaxConnections != 16 {
+		t.Errorf("Expected MaxConnections to be 16, got %d", downloader.MaxConnections)
+	}
+
+	if downloader.MinConnections != 2 {
+		t.Errorf("Expected MinConnections to be 2, got %d", downloader.MinConnections)
+	}
+
+	if downloader.CurrentConnections != 4 {
+		t.Errorf("Expected CurrentConnections to be 4, got %d", downloader.CurrentConnections)
+	}
+
+	if downloader.ChunkSize != 1024*1024 {
+		t.Errorf("Expected ChunkSize to be 1MB, got %d", downloader.ChunkSize)
+	}
+}
+func TestCalculateOptimalConnections(t *testing.T) {
+	clock := &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	SetClock(clock)
+	t.Cleanup(func() { SetClock(nil) })
+
+	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+
+	// Test with no throughput measured (should not change connections)
+	originalConnections := downloader.CurrentConnections
+	downloader.calculateOptimalConnections()
+	clock.advance(time.Second)
+	downloader.calculateOptimalConnections()
+
+	if downloader.CurrentConnections != originalConnections {
+		t.Errorf("Expected connections to remain unchanged with no throughput measured")
+	}
+
+	// The first measurement probes one more connection
+	feedThroughput(downloader, clock, 40*1024*1024)
+
+	if downloader.CurrentConnections != originalConnections+1 {
+		t.Errorf("Expected connections to increase to probe for more throughput")
+	}
+
+	// Throughput that drops with the extra connection (should decrease connections)
+	feedThroughput(downloader, clock, 10*1024*1024)
+
+	if downloader.CurrentConnections >= originalConnections+1 {
+		t.Errorf("Expected connections to decrease when the extra connection hurt throughput")
+	}
+}
+func TestDownloadCancel(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	started := make(chan struct{})
+	var startOnce sync.Once
+
+	// Ranged GETs send a little data, then hang until the client goes away
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || r.Method != "GET" {
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(payload)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[start : start+1024])
+		w.(http.Flusher).Flush()
+		startOnce.Do(func() { close(started) })
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "cancelled.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 64 * 1024
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- downloader.Download(ctx) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not stop after cancellation")
+	}
+
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Expected no file under the final name after cancellation, stat returned: %v", err)
+	}
+	if _, err := os.Stat(downloader.PartPath()); err != nil {
+		t.Errorf("Expected partial data to be kept: %v", err)
+	}
+}
+
+func TestFailedChunkFailsDownload(t *testing.T) {
+	payload := testPayload(64 * 16 * 1024)
+	chunkSize := int64(16 * 1024)
+	var served atomic.Int32
+
+	// The second chunk always 500s; every other chunk is slow, so workers
+	// that kept going after the failure would take a long while to drain
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && r.Method == "GET" {
+			if start == chunkSize {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			served.Add(1)
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "failed.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = chunkSize
+	downloader.RetryPolicy = DefaultRetryPolicy{} // no retries
+
+	err := downloader.Download(context.Background())
+	if err == nil {
+		t.Fatal("Expected download with a failing chunk to fail")
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the chunk error, not a cancellation: %v", err)
+	}
+
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Expected no file under the final name after a failed chunk, stat returned: %v", err)
+	}
+	if n := served.Load(); n > 16 {
+		t.Errorf("Expected workers to stop after the failure, but %d of 63 good chunks were requested", n)
+	}
+}
+
+func TestMismatchedContentRange(t *testing.T) {
+	payload := testPayload(128 * 1024)
+
+	// The first ranged GET gets bytes shifted by one from what was asked for,
+	// labelled as such; the rest are served correctly
+	newServer := func(misbehaving *atomic.Bool) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var start, end int64
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && r.Method == "GET" && misbehaving.Swap(false) {
+				shift := int64(1)
+				if end+1 >= int64(len(payload)) {
+					shift = -1
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start+shift, end+shift, len(payload)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(payload[start+shift : end+shift+1])
+				return
+			}
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	t.Run("fails without retries", func(t *testing.T) {
+		var misbehaving atomic.Bool
+		misbehaving.Store(true)
+		server := newServer(&misbehaving)
+
+		output := filepath.Join(t.TempDir(), "mismatch.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		downloader.ChunkSize = 64 * 1024
+		downloader.RetryPolicy = DefaultRetryPolicy{}
+
+		err := downloader.Download(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "server returned range") {
+			t.Fatalf("Expected a range mismatch error, got %v", err)
+		}
+	})
+
+	t.Run("retries the chunk", func(t *testing.T) {
+		var misbehaving atomic.Bool
+		misbehaving.Store(true)
+		server := newServer(&misbehaving)
+
+		output := filepath.Join(t.TempDir(), "mismatch.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		downloader.ChunkSize = 64 * 1024
+		downloader.RetryPolicy = &fixedRetryPolicy{max: 1}
+
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Error("Downloaded file does not match payload")
+		}
+	})
+}
+
+func TestOversizedChunkResponse(t *testing.T) {
+	payload := testPayload(128 * 1024)
+
+	// Ranged GETs carry the right Content-Range but run on to the end of the file
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && r.Method == "GET" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(payload)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(payload[start : end+1])
+			w.Write(bytes.Repeat([]byte{0xee}, 4096))
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "oversized.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 32 * 1024
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Extra bytes from the server overwrote neighbouring chunks")
+	}
+	if downloader.Stats.BytesDownloaded != int64(len(payload)) {
+		t.Errorf("Expected %d bytes counted, got %d", len(payload), downloader.Stats.BytesDownloaded)
+	}
+}
+
+func TestServerIgnoringRange(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	var gets atomic.Int32
+
+	// HEAD advertises ranges, but every GET gets the full body with a 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		if r.Method == "GET" {
+			gets.Add(1)
+			w.Write(payload)
+		}
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "ignored.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 64 * 1024
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Downloaded file does not match payload")
+	}
+	if downloader.Stats.BytesDownloaded != int64(len(payload)) {
+		t.Errorf("Expected %d bytes counted, got %d", len(payload), downloader.Stats.BytesDownloaded)
+	}
+
+	// At most one ranged GET per initial worker, plus the single-connection GET
+	if n := gets.Load(); n > int32(downloader.CurrentConnections)+1 {
+		t.Errorf("Expected the parallel plan to be abandoned promptly, saw %d GETs", n)
+	}
+	if _, err := os.Stat(downloader.statePath()); !os.IsNotExist(err) {
+		t.Errorf("Expected no checkpoint left behind, stat returned: %v", err)
+	}
+}
+
+func TestServerCappingRangeLength(t *testing.T) {
+	const maxRange = 1024 * 1024
+	payload := testPayload(6*maxRange + 12345)
+
+	var oversized atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || r.Method != "GET" {
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			return
+		}
+		if end-start+1 > maxRange {
+			oversized.Add(1)
+			end = start + maxRange - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(payload)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[start : end+1])
+	}))
+	defer server.Close()
+
+	t.Run("adapt", func(t *testing.T) {
+		oversized.Store(0)
+		output := filepath.Join(t.TempDir(), "capped.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		downloader.ChunkSize = 4 * maxRange
+		downloader.MinChunkSize = downloader.ChunkSize // keep every chunk over the cap
+
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("Downloaded file does not match payload")
+		}
+		if downloader.ChunkSize != maxRange {
+			t.Errorf("Expected ChunkSize clamped to %d, got %d", maxRange, downloader.ChunkSize)
+		}
+
+		// Only chunks already handed out before the cap was seen ask for too much
+		if n := oversized.Load(); n > int32(downloader.CurrentConnections)+1 {
+			t.Errorf("Expected pending chunks to be re-planned, but %d requests exceeded the cap", n)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "capped.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		downloader.ChunkSize = 4 * maxRange
+		downloader.MinChunkSize = downloader.ChunkSize // keep every chunk over the cap
+		downloader.RangeCap = RangeCapFail
+		downloader.RetryPolicy = DefaultRetryPolicy{}
+
+		if err := downloader.Download(context.Background()); err == nil {
+			t.Fatal("Expected a capped range to fail with RangeCapFail")
+		}
+	})
+}
+
+func TestFilenameConflictHook(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "file.bin")
+	alternative := filepath.Join(dir, "file (1).bin")
+	if err := os.WriteFile(existing, []byte("keep me"), 0644); err != nil {
+		t.Fatalf("Failed to create existing file: %v", err)
+	}
+
+	// Without a hook the existing file is protected
+	downloader := NewAdaptiveDownloader(server.URL, existing)
+	if err := downloader.Download(context.Background()); err == nil {
+		t.Fatal("Expected an error when the target exists and no hook is set")
+	}
+
+	var asked string
+	downloader = NewAdaptiveDownloader(server.URL, existing)
+	downloader.OnFilenameConflict = func(path string) (string, bool) {
+		asked = path
+		return alternative, true
+	}
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	if asked != existing {
+		t.Errorf("Expected hook to be asked about %s, got %q", existing, asked)
+	}
+	if got, _ := os.ReadFile(alternative); !bytes.Equal(got, payload) {
+		t.Error("Expected download to land at the alternative path")
+	}
+	if got, _ := os.ReadFile(existing); string(got) != "keep me" {
+		t.Errorf("Expected existing file to be untouched, got %q", got)
+	}
+
+	// Declining aborts without touching anything
+	downloader = NewAdaptiveDownloader(server.URL, existing)
+	downloader.OnFilenameConflict = func(string) (string, bool) { return "", false }
+	if err := downloader.Download(context.Background()); err == nil {
+		t.Error("Expected the download to abort when the hook declines")
+	}
+}
+
+func TestProgressFunc(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	server := newPayloadServer(t, payload)
+
+	var mu sync.Mutex
+	var updates []int64
+	var totals []int64
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "progress.bin"))
+	downloader.ChunkSize = 64 * 1024
+	downloader.MaxBytesPerSec = 1024 * 1024 // stretch the download over several ticks
+	downloader.ProgressInterval = 20 * time.Millisecond
+	downloader.ProgressFunc = func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, p.Downloaded)
+		totals = append(totals, p.Total)
+	}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(updates) < 3 {
+		t.Fatalf("Expected several progress updates, got %d", len(updates))
+	}
+	for i := 1; i < len(updates); i++ {
+		if updates[i] < updates[i-1] {
+			t.Errorf("Progress went backwards: %d then %d", updates[i-1], updates[i])
+		}
+	}
+	if updates[len(updates)-1] <= updates[0] {
+		t.Errorf("Expected progress to increase, got %v", updates)
+	}
+	for _, total := range totals {
+		if total != int64(len(payload)) {
+			t.Errorf("Expected total %d, got %d", len(payload), total)
+			break
+		}
+	}
+}
+
+func TestMaxChunks(t *testing.T) {
+	payload := testPayload(1024 * 1024)
+	server := newPayloadServer(t, payload)
+
+	tests := []struct {
+		name         string
+		chunkSize    int64
+		maxChunks    int
+		minChunkSize int64
+		wantChunks   int
+	}{
+		{"within the cap", 32 * 1024, 100, 0, 32},
+		{"grown to the cap", 32 * 1024, 4, 0, 4},
+		{"picked from the file size", 0, 0, 64 * 1024, 16},
+		{"picked within the cap", 0, 8, 64 * 1024, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "payload.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.ChunkSize = tt.chunkSize
+			downloader.MaxChunks = tt.maxChunks
+			downloader.MinChunkSize = tt.minChunkSize
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("Downloaded file does not match payload: %v", err)
+			}
+			if downloader.Stats.Chunks != tt.wantChunks {
+				t.Errorf("Expected %d chunks, got %d", tt.wantChunks, downloader.Stats.Chunks)
+			}
+			if downloader.ChunkSize != tt.chunkSize {
+				t.Errorf("Expected ChunkSize to stay %d, got %d", tt.chunkSize, downloader.ChunkSize)
+			}
+		})
+	}
+}
+
+func TestNoPreallocate(t *testing.T) {
+	payload := testPayload(512*1024 + 123)
+
+	for _, tt := range []struct {
+		name        string
+		preallocate bool
+		priority    ChunkPriority
+	}{
+		{"preallocated", true, ChunkPriorityHead},
+		{"not preallocated", false, ChunkPriorityHead},
+		{"not preallocated, tail first", false, ChunkPriorityTail},
+		{"not preallocated, edges", false, ChunkPriorityEdges},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The last chunk is held back so the part file can be inspected
+			// before anything reaches the end of the file
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" && strings.HasPrefix(r.Header.Get("Range"), "bytes=524288-") {
+					<-release
+				}
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "payload.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.ChunkSize = 64 * 1024
+			downloader.ChunkPriority = tt.priority
+			downloader.NoPreallocate = !tt.preallocate
+
+			done := make(chan error, 1)
+			go func() { done <- downloader.Download(context.Background()) }()
+
+			if err := downloader.WaitForRange(context.Background(), 0, 512*1024, 5*time.Second); err != nil {
+				close(release)
+				t.Fatalf("WaitForRange() returned error: %v", err)
+			}
+			info, err := os.Stat(downloader.PartPath())
+			close(release)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preallocated := info.Size() == int64(len(payload)); preallocated != tt.preallocate {
+				t.Errorf("Expected preallocation %v, part file is %d bytes", tt.preallocate, info.Size())
+			}
+
+			if err := <-done; err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("Downloaded file does not match payload: %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestSmallFileSingleConnection(t *testing.T) {
+	defaultSmallFileThreshold = DefaultSmallFileThreshold
+	t.Cleanup(func() { defaultSmallFileThreshold = -1 })
+
+	tests := []struct {
+		name       string
+		size       int
+		threshold  int64
+		wantSingle bool
+	}{
+		{"small file", 100 * 1024, 0, true},
+		{"large file", 50 * 1024 * 1024, 0, false},
+		{"threshold disabled", 100 * 1024, -1, false},
+		{"raised threshold", 3 * 1024 * 1024, 4 * 1024 * 1024, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := testPayload(tt.size)
+			var ranged atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" && r.Header.Get("Range") != "" {
+					ranged.Add(1)
+				}
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "payload.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.SmallFileThreshold = tt.threshold
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+
+			result := downloader.Result()
+			if result.SingleConnection != tt.wantSingle {
+				t.Errorf("Expected SingleConnection %v, got %v with %d chunks", tt.wantSingle, result.SingleConnection, result.ChunkCount)
+			}
+			if tt.wantSingle && ranged.Load() != 0 {
+				t.Errorf("Expected one plain GET, got %d ranged requests", ranged.Load())
+			}
+			if !tt.wantSingle && ranged.Load() == 0 {
+				t.Error("Expected the file fetched in ranged chunks")
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Error("Downloaded file does not match payload")
+			}
+		})
+	}
+}
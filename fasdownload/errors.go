@@ -0,0 +1,220 @@
+package fasdownload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPStatusError reports a response with an unexpected status code
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+
+	// resp is kept so a RetryPolicy can inspect the response
+	resp *http.Response
+}
+
+func newHTTPStatusError(resp *http.Response) *HTTPStatusError {
+	return &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status, resp: resp}
+}
+
+func (e *HTTPStatusError) Error() string {
+	return "server returned status: " + e.Status
+}
+
+// RangeUnsupportedError reports a server that won't serve the byte ranges
+// a parallel download needs
+type RangeUnsupportedError struct {
+	Reason string
+}
+
+func (e *RangeUnsupportedError) Error() string {
+	return e.Reason
+}
+
+// errRangeIgnored reports a 200 response to a ranged request: the server is
+// sending the whole file rather than the bytes asked for
+var errRangeIgnored = &RangeUnsupportedError{Reason: "server ignored the Range header"}
+
+// RangeNotSatisfiableError reports a 416 response to a chunk request: the
+// range asked for lies past the end of the file the server has, a sign
+// the size the download planned with, or the checkpoint it resumed, is off
+type RangeNotSatisfiableError struct {
+	Start, End int64
+	FileSize   int64
+}
+
+func (e *RangeNotSatisfiableError) Error() string {
+	return fmt.Sprintf("requested range %d-%d not satisfiable (file size %d)", e.Start, e.End, e.FileSize)
+}
+
+// UnsupportedSchemeError reports a redirect to a URL the HTTP client can't
+// fetch, such as an ftp:// mirror
+type UnsupportedSchemeError struct {
+	URL    string
+	Scheme string
+}
+
+func (e *UnsupportedSchemeError) Error() string {
+	return fmt.Sprintf("redirected to unsupported scheme %q: %s", e.Scheme, e.URL)
+}
+
+// errContentChanged reports a 200 response to a ranged request carrying
+// If-Range: the file no longer matches the validator the bytes on disk were
+// fetched under, so the server sent all of the new one
+var errContentChanged = errors.New("remote file changed since the download was interrupted")
+
+// ErrFileExists reports an output file that is already there when neither
+// Overwrite nor OnFilenameConflict allows replacing it
+var ErrFileExists = errors.New("file already exists")
+
+// ErrNotModified reports a download IfNewer skipped, since the file on
+// disk is as new as the server's
+var ErrNotModified = errors.New("file up to date")
+
+// errEmptyResponse reports a successful response with no body for a file
+// that should have content, as some flaky proxies send
+var errEmptyResponse = errors.New("server sent an empty response for a non-empty file")
+
+// ChecksumMismatchError reports a downloaded file whose digest differs from
+// the expected checksum, or from the server's ETag when ETag is set
+type ChecksumMismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+	ETag      bool
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	if e.ETag {
+		return fmt.Sprintf("ETag mismatch: expected %s %s, got %s", e.Algorithm, e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("%s checksum mismatch: expected %s, got %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+// DiskSpaceError reports a filesystem without room for the download
+type DiskSpaceError struct {
+	Path      string
+	Needed    int64
+	Available int64
+}
+
+func (e *DiskSpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space: need %d, have %d", e.Needed, e.Available)
+}
+
+// DiskFullError reports a download that ran out of disk space part way
+// through. Written counts the bytes of whole chunks on disk by then; they
+// stay in the checkpoint, so once space is freed the download resumes
+// after them.
+type DiskFullError struct {
+	Path    string
+	Written int64
+	Err     error
+}
+
+func (e *DiskFullError) Error() string {
+	return fmt.Sprintf("disk full after %d bytes writing %s: free some space and run again to resume", e.Written, e.Path)
+}
+
+func (e *DiskFullError) Unwrap() error {
+	return e.Err
+}
+
+// writeError reports a chunk's bytes failing to reach the disk or sink.
+// Fetching them again, or from a mirror, wouldn't help, so it stops the
+// download rather than being retried.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return "write failed: " + e.err.Error()
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+// SizeMismatchError reports a finished download whose byte count differs
+// from the size the server reported: Source is "received" for the bytes
+// that arrived and "on disk" for the file written
+type SizeMismatchError struct {
+	Source   string
+	Expected int64
+	Actual   int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("size mismatch: %d bytes %s, expected %d", e.Actual, e.Source, e.Expected)
+}
+
+// ChunkPlanError reports a chunk plan that StrictChunkPlanning caught
+// leaving gaps in the file or writing some bytes twice
+type ChunkPlanError struct {
+	Problems []string
+}
+
+func (e *ChunkPlanError) Error() string {
+	return "chunk plan doesn't tile the file: " + strings.Join(e.Problems, ", ")
+}
+
+// FileTooLargeError reports a server claiming a file bigger than
+// MaxFileSize
+type FileTooLargeError struct {
+	Size int64
+	Max  int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("server reports %d bytes, more than the %d allowed", e.Size, e.Max)
+}
+
+// TimeoutError reports a request that ran out of time
+type TimeoutError struct {
+	Op  string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out: %v", e.Op, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// errDeadline is the cause a download's context is cancelled with when
+// Deadline runs out
+var errDeadline = errors.New("download deadline exceeded")
+
+// DeadlineError reports a download that was still running when Deadline
+// ran out, with the bytes it had by then. It matches
+// context.DeadlineExceeded with errors.Is.
+type DeadlineError struct {
+	Deadline   time.Duration
+	Downloaded int64
+	Err        error
+}
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("download did not finish within %v: %d bytes downloaded", e.Deadline, e.Downloaded)
+}
+
+func (e *DeadlineError) Unwrap() []error {
+	return []error{context.DeadlineExceeded, e.Err}
+}
+
+// wrapTimeout wraps err in a TimeoutError when it is a network timeout
+func wrapTimeout(op string, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Op: op, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,226 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPStatusError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "missing.bin"))
+	err := downloader.Download(context.Background())
+
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("Expected an *HTTPStatusError, got %v", err)
+	}
+	if statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status code 404, got %d", statusErr.StatusCode)
+	}
+}
+
+func TestRangeUnsupportedError(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || r.Method != "GET" {
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			return
+		}
+		end = min(end, start+1023)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(payload)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[start : end+1])
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "capped.bin"))
+	downloader.RangeCap = RangeCapFail
+	err := downloader.Download(context.Background())
+
+	var rangeErr *RangeUnsupportedError
+	if !errors.As(err, &rangeErr) {
+		t.Fatalf("Expected a *RangeUnsupportedError, got %v", err)
+	}
+}
+
+func TestChecksumMismatchError(t *testing.T) {
+	server := newPayloadServer(t, testPayload(64*1024))
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "corrupt.bin"))
+	downloader.Checksum = "sha256:" + string(bytes.Repeat([]byte("0"), 64))
+	err := downloader.Download(context.Background())
+
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected a *ChecksumMismatchError, got %v", err)
+	}
+	if mismatch.Algorithm != "sha256" || mismatch.Actual == mismatch.Expected {
+		t.Errorf("Unexpected mismatch details: %+v", mismatch)
+	}
+}
+
+func TestDiskSpaceError(t *testing.T) {
+	stubDiskSpace(t, 1000, nil)
+	server := newPayloadServer(t, testPayload(64*1024))
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "large.bin"))
+	err := downloader.Download(context.Background())
+
+	var spaceErr *DiskSpaceError
+	if !errors.As(err, &spaceErr) {
+		t.Fatalf("Expected a *DiskSpaceError, got %v", err)
+	}
+	if spaceErr.Needed != 64*1024 || spaceErr.Available != 1000 {
+		t.Errorf("Expected need 65536, have 1000, got %+v", spaceErr)
+	}
+}
+
+func TestSizeMismatchError(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	short := int64(10 * 1024)
+
+	t.Run("short chunk", func(t *testing.T) {
+		// Ranges over byte 74KB promise all their bytes, but the connection
+		// closes there every time
+		cut := 64*1024 + short
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var start, end int64
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && r.Method == "GET" && start <= cut && end > cut {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(payload)))
+				w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(payload[start:cut])
+				return
+			}
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+		}))
+		defer server.Close()
+
+		output := filepath.Join(t.TempDir(), "payload.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		downloader.ChunkSize = 64 * 1024
+		downloader.RetryPolicy = DefaultRetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond}
+
+		if err := downloader.Download(context.Background()); err == nil {
+			t.Fatal("Expected the short chunk to fail the download")
+		}
+		if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Errorf("Expected no completed file, got %v", err)
+		}
+	})
+
+	t.Run("short stream", func(t *testing.T) {
+		// Without range support the file comes in one stream, which ends
+		// early but consistently with its own Content-Length
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Accept-Ranges", "none")
+			if r.Method == "HEAD" {
+				w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(short))
+			w.Write(payload[:short])
+		}))
+		defer server.Close()
+
+		output := filepath.Join(t.TempDir(), "payload.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		err := downloader.Download(context.Background())
+
+		var sizeErr *SizeMismatchError
+		if !errors.As(err, &sizeErr) {
+			t.Fatalf("Expected a *SizeMismatchError, got %v", err)
+		}
+		if sizeErr.Source != "received" || sizeErr.Expected != int64(len(payload)) || sizeErr.Actual != short {
+			t.Errorf("Expected %d of %d bytes received, got %+v", short, len(payload), sizeErr)
+		}
+		if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Errorf("Expected no completed file, got %v", err)
+		}
+	})
+
+	t.Run("short file", func(t *testing.T) {
+		file, err := os.Create(filepath.Join(t.TempDir(), "payload.bin.part"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.Write(payload[:short])
+
+		downloader := NewAdaptiveDownloader("https://example.com/payload.bin", "payload.bin")
+		downloader.FileSize = int64(len(payload))
+		var sizeErr *SizeMismatchError
+		if err := downloader.checkSize(file, int64(len(payload))); !errors.As(err, &sizeErr) || sizeErr.Source != "on disk" {
+			t.Errorf("Expected an on-disk *SizeMismatchError, got %v", err)
+		}
+	})
+}
+
+func TestTimeoutError(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "slow.bin"))
+	downloader.HeadTimeout = 50 * time.Millisecond
+	err := downloader.Download(context.Background())
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected a *TimeoutError, got %v", err)
+	}
+}
+
+func TestDeadlineError(t *testing.T) {
+	payload := testPayload(4 * 1024 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, slowReader{bytes.NewReader(payload)})
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "slow.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 256 * 1024
+	downloader.Deadline = 50 * time.Millisecond
+
+	start := time.Now()
+	err := downloader.Download(context.Background())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the download to stop at the deadline, took %v", elapsed)
+	}
+
+	var deadlineErr *DeadlineError
+	if !errors.As(err, &deadlineErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a *DeadlineError matching context.DeadlineExceeded, got %v", err)
+	}
+	if deadlineErr.Deadline != 50*time.Millisecond {
+		t.Errorf("Expected the deadline in the error, got %v", deadlineErr.Deadline)
+	}
+	if deadlineErr.Downloaded <= 0 || deadlineErr.Downloaded >= int64(len(payload)) {
+		t.Errorf("Expected part of the file to be reported, got %d bytes", deadlineErr.Downloaded)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Expected no file under the final name, stat returned: %v", err)
+	}
+
+	// A caller cancelling first is not a deadline
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := downloader.Download(ctx); errors.As(err, &deadlineErr) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a plain cancellation, got %v", err)
+	}
+}
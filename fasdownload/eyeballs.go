@@ -0,0 +1,179 @@
+package fasdownload
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// IPFamily is the address family a download tries first
+type IPFamily string
+
+const (
+	// IPFamilyAny leaves the order to the system resolver
+	IPFamilyAny IPFamily = ""
+	// IPFamilyIPv4 tries IPv4 addresses first
+	IPFamilyIPv4 IPFamily = "ipv4"
+	// IPFamilyIPv6 tries IPv6 addresses first
+	IPFamilyIPv6 IPFamily = "ipv6"
+)
+
+// DefaultFallbackDelay is the head start the preferred family gets
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+// dialFunc is the signature of net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// happyEyeballs races the two address families (RFC 8305): the preferred
+// family's addresses are tried first, and the other family joins once they
+// have had delay to connect or have all failed. The first connection wins.
+type happyEyeballs struct {
+	prefer IPFamily
+	delay  time.Duration
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	dial   dialFunc
+}
+
+// dialContext returns the dial function connections are made with: the
+// dialer itself, or DialContext when set, through the SOCKS5 proxy if
+// there is one, or else racing address families if IPFamily prefers one; a
+// family other than IPFamilyIPv4 or IPFamilyIPv6 counts as no preference.
+// Every connection it opens is counted in Stats.
+func (d *AdaptiveDownloader) dialContext(dialer *net.Dialer) dialFunc {
+	var dial dialFunc = dialer.DialContext
+	if d.DialContext != nil {
+		dial = d.DialContext
+	}
+	if d.socks != nil {
+		return d.countDials(d.socks.dialThrough(dial))
+	}
+	if d.IPFamily == IPFamilyIPv4 || d.IPFamily == IPFamilyIPv6 {
+		h := &happyEyeballs{
+			prefer: d.IPFamily,
+			delay:  orDefault(d.FallbackDelay, DefaultFallbackDelay),
+			lookup: net.DefaultResolver.LookupIPAddr,
+			dial:   dial,
+		}
+		dial = h.DialContext
+	}
+	return d.countDials(dial)
+}
+
+// countDials wraps dial to count the connections it opens; with Happy
+// Eyeballs only the winning attempt is counted
+func (d *AdaptiveDownloader) countDials(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			d.Stats.mu.Lock()
+			d.Stats.Dials++
+			d.Stats.mu.Unlock()
+		}
+		return conn, err
+	}
+}
+
+// DialContext implements dialFunc
+func (h *happyEyeballs) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if network != "tcp" || err != nil || net.ParseIP(host) != nil {
+		return h.dial(ctx, network, addr)
+	}
+
+	ips, err := h.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var primary, fallback []string
+	for _, ip := range ips {
+		target := net.JoinHostPort(ip.String(), port)
+		if (ip.IP.To4() != nil) == (h.prefer == IPFamilyIPv4) {
+			primary = append(primary, target)
+		} else {
+			fallback = append(fallback, target)
+		}
+	}
+	if len(primary) == 0 {
+		primary, fallback = fallback, nil
+	}
+	return h.race(ctx, network, primary, fallback)
+}
+
+// race dials the primary addresses, starting on the fallback ones after the
+// head start, and returns the first connection made
+func (h *happyEyeballs) race(ctx context.Context, network string, primary, fallback []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	racer := func(addrs []string) {
+		conn, err := h.dialSerial(ctx, network, addrs)
+		select {
+		case results <- result{conn, err}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go racer(primary)
+	pending := 1
+
+	var timer <-chan time.Time
+	if len(fallback) > 0 {
+		t := time.NewTimer(h.delay)
+		defer t.Stop()
+		timer = t.C
+	}
+	startFallback := func() {
+		timer = nil
+		go racer(fallback)
+		pending++
+	}
+
+	var firstErr error
+	for {
+		select {
+		case <-timer:
+			startFallback()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			// Don't make the other family wait out the head start
+			if timer != nil {
+				startFallback()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dialSerial tries addrs in order until one connects
+func (h *happyEyeballs) dialSerial(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	err := errors.New("no addresses to dial")
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = h.dial(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
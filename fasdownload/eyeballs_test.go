@@ -0,0 +1,119 @@
+package fasdownload
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// familyConn is a connection that remembers the address it was dialed to
+type familyConn struct {
+	net.Conn
+	addr string
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	addrs := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}}
+
+	tests := []struct {
+		name   string
+		prefer IPFamily
+		slow   string // address prefix that takes a second to connect
+		broken string // address prefix that fails at once
+		want   string
+		within time.Duration
+	}{
+		{"preferred IPv6 connects", IPFamilyIPv6, "", "", "[2001:db8::1]:443", 40 * time.Millisecond},
+		{"preferred IPv4 connects", IPFamilyIPv4, "", "", "192.0.2.1:443", 40 * time.Millisecond},
+		{"slow IPv6 loses to IPv4", IPFamilyIPv6, "[", "", "192.0.2.1:443", 200 * time.Millisecond},
+		{"slow IPv4 loses to IPv6", IPFamilyIPv4, "192.", "", "[2001:db8::1]:443", 200 * time.Millisecond},
+		{"broken IPv6 falls back without waiting", IPFamilyIPv6, "", "[", "192.0.2.1:443", 40 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		tt := tt // the losing dial may still be running after the subtest
+		t.Run(tt.name, func(t *testing.T) {
+			h := &happyEyeballs{
+				prefer: tt.prefer,
+				delay:  50 * time.Millisecond,
+				lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+					return addrs, nil
+				},
+				dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					if tt.broken != "" && strings.HasPrefix(addr, tt.broken) {
+						return nil, errors.New("network unreachable")
+					}
+					if tt.slow != "" && strings.HasPrefix(addr, tt.slow) {
+						select {
+						case <-time.After(time.Second):
+						case <-ctx.Done():
+							return nil, ctx.Err()
+						}
+					}
+					client, server := net.Pipe()
+					server.Close()
+					return &familyConn{Conn: client, addr: addr}, nil
+				},
+			}
+
+			start := time.Now()
+			conn, err := h.DialContext(context.Background(), "tcp", "files.example.test:443")
+			if err != nil {
+				t.Fatalf("DialContext() returned error: %v", err)
+			}
+			defer conn.Close()
+
+			if got := conn.(*familyConn).addr; got != tt.want {
+				t.Errorf("Expected a connection to %s, got %s", tt.want, got)
+			}
+			if elapsed := time.Since(start); elapsed > tt.within {
+				t.Errorf("Expected to connect within %v, took %v", tt.within, elapsed)
+			}
+		})
+	}
+}
+
+func TestHappyEyeballsAllFail(t *testing.T) {
+	h := &happyEyeballs{
+		prefer: IPFamilyIPv4,
+		delay:  time.Second,
+		lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+		},
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	if _, err := h.DialContext(context.Background(), "tcp", "files.example.test:443"); err == nil {
+		t.Fatal("Expected an error when every address fails")
+	}
+}
+
+func TestUnknownIPFamily(t *testing.T) {
+	for _, family := range []IPFamily{IPFamilyAny, "IPv4", "ipv5"} {
+		t.Run(string(family), func(t *testing.T) {
+			var dialed []string
+			downloader := NewAdaptiveDownloader("https://files.example.test/file.bin", "file.bin")
+			downloader.IPFamily = family
+			downloader.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = append(dialed, addr)
+				client, server := net.Pipe()
+				server.Close()
+				return client, nil
+			}
+
+			// Without a preference the host goes to the dialer unresolved
+			conn, err := downloader.dialContext(&net.Dialer{})(context.Background(), "tcp", "files.example.test:443")
+			if err != nil {
+				t.Fatalf("dial returned error: %v", err)
+			}
+			conn.Close()
+			if len(dialed) != 1 || dialed[0] != "files.example.test:443" {
+				t.Errorf("Expected a single dial to the host name, got %v", dialed)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fault is what faultTransport does to one request: hold it for delay,
+// then fail it with err, or else answer it with status, or else cut its
+// body off after truncate bytes
+type fault struct {
+	delay    time.Duration
+	err      error
+	status   int
+	truncate int64
+}
+
+// faultTransport is an http.RoundTripper for Transport that passes
+// requests on to next, except the GETs numbered in faults (from 1, in the
+// order they are sent; HEAD requests aren't counted), which it makes fail
+// as described. It records the Range header of every GET.
+type faultTransport struct {
+	next   http.RoundTripper
+	faults map[int]fault
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+// errInjected is the error faultTransport fails requests with
+var errInjected = errors.New("injected connection failure")
+
+func (f *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return f.next.RoundTrip(req)
+	}
+	f.mu.Lock()
+	f.ranges = append(f.ranges, req.Header.Get("Range"))
+	flt, ok := f.faults[len(f.ranges)]
+	f.mu.Unlock()
+	if !ok {
+		return f.next.RoundTrip(req)
+	}
+
+	if flt.delay > 0 {
+		select {
+		case <-time.After(flt.delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if flt.err != nil {
+		return nil, flt.err
+	}
+	if flt.status != 0 {
+		return &http.Response{
+			Status:     http.StatusText(flt.status),
+			StatusCode: flt.status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(bytes.NewReader(nil)),
+			Request:    req,
+		}, nil
+	}
+
+	resp, err := f.next.RoundTrip(req)
+	if err == nil && flt.truncate > 0 {
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: flt.truncate}
+	}
+	return resp, err
+}
+
+// requests returns the Range header of each GET sent so far
+func (f *faultTransport) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.ranges...)
+}
+
+// truncatedBody passes on remaining bytes of a response body, then fails
+// as a dropped connection would
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func TestRetryWithInjectedFaults(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+	whole := "bytes=0-65535"
+
+	tests := []struct {
+		name    string
+		faults  map[int]fault
+		timeout time.Duration
+		wantErr bool
+		ranges  []string
+	}{
+		{"no faults", nil, 0, false, []string{whole}},
+		{"connection failure", map[int]fault{1: {err: errInjected}}, 0, false, []string{whole, whole}},
+		{"rate limited twice", map[int]fault{1: {status: 429}, 2: {status: 429}}, 0, false, []string{whole, whole, whole}},
+		{"body cut short", map[int]fault{1: {truncate: 20000}}, 0, false, []string{whole, "bytes=20000-65535"}},
+		{"slow response", map[int]fault{1: {delay: time.Second}}, 100 * time.Millisecond, false, []string{whole, whole}},
+		{"gives up", map[int]fault{1: {err: errInjected}, 2: {err: errInjected}, 3: {err: errInjected}}, 0, true, []string{whole, whole, whole}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &faultTransport{next: http.DefaultTransport, faults: tt.faults}
+			output := filepath.Join(t.TempDir(), "faults.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.Transport = transport
+			downloader.ChunkSize = int64(len(payload))
+			downloader.CurrentConnections = 1
+			downloader.RetryPolicy = &fixedRetryPolicy{max: 2, delay: time.Millisecond}
+			downloader.Timeout = tt.timeout
+
+			err := downloader.Download(context.Background())
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("Download() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := transport.requests(); fmt.Sprint(got) != fmt.Sprint(tt.ranges) {
+				t.Errorf("Expected requests for %q, got %q", tt.ranges, got)
+			}
+			if want := len(tt.ranges) - 1; downloader.Stats.RetryCount() != want {
+				t.Errorf("Expected %d retries, got %d", want, downloader.Stats.RetryCount())
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Error("Downloaded file does not match payload")
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package fasdownload
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// DefaultFilename is what a download is saved as when neither the server
+// nor the URL names the file, as for a site's root
+const DefaultFilename = "downloaded_file"
+
+// preferredExtensions picks the usual extension for common media types,
+// where the system's table lists several or none; an empty one means the
+// type says nothing about the file
+var preferredExtensions = map[string]string{
+	"application/gzip":         ".gz",
+	"application/json":         ".json",
+	"application/octet-stream": "",
+	"application/pdf":          ".pdf",
+	"application/x-gzip":       ".gz",
+	"application/x-tar":        ".tar",
+	"application/zip":          ".zip",
+	"image/jpeg":               ".jpg",
+	"text/html":                ".html",
+	"text/plain":               ".txt",
+}
+
+// deriveFilename names a download the user didn't name: the
+// Content-Disposition filename, else the last element of rawURL's path,
+// else DefaultFilename with an extension guessed from contentType. The
+// result is always a single, usable path element.
+func deriveFilename(rawURL, contentDisposition, contentType string) string {
+	if name := filenameFromContentDisposition(contentDisposition); name != "" {
+		return name
+	}
+	if name := FilenameFromURL(rawURL); name != "" {
+		return name
+	}
+	return DefaultFilename + extensionForType(contentType)
+}
+
+// FilenameFromURL returns the last element of rawURL's path, decoded and
+// without the query; a path ending in "/" is named after its last
+// directory. It is "" for a site's root or a URL that doesn't parse.
+func FilenameFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return sanitizeFilename(strings.TrimRight(u.Path, "/"))
+}
+
+// extensionForType returns the extension, with its dot, for a
+// Content-Type header, or "" when there is no telling
+func extensionForType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// filenameFromContentDisposition extracts a safe filename from a
+// Content-Disposition header, preferring the RFC 5987 filename* form.
+// It returns "" when the header has no usable filename.
+func filenameFromContentDisposition(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	// ParseMediaType decodes filename*=UTF-8''... into the "filename" key
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	return sanitizeFilename(params["filename"])
+}
+
+// sanitizeFilename reduces name to its final path element so a
+// server-supplied name can't point outside the current directory
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimSpace(path.Base(name))
+	if name == "" || name == "." || name == ".." || name == "/" || strings.ContainsRune(name, 0) {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,131 @@
+package fasdownload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilenameFromContentDisposition(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`attachment; filename="report.pdf"`, "report.pdf"},
+		{`attachment; filename=report.pdf`, "report.pdf"},
+		{`attachment; filename*=UTF-8''na%C3%AFve%20file.txt`, "naïve file.txt"},
+		{`attachment; filename="fallback.txt"; filename*=UTF-8''encoded.txt`, "encoded.txt"},
+		{`attachment; filename="../../etc/passwd"`, "passwd"},
+		{`attachment; filename="..\\..\\boot.ini"`, "boot.ini"},
+		{`attachment; filename=".."`, ""},
+		{`attachment`, ""},
+		{``, ""},
+	}
+
+	for _, tt := range tests {
+		if got := filenameFromContentDisposition(tt.header); got != tt.want {
+			t.Errorf("filenameFromContentDisposition(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGetFileSizeUsesContentDisposition(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Header().Set("Content-Disposition", `attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL+"/download?id=123", "download?id=123")
+	downloader.AutoFilename = true
+
+	if _, err := downloader.getFileSize(context.Background()); err != nil {
+		t.Fatalf("getFileSize() returned error: %v", err)
+	}
+	if downloader.Filename != "résumé.pdf" {
+		t.Errorf("Expected filename from Content-Disposition, got %q", downloader.Filename)
+	}
+
+	// An explicit output name is left alone
+	downloader = NewAdaptiveDownloader(server.URL+"/download?id=123", "chosen.pdf")
+	if _, err := downloader.getFileSize(context.Background()); err != nil {
+		t.Fatalf("getFileSize() returned error: %v", err)
+	}
+	if downloader.Filename != "chosen.pdf" {
+		t.Errorf("Expected explicit filename to be kept, got %q", downloader.Filename)
+	}
+}
+
+func TestFilenameFromURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/files/archive.zip", "archive.zip"},
+		{"https://example.com/files/archive.zip?token=abc#part", "archive.zip"},
+		{"https://example.com/files/my%20report.pdf", "my report.pdf"},
+		{"https://example.com/files/", "files"},
+		{"https://example.com/files//", "files"},
+		{"https://example.com/", ""},
+		{"https://example.com", ""},
+		{"https://example.com/?download=1", ""},
+		{"https://example.com/a/..", ""},
+		{"https://example.com/dir%2F..%2Fescape", "escape"},
+		{"https://example.com/back%5Cslash.txt", "slash.txt"},
+		{"://not a url", ""},
+	}
+
+	for _, tt := range tests {
+		if got := FilenameFromURL(tt.url); got != tt.want {
+			t.Errorf("FilenameFromURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveFilename(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		disposition string
+		contentType string
+		want        string
+	}{
+		{"disposition wins", "https://example.com/get?id=1", `attachment; filename="data.csv"`, "text/html", "data.csv"},
+		{"unusable disposition", "https://example.com/file.bin", `attachment; filename=".."`, "", "file.bin"},
+		{"url base", "https://example.com/file.bin", "", "text/html", "file.bin"},
+		{"root with html", "https://example.com/", "", "text/html; charset=utf-8", "downloaded_file.html"},
+		{"root with zip", "https://example.com", "", "application/zip", "downloaded_file.zip"},
+		{"root with octet-stream", "https://example.com/", "", "application/octet-stream", "downloaded_file"},
+		{"root with no type", "https://example.com/", "", "", "downloaded_file"},
+		{"root with bad type", "https://example.com/", "", ";;", "downloaded_file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deriveFilename(tt.url, tt.disposition, tt.contentType); got != tt.want {
+				t.Errorf("deriveFilename() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFileSizeNamesRootURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL+"/", filepath.Join("out", DefaultFilename))
+	downloader.AutoFilename = true
+	if _, err := downloader.getFileSize(context.Background()); err != nil {
+		t.Fatalf("getFileSize() returned error: %v", err)
+	}
+	if want := filepath.Join("out", "downloaded_file.html"); downloader.Filename != want {
+		t.Errorf("Expected %q, got %q", want, downloader.Filename)
+	}
+}
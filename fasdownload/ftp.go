@@ -0,0 +1,263 @@
+package fasdownload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// errNoRestart reports an FTP server that refused to start a transfer at
+// an offset, so the file has to be fetched from the start
+var errNoRestart = errors.New("server can't resume the transfer")
+
+// isFTP reports whether the download's URL is an ftp:// one
+func (d *AdaptiveDownloader) isFTP() bool {
+	return strings.HasPrefix(strings.ToLower(d.URL), "ftp://")
+}
+
+// ftpConnect opens and logs in an FTP control connection, returning it and
+// the path of the file on the server. Credentials come from the URL, then
+// BasicAuth; without either the login is anonymous.
+func (d *AdaptiveDownloader) ftpConnect(ctx context.Context) (*ftp.ServerConn, string, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	} else if d.BasicAuth != nil {
+		user, password = d.BasicAuth.Username, d.BasicAuth.Password
+	}
+
+	// The control and data connections go through the same dialer as HTTP
+	dial := d.dialContext(d.newDialer())
+	conn, err := ftp.Dial(addr, ftp.DialWithDialFunc(func(network, address string) (net.Conn, error) {
+		return dial(ctx, network, address)
+	}))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, "", fmt.Errorf("FTP login as %s failed: %w", user, err)
+	}
+	return conn, u.Path, nil
+}
+
+// ftpStat sets FileSize from the SIZE command, -1 when the server doesn't
+// support it, and the modification time checkpoints are matched against
+func (d *AdaptiveDownloader) ftpStat(ctx context.Context) error {
+	conn, path, err := d.ftpConnect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Quit()
+
+	d.Protocol = "FTP"
+	d.FileSize = -1
+	if size, err := conn.FileSize(path); err == nil && size >= 0 {
+		if err := d.checkFileSize(size); err != nil {
+			return err
+		}
+		d.FileSize = size
+	}
+	d.lastModified = ""
+	if conn.IsGetTimeSupported() {
+		if modified, err := conn.GetTime(path); err == nil {
+			d.lastModified = modified.UTC().Format(http.TimeFormat)
+		}
+	}
+	return nil
+}
+
+// downloadFTP fetches an ftp:// URL. FTP has no ranged requests to spread
+// over connections, so the file comes over one data connection; after a
+// failure the transfer resumes with REST from the last byte written, both
+// on retry and, through the checkpoint, on the next run.
+func (d *AdaptiveDownloader) downloadFTP(ctx context.Context) error {
+	if err := d.ftpStat(ctx); err != nil {
+		return cancellationError(ctx, fmt.Errorf("failed to get file info: %w", err))
+	}
+	if d.notModified() {
+		return ErrNotModified
+	}
+
+	d.detectSpecialTarget()
+	if err := d.resolveConflict(); err != nil {
+		return err
+	}
+	if d.FileSize >= 0 {
+		d.logf("File size: %d bytes\n", d.FileSize)
+	} else {
+		d.logf("File size: unknown\n")
+	}
+
+	d.logf("Downloading file in single connection...\n")
+	d.single = true
+	d.Stats.mu.Lock()
+	d.Stats.Chunks = 1
+	d.Stats.mu.Unlock()
+
+	// Only a checkpointed prefix of the .part file can be resumed
+	d.completed = &rangeSet{}
+	if d.FileSize > 0 && !d.fileless() {
+		completed, err := d.loadCheckpoint()
+		if err != nil {
+			return err
+		}
+		if len(completed.ranges) > 0 && completed.ranges[0].Start == 0 {
+			d.completed.add(0, completed.ranges[0].End)
+		}
+	}
+	d.resumed = d.completed.total()
+	if d.resumed > 0 {
+		d.logf("Resuming download: %d of %d bytes already on disk\n", d.resumed, d.FileSize)
+	}
+
+	if !d.special && !d.fileless() {
+		if err := checkDiskSpace(d.PartPath(), d.FileSize-d.resumed); err != nil {
+			return err
+		}
+	}
+	target := d.sequentialTarget()
+	var file *os.File
+	if target == nil {
+		var err error
+		if file, err = d.openTarget(d.resumed > 0); err != nil {
+			return err
+		}
+		defer file.Close()
+		target = file
+	}
+
+	stopProgress := d.startProgress(ctx)
+	defer stopProgress()
+
+	offset := d.resumed
+	for attempt := 1; ; attempt++ {
+		// A stream carries on where the last transfer stopped
+		if file != nil {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		n, err := d.fetchFTP(ctx, target, offset)
+		if errors.Is(err, errNoRestart) {
+			if d.fileless() {
+				return fmt.Errorf("%w, and %d bytes have already been streamed", err, offset)
+			}
+			d.logf("\nServer can't resume. Downloading from the start.\n")
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+			offset, d.resumed = 0, 0
+			d.completed = &rangeSet{}
+			attempt = 0
+			continue
+		}
+		offset += n
+		if err == nil && d.FileSize >= 0 && offset < d.FileSize {
+			err = fmt.Errorf("transfer ended after %d of %d bytes: %w", offset, d.FileSize, io.ErrUnexpectedEOF)
+		}
+		if err == nil {
+			break
+		}
+
+		// Keep what arrived for the next run
+		if offset > 0 && d.FileSize > 0 && !d.fileless() {
+			d.stateMu.Lock()
+			d.completed.add(0, offset)
+			d.unsaved = offset
+			d.stateMu.Unlock()
+			if flushErr := d.flushCheckpoint(); flushErr != nil {
+				d.logf("\nFailed to save checkpoint: %v\n", flushErr)
+			}
+		}
+
+		retry, delay := d.retryPolicy().ShouldRetry(attempt, nil, err)
+		if ctx.Err() != nil || !retry {
+			return cancellationError(ctx, err)
+		}
+		d.Stats.mu.Lock()
+		d.Stats.Retries++
+		d.Stats.mu.Unlock()
+		d.debugf("Retrying FTP transfer from byte %d in %v: %v\n", offset, delay, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return cancellationError(ctx, err)
+		}
+	}
+
+	if err := d.checkSize(file, offset); err != nil {
+		return err
+	}
+	if err := d.finalize(file); err != nil {
+		return err
+	}
+	if !d.inPlace() {
+		os.Remove(d.statePath())
+	}
+
+	result := d.Result()
+	d.logf("\nDownload completed!\n")
+	d.logf("Total time: %v\n", result.Duration)
+	d.logf("Average speed: %.2f MB/s\n", result.AverageBytesPerSec/1024/1024)
+
+	return d.verify()
+}
+
+// fetchFTP retrieves the file from offset on a new connection and writes it
+// to w, returning how many bytes were written
+func (d *AdaptiveDownloader) fetchFTP(ctx context.Context, w io.Writer, offset int64) (int64, error) {
+	watch := d.watchIdle(ctx)
+	defer watch.stop()
+
+	conn, path, err := d.ftpConnect(watch.ctx)
+	if err != nil {
+		return 0, watch.err("FTP connection", err)
+	}
+	defer conn.Quit()
+
+	resp, err := conn.RetrFrom(path, uint64(offset))
+	var reply *textproto.Error
+	if offset > 0 && errors.As(err, &reply) && (reply.Code == ftp.StatusNotImplemented || reply.Code == ftp.StatusCommandNotImplemented || reply.Code == ftp.StatusBadCommand) {
+		return 0, fmt.Errorf("%w at byte %d: %v", errNoRestart, offset, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Close()
+
+	// The data connection doesn't follow the context on its own
+	stop := context.AfterFunc(watch.ctx, func() { resp.SetDeadline(time.Now()) })
+	defer stop()
+
+	body := &meteredBody{d: d, ctx: ctx, body: resp, watch: watch}
+	written, err := io.Copy(w, body)
+	if err != nil {
+		if body.err != nil {
+			return written, wrapTimeout("FTP transfer", watch.err("FTP transfer", body.err))
+		}
+		return written, err
+	}
+	if err := resp.Close(); err != nil && (d.FileSize < 0 || offset+written < d.FileSize) {
+		return written, err
+	}
+	return written, nil
+}
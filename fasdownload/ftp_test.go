@@ -0,0 +1,193 @@
+package fasdownload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ftpStub is an in-process FTP server with just enough of the protocol for
+// a download: login, SIZE, EPSV, REST and RETR. When cutAt is set, the
+// first transfer is aborted after that many bytes.
+type ftpStub struct {
+	ln      net.Listener
+	payload []byte
+	cutAt   int
+
+	mu     sync.Mutex
+	logins []string
+	rests  []int64
+	retrs  int
+}
+
+func newFTPStub(t *testing.T, payload []byte, cutAt int) *ftpStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ftpStub{ln: ln, payload: payload, cutAt: cutAt}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ftpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 stub ready")
+
+	var user string
+	var offset int64
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			user = arg
+			reply("331 password required")
+		case "PASS":
+			s.mu.Lock()
+			s.logins = append(s.logins, user+":"+arg)
+			s.mu.Unlock()
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 type set")
+		case "SIZE":
+			reply("213 %d", len(s.payload))
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			reply("229 entering extended passive mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			s.mu.Lock()
+			s.rests = append(s.rests, offset)
+			s.mu.Unlock()
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			s.mu.Lock()
+			s.retrs++
+			cut := s.retrs == 1 && s.cutAt > 0
+			s.mu.Unlock()
+
+			reply("150 opening data connection")
+			dc, err := data.Accept()
+			if err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			if cut {
+				dc.Write(s.payload[offset:s.cutAt])
+				dc.Close()
+				reply("426 transfer aborted")
+			} else {
+				dc.Write(s.payload[offset:])
+				dc.Close()
+				reply("226 transfer complete")
+			}
+			offset = 0
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTPDownload(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	cutAt := 200 * 1024
+
+	tests := []struct {
+		name      string
+		userinfo  string
+		wantLogin string
+		retry     bool // resume within the run rather than on the next one
+	}{
+		{"anonymous", "", "anonymous:anonymous", false},
+		{"credentialed", "alice:secret@", "alice:secret", false},
+		{"retried", "", "anonymous:anonymous", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newFTPStub(t, payload, cutAt)
+			url := fmt.Sprintf("ftp://%s%s/pub/payload.bin", tt.userinfo, stub.ln.Addr())
+			output := filepath.Join(t.TempDir(), "payload.bin")
+
+			if !tt.retry {
+				first := NewAdaptiveDownloader(url, output)
+				first.RetryPolicy = DefaultRetryPolicy{} // fail on the first abort
+				if err := first.Download(context.Background()); err == nil {
+					t.Fatal("Expected the aborted transfer to fail")
+				}
+				if _, err := os.Stat(first.statePath()); err != nil {
+					t.Fatalf("Expected a checkpoint after the abort: %v", err)
+				}
+			}
+
+			downloader := NewAdaptiveDownloader(url, output)
+			downloader.RetryPolicy = DefaultRetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond}
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("Downloaded file does not match payload: got %d bytes, want %d", len(got), len(payload))
+			}
+
+			stub.mu.Lock()
+			defer stub.mu.Unlock()
+			if len(stub.rests) != 1 || stub.rests[0] != int64(cutAt) {
+				t.Errorf("Expected one REST %d, got %v", cutAt, stub.rests)
+			}
+			for _, login := range stub.logins {
+				if login != tt.wantLogin {
+					t.Errorf("Expected login %q, got %q", tt.wantLogin, login)
+				}
+			}
+			result := downloader.Result()
+			if !result.SingleConnection || result.BytesResumed+result.BytesDownloaded < int64(len(payload)) {
+				t.Errorf("Unexpected result: %+v", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package fasdownload
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// DefaultHistogramBuckets are the upper bounds used when none are configured
+var DefaultHistogramBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// DurationHistogram counts durations into buckets by upper bound.
+// Counts has one more entry than Bounds for durations above the last bound.
+type DurationHistogram struct {
+	Bounds []time.Duration
+	Counts []int
+}
+
+// DownloadResult summarizes a finished download. BytesResumed were already
+// on disk from an earlier run and BytesDownloaded were fetched by this one;
+// the difference is the bandwidth resume saved. AverageBytesPerSec is over
+// the bytes this run fetched. SingleConnection reports that the file came
+// over one connection, because the server doesn't support or ignored
+// ranges, or the stream had to be decoded in order. FinalConnections is the
+// target the adaptive logic ended at; ConnectionsOpened counts the TCP
+// connections actually dialed, metadata requests included, which exceeds
+// it when keep-alive connections aren't being reused. ChunkRetries and
+// BytesRedownloaded break down the retries as DownloadStats does.
+type DownloadResult struct {
+	TotalBytes         int64
+	BytesResumed       int64
+	BytesDownloaded    int64
+	Duration           time.Duration
+	AverageBytesPerSec float64
+	FinalConnections   int
+	ChunkCount         int
+	RetryCount         int
+	ChunkRetries       map[int]int
+	BytesRedownloaded  int64
+	SingleConnection   bool
+	ConnectionsOpened  int
+
+	ChunkDurations DurationHistogram
+	P50            time.Duration
+	P95            time.Duration
+	P99            time.Duration
+}
+
+// newDurationHistogram buckets durations using the given ascending bounds
+func newDurationHistogram(durations []time.Duration, bounds []time.Duration) DurationHistogram {
+	h := DurationHistogram{
+		Bounds: append([]time.Duration(nil), bounds...),
+		Counts: make([]int, len(bounds)+1),
+	}
+	for _, d := range durations {
+		i := sort.Search(len(bounds), func(i int) bool { return d <= bounds[i] })
+		h.Counts[i]++
+	}
+	return h
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Result returns the metrics of the download: its size, time and speed,
+// connections and chunks, and how much of the file came from resume. While
+// a download runs the duration is the time so far. The chunk duration
+// histogram and percentiles cover the last 1024 chunks.
+func (d *AdaptiveDownloader) Result() *DownloadResult {
+	d.Stats.mu.Lock()
+	durations := d.Stats.chunkTimes.values()
+	downloaded := d.Stats.BytesDownloaded
+	chunks := d.Stats.Chunks
+	retries := d.Stats.Retries
+	redownloaded := d.Stats.BytesRedownloaded
+	dials := d.Stats.Dials
+	start := d.Stats.StartTime
+	d.Stats.mu.Unlock()
+	chunkRetries := d.Stats.RetriesByChunk()
+
+	end := d.finished
+	if end.IsZero() {
+		end = now()
+	}
+	duration := end.Sub(start)
+	speed := averageSpeed(downloaded, duration)
+
+	// A file of unknown size is as large as what arrived
+	total := d.FileSize
+	if total < 0 {
+		total = d.resumed + downloaded
+	}
+
+	connections := 1
+	if !d.single {
+		d.mu.Lock()
+		connections = d.CurrentConnections
+		d.mu.Unlock()
+	}
+
+	bounds := d.HistogramBuckets
+	if len(bounds) == 0 {
+		bounds = DefaultHistogramBuckets
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	return &DownloadResult{
+		TotalBytes:         total,
+		BytesResumed:       d.resumed,
+		BytesDownloaded:    downloaded,
+		Duration:           duration,
+		AverageBytesPerSec: speed,
+		FinalConnections:   connections,
+		ChunkCount:         chunks,
+		RetryCount:         retries,
+		ChunkRetries:       chunkRetries,
+		BytesRedownloaded:  redownloaded,
+		SingleConnection:   d.single,
+		ConnectionsOpened:  dials,
+		ChunkDurations:     newDurationHistogram(durations, bounds),
+		P50:                percentile(durations, 50),
+		P95:                percentile(durations, 95),
+		P99:                percentile(durations, 99),
+	}
+}
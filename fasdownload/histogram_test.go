@@ -0,0 +1,135 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResultHistogramAndPercentiles(t *testing.T) {
+	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+	downloader.HistogramBuckets = []time.Duration{time.Second, 5 * time.Second}
+
+	// 100 chunks taking 1ms, 2ms, ... 100ms, plus a few slow outliers replacing the tail
+	outliers := map[int]time.Duration{98: 3 * time.Second, 99: 4 * time.Second, 100: 8 * time.Second}
+	for i := 1; i <= 100; i++ {
+		d, ok := outliers[i]
+		if !ok {
+			d = time.Duration(i) * time.Millisecond
+		}
+		downloader.Stats.recordChunkTime(d)
+	}
+
+	result := downloader.Result()
+
+	if result.P50 != 50*time.Millisecond {
+		t.Errorf("Expected p50 of 50ms, got %v", result.P50)
+	}
+	if result.P95 != 95*time.Millisecond {
+		t.Errorf("Expected p95 of 95ms, got %v", result.P95)
+	}
+	if result.P99 != 4*time.Second {
+		t.Errorf("Expected p99 of 4s, got %v", result.P99)
+	}
+
+	want := []int{97, 2, 1}
+	if !reflect.DeepEqual(result.ChunkDurations.Counts, want) {
+		t.Errorf("Expected bucket counts %v, got %v", want, result.ChunkDurations.Counts)
+	}
+}
+
+func TestResultWithoutChunks(t *testing.T) {
+	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+
+	result := downloader.Result()
+	if result.P50 != 0 || result.P99 != 0 {
+		t.Errorf("Expected zero percentiles without samples, got p50=%v p99=%v", result.P50, result.P99)
+	}
+	if len(result.ChunkDurations.Counts) != len(DefaultHistogramBuckets)+1 {
+		t.Errorf("Expected default buckets, got %d counts", len(result.ChunkDurations.Counts))
+	}
+}
+
+func TestResultAfterDownload(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tests := []struct {
+		name   string
+		ranges bool
+		want   DownloadResult
+	}{
+		{"parallel", true, DownloadResult{
+			TotalBytes:         int64(len(payload)),
+			BytesDownloaded:    int64(len(payload)),
+			Duration:           100 * time.Millisecond,
+			AverageBytesPerSec: float64(len(payload)) * 10,
+			FinalConnections:   2,
+			ChunkCount:         4,
+			RetryCount:         1,
+		}},
+		{"single connection", false, DownloadResult{
+			TotalBytes:       int64(len(payload)),
+			BytesDownloaded:  int64(len(payload)),
+			FinalConnections: 1,
+			ChunkCount:       1,
+			SingleConnection: true,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first ranged GET fails once; its 100ms retry delay is the
+			// only time that passes on the virtual clock
+			clock := &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			SetClock(clock)
+
+			var gets atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.ranges && r.Method == "GET" && gets.Add(1) == 1 {
+					http.Error(w, "busy", http.StatusServiceUnavailable)
+					return
+				}
+				if !tt.ranges {
+					w.Write(payload)
+					return
+				}
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+			downloader.ChunkSize = 64 * 1024
+			downloader.CurrentConnections = 2
+			downloader.MaxConnections = 2
+			downloader.RetryPolicy = DefaultRetryPolicy{MaxRetries: 3, BaseDelay: 100 * time.Millisecond}
+
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+
+			got := *downloader.Result()
+			got.ChunkDurations, got.P50, got.P95, got.P99 = DurationHistogram{}, 0, 0, 0
+			got.ConnectionsOpened = 0 // depends on keep-alive timing; see TestConnectionsOpened
+
+			// Which chunk's request failed depends on the workers' timing
+			chunkRetries := 0
+			for _, n := range got.ChunkRetries {
+				chunkRetries += n
+			}
+			if chunkRetries != tt.want.RetryCount {
+				t.Errorf("Expected %d chunk retries, got %v", tt.want.RetryCount, got.ChunkRetries)
+			}
+			got.ChunkRetries = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unexpected result:\ngot:  %+v\nwant: %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,470 @@
+package fasdownload
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newDialer creates the dialer used for all connections, applying socket options
+func (d *AdaptiveDownloader) newDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   orDefault(d.DialTimeout, DefaultDialTimeout),
+		KeepAlive: 30 * time.Second,
+		// Used for the system's own Happy Eyeballs when no IPFamily is set
+		FallbackDelay: d.FallbackDelay,
+		Control:       socketControl(d.SocketReceiveBuffer, d.SocketSendBuffer),
+	}
+}
+
+// newClient creates an HTTP client that sends requests through roundTripper
+// and follows at most maxRedirects redirects
+func (d *AdaptiveDownloader) newClient(timeout time.Duration, maxRedirects int) *http.Client {
+	return &http.Client{
+		Transport:     d.roundTripper(),
+		Timeout:       timeout,
+		CheckRedirect: redirectPolicy(maxRedirects),
+		Jar:           d.jar,
+	}
+}
+
+// roundTripper returns Transport if set, otherwise a transport whose
+// connections use the configured dialer, proxy and TLS settings
+func (d *AdaptiveDownloader) roundTripper() http.RoundTripper {
+	if d.Transport != nil {
+		return d.Transport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = d.proxyFunc()
+	transport.TLSHandshakeTimeout = orDefault(d.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout)
+	transport.IdleConnTimeout = orDefault(d.IdleConnTimeout, DefaultIdleConnTimeout)
+	// Keep a connection per worker alive between chunks
+	transport.MaxIdleConnsPerHost = max(d.MaxConnections, http.DefaultMaxIdleConnsPerHost)
+	transport.MaxConnsPerHost = max(d.MaxConnsPerHost, 0)
+	dial := d.dialContext(d.newDialer())
+	transport.DialContext = dial
+	if d.tlsConfig != nil {
+		transport.TLSClientConfig = d.tlsConfig.Clone()
+	}
+	if d.handshakes != nil {
+		transport.DialTLSContext = d.limitedTLSDial(transport, dial)
+	}
+	return transport
+}
+
+// proxyFunc chooses the proxy for each request: Proxy when set, otherwise
+// HTTP_PROXY or HTTPS_PROXY by the request's scheme. Hosts listed in
+// NO_PROXY, and localhost, are always reached directly. The environment is
+// read per download rather than once per process. With a SOCKS5 proxy
+// there is none: the dialer already goes through it.
+func (d *AdaptiveDownloader) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if d.socks != nil {
+		return nil
+	}
+	config := httpproxy.FromEnvironment()
+	if d.Proxy != "" {
+		config.HTTPProxy = d.Proxy
+		config.HTTPSProxy = d.Proxy
+	}
+	proxy := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// limitedTLSDial returns a DialTLSContext that performs the TLS handshake
+// itself so at most MaxConcurrentHandshakes run at once across every client
+// of this download. The TCP connect happens outside the limit.
+func (d *AdaptiveDownloader) limitedTLSDial(transport *http.Transport, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// The transport has filled in NextProtos by the time it dials
+		config := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			config = transport.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			config.ServerName = host
+		}
+
+		select {
+		case d.handshakes <- struct{}{}:
+		case <-ctx.Done():
+			conn.Close()
+			return nil, ctx.Err()
+		}
+		defer func() { <-d.handshakes }()
+
+		// The transport's handshake timeout doesn't cover a custom dialer
+		ctx, cancel := context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+		defer cancel()
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// errTooManyRedirects reports a redirect chain longer than the limit
+var errTooManyRedirects = errors.New("too many redirects")
+
+// redirectPolicy returns a CheckRedirect func allowing at most limit
+// redirects, and only to HTTP or HTTPS URLs
+func redirectPolicy(limit int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if scheme := strings.ToLower(req.URL.Scheme); scheme != "http" && scheme != "https" {
+			return &UnsupportedSchemeError{URL: req.URL.Redacted(), Scheme: scheme}
+		}
+		if len(via) > limit {
+			return fmt.Errorf("%w: stopped after %d", errTooManyRedirects, limit)
+		}
+		return nil
+	}
+}
+
+// newRequest creates a request for the current source (URL or a mirror)
+// carrying the configured headers and credentials. Once the source has
+// redirected to another host, credentials are not sent there, just as the
+// client drops them when following the redirect itself.
+func (d *AdaptiveDownloader) newRequest(ctx context.Context, method string) (*http.Request, error) {
+	target, origin := d.requestTarget()
+	req, err := d.newRequestTo(ctx, method, target)
+	if err != nil {
+		return nil, err
+	}
+	if target != origin && !sameHost(target, origin) {
+		req.Header.Del("Authorization")
+		req.Header.Del("Cookie")
+	}
+	return req, nil
+}
+
+// sameHost reports whether two URLs point at the same host and port
+func sameHost(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	return errA == nil && errB == nil && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// newRequestTo is newRequest for an explicit URL
+func (d *AdaptiveDownloader) newRequestTo(ctx context.Context, method, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range d.Headers {
+		req.Header.Set(key, value)
+	}
+	if d.BasicAuth != nil {
+		req.SetBasicAuth(d.BasicAuth.Username, d.BasicAuth.Password)
+	}
+	if d.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+d.BearerToken)
+	}
+	return req, nil
+}
+
+// getFileSize gets the file size from the server and checks range support
+func (d *AdaptiveDownloader) getFileSize(ctx context.Context) (bool, error) {
+	resp, err := d.head(ctx)
+	if err != nil {
+		// A redirect off HTTP leads nowhere a GET could follow either
+		var schemeErr *UnsupportedSchemeError
+		if ctx.Err() != nil || errors.As(err, &schemeErr) || errors.Is(err, ErrNotModified) {
+			return false, err
+		}
+		return d.getFileSizeByGet(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if d.readMetadata(resp) {
+		return false, nil
+	}
+
+	contentLength := resp.Header.Get("Content-Length")
+
+	// Without a content length, a ranged request may still reveal the size
+	// in its Content-Range; otherwise we'll handle it in download
+	if contentLength == "" {
+		if resp.Header.Get("Accept-Ranges") != "none" {
+			if supported, total := d.probeRange(ctx); supported && total >= 0 {
+				if err := d.checkFileSize(total); err != nil {
+					return false, err
+				}
+				d.logf("Server didn't provide content length in HEAD request. Range probe reports %d bytes.\n", total)
+				d.FileSize = total
+				return true, nil
+			}
+		}
+		d.logf("Server didn't provide content length in HEAD request. Will determine during download.\n")
+		d.FileSize = -1   // Mark as unknown
+		return false, nil // Can't do range requests without knowing size
+	}
+
+	size, err := parseContentLength(contentLength)
+	if err != nil {
+		return false, err
+	}
+	if err := d.checkFileSize(size); err != nil {
+		return false, err
+	}
+
+	d.FileSize = size
+
+	// Check if server supports range requests
+	switch resp.Header.Get("Accept-Ranges") {
+	case "bytes":
+		return true, nil
+	case "":
+		// Many servers honor ranges without advertising them
+		supported, _ := d.probeRange(ctx)
+		return supported, nil
+	default:
+		return false, nil
+	}
+}
+
+// head makes the HEAD request to the current source, retrying a failed
+// request or a 5xx or 429 answer under the retry policy as chunks are. The
+// caller closes the response.
+func (d *AdaptiveDownloader) head(ctx context.Context) (*http.Response, error) {
+	client := d.newClient(d.HeadTimeout, d.MaxHeadRedirects)
+	for attempt := 1; ; attempt++ {
+		req, err := d.newRequest(ctx, "HEAD")
+		if err != nil {
+			return nil, err
+		}
+		if !d.localModTime.IsZero() {
+			req.Header.Set("If-Modified-Since", d.localModTime.UTC().Format(http.TimeFormat))
+		}
+
+		// A bad status reaches the policy as a response rather than an error
+		var failed *http.Response
+		resp, err := client.Do(req)
+		if err != nil {
+			err = wrapTimeout("HEAD request", err)
+		} else if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			return nil, ErrNotModified
+		} else if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			failed, err = resp, newHTTPStatusError(resp)
+		} else {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		reqErr := err
+		if failed != nil {
+			reqErr = nil
+		}
+		retry, delay := d.retryPolicy().ShouldRetry(attempt, failed, reqErr)
+		if !retry {
+			return nil, err
+		}
+		d.Stats.mu.Lock()
+		d.Stats.Retries++
+		d.Stats.mu.Unlock()
+		d.debugf("Retrying HEAD request in %v: %v\n", delay, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readMetadata takes what the HEAD response, or the GET standing in for
+// it, says about the file other than its size, naming the file when
+// AutoFilename is set. It reports whether the content is encoded, in which
+// case the size is unknown and ranges can't be used.
+func (d *AdaptiveDownloader) readMetadata(resp *http.Response) (encoded bool) {
+	d.etag = resp.Header.Get("ETag")
+	d.lastModified = resp.Header.Get("Last-Modified")
+	d.encoded = contentEncoding(resp) != CompressionNone
+	d.resolve(resp.Request.URL)
+	d.Protocol = resp.Proto
+
+	if d.AutoFilename {
+		// The server names the file, not the directory it goes in
+		disposition := resp.Header.Get("Content-Disposition")
+		name := deriveFilename(d.URL, disposition, resp.Header.Get("Content-Type"))
+		if name != filepath.Base(d.Filename) {
+			d.Filename = filepath.Join(filepath.Dir(d.Filename), name)
+			if filenameFromContentDisposition(disposition) != "" {
+				d.logf("Using filename from Content-Disposition: %s\n", d.Filename)
+			} else {
+				d.logf("Using filename %s\n", d.Filename)
+			}
+		}
+	}
+
+	// The Content-Length of encoded content is the encoded size, not the
+	// file's, and ranges would address encoded bytes
+	if d.encoded {
+		d.logf("Server sends %s-encoded content. Size is unknown until decoded.\n", contentEncoding(resp))
+		d.FileSize = -1
+	}
+	return d.encoded
+}
+
+// getFileSizeByGet stands in for a HEAD request that failed for good, as on
+// servers that refuse HEAD or answer it wrongly: a GET for the first byte
+// reveals the size and range support just the same. When the GET fails
+// too, headErr is returned.
+func (d *AdaptiveDownloader) getFileSizeByGet(ctx context.Context, headErr error) (bool, error) {
+	req, err := d.newRequest(ctx, "GET")
+	if err != nil {
+		return false, headErr
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := d.newClient(d.HeadTimeout, d.MaxHeadRedirects).Do(req)
+	if err != nil {
+		return false, headErr
+	}
+	defer resp.Body.Close()
+
+	// Only a 206 with a known total or a 200 says how large the file is
+	var total int64 = -1
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if _, _, total, err = parseContentRange(resp.Header.Get("Content-Range")); err != nil || total < 0 {
+			return false, headErr
+		}
+	case http.StatusOK:
+	default:
+		return false, headErr
+	}
+
+	d.logf("HEAD request failed: %v; took the file's details from a GET instead\n", headErr)
+	if d.readMetadata(resp) {
+		return false, nil
+	}
+
+	if total >= 0 {
+		if err := d.checkFileSize(total); err != nil {
+			return false, err
+		}
+		d.FileSize = total
+		return true, nil
+	}
+
+	// The whole file is on its way; it is fetched again by the download
+	d.FileSize = -1
+	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
+		size, err := parseContentLength(contentLength)
+		if err != nil {
+			return false, err
+		}
+		if err := d.checkFileSize(size); err != nil {
+			return false, err
+		}
+		d.FileSize = size
+	}
+	return false, nil
+}
+
+// DefaultMaxFileSize is the MaxFileSize used when it is not set: 1 PiB,
+// far beyond a real download but well short of a garbage Content-Length
+// near math.MaxInt64
+const DefaultMaxFileSize = 1 << 50
+
+// parseContentLength parses a Content-Length value, which must be a plain
+// non-negative number
+func parseContentLength(value string) (int64, error) {
+	size, err := strconv.ParseUint(value, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Length %q", value)
+	}
+	return int64(size), nil
+}
+
+// checkFileSize refuses a reported size above MaxFileSize
+func (d *AdaptiveDownloader) checkFileSize(size int64) error {
+	limit := d.MaxFileSize
+	if limit <= 0 {
+		limit = DefaultMaxFileSize
+	}
+	if size > limit {
+		return &FileTooLargeError{Size: size, Max: limit}
+	}
+	return nil
+}
+
+// probeRange requests the first byte of the file and reports whether the
+// server answered with partial content, along with the total size from its
+// Content-Range (-1 when the server doesn't say)
+func (d *AdaptiveDownloader) probeRange(ctx context.Context) (supported bool, total int64) {
+	req, err := d.newRequest(ctx, "GET")
+	if err != nil {
+		return false, -1
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := d.newClient(d.HeadTimeout, d.MaxHeadRedirects).Do(req)
+	if err != nil {
+		return false, -1
+	}
+	defer resp.Body.Close()
+
+	contentRange := resp.Header.Get("Content-Range")
+	if resp.StatusCode != http.StatusPartialContent || contentRange == "" {
+		return false, -1
+	}
+	if _, _, total, err = parseContentRange(contentRange); err != nil {
+		total = -1
+	}
+	return true, total
+}
+
+// parseContentRange parses a "bytes start-end/total" Content-Range value.
+// total is -1 when the server sends "*" for an unknown length.
+func parseContentRange(value string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	span, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	total = -1
+	var err3 error
+	if size != "*" {
+		total, err3 = strconv.ParseInt(size, 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || start < 0 || end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	return start, end, total, nil
+}
@@ -0,0 +1,802 @@
+package fasdownload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetFileSize(t *testing.T) {
+	// Create a test server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("Expected HEAD request, got %s", r.Method)
+		}
+
+		w.Header().Set("Content-Length", "1024")
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, "test.file")
+
+	supportsRanges, err := downloader.getFileSize(context.Background())
+	if err != nil {
+		t.Fatalf("getFileSize() returned error: %v", err)
+	}
+
+	if !supportsRanges {
+		t.Error("Expected server to support range requests")
+	}
+
+	if downloader.FileSize != 1024 {
+		t.Errorf("Expected file size to be 1024, got %d", downloader.FileSize)
+	}
+}
+
+// newRawServer answers every request with response as written, headers the
+// net/http server would refuse to send included, and returns its URL
+func newRawServer(t *testing.T, response string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+					io.WriteString(conn, response)
+				}
+			}()
+		}
+	}()
+	return "http://" + listener.Addr().String() + "/file.bin"
+}
+
+func TestBadContentLength(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength string
+		maxFileSize   int64
+		tooLarge      bool
+	}{
+		{name: "near MaxInt64", contentLength: "9223372036854775000", tooLarge: true},
+		{name: "above MaxFileSize", contentLength: "2048", maxFileSize: 1024, tooLarge: true},
+		{name: "negative", contentLength: "-5"},
+		{name: "not a number", contentLength: "lots"},
+		{name: "overflows int64", contentLength: "99999999999999999999"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := newRawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: "+tt.contentLength+"\r\nAccept-Ranges: bytes\r\nConnection: close\r\n\r\n")
+			dir := t.TempDir()
+			downloader := NewAdaptiveDownloader(url, filepath.Join(dir, "file.bin"))
+			downloader.MaxFileSize = tt.maxFileSize
+			downloader.RetryPolicy = DefaultRetryPolicy{}
+
+			err := downloader.Download(context.Background())
+			var tooLarge *FileTooLargeError
+			switch {
+			case tt.tooLarge && !errors.As(err, &tooLarge):
+				t.Fatalf("Expected a *FileTooLargeError, got %v", err)
+			case !tt.tooLarge && (err == nil || !strings.Contains(err.Error(), "Content-Length")):
+				t.Fatalf("Expected a bad Content-Length error, got %v", err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("Expected nothing written, found %v", entries)
+			}
+		})
+	}
+
+	// The transport refuses most bad values itself; the parser backs it up
+	for _, value := range []string{"-5", "lots", "+5", "99999999999999999999", ""} {
+		if _, err := parseContentLength(value); err == nil {
+			t.Errorf("parseContentLength(%q) accepted a bad value", value)
+		}
+	}
+	if size, err := parseContentLength("1024"); err != nil || size != 1024 {
+		t.Errorf("parseContentLength(\"1024\") = %d, %v", size, err)
+	}
+}
+
+func TestGetFileSizeNoRangeSupport(t *testing.T) {
+	// Create a test server without range support
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "2048")
+		// Don't set Accept-Ranges header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, "test.file")
+
+	supportsRanges, err := downloader.getFileSize(context.Background())
+	if err != nil {
+		t.Fatalf("getFileSize() returned error: %v", err)
+	}
+
+	if supportsRanges {
+		t.Error("Expected server to not support range requests")
+	}
+
+	if downloader.FileSize != 2048 {
+		t.Errorf("Expected file size to be 2048, got %d", downloader.FileSize)
+	}
+}
+
+// hiddenRangesWriter drops Accept-Ranges so a range-capable handler stops advertising it
+type hiddenRangesWriter struct {
+	http.ResponseWriter
+}
+
+func (w hiddenRangesWriter) WriteHeader(status int) {
+	w.Header().Del("Accept-Ranges")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func TestGetFileSizeProbesRangeSupport(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	var rangedRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&rangedRequests, 1)
+		}
+		http.ServeContent(hiddenRangesWriter{w}, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "probed.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 64 * 1024
+
+	supportsRanges, err := downloader.getFileSize(context.Background())
+	if err != nil {
+		t.Fatalf("getFileSize() returned error: %v", err)
+	}
+	if !supportsRanges {
+		t.Fatal("Expected probe to detect range support without Accept-Ranges")
+	}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Downloaded content does not match payload")
+	}
+
+	// One probe per getFileSize call plus one request per chunk
+	if n := atomic.LoadInt32(&rangedRequests); n < 2+4 {
+		t.Errorf("Expected parallel ranged requests, got %d", n)
+	}
+}
+
+func TestSizeFromContentRange(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	// HEAD says nothing about the size; only ranged responses reveal it
+	var rangedRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			rangedRequests.Add(1)
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "sized.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 64 * 1024
+
+	supportsRanges, err := downloader.getFileSize(context.Background())
+	if err != nil {
+		t.Fatalf("getFileSize() returned error: %v", err)
+	}
+	if !supportsRanges || downloader.FileSize != int64(len(payload)) {
+		t.Fatalf("Expected ranges with size %d from Content-Range, got ranges=%v size=%d", len(payload), supportsRanges, downloader.FileSize)
+	}
+
+	rangedRequests.Store(0)
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Downloaded content does not match payload")
+	}
+
+	// The probe plus one ranged request per chunk
+	if n := rangedRequests.Load(); n != 1+4 {
+		t.Errorf("Expected a parallel download of 4 chunks, got %d ranged requests", n)
+	}
+}
+
+func TestRedirectLimitsAreIndependent(t *testing.T) {
+	payload := testPayload(16 * 1024)
+
+	// /hop/N redirects to /hop/N-1; /hop/0 serves the file
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/hop/%d", hops-1), http.StatusFound)
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+
+	// HEAD may follow one redirect, GET three
+	downloader := NewAdaptiveDownloader(server.URL+"/hop/2", filepath.Join(dir, "a.bin"))
+	downloader.MaxHeadRedirects = 1
+	downloader.MaxGetRedirects = 3
+
+	if _, err := downloader.getFileSize(context.Background()); err == nil {
+		t.Error("Expected HEAD to stop after 1 redirect")
+	}
+	if err := downloader.downloadSingleConnection(context.Background()); err != nil {
+		t.Errorf("Expected GET to follow 2 redirects, got %v", err)
+	}
+
+	// And the reverse
+	downloader = NewAdaptiveDownloader(server.URL+"/hop/2", filepath.Join(dir, "b.bin"))
+	downloader.MaxHeadRedirects = 3
+	downloader.MaxGetRedirects = 1
+
+	if _, err := downloader.getFileSize(context.Background()); err != nil {
+		t.Errorf("Expected HEAD to follow 2 redirects, got %v", err)
+	}
+
+	// Forget where HEAD resolved to, so the GET has to follow the chain
+	downloader.setSource(0)
+	if err := downloader.downloadSingleConnection(context.Background()); err == nil {
+		t.Error("Expected GET to stop after 1 redirect")
+	}
+}
+
+func TestRedirectToUnsupportedScheme(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	tests := []struct {
+		name      string
+		redirects string // the method whose requests are sent to FTP
+	}{
+		{"HEAD", "HEAD"},
+		{"GET", "GET"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == tt.redirects {
+					http.Redirect(w, r, "ftp://mirror.example.com/pub/payload.bin", http.StatusFound)
+					return
+				}
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			downloader := NewAdaptiveDownloader(server.URL+"/payload.bin", filepath.Join(t.TempDir(), "payload.bin"))
+			downloader.CurrentConnections = 1
+			err := downloader.Download(context.Background())
+
+			var schemeErr *UnsupportedSchemeError
+			if !errors.As(err, &schemeErr) {
+				t.Fatalf("Expected an UnsupportedSchemeError, got %v", err)
+			}
+			if schemeErr.Scheme != "ftp" || schemeErr.URL != "ftp://mirror.example.com/pub/payload.bin" {
+				t.Errorf("Expected the ftp:// target to be named, got %+v", schemeErr)
+			}
+			if downloader.Stats.Retries != 0 {
+				t.Errorf("Expected no retries of an unfetchable redirect, got %d", downloader.Stats.Retries)
+			}
+		})
+	}
+}
+
+func TestGetFileSizeHeadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never answer; wait for the client to give up or the test to end
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	downloader := NewAdaptiveDownloader(server.URL, "test.file")
+	downloader.HeadTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err := downloader.getFileSize(context.Background())
+	if err == nil {
+		t.Fatal("Expected getFileSize() to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected a prompt timeout, took %v", elapsed)
+	}
+}
+
+func TestCustomHeadersAndAuthOnEveryRequest(t *testing.T) {
+	payload := testPayload(128 * 1024)
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	var missing []string
+
+	// advertise controls how range support is signalled: "bytes", "none" or hidden
+	newServer := func(advertise string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			kind := r.Method
+			if r.Header.Get("Range") != "" {
+				kind += " range"
+			}
+
+			mu.Lock()
+			seen[kind]++
+			if r.Header.Get("Authorization") != "Bearer secret-token" || r.Header.Get("X-Api-Key") != "abc123" {
+				missing = append(missing, kind)
+			}
+			mu.Unlock()
+
+			switch advertise {
+			case "none":
+				w.Header().Set("Accept-Ranges", "none")
+				if r.Method == "HEAD" {
+					w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+					return
+				}
+				w.Write(payload)
+			case "hidden":
+				http.ServeContent(hiddenRangesWriter{w}, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			default:
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}
+		}))
+	}
+
+	dir := t.TempDir()
+	for _, advertise := range []string{"hidden", "none"} {
+		server := newServer(advertise)
+		downloader := NewAdaptiveDownloader(server.URL, filepath.Join(dir, advertise+".bin"))
+		downloader.ChunkSize = 32 * 1024
+		downloader.Headers = map[string]string{"X-Api-Key": "abc123"}
+		downloader.BearerToken = "secret-token"
+
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() against %q server returned error: %v", advertise, err)
+		}
+		server.Close()
+	}
+
+	// HEAD, range probe and chunk GETs from the first server; plain GET from the second
+	for _, kind := range []string{"HEAD", "GET range", "GET"} {
+		if seen[kind] == 0 {
+			t.Errorf("Expected at least one %s request", kind)
+		}
+	}
+	if len(missing) > 0 {
+		t.Errorf("Requests missing custom headers or auth: %v", missing)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+	downloader.BasicAuth = &BasicAuth{Username: "user", Password: "pass"}
+
+	req, err := downloader.newRequest(context.Background(), "GET")
+	if err != nil {
+		t.Fatalf("newRequest() returned error: %v", err)
+	}
+
+	user, pass, ok := req.BasicAuth()
+	if !ok || user != "user" || pass != "pass" {
+		t.Errorf("Expected basic auth user/pass, got %q/%q (ok=%v)", user, pass, ok)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value   string
+		start   int64
+		end     int64
+		total   int64
+		wantErr bool
+	}{
+		{"bytes 0-499/1234", 0, 499, 1234, false},
+		{"bytes 500-999/*", 500, 999, -1, false},
+		{"bytes 0-0/1", 0, 0, 1, false},
+		{"", 0, 0, 0, true},
+		{"bytes */1234", 0, 0, 0, true},
+		{"bytes 10-5/100", 0, 0, 0, true},
+		{"bytes 0-100/100", 0, 0, 0, true},
+		{"items 0-1/2", 0, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		start, end, total, err := parseContentRange(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseContentRange(%q): expected error", tt.value)
+			}
+			continue
+		}
+		if err != nil || start != tt.start || end != tt.end || total != tt.total {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, %v; want %d, %d, %d", tt.value, start, end, total, err, tt.start, tt.end, tt.total)
+		}
+	}
+}
+
+func TestTLSHandshakeLimit(t *testing.T) {
+	payload := testPayload(512 * 1024)
+
+	// Hold every handshake open briefly and record the peak overlap
+	var inFlight, peak, total atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			n := inFlight.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			total.Add(1)
+			time.Sleep(30 * time.Millisecond)
+			inFlight.Add(-1)
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	download := func(limit int) {
+		t.Helper()
+		// Let handshakes the previous run no longer needed finish first
+		for inFlight.Load() > 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		peak.Store(0)
+		total.Store(0)
+
+		output := filepath.Join(t.TempDir(), "tls.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		downloader.tlsConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+		downloader.ChunkSize = 32 * 1024
+		downloader.CurrentConnections = 8
+		downloader.MaxConnections = 8
+		downloader.MaxConcurrentHandshakes = limit
+
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("Downloaded file does not match payload")
+		}
+	}
+
+	// Without a limit the workers' handshakes overlap
+	download(0)
+	if peak.Load() <= 2 {
+		t.Fatalf("Expected unlimited handshakes to overlap by more than 2, peak was %d", peak.Load())
+	}
+
+	// Workers share pooled connections, so there are far fewer handshakes
+	// than the 16 chunks
+	download(2)
+	if total.Load() > 9 {
+		t.Errorf("Expected at most a handshake per worker plus the HEAD request, got %d", total.Load())
+	}
+	if peak.Load() > 2 {
+		t.Errorf("Expected at most 2 concurrent handshakes, peak was %d", peak.Load())
+	}
+}
+
+func TestProxy(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	const target = "http://files.example.test/payload.bin"
+
+	// The mock proxy answers for the target host itself, which doesn't exist
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "files.example.test" {
+			http.Error(w, "unexpected host "+r.URL.Host, http.StatusBadGateway)
+			return
+		}
+		proxied.Add(1)
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer proxy.Close()
+
+	download := func(t *testing.T, configure func(*AdaptiveDownloader)) error {
+		t.Helper()
+		proxied.Store(0)
+		output := filepath.Join(t.TempDir(), "proxied.bin")
+		downloader := NewAdaptiveDownloader(target, output)
+		downloader.HeadTimeout = 5 * time.Second
+		configure(downloader)
+		if err := downloader.Download(context.Background()); err != nil {
+			return err
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("Downloaded file does not match payload")
+		}
+		return nil
+	}
+
+	t.Run("Proxy field", func(t *testing.T) {
+		t.Setenv("HTTP_PROXY", "")
+		t.Setenv("NO_PROXY", "")
+		err := download(t, func(d *AdaptiveDownloader) { d.Proxy = proxy.URL })
+		if err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		if proxied.Load() == 0 {
+			t.Error("Expected requests to go through the proxy")
+		}
+	})
+
+	t.Run("HTTP_PROXY", func(t *testing.T) {
+		t.Setenv("HTTP_PROXY", proxy.URL)
+		t.Setenv("NO_PROXY", "")
+		if err := download(t, func(*AdaptiveDownloader) {}); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		if proxied.Load() == 0 {
+			t.Error("Expected requests to go through the proxy")
+		}
+	})
+
+	t.Run("NO_PROXY", func(t *testing.T) {
+		t.Setenv("HTTP_PROXY", proxy.URL)
+		t.Setenv("NO_PROXY", ".example.test")
+
+		// Going direct fails, since the host doesn't resolve
+		if err := download(t, func(d *AdaptiveDownloader) { d.RetryPolicy = DefaultRetryPolicy{} }); err == nil {
+			t.Error("Expected the direct request to fail")
+		}
+		if n := proxied.Load(); n != 0 {
+			t.Errorf("Expected no requests through the proxy, got %d", n)
+		}
+	})
+}
+
+func TestResolvedURL(t *testing.T) {
+	payload := testPayload(512 * 1024)
+
+	var cdnGets, leakedAuth atomic.Int32
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			cdnGets.Add(1)
+		}
+		if r.Header.Get("Authorization") != "" {
+			leakedAuth.Add(1)
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer cdn.Close()
+
+	// Redirect to the CDN under a different host name, as a real CDN would be
+	cdnURL := strings.Replace(cdn.URL, "127.0.0.1", "localhost", 1) + "/payload.bin"
+	var originRequests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Add(1)
+		http.Redirect(w, r, cdnURL, http.StatusFound)
+	}))
+	defer origin.Close()
+
+	output := filepath.Join(t.TempDir(), "resolved.bin")
+	downloader := NewAdaptiveDownloader(origin.URL+"/download", output)
+	downloader.ChunkSize = 64 * 1024
+	downloader.BearerToken = "secret"
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Downloaded file does not match payload")
+	}
+
+	if downloader.ResolvedURL != cdnURL {
+		t.Errorf("Expected ResolvedURL %s, got %s", cdnURL, downloader.ResolvedURL)
+	}
+	if n := originRequests.Load(); n != 1 {
+		t.Errorf("Expected only the HEAD request at the origin, got %d requests", n)
+	}
+	if n := cdnGets.Load(); n != 8 {
+		t.Errorf("Expected all 8 chunks fetched from the CDN, got %d", n)
+	}
+	if n := leakedAuth.Load(); n != 0 {
+		t.Errorf("Expected credentials not to reach the CDN, sent with %d requests", n)
+	}
+}
+
+func TestConnectionsOpened(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	var accepted atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			accepted.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	var dials atomic.Int32
+	dialer := &net.Dialer{}
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.ChunkSize = 32 * 1024
+	downloader.CurrentConnections = 2
+	downloader.MaxConnections = 2
+	downloader.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	result := downloader.Result()
+	if result.ConnectionsOpened != int(dials.Load()) || result.ConnectionsOpened != int(accepted.Load()) {
+		t.Errorf("Expected %d connections opened (server accepted %d), got %d", dials.Load(), accepted.Load(), result.ConnectionsOpened)
+	}
+	// 16 chunks over 2 kept-alive connections, plus the metadata requests'
+	if result.ConnectionsOpened == 0 || result.ConnectionsOpened >= result.ChunkCount {
+		t.Errorf("Expected connections to be reused across %d chunks, got %d opened", result.ChunkCount, result.ConnectionsOpened)
+	}
+}
+
+func TestHeadRetried(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	// The first two HEAD requests meet a momentary outage
+	var heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" && heads.Add(1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "payload.bin")
+	policy := &fixedRetryPolicy{max: 3, delay: time.Millisecond}
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 64 * 1024
+	downloader.RetryPolicy = policy
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("Downloaded file does not match payload: %v", err)
+	}
+	if n := heads.Load(); n != 3 {
+		t.Errorf("Expected the HEAD request to succeed on its third try, made %d", n)
+	}
+	if downloader.Result().SingleConnection {
+		t.Error("Expected a parallel download once HEAD succeeded")
+	}
+
+	// A client error isn't retried
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	downloader = NewAdaptiveDownloader(notFound.URL, filepath.Join(t.TempDir(), "missing.bin"))
+	downloader.RetryPolicy = DefaultRetryPolicy{MaxRetries: 3, BaseDelay: time.Hour}
+	var statusErr *HTTPStatusError
+	if err := downloader.Download(context.Background()); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the 404 to fail the download at once, got %v", err)
+	}
+}
+
+func TestHeadFallsBackToGet(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	tests := []struct {
+		name   string
+		ranges bool
+	}{
+		{"ranges", true},
+		{"no ranges", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The server refuses HEAD outright
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					http.Error(w, "no HEAD here", http.StatusMethodNotAllowed)
+					return
+				}
+				if !tt.ranges {
+					r.Header.Del("Range")
+				}
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			var output bytes.Buffer
+			path := filepath.Join(t.TempDir(), "payload.bin")
+			downloader := NewAdaptiveDownloader(server.URL, path)
+			downloader.ChunkSize = 64 * 1024
+			downloader.Output = &output
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("Downloaded file does not match payload: %v", err)
+			}
+			if downloader.FileSize != int64(len(payload)) {
+				t.Errorf("Expected the size from the GET, got %d", downloader.FileSize)
+			}
+			if single := downloader.Result().SingleConnection; single == tt.ranges {
+				t.Errorf("Expected SingleConnection %v, got %v", !tt.ranges, single)
+			}
+			if !strings.Contains(output.String(), "took the file's details from a GET instead") {
+				t.Errorf("Expected the fallback to be reported, got:\n%s", output.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package fasdownload
+
+import (
+	"context"
+	"sync"
+)
+
+// byteSemaphore caps the bytes held in chunk buffers across all connections.
+// A request larger than the cap is granted the whole cap, so callers size
+// their buffers by what acquire returns.
+type byteSemaphore struct {
+	limit int64
+	used  int64
+	peak  int64
+	freed chan struct{} // closed and replaced whenever bytes are released
+	mu    sync.Mutex
+}
+
+// newByteSemaphore returns a semaphore for limit bytes, or nil for unlimited
+func newByteSemaphore(limit int64) *byteSemaphore {
+	if limit <= 0 {
+		return nil
+	}
+	return &byteSemaphore{limit: limit, freed: make(chan struct{})}
+}
+
+// acquire blocks until up to n bytes are available and returns how many
+// were granted, which the caller must release
+func (s *byteSemaphore) acquire(ctx context.Context, n int64) (int64, error) {
+	if s == nil {
+		return n, nil
+	}
+	n = min(n, s.limit)
+
+	for {
+		s.mu.Lock()
+		if s.used+n <= s.limit {
+			s.used += n
+			s.peak = max(s.peak, s.used)
+			s.mu.Unlock()
+			return n, nil
+		}
+		freed := s.freed
+		s.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// release returns n acquired bytes and wakes the waiters
+func (s *byteSemaphore) release(n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
@@ -0,0 +1,72 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxInFlightBytes(t *testing.T) {
+	payload := testPayload(4 * 1024 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	// Eight connections of 1MB chunks would buffer 8MB without the cap
+	const limit = 256 * 1024
+	output := filepath.Join(t.TempDir(), "payload.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 1024 * 1024
+	downloader.CurrentConnections = 8
+	downloader.MaxConnections = 8
+	downloader.CoalesceWrites = true
+	downloader.MaxInFlightBytes = limit
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Downloaded file does not match payload")
+	}
+
+	sem := downloader.inFlight
+	if sem.peak == 0 || sem.peak > limit {
+		t.Errorf("Expected peak buffered bytes within (0, %d], got %d", limit, sem.peak)
+	}
+	if sem.used != 0 {
+		t.Errorf("Expected every buffer to be released, %d bytes still held", sem.used)
+	}
+}
+
+func TestByteSemaphoreWaits(t *testing.T) {
+	sem := newByteSemaphore(100)
+	if n, _ := sem.acquire(context.Background(), 250); n != 100 {
+		t.Fatalf("Expected an oversized request to be granted the cap, got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := sem.acquire(ctx, 1); err == nil {
+		t.Fatal("Expected acquire to block while the cap is used up")
+	}
+
+	done := make(chan int64)
+	go func() {
+		n, _ := sem.acquire(context.Background(), 60)
+		done <- n
+	}()
+	sem.release(100)
+	if n := <-done; n != 60 {
+		t.Errorf("Expected 60 bytes once released, got %d", n)
+	}
+}
@@ -0,0 +1,55 @@
+package fasdownload
+
+import (
+	"context"
+	"sync"
+)
+
+// requestSlots caps the chunk requests in flight across every
+// AdaptiveDownloader in the process; nil slots means no cap
+var requestSlots struct {
+	mu    sync.Mutex
+	slots chan struct{}
+}
+
+// SetMaxConcurrentRequests caps the chunk requests in flight at once across
+// every download in the process, so several downloads or a batch run
+// together can't open more connections than a server tolerates. Requests
+// over the cap wait for one to finish. n of 0 or less removes the cap.
+// Requests already running when it changes finish under the old one.
+func SetMaxConcurrentRequests(n int) {
+	requestSlots.mu.Lock()
+	defer requestSlots.mu.Unlock()
+	requestSlots.slots = nil
+	if n > 0 {
+		requestSlots.slots = make(chan struct{}, n)
+	}
+}
+
+// acquireRequestSlot waits for room under SetMaxConcurrentRequests and
+// returns the func that gives it back
+func acquireRequestSlot(ctx context.Context) (func(), error) {
+	requestSlots.mu.Lock()
+	slots := requestSlots.slots
+	requestSlots.mu.Unlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// connectionLimit returns the most connections the adaptive logic may use:
+// MaxConnections, held to MaxConnsPerHost when that is set. Over HTTP/2
+// the count is of streams, and the cap applies to the connections instead.
+func (d *AdaptiveDownloader) connectionLimit() int {
+	if d.MaxConnsPerHost > 0 && !d.http2() {
+		return max(min(d.MaxConnections, d.MaxConnsPerHost), 1)
+	}
+	return d.MaxConnections
+}
@@ -0,0 +1,93 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newConcurrencyServer serves payload slowly enough for requests to
+// overlap, recording the most GETs it was handling at once
+func newConcurrencyServer(t *testing.T, payload []byte, peak *atomic.Int32) *httptest.Server {
+	t.Helper()
+	var active atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			n := active.Add(1)
+			defer active.Add(-1)
+			for {
+				old := peak.Load()
+				if n <= old || peak.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	var peak atomic.Int32
+	server := newConcurrencyServer(t, payload, &peak)
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.ChunkSize = 32 * 1024
+	downloader.CurrentConnections = 8
+	downloader.MaxConnsPerHost = 2
+	downloader.AdaptInterval = 10 * time.Millisecond
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	if got := peak.Load(); got > 2 {
+		t.Errorf("Expected at most 2 requests at once, the server saw %d", got)
+	}
+	if downloader.CurrentConnections > 2 {
+		t.Errorf("Expected CurrentConnections held to 2, got %d", downloader.CurrentConnections)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	var peak atomic.Int32
+	server := newConcurrencyServer(t, payload, &peak)
+
+	SetMaxConcurrentRequests(3)
+	defer SetMaxConcurrentRequests(0)
+
+	// Three downloads of 4 connections each share the 3 slots
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			downloader := NewAdaptiveDownloader(server.URL, filepath.Join(dir, fmt.Sprintf("payload-%d.bin", i)))
+			downloader.ChunkSize = 32 * 1024
+			errs <- downloader.Download(context.Background())
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+	}
+
+	if got := peak.Load(); got > 3 {
+		t.Errorf("Expected at most 3 requests at once across downloads, the server saw %d", got)
+	}
+}
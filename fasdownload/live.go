@@ -0,0 +1,206 @@
+package fasdownload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// errLiveNoFile reports a live read of a download that isn't written to a file
+var errLiveNoFile = errors.New("live reads need an output file, not a stream or sink")
+
+// liveRanges tracks which bytes of the file are written while a download
+// runs, and wakes whoever is waiting for them each time more are
+type liveRanges struct {
+	mu   sync.Mutex
+	set  rangeSet
+	size int64 // the file's size, or 0 while it is not known
+
+	// changed is closed and replaced whenever the set grows or the
+	// download ends
+	changed chan struct{}
+	done    bool
+	err     error
+}
+
+// wake releases the current waiters; callers must hold mu
+func (l *liveRanges) wake() {
+	if l.changed != nil {
+		close(l.changed)
+	}
+	l.changed = make(chan struct{})
+}
+
+// reset starts tracking a new download with nothing written yet
+func (l *liveRanges) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.set = rangeSet{}
+	l.size = 0
+	l.done, l.err = false, nil
+	l.wake()
+}
+
+// setSize records the file's size, so waits are cut off at its end
+func (l *liveRanges) setSize(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.size = max(size, 0)
+	l.wake()
+}
+
+// add records bytes [start, end) as written
+func (l *liveRanges) add(start, end int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.set.add(start, end)
+	l.wake()
+}
+
+// finish records that the download ended, failing with err if not nil
+func (l *liveRanges) finish(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.done, l.err = true, err
+	l.wake()
+}
+
+// covers reports whether [start, end) is written; callers must hold mu
+func (l *liveRanges) covers(start, end int64) bool {
+	for _, r := range l.set.ranges {
+		if r.Start <= start && end <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until [start, end) is written, cut off at the end of the
+// file, or the download ends. Once it has ended successfully every byte
+// there is is written, so only a failure is returned.
+func (l *liveRanges) wait(ctx context.Context, start, end int64) error {
+	for {
+		l.mu.Lock()
+		if l.size > 0 {
+			end = min(end, l.size)
+		}
+		if end <= start || l.covers(start, end) || (l.done && l.err == nil) {
+			l.mu.Unlock()
+			return nil
+		}
+		if l.done {
+			err := l.err
+			l.mu.Unlock()
+			return fmt.Errorf("download failed before bytes %d-%d were written: %w", start, end-1, err)
+		}
+		if l.changed == nil {
+			l.changed = make(chan struct{})
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WaitForRange blocks until length bytes from offset have been written to
+// the file being downloaded, for a consumer reading it while it downloads.
+// Bytes count as written once the chunk holding them completes; a download
+// over a single connection has them all at once when it finishes. A range
+// running past the end of the file waits only for the bytes up to it.
+// WaitForRange returns a *TimeoutError when timeout (0 for none) elapses
+// first, and an error wrapping the download's own when it fails.
+func (d *AdaptiveDownloader) WaitForRange(ctx context.Context, offset, length int64, timeout time.Duration) error {
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := d.live.wait(waitCtx, offset, offset+length)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return &TimeoutError{Op: fmt.Sprintf("waiting for bytes %d-%d", offset, offset+length-1), Err: err}
+	}
+	return err
+}
+
+// LiveReader reads the file while it is still downloading, each read
+// waiting up to Timeout for the bytes it asks for to be written rather
+// than returning short. It suits sequential consumers of a download
+// fetched with ChunkPriorityHead, such as a media player.
+type LiveReader struct {
+	// Timeout bounds how long one read waits for its bytes; 0 waits for
+	// as long as the download runs
+	Timeout time.Duration
+
+	d      *AdaptiveDownloader
+	ctx    context.Context
+	offset int64
+	file   *os.File
+}
+
+// NewLiveReader returns a reader of the file d is downloading, starting at
+// its first byte. It may be created before Download is called; reads stop
+// waiting once ctx is done.
+func (d *AdaptiveDownloader) NewLiveReader(ctx context.Context, timeout time.Duration) *LiveReader {
+	return &LiveReader{Timeout: timeout, d: d, ctx: ctx}
+}
+
+// Read reads the next len(p) bytes, waiting for them to be written
+func (r *LiveReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes at off, waiting for them to be written
+func (r *LiveReader) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.d.WaitForRange(r.ctx, off, int64(len(p)), r.Timeout); err != nil {
+		return 0, err
+	}
+	if r.file == nil {
+		file, err := r.d.openLive()
+		if err != nil {
+			return 0, err
+		}
+		r.file = file
+	}
+	return r.file.ReadAt(p, off)
+}
+
+// Close closes the file the reader reads from
+func (r *LiveReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// openLive opens the file being downloaded for reading: the .part file
+// while it runs, or Filename once it has been renamed into place. An open
+// .part file keeps reading the same data after the rename. It is only
+// called once a wait has returned, after the download settled where it
+// writes.
+func (d *AdaptiveDownloader) openLive() (*os.File, error) {
+	if d.fileless() {
+		return nil, errLiveNoFile
+	}
+
+	file, err := os.Open(d.PartPath())
+	if os.IsNotExist(err) {
+		return os.Open(d.Filename)
+	}
+	return file, err
+}
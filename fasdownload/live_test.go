@@ -0,0 +1,112 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLiveReaderWaitsForChunks(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	// The first chunk is held back until the test releases it
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.Header.Get("Range") == "bytes=0-65535" {
+			<-release
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.ChunkSize = 64 * 1024
+	reader := downloader.NewLiveReader(context.Background(), 0)
+	defer reader.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- downloader.Download(context.Background()) }()
+
+	// The later chunks arrive while the first is held back
+	if err := downloader.WaitForRange(context.Background(), 192*1024, 64*1024, 5*time.Second); err != nil {
+		t.Fatalf("WaitForRange() for the last chunk returned error: %v", err)
+	}
+	err := downloader.WaitForRange(context.Background(), 0, 1024, 20*time.Millisecond)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected a *TimeoutError while the first chunk is held back, got %v", err)
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	read := make(chan result, 1)
+	go func() {
+		buf := make([]byte, 100*1024)
+		n, err := io.ReadFull(reader, buf)
+		read <- result{buf[:n], err}
+	}()
+
+	select {
+	case <-read:
+		t.Fatal("Expected the read to wait for the first chunk")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case got := <-read:
+		if got.err != nil {
+			t.Fatalf("Read returned error: %v", got.err)
+		}
+		if !bytes.Equal(got.data, payload[:100*1024]) {
+			t.Error("Expected the read to return the start of the payload")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the read to unblock once the first chunk was written")
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	// Reading on after the rename, up to the end of the file
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if !bytes.Equal(rest, payload[100*1024:]) {
+		t.Errorf("Expected the rest of the payload, got %d bytes", len(rest))
+	}
+}
+
+func TestLiveReaderDownloadFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	reader := downloader.NewLiveReader(context.Background(), 5*time.Second)
+	read := make(chan error, 1)
+	go func() {
+		_, err := reader.Read(make([]byte, 1024))
+		read <- err
+	}()
+
+	downloadErr := downloader.Download(context.Background())
+	if downloadErr == nil {
+		t.Fatal("Expected the download to fail")
+	}
+	var statusErr *HTTPStatusError
+	if err := <-read; !errors.As(err, &statusErr) {
+		t.Errorf("Expected the read to fail with the download's error, got %v", err)
+	}
+}
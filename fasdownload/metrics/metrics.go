@@ -0,0 +1,137 @@
+// Package metrics exposes downloads' progress as Prometheus metrics. It is
+// kept apart from fasdownload so programs that don't serve metrics don't
+// link the Prometheus client.
+package metrics
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"fas-download/fasdownload"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector for the downloads it tracks, read
+// from their DownloadStats each time it is scraped
+type Collector struct {
+	bytes      *prometheus.Desc
+	retries    *prometheus.Desc
+	active     *prometheus.Desc
+	throughput *prometheus.Desc
+
+	mu        sync.Mutex
+	downloads map[*fasdownload.AdaptiveDownloader]*tracked
+
+	// doneBytes and doneRetries carry the counts of downloads no longer
+	// tracked, so the counters never go down
+	doneBytes   int64
+	doneRetries int64
+}
+
+// tracked is what the collector keeps for one download
+type tracked struct {
+	// bytes and retries are totals across restarts, which set the
+	// download's own counts back to zero; last* are the counts last seen
+	bytes, lastBytes     int64
+	retries, lastRetries int64
+
+	// bytesPerSec holds the float64 bits of the latest throughput sample
+	bytesPerSec atomic.Uint64
+}
+
+// NewCollector returns a collector that tracks no downloads yet
+func NewCollector() *Collector {
+	return &Collector{
+		bytes: prometheus.NewDesc("fasdownload_downloaded_bytes_total",
+			"Bytes fetched from the network.", nil, nil),
+		retries: prometheus.NewDesc("fasdownload_retries_total",
+			"Requests retried after a failure.", nil, nil),
+		active: prometheus.NewDesc("fasdownload_active_connections",
+			"Chunks being fetched right now, one connection or stream each.", nil, nil),
+		throughput: prometheus.NewDesc("fasdownload_throughput_bytes_per_second",
+			"Download speed over the latest progress interval, summed across downloads.", nil, nil),
+		downloads: make(map[*fasdownload.AdaptiveDownloader]*tracked),
+	}
+}
+
+// Track adds d to the collector's metrics. It must be called before d's
+// Download starts, since it takes over ThroughputFunc, calling any func
+// already set in turn. The returned func stops tracking d once the
+// download is over, keeping its bytes and retries in the totals.
+func (c *Collector) Track(d *fasdownload.AdaptiveDownloader) (untrack func()) {
+	t := &tracked{}
+	next := d.ThroughputFunc
+	d.ThroughputFunc = func(sample fasdownload.ThroughputSample) {
+		t.bytesPerSec.Store(math.Float64bits(sample.BytesPerSec))
+		if next != nil {
+			next(sample)
+		}
+	}
+
+	c.mu.Lock()
+	c.downloads[d] = t
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			t.update(d)
+			c.doneBytes += t.bytes
+			c.doneRetries += t.retries
+			delete(c.downloads, d)
+		})
+	}
+}
+
+// update adds what d fetched and retried since the last call
+func (t *tracked) update(d *fasdownload.AdaptiveDownloader) {
+	t.bytes += growth(&t.lastBytes, d.Stats.Downloaded())
+	t.retries += growth(&t.lastRetries, int64(d.Stats.RetryCount()))
+}
+
+// growth returns how far count rose since *last and records it; a count
+// that went down was reset, so all of it is new
+func growth(last *int64, count int64) int64 {
+	grown := count - *last
+	if count < *last {
+		grown = count
+	}
+	*last = count
+	return grown
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bytes
+	ch <- c.retries
+	ch <- c.active
+	ch <- c.throughput
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	bytes, retries := c.doneBytes, c.doneRetries
+	active, bytesPerSec := 0, 0.0
+	for d, t := range c.downloads {
+		t.update(d)
+		bytes += t.bytes
+		retries += t.retries
+		for _, state := range d.ChunkStates() {
+			if state.Status == fasdownload.ChunkActive {
+				active++
+			}
+		}
+		bytesPerSec += math.Float64frombits(t.bytesPerSec.Load())
+	}
+	c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, float64(bytes))
+	ch <- prometheus.MustNewConstMetric(c.retries, prometheus.CounterValue, float64(retries))
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(active))
+	ch <- prometheus.MustNewConstMetric(c.throughput, prometheus.GaugeValue, bytesPerSec)
+}
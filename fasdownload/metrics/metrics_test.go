@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fas-download/fasdownload"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather returns each metric's value by family name
+func gather(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() returned error: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		metric := family.GetMetric()[0]
+		switch {
+		case metric.GetCounter() != nil:
+			values[family.GetName()] = metric.GetCounter().GetValue()
+		case metric.GetGauge() != nil:
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestCollectorTotals(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	collector := NewCollector()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	var samples int
+	dir := t.TempDir()
+	for _, name := range []string{"a.bin", "b.bin"} {
+		downloader := fasdownload.NewAdaptiveDownloader(server.URL+"/file.bin", filepath.Join(dir, name))
+		downloader.SmallFileThreshold = -1
+		downloader.ProgressInterval = time.Millisecond
+		downloader.ThroughputFunc = func(fasdownload.ThroughputSample) { samples++ }
+
+		untrack := collector.Track(downloader)
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		untrack()
+	}
+
+	// Finished downloads stay in the counters but not the gauges
+	values := gather(t, registry)
+	if got, want := values["fasdownload_downloaded_bytes_total"], float64(2*len(payload)); got != want {
+		t.Errorf("Expected %v bytes downloaded, got %v", want, got)
+	}
+	if got := values["fasdownload_retries_total"]; got != 0 {
+		t.Errorf("Expected no retries, got %v", got)
+	}
+	if got := values["fasdownload_active_connections"]; got != 0 {
+		t.Errorf("Expected no active connections, got %v", got)
+	}
+	if got := values["fasdownload_throughput_bytes_per_second"]; got != 0 {
+		t.Errorf("Expected no throughput once every download is done, got %v", got)
+	}
+	if samples == 0 {
+		t.Error("Expected an existing ThroughputFunc to still receive samples")
+	}
+}
+
+func TestGrowth(t *testing.T) {
+	var last int64
+	for _, tt := range []struct{ count, want int64 }{
+		{100, 100},
+		{250, 150},
+		{250, 0},
+		// A restart sets the count back to zero
+		{40, 40},
+		{90, 50},
+	} {
+		if got := growth(&last, tt.count); got != tt.want {
+			t.Errorf("growth to %d: expected %d, got %d", tt.count, tt.want, got)
+		}
+	}
+}
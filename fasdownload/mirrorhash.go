@@ -0,0 +1,100 @@
+package fasdownload
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// mirrorReplicas is how many points each source gets on the hash ring, so
+// chunks spread evenly and a source joining or leaving moves only its share
+const mirrorReplicas = 160
+
+// mirrorRing maps chunks to sources by consistent hashing. Sources are
+// placed by their configured URL rather than their position, so the same
+// byte range goes to the same source on every run with the same mirrors,
+// whatever their order.
+type mirrorRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint64
+	source int    // 0 for URL, i for Mirrors[i-1]
+	target string // where that source's requests go after redirects
+}
+
+// ringHash hashes key onto the ring
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV leaves similar keys close together; mix the bits so they spread
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// add places a source on the ring
+func (r *mirrorRing) add(source int, url, target string) {
+	for i := 0; i < mirrorReplicas; i++ {
+		r.points = append(r.points, ringPoint{hash: ringHash(fmt.Sprintf("%s#%d", url, i)), source: source, target: target})
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+}
+
+// pick returns the point owning the byte range start-end (inclusive): the
+// first at or after the range's hash, wrapping around
+func (r *mirrorRing) pick(start, end int64) ringPoint {
+	h := ringHash(fmt.Sprintf("%d-%d", start, end))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i]
+}
+
+// buildMirrorRing puts the current source and every mirror reporting the
+// file's size on the ring for MirrorHashing. Mirrors that fail the check
+// are left out, as failover would skip them.
+func (d *AdaptiveDownloader) buildMirrorRing(ctx context.Context) {
+	d.ring = nil
+	if !d.MirrorHashing || len(d.Mirrors) == 0 {
+		return
+	}
+
+	ring := &mirrorRing{}
+	current := d.sourceIndex()
+	for index := 0; index <= len(d.Mirrors); index++ {
+		url := d.urlAt(index)
+		if index == current {
+			ring.add(index, url, d.sourceURL())
+			continue
+		}
+		size, final, err := d.headSize(ctx, url)
+		if err != nil {
+			d.logf("Mirror %s unavailable: %v\n", url, err)
+			continue
+		}
+		if size != d.FileSize {
+			d.logf("Mirror %s reports %d bytes, expected %d; skipping it\n", url, size, d.FileSize)
+			continue
+		}
+		ring.add(index, url, final)
+	}
+	d.ring = ring
+	d.logf("Spreading chunks across %d sources by byte range\n", len(ring.points)/mirrorReplicas)
+}
+
+// chunkTarget returns the URL a chunk's requests go to under MirrorHashing,
+// or "" to use the current source
+func (d *AdaptiveDownloader) chunkTarget(chunk ChunkInfo) string {
+	if d.ring == nil {
+		return ""
+	}
+	return d.ring.pick(chunk.Start, chunk.End).target
+}
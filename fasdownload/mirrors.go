@@ -0,0 +1,145 @@
+package fasdownload
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// sourceIndex returns the index of the URL requests currently go to
+func (d *AdaptiveDownloader) sourceIndex() int {
+	d.sourceMu.Lock()
+	defer d.sourceMu.Unlock()
+	return d.source
+}
+
+// setSource points requests at URL (0) or Mirrors[index-1], forgetting
+// where the previous source redirected to
+func (d *AdaptiveDownloader) setSource(index int) {
+	d.sourceMu.Lock()
+	defer d.sourceMu.Unlock()
+	d.source = index
+	d.ResolvedURL = ""
+}
+
+// sourceURL returns the URL requests currently go to: where the current
+// source redirected to if known, otherwise the source itself
+func (d *AdaptiveDownloader) sourceURL() string {
+	target, _ := d.requestTarget()
+	return target
+}
+
+// requestTarget returns the URL requests currently go to and the configured
+// URL it was resolved from
+func (d *AdaptiveDownloader) requestTarget() (target, origin string) {
+	d.sourceMu.Lock()
+	defer d.sourceMu.Unlock()
+	origin = d.urlAt(d.source)
+	if d.ResolvedURL != "" {
+		return d.ResolvedURL, origin
+	}
+	return origin, origin
+}
+
+// resolve records the URL a metadata request ended up at after redirects,
+// so later requests go there directly instead of redirecting every time
+func (d *AdaptiveDownloader) resolve(final *url.URL) {
+	d.sourceMu.Lock()
+	defer d.sourceMu.Unlock()
+	d.setResolvedLocked(final.String())
+}
+
+// setResolvedLocked sets ResolvedURL, or clears it when final is the source
+// itself; callers must hold d.sourceMu
+func (d *AdaptiveDownloader) setResolvedLocked(final string) {
+	origin := d.urlAt(d.source)
+	if final == origin {
+		d.ResolvedURL = ""
+		return
+	}
+	if final != d.ResolvedURL {
+		d.logf("Resolved %s to %s\n", origin, final)
+	}
+	d.ResolvedURL = final
+}
+
+// urlAt returns URL for index 0 and Mirrors[index-1] otherwise
+func (d *AdaptiveDownloader) urlAt(index int) string {
+	if index == 0 {
+		return d.URL
+	}
+	return d.Mirrors[index-1]
+}
+
+// getFileSizeWithFailover runs getFileSize against URL, then each mirror in
+// turn until one answers
+func (d *AdaptiveDownloader) getFileSizeWithFailover(ctx context.Context) (bool, error) {
+	supportsRanges, err := d.getFileSize(ctx)
+	for index := 1; err != nil && !errors.Is(err, ErrNotModified) && ctx.Err() == nil && index <= len(d.Mirrors); index++ {
+		d.logf("HEAD request to %s failed: %v; trying mirror %s\n", d.urlAt(index-1), err, d.urlAt(index))
+		d.setSource(index)
+		supportsRanges, err = d.getFileSize(ctx)
+	}
+	return supportsRanges, err
+}
+
+// failover moves requests off the source at index from after a request to
+// it failed for good. It reports whether the request should be tried
+// again: either another chunk already switched sources, or a later mirror
+// reports the same size as the file being downloaded. The lock is held
+// while mirrors are checked so concurrent failures switch only once.
+func (d *AdaptiveDownloader) failover(ctx context.Context, from int) bool {
+	d.sourceMu.Lock()
+	defer d.sourceMu.Unlock()
+
+	if d.source != from {
+		return true
+	}
+	for index := from + 1; index <= len(d.Mirrors) && ctx.Err() == nil; index++ {
+		url := d.urlAt(index)
+		size, final, err := d.headSize(ctx, url)
+		if err != nil {
+			d.logf("Mirror %s unavailable: %v\n", url, err)
+			continue
+		}
+		if size != d.FileSize {
+			d.logf("Mirror %s reports %d bytes, expected %d; skipping it\n", url, size, d.FileSize)
+			continue
+		}
+		d.logf("Switching to mirror %s\n", url)
+		d.source = index
+		d.setResolvedLocked(final)
+
+		// Errors from the old source say nothing about the new one
+		d.burst.reset()
+		return true
+	}
+	return false
+}
+
+// headSize returns the Content-Length url reports, or -1 if it reports none,
+// and the URL it redirects to
+func (d *AdaptiveDownloader) headSize(ctx context.Context, url string) (int64, string, error) {
+	req, err := d.newRequestTo(ctx, "HEAD", url)
+	if err != nil {
+		return 0, "", err
+	}
+
+	resp, err := d.newClient(d.HeadTimeout, d.MaxHeadRedirects).Do(req)
+	if err != nil {
+		return 0, "", wrapTimeout("HEAD request", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", newHTTPStatusError(resp)
+	}
+	final := resp.Request.URL.String()
+	contentLength := resp.Header.Get("Content-Length")
+	if contentLength == "" {
+		return -1, final, nil
+	}
+	size, err := parseContentLength(contentLength)
+	return size, final, err
+}
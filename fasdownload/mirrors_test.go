@@ -0,0 +1,196 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorFailover(t *testing.T) {
+	payload := testPayload(8*1024*1024 + 4321)
+
+	t.Run("HEAD fails on primary", func(t *testing.T) {
+		primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusInternalServerError)
+		}))
+		defer primary.Close()
+		mirror := newPayloadServer(t, payload)
+
+		output := filepath.Join(t.TempDir(), "mirror.bin")
+		downloader := NewAdaptiveDownloader(primary.URL, output)
+		downloader.Mirrors = []string{mirror.URL}
+		downloader.RetryPolicy = &fixedRetryPolicy{max: 1, delay: time.Millisecond}
+
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("Downloaded file does not match payload")
+		}
+	})
+
+	t.Run("chunks fail on primary", func(t *testing.T) {
+		// The primary serves HEAD and the first few chunks, then only 500s
+		var served atomic.Int32
+		primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" && served.Add(1) > 3 {
+				http.Error(w, "down", http.StatusInternalServerError)
+				return
+			}
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+		}))
+		defer primary.Close()
+
+		// A mirror with a different size must be skipped
+		wrongSize := newPayloadServer(t, payload[:1024])
+
+		var mirrorGets atomic.Int32
+		mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				mirrorGets.Add(1)
+			}
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+		}))
+		defer mirror.Close()
+
+		output := filepath.Join(t.TempDir(), "mirror.bin")
+		downloader := NewAdaptiveDownloader(primary.URL, output)
+		downloader.Mirrors = []string{wrongSize.URL, mirror.URL}
+		downloader.RetryPolicy = &fixedRetryPolicy{max: 1, delay: time.Millisecond}
+
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("Downloaded file does not match payload")
+		}
+
+		// Chunks finished on the primary are kept, not fetched again
+		chunks := int32(downloader.Stats.Chunks)
+		if n := mirrorGets.Load(); n == 0 || n >= chunks {
+			t.Errorf("Expected the mirror to serve some but not all of %d chunks, served %d", chunks, n)
+		}
+	})
+
+	t.Run("no usable mirror", func(t *testing.T) {
+		primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusInternalServerError)
+		}))
+		defer primary.Close()
+
+		downloader := NewAdaptiveDownloader(primary.URL, filepath.Join(t.TempDir(), "mirror.bin"))
+		downloader.Mirrors = []string{primary.URL + "/other"}
+		downloader.RetryPolicy = &fixedRetryPolicy{max: 1, delay: time.Millisecond}
+
+		if err := downloader.Download(context.Background()); err == nil {
+			t.Fatal("Expected an error when every source fails")
+		}
+	})
+}
+
+func TestMirrorHashing(t *testing.T) {
+	payload := testPayload(1024 * 1024)
+
+	// Each server records the ranges it was asked for
+	type source struct {
+		server *httptest.Server
+		mu     sync.Mutex
+		ranges map[string]bool
+	}
+	sources := make([]*source, 4)
+	for i := range sources {
+		s := &source{ranges: make(map[string]bool)}
+		s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				s.mu.Lock()
+				s.ranges[r.Header.Get("Range")] = true
+				s.mu.Unlock()
+			}
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+		}))
+		defer s.server.Close()
+		sources[i] = s
+	}
+
+	// run downloads from the first source with the rest of urls as mirrors
+	// and returns which source served each range
+	run := func(urls []string) map[string]string {
+		for _, s := range sources {
+			s.mu.Lock()
+			clear(s.ranges)
+			s.mu.Unlock()
+		}
+		output := filepath.Join(t.TempDir(), "payload.bin")
+		downloader := NewAdaptiveDownloader(urls[0], output)
+		downloader.Mirrors = urls[1:]
+		downloader.MirrorHashing = true
+		downloader.ChunkSize = 16 * 1024
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		if got, err := os.ReadFile(output); err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("Downloaded file does not match payload: %v", err)
+		}
+
+		served := make(map[string]string)
+		for _, s := range sources {
+			for r := range s.ranges {
+				served[r] = s.server.URL
+			}
+		}
+		return served
+	}
+
+	urls := []string{sources[0].server.URL, sources[1].server.URL, sources[2].server.URL}
+	first := run(urls)
+	if len(first) != 64 {
+		t.Fatalf("Expected 64 ranges, got %d", len(first))
+	}
+	counts := make(map[string]int)
+	for _, url := range first {
+		counts[url]++
+	}
+	for _, url := range urls {
+		if counts[url] == 0 {
+			t.Errorf("Expected chunks spread across every source, got %v", counts)
+		}
+	}
+
+	// The same mirrors, in any order, map every range the same way
+	again := run([]string{urls[0], urls[2], urls[1]})
+	for r, url := range first {
+		if again[r] != url {
+			t.Errorf("Range %s went to %s, then %s", r, url, again[r])
+		}
+	}
+
+	// Another mirror only takes over its own share
+	grown := run(append(urls, sources[3].server.URL))
+	moved := 0
+	for r, url := range first {
+		if grown[r] != url {
+			if grown[r] != sources[3].server.URL {
+				t.Errorf("Range %s moved from %s to %s, not the new mirror", r, url, grown[r])
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 32 {
+		t.Errorf("Expected about a quarter of the ranges to move to the new mirror, %d did", moved)
+	}
+}
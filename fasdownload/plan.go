@@ -0,0 +1,90 @@
+package fasdownload
+
+import (
+	"context"
+	"time"
+)
+
+// DownloadPlan is what Download would do, worked out from the HEAD request
+// alone
+type DownloadPlan struct {
+	// URL is where requests would go after redirects and mirror failover
+	URL string
+	// Filename is the output path, including a Content-Disposition name
+	// when AutoFilename is set
+	Filename string
+	// FileSize is -1 when the server doesn't report it
+	FileSize       int64
+	SupportsRanges bool
+	Protocol       string
+	// ChunkSize, Chunks and Connections describe the parallel download;
+	// a single-connection download has ChunkSize 0 and one chunk. Chunks
+	// only cover bytes a checkpoint doesn't already have (Resumed).
+	ChunkSize   int64
+	Chunks      int
+	Connections int
+	Resumed     int64
+	// LastModified is the server's Last-Modified time, zero when it sent
+	// none that parses
+	LastModified time.Time
+}
+
+// Plan makes the HEAD request (and range probe) a download starts with and
+// reports the resulting plan without fetching any data or touching the
+// output file
+func (d *AdaptiveDownloader) Plan(ctx context.Context) (*DownloadPlan, error) {
+	if err := d.prepare(); err != nil {
+		return nil, err
+	}
+	if err := d.applyTrailingSlash(); err != nil {
+		return nil, err
+	}
+	if d.isFTP() {
+		if err := d.ftpStat(ctx); err != nil {
+			return nil, err
+		}
+		return &DownloadPlan{URL: d.URL, Filename: d.Filename, FileSize: d.FileSize, Protocol: d.Protocol, Chunks: 1, Connections: 1}, nil
+	}
+	d.setSource(0)
+	supportsRanges, err := d.getFileSizeWithFailover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkSandbox(); err != nil {
+		return nil, err
+	}
+
+	url := d.ResolvedURL
+	if url == "" {
+		url = d.sourceURL()
+	}
+	plan := &DownloadPlan{
+		URL:            url,
+		Filename:       d.Filename,
+		FileSize:       d.FileSize,
+		SupportsRanges: supportsRanges,
+		Protocol:       d.Protocol,
+		Chunks:         1,
+		Connections:    1,
+	}
+	if modified, ok := parseHTTPTime(d.lastModified); ok {
+		plan.LastModified = modified
+	}
+	d.detectDelta(supportsRanges)
+	if d.singleConnection(supportsRanges) {
+		return plan, nil
+	}
+
+	completed, err := d.loadCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	plan.Resumed = completed.total()
+	plan.ChunkSize = d.effectiveChunkSize()
+	plan.Chunks = len(planChunks(completed.missing(d.FileSize), plan.ChunkSize))
+	plan.Connections = d.CurrentConnections
+	if d.http2() {
+		_, plan.Connections = d.http2Concurrency()
+	}
+	return plan, nil
+}
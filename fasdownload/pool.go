@@ -0,0 +1,141 @@
+package fasdownload
+
+import (
+	"context"
+	"sync"
+)
+
+// workerPool runs chunk workers and grows or shrinks to match a target count.
+// The first failing chunk cancels the pool's context so every other worker
+// stops instead of carrying on around the gap.
+type workerPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	chunks <-chan ChunkInfo
+	work   func(context.Context, ChunkInfo) error
+	// hold, when set, blocks a worker before it picks up each chunk
+	hold   func(context.Context) error
+	stop   chan struct{}
+	errs   chan error
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	target int
+	live   int
+}
+
+// newWorkerPool creates a pool that feeds chunks to work under a context
+// derived from ctx
+func newWorkerPool(ctx context.Context, chunks <-chan ChunkInfo, maxWorkers int, work func(context.Context, ChunkInfo) error) *workerPool {
+	ctx, cancel := context.WithCancel(ctx)
+	return &workerPool{
+		ctx:    ctx,
+		cancel: cancel,
+		chunks: chunks,
+		work:   work,
+		stop:   make(chan struct{}, maxWorkers),
+		errs:   make(chan error, 1),
+	}
+}
+
+// start launches the initial set of workers
+func (p *workerPool) start(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		p.spawn()
+	}
+}
+
+// resize spawns or stops workers until the target matches n.
+// It is a no-op once every worker has exited.
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.live == 0 {
+		return
+	}
+
+	for p.target < n {
+		p.spawn()
+	}
+	for p.target > n {
+		select {
+		case p.stop <- struct{}{}:
+			p.target--
+		default:
+			return
+		}
+	}
+}
+
+// spawn starts one worker; callers must hold p.mu
+func (p *workerPool) spawn() {
+	p.target++
+	p.live++
+	p.wg.Add(1)
+	go p.run()
+}
+
+// run pulls chunks until the channel drains, a stop signal arrives, the
+// pool is cancelled, or work fails
+func (p *workerPool) run() {
+	defer func() {
+		p.mu.Lock()
+		p.live--
+		p.mu.Unlock()
+		p.wg.Done()
+	}()
+
+	for {
+		if p.hold != nil && p.hold(p.ctx) != nil {
+			return
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-p.ctx.Done():
+			return
+		case chunk, ok := <-p.chunks:
+			if !ok {
+				return
+			}
+			if err := p.ctx.Err(); err != nil {
+				return
+			}
+			if err := p.work(p.ctx, chunk); err != nil {
+				// Keep the first error; later ones are usually just the
+				// cancellation it caused
+				select {
+				case p.errs <- err:
+				default:
+				}
+				p.cancel()
+				return
+			}
+		}
+	}
+}
+
+// active returns the number of worker goroutines currently running
+func (p *workerPool) active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.live
+}
+
+// wait blocks until all workers exit and returns the first error, if any.
+// Workers that stopped because the parent context was cancelled report
+// that cancellation.
+func (p *workerPool) wait() error {
+	p.wg.Wait()
+	defer p.cancel()
+
+	select {
+	case err := <-p.errs:
+		return err
+	default:
+		return p.ctx.Err()
+	}
+}
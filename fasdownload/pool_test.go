@@ -0,0 +1,52 @@
+package fasdownload
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolFollowsConnections(t *testing.T) {
+	clock := &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	SetClock(clock)
+	t.Cleanup(func() { SetClock(nil) })
+
+	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+
+	// An open, empty channel keeps workers idle so only resizing changes the count
+	chunks := make(chan ChunkInfo)
+	pool := newWorkerPool(context.Background(), chunks, downloader.MaxConnections, func(context.Context, ChunkInfo) error { return nil })
+	downloader.pool = pool
+	pool.start(downloader.CurrentConnections)
+
+	waitForWorkers := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for pool.active() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d live workers, got %d", want, pool.active())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitForWorkers(4)
+
+	// Probing for more throughput should add a worker
+	downloader.calculateOptimalConnections()
+	feedThroughput(downloader, clock, 40*1024*1024)
+	waitForWorkers(5)
+
+	// Throughput falling with it should remove one
+	feedThroughput(downloader, clock, 30*1024*1024)
+	waitForWorkers(4)
+
+	if downloader.CurrentConnections != pool.active() {
+		t.Errorf("Expected live workers to match CurrentConnections %d, got %d", downloader.CurrentConnections, pool.active())
+	}
+
+	close(chunks)
+	if err := pool.wait(); err != nil {
+		t.Errorf("wait() returned error: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package fasdownload
+
+import "time"
+
+// Progress is a snapshot of a running download passed to ProgressFunc
+type Progress struct {
+	// Downloaded counts bytes on disk so far, including resumed ones
+	Downloaded int64
+	// Total is the file size, or -1 if unknown
+	Total int64
+	// BytesPerSec is the average speed since the download started
+	BytesPerSec float64
+	// ETA is the estimated time remaining at the recent speed; 0 when the
+	// size is unknown or nothing has arrived lately
+	ETA time.Duration
+}
+
+// etaWindow is how far back the recent speed behind the ETA looks
+const etaWindow = 5 * time.Second
+
+// speedSample is the byte count seen at a point in time
+type speedSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// speedWindow tracks throughput over the last span so an ETA follows the
+// current speed instead of lagging behind the whole-download average
+type speedWindow struct {
+	span    time.Duration
+	samples []speedSample
+}
+
+// add records the running byte total at time at, dropping samples that
+// are no longer needed: the oldest one kept is the newest at least span old
+func (w *speedWindow) add(at time.Time, bytes int64) {
+	w.samples = append(w.samples, speedSample{at: at, bytes: bytes})
+	for len(w.samples) > 2 && at.Sub(w.samples[1].at) >= w.span {
+		w.samples = w.samples[1:]
+	}
+}
+
+// rate returns the bytes per second across the window
+func (w *speedWindow) rate() float64 {
+	if len(w.samples) < 2 {
+		return 0
+	}
+	first, last := w.samples[0], w.samples[len(w.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+// minSpeedElapsed is the least time an average speed is computed over; a
+// tick that fires right after the start would otherwise divide by nearly
+// nothing and report a wildly high, infinite or NaN speed
+const minSpeedElapsed = time.Millisecond
+
+// averageSpeed returns bytes per second over elapsed, or 0 until some bytes
+// have arrived over a measurable time
+func averageSpeed(bytes int64, elapsed time.Duration) float64 {
+	if bytes <= 0 || elapsed < minSpeedElapsed {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+// estimateETA returns how long remaining bytes take at speed bytes per
+// second, or 0 if that can't be estimated
+func estimateETA(remaining int64, speed float64) time.Duration {
+	if remaining <= 0 || speed <= 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / speed * float64(time.Second))
+}
@@ -0,0 +1,107 @@
+package fasdownload
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpeedWindow(t *testing.T) {
+	start := time.Unix(0, 0)
+	w := &speedWindow{span: 5 * time.Second}
+
+	// 10 seconds at 1 MB/s, then 5 seconds at 4 MB/s
+	var total int64
+	w.add(start, 0)
+	for s := 1; s <= 15; s++ {
+		if s <= 10 {
+			total += 1 << 20
+		} else {
+			total += 4 << 20
+		}
+		w.add(start.Add(time.Duration(s)*time.Second), total)
+	}
+
+	// The window has forgotten the slow start that the overall average
+	// still reflects
+	if got, want := w.rate(), float64(4<<20); got != want {
+		t.Errorf("rate() = %.0f, want %.0f", got, want)
+	}
+	if len(w.samples) > 7 {
+		t.Errorf("Expected old samples to be dropped, kept %d", len(w.samples))
+	}
+
+	// A burst inside the window is smoothed across it
+	w.add(start.Add(15500*time.Millisecond), total+10<<20)
+	if got := w.rate(); got >= float64(10<<20) {
+		t.Errorf("Expected the burst to be averaged over the window, got %.0f B/s", got)
+	}
+}
+
+func TestEstimateETA(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining int64
+		speed     float64
+		want      time.Duration
+	}{
+		{"steady", 83 << 20, 1 << 20, 83 * time.Second},
+		{"fraction", 1 << 19, 1 << 20, 500 * time.Millisecond},
+		{"stalled", 1 << 20, 0, 0},
+		{"done", 0, 1 << 20, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateETA(tt.remaining, tt.speed); got != tt.want {
+				t.Errorf("estimateETA(%d, %.0f) = %v, want %v", tt.remaining, tt.speed, got, tt.want)
+			}
+		})
+	}
+
+	if got := estimateETA(83<<20, 1<<20).String(); got != "1m23s" {
+		t.Errorf("Expected ETA to print as 1m23s, got %s", got)
+	}
+}
+
+func TestAverageSpeedGuards(t *testing.T) {
+	tests := []struct {
+		name    string
+		bytes   int64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"zero elapsed and bytes", 0, 0, 0},
+		{"zero elapsed", 1 << 20, 0, 0},
+		{"sub-millisecond elapsed", 1 << 20, 500 * time.Microsecond, 0},
+		{"clock went backwards", 1 << 20, -time.Second, 0},
+		{"zero bytes", 0, time.Second, 0},
+		{"steady", 2 << 20, 2 * time.Second, 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			speed := averageSpeed(tt.bytes, tt.elapsed)
+			if math.IsNaN(speed) || math.IsInf(speed, 0) || speed != tt.want {
+				t.Fatalf("averageSpeed(%d, %v) = %v, want %v", tt.bytes, tt.elapsed, speed, tt.want)
+			}
+
+			// Neither the progress line nor a JSON progress event may carry
+			// NaN or Inf
+			var out bytes.Buffer
+			downloader := NewAdaptiveDownloader("https://example.com/file.zip", "file.zip")
+			downloader.Output = &out
+			p := Progress{Downloaded: tt.bytes, Total: 4 << 20, BytesPerSec: speed, ETA: estimateETA(4<<20-tt.bytes, speed)}
+			downloader.printProgress(p)
+			if line := out.String(); strings.Contains(line, "NaN") || strings.Contains(line, "Inf") {
+				t.Errorf("Expected finite progress, got %q", line)
+			}
+			if _, err := json.Marshal(p); err != nil {
+				t.Errorf("Expected progress to encode as JSON: %v", err)
+			}
+		})
+	}
+}
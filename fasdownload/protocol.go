@@ -0,0 +1,74 @@
+package fasdownload
+
+import "net/http"
+
+// Defaults for the HTTP/2 concurrency model
+const (
+	DefaultHTTP2Connections = 1
+	DefaultHTTP2Streams     = 16
+)
+
+// http2 reports whether the server negotiated HTTP/2 on the first request
+func (d *AdaptiveDownloader) http2() bool {
+	return d.Protocol == "HTTP/2.0"
+}
+
+// configureConcurrency picks the concurrency model for the negotiated
+// protocol and creates the clients chunks are fetched with. Over HTTP/1.1
+// every worker has its own connection, so the connection count is the
+// concurrency; one client pools them all, and each chunk reuses an idle
+// connection instead of paying for a new TCP and TLS handshake. HTTP/2
+// multiplexes streams, so more requests run at once over a few shared
+// connections: extra TCP connections would only compete with each other
+// for congestion window.
+func (d *AdaptiveDownloader) configureConcurrency() {
+	if !d.http2() {
+		d.clients = []*http.Client{d.newClient(d.Timeout, d.MaxGetRedirects)}
+		d.mu.Lock()
+		d.CurrentConnections = min(d.CurrentConnections, d.connectionLimit())
+		d.mu.Unlock()
+		return
+	}
+
+	connections, streams := d.http2Concurrency()
+	if d.MaxConnsPerHost > 0 {
+		connections = min(connections, d.MaxConnsPerHost)
+	}
+	d.clients = make([]*http.Client, connections)
+	for i := range d.clients {
+		d.clients[i] = d.newClient(d.Timeout, d.MaxGetRedirects)
+	}
+
+	d.mu.Lock()
+	d.CurrentConnections = streams
+	d.MaxConnections = max(d.MaxConnections, streams)
+	d.mu.Unlock()
+	d.logf("Server negotiated HTTP/2: %d streams over %d connections\n", streams, connections)
+}
+
+// http2Concurrency returns the HTTP/2 connection and stream counts
+func (d *AdaptiveDownloader) http2Concurrency() (connections, streams int) {
+	connections = d.HTTP2Connections
+	if connections <= 0 {
+		connections = DefaultHTTP2Connections
+	}
+	streams = d.HTTP2Streams
+	if streams <= 0 {
+		streams = DefaultHTTP2Streams
+	}
+	return connections, max(streams, connections)
+}
+
+// chunkClient returns the shared client a chunk is fetched with, spreading
+// chunks across the HTTP/2 connections
+func (d *AdaptiveDownloader) chunkClient(chunk ChunkInfo) *http.Client {
+	return d.clients[chunk.Index%len(d.clients)]
+}
+
+// closeIdleConnections closes the connections the shared clients kept open
+// once a download is over
+func (d *AdaptiveDownloader) closeIdleConnections() {
+	for _, client := range d.clients {
+		client.CloseIdleConnections()
+	}
+}
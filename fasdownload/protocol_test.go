@@ -0,0 +1,151 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyByProtocol(t *testing.T) {
+	payload := testPayload(4 * 1024 * 1024)
+
+	// Record the distinct client connections and the peak number of requests
+	// in flight at once
+	var mu sync.Mutex
+	conns := map[string]bool{}
+	var inFlight, peak atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			conns[r.RemoteAddr] = true
+			mu.Unlock()
+
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	})
+
+	download := func(t *testing.T, server *httptest.Server) *AdaptiveDownloader {
+		t.Helper()
+		mu.Lock()
+		clear(conns)
+		mu.Unlock()
+		peak.Store(0)
+
+		output := filepath.Join(t.TempDir(), "proto.bin")
+		downloader := NewAdaptiveDownloader(server.URL, output)
+		downloader.tlsConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+		downloader.ChunkSize = 64 * 1024
+		downloader.HTTP2Streams = 12
+
+		if err := downloader.Download(context.Background()); err != nil {
+			t.Fatalf("Download() returned error: %v", err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("Downloaded file does not match payload")
+		}
+		return downloader
+	}
+
+	t.Run("HTTP/1.1", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(handler)
+		server.StartTLS()
+		defer server.Close()
+
+		downloader := download(t, server)
+		if downloader.Protocol != "HTTP/1.1" {
+			t.Fatalf("Expected HTTP/1.1, got %s", downloader.Protocol)
+		}
+		if p := peak.Load(); p > int32(downloader.MaxConnections) {
+			t.Errorf("Expected at most %d requests in flight, got %d", downloader.MaxConnections, p)
+		}
+		if n := len(conns); n < 4 {
+			t.Errorf("Expected a connection per worker, got %d connections", n)
+		}
+	})
+
+	t.Run("HTTP/2", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(handler)
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		downloader := download(t, server)
+		if downloader.Protocol != "HTTP/2.0" {
+			t.Fatalf("Expected HTTP/2.0, got %s", downloader.Protocol)
+		}
+		if downloader.CurrentConnections < 12 {
+			t.Errorf("Expected at least 12 concurrent streams, got %d", downloader.CurrentConnections)
+		}
+		if p := peak.Load(); p <= 4 {
+			t.Errorf("Expected more than 4 streams in flight, got %d", p)
+		}
+
+		// Every chunk is a stream on the one shared connection
+		if n := len(conns); n != 1 {
+			t.Errorf("Expected chunks multiplexed over 1 connection, got %d", n)
+		}
+	})
+}
+
+// BenchmarkChunkClients fetches 64KB chunks over TLS with a new client per
+// chunk, as chunks used to be fetched, and with the shared client
+func BenchmarkChunkClients(b *testing.B) {
+	payload := testPayload(1024 * 1024)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	const chunk = 64 * 1024
+	run := func(b *testing.B, perChunk bool) {
+		file, err := os.Create(filepath.Join(b.TempDir(), "payload.bin"))
+		if err != nil {
+			b.Fatalf("Failed to create file: %v", err)
+		}
+		defer file.Close()
+
+		downloader := NewAdaptiveDownloader(server.URL, file.Name())
+		downloader.tlsConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+		downloader.configureConcurrency()
+		defer downloader.closeIdleConnections()
+
+		b.SetBytes(chunk)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			client := downloader.chunkClient(ChunkInfo{Index: i})
+			if perChunk {
+				client = downloader.newClient(downloader.Timeout, downloader.MaxGetRedirects)
+			}
+			start := int64(i%(len(payload)/chunk)) * chunk
+			if _, err := downloader.fetchRange(context.Background(), client, "", start, start+chunk-1, fileSink{file}); err != nil {
+				b.Fatalf("fetchRange() returned error: %v", err)
+			}
+			if perChunk {
+				client.CloseIdleConnections()
+			}
+		}
+	}
+
+	b.Run("per-chunk", func(b *testing.B) { run(b, true) })
+	b.Run("shared", func(b *testing.B) { run(b, false) })
+}
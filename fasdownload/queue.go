@@ -0,0 +1,127 @@
+package fasdownload
+
+import (
+	"context"
+	"sync"
+)
+
+// ChunkPriority controls the order chunks are dispatched in, so a program
+// reading the file while it downloads finds the parts it needs sooner
+type ChunkPriority string
+
+const (
+	// ChunkPriorityHead fetches from the start of the file to the end
+	ChunkPriorityHead ChunkPriority = "head"
+	// ChunkPriorityTail fetches from the end of the file first, for formats
+	// such as zip that keep their index at the end
+	ChunkPriorityTail ChunkPriority = "tail"
+	// ChunkPriorityEdges alternates between both ends and works inward
+	ChunkPriorityEdges ChunkPriority = "edges"
+)
+
+// orderChunks returns chunks, which are in file order, in the order
+// priority dispatches them
+func orderChunks(chunks []ChunkInfo, priority ChunkPriority) []ChunkInfo {
+	ordered := make([]ChunkInfo, 0, len(chunks))
+	switch priority {
+	case ChunkPriorityTail:
+		for i := len(chunks) - 1; i >= 0; i-- {
+			ordered = append(ordered, chunks[i])
+		}
+	case ChunkPriorityEdges:
+		for i, j := 0, len(chunks)-1; i <= j; i, j = i+1, j-1 {
+			ordered = append(ordered, chunks[i])
+			if i != j {
+				ordered = append(ordered, chunks[j])
+			}
+		}
+	default:
+		ordered = append(ordered, chunks...)
+	}
+	return ordered
+}
+
+// chunkQueue hands out planned chunks in order. Chunks that haven't been
+// handed out yet can still be re-split, so the plan can adapt mid-download.
+type chunkQueue struct {
+	mu        sync.Mutex
+	pending   []ChunkInfo
+	nextIndex int
+}
+
+// newChunkQueue queues chunks, numbering any later splits after them
+func newChunkQueue(chunks []ChunkInfo) *chunkQueue {
+	next := 0
+	for _, chunk := range chunks {
+		next = max(next, chunk.Index+1)
+	}
+	return &chunkQueue{pending: append([]ChunkInfo(nil), chunks...), nextIndex: next}
+}
+
+// pop removes and returns the next chunk
+func (q *chunkQueue) pop() (ChunkInfo, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return ChunkInfo{}, false
+	}
+	chunk := q.pending[0]
+	q.pending = q.pending[1:]
+	return chunk, true
+}
+
+// resplit cuts every pending chunk larger than size into pieces of at most
+// size bytes, keeping their order, and returns how many chunks were added
+func (q *chunkQueue) resplit(size int64) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	added := 0
+	split := make([]ChunkInfo, 0, len(q.pending))
+	for _, chunk := range q.pending {
+		if chunk.End-chunk.Start+1 <= size {
+			split = append(split, chunk)
+			continue
+		}
+		for start := chunk.Start; start <= chunk.End; start += size {
+			piece := ChunkInfo{Start: start, End: min(start+size-1, chunk.End), Index: chunk.Index}
+			if start != chunk.Start {
+				piece.Index = q.nextIndex
+				q.nextIndex++
+				added++
+			}
+			split = append(split, piece)
+		}
+	}
+	q.pending = split
+	return added
+}
+
+// snapshot returns a copy of the chunks not yet handed out
+func (q *chunkQueue) snapshot() []ChunkInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]ChunkInfo(nil), q.pending...)
+}
+
+// feed sends queued chunks on the returned channel until the queue is empty
+// or ctx is done, then closes it
+func (q *chunkQueue) feed(ctx context.Context) <-chan ChunkInfo {
+	ch := make(chan ChunkInfo)
+	go func() {
+		defer close(ch)
+		for {
+			chunk, ok := q.pop()
+			if !ok {
+				return
+			}
+			select {
+			case ch <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,128 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChunkQueueResplit(t *testing.T) {
+	queue := newChunkQueue(planChunks([]byteRange{{0, 40}}, 20))
+
+	first, _ := queue.pop()
+	if first != (ChunkInfo{Start: 0, End: 19, Index: 0}) {
+		t.Fatalf("Expected the first chunk, got %v", first)
+	}
+
+	// Only the pending chunk is split; new pieces are numbered after the plan
+	if added := queue.resplit(8); added != 2 {
+		t.Errorf("Expected 2 chunks added, got %d", added)
+	}
+
+	var rest []ChunkInfo
+	for {
+		chunk, ok := queue.pop()
+		if !ok {
+			break
+		}
+		rest = append(rest, chunk)
+	}
+
+	want := []ChunkInfo{
+		{Start: 20, End: 27, Index: 1},
+		{Start: 28, End: 35, Index: 2},
+		{Start: 36, End: 39, Index: 3},
+	}
+	if !reflect.DeepEqual(rest, want) {
+		t.Errorf("Expected %v, got %v", want, rest)
+	}
+}
+
+func TestOrderChunks(t *testing.T) {
+	chunks := planChunks([]byteRange{{0, 50}}, 10)
+	starts := func(chunks []ChunkInfo) []int64 {
+		var s []int64
+		for _, chunk := range chunks {
+			s = append(s, chunk.Start)
+		}
+		return s
+	}
+
+	tests := []struct {
+		priority ChunkPriority
+		want     []int64
+	}{
+		{"", []int64{0, 10, 20, 30, 40}},
+		{ChunkPriorityHead, []int64{0, 10, 20, 30, 40}},
+		{ChunkPriorityTail, []int64{40, 30, 20, 10, 0}},
+		{ChunkPriorityEdges, []int64{0, 40, 10, 30, 20}},
+	}
+
+	for _, tt := range tests {
+		if got := starts(orderChunks(chunks, tt.priority)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("orderChunks(%q) = %v, want %v", tt.priority, got, tt.want)
+		}
+	}
+}
+
+func TestChunkPriorityTail(t *testing.T) {
+	const chunkSize = 32 * 1024
+	payload := testPayload(16 * chunkSize)
+
+	var mu sync.Mutex
+	var served []int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil {
+			mu.Lock()
+			served = append(served, start)
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	// One connection, so chunks finish in the order they are dispatched
+	output := filepath.Join(t.TempDir(), "tail.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = chunkSize
+	downloader.MinConnections = 1
+	downloader.CurrentConnections = 1
+	downloader.MaxConnections = 1
+	downloader.ChunkPriority = ChunkPriorityTail
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Downloaded file does not match payload")
+	}
+
+	// The last quarter of the file completes before anything in the middle
+	mu.Lock()
+	defer mu.Unlock()
+	tail, middle := -1, len(served)
+	for i, start := range served {
+		switch {
+		case start >= int64(len(payload))*3/4:
+			tail = max(tail, i)
+		case start >= int64(len(payload))/4:
+			middle = min(middle, i)
+		}
+	}
+	if tail < 0 || tail > middle {
+		t.Errorf("Expected tail chunks before middle chunks, got completion order %v", served)
+	}
+}
@@ -0,0 +1,207 @@
+package fasdownload
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// byteRange is a half-open interval [Start, End) of file offsets
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// rangeSet is a sorted set of non-overlapping, non-adjacent byte ranges
+type rangeSet struct {
+	ranges []byteRange
+}
+
+// add inserts [start, end) and merges it with any ranges it touches
+func (s *rangeSet) add(start, end int64) {
+	if end <= start {
+		return
+	}
+
+	merged := make([]byteRange, 0, len(s.ranges)+1)
+	inserted := false
+	for _, r := range s.ranges {
+		switch {
+		case r.End < start:
+			merged = append(merged, r)
+		case r.Start > end:
+			if !inserted {
+				merged = append(merged, byteRange{start, end})
+				inserted = true
+			}
+			merged = append(merged, r)
+		default:
+			start = min(start, r.Start)
+			end = max(end, r.End)
+		}
+	}
+	if !inserted {
+		merged = append(merged, byteRange{start, end})
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Start < merged[j].Start })
+	s.ranges = merged
+}
+
+// missing returns the gaps in [0, size) not covered by the set
+func (s *rangeSet) missing(size int64) []byteRange {
+	gaps := make([]byteRange, 0)
+	next := int64(0)
+	for _, r := range s.ranges {
+		if r.Start >= size {
+			break
+		}
+		if r.Start > next {
+			gaps = append(gaps, byteRange{next, r.Start})
+		}
+		next = max(next, r.End)
+	}
+	if next < size {
+		gaps = append(gaps, byteRange{next, size})
+	}
+	return gaps
+}
+
+// total returns the number of bytes covered by the set
+func (s *rangeSet) total() int64 {
+	var n int64
+	for _, r := range s.ranges {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// checkCoverage verifies that the intervals written cover [0, size) exactly
+// once, naming every gap and overlap otherwise. Unlike rangeSet it keeps
+// each interval as written, so a byte written twice is caught too.
+func checkCoverage(size int64, written []byteRange) error {
+	if problems := coverageProblems(size, written); len(problems) > 0 {
+		return fmt.Errorf("written chunks don't cover the file: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// checkChunkPlan verifies before anything is fetched that the chunks, with
+// the ranges already on disk, tile [0, size) with no gap or overlap
+func checkChunkPlan(size int64, completed []byteRange, chunks []ChunkInfo) error {
+	var problems []string
+	ranges := append([]byteRange(nil), completed...)
+	for _, c := range chunks {
+		if c.End < c.Start {
+			problems = append(problems, fmt.Sprintf("chunk %d ends at byte %d before it starts at %d", c.Index, c.End, c.Start))
+			continue
+		}
+		ranges = append(ranges, byteRange{c.Start, c.End + 1})
+	}
+	problems = append(problems, coverageProblems(size, ranges)...)
+
+	if len(problems) > 0 {
+		return &ChunkPlanError{Problems: problems}
+	}
+	return nil
+}
+
+// coverageProblems describes every gap in, overlap between and byte past
+// the end of ranges as laid over [0, size)
+func coverageProblems(size int64, ranges []byteRange) []string {
+	sorted := append([]byteRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var problems []string
+	next := int64(0)
+	for _, r := range sorted {
+		if r.Start > next {
+			problems = append(problems, fmt.Sprintf("gap at bytes %d-%d", next, r.Start-1))
+		} else if r.Start < next {
+			problems = append(problems, fmt.Sprintf("overlap at bytes %d-%d", r.Start, min(next, r.End)-1))
+		}
+		next = max(next, r.End)
+	}
+	if next < size {
+		problems = append(problems, fmt.Sprintf("gap at bytes %d-%d", next, size-1))
+	} else if next > size {
+		problems = append(problems, fmt.Sprintf("bytes %d-%d written past the end of the file", size, next-1))
+	}
+	return problems
+}
+
+// DefaultMaxChunks is the MaxChunks used when it is not set
+const DefaultMaxChunks = 10000
+
+// DefaultMinChunkSize is the MinChunkSize used when it is not set
+const DefaultMinChunkSize = 256 * 1024
+
+// DefaultSmallFileThreshold is the size below which a file is downloaded
+// over a single connection
+const DefaultSmallFileThreshold = 2 * 1024 * 1024
+
+// defaultSmallFileThreshold is the threshold used when SmallFileThreshold
+// is 0. It is a variable so tests can fetch small payloads in chunks
+// without setting SmallFileThreshold on every downloader.
+var defaultSmallFileThreshold int64 = DefaultSmallFileThreshold
+
+// smallFileThreshold returns SmallFileThreshold, or the default when unset
+func (d *AdaptiveDownloader) smallFileThreshold() int64 {
+	if d.SmallFileThreshold == 0 {
+		return defaultSmallFileThreshold
+	}
+	return d.SmallFileThreshold
+}
+
+// smallFile reports whether the file is small enough to fetch over a
+// single connection rather than in chunks
+func (d *AdaptiveDownloader) smallFile() bool {
+	return d.FileSize >= 0 && d.FileSize < d.smallFileThreshold()
+}
+
+// singleConnection reports whether the download goes over one connection
+// rather than in ranged chunks. A delta update fetches its blocks as ranges
+// however small the file, so detectDelta must have run.
+func (d *AdaptiveDownloader) singleConnection(supportsRanges bool) bool {
+	return !supportsRanges || d.Decompress != CompressionNone || d.streamed() || d.smallFile() && !d.delta
+}
+
+// computeChunkSize returns the smallest chunk size, but never less than
+// floor, that splits a file of fileSize bytes into at most maxChunks
+// chunks: floor itself for small files, and larger chunks for huge ones.
+// A file of unknown size gets floor.
+func computeChunkSize(fileSize int64, maxChunks int, floor int64) int64 {
+	if fileSize <= 0 || maxChunks <= 0 {
+		return floor
+	}
+	return max(floor, (fileSize+int64(maxChunks)-1)/int64(maxChunks))
+}
+
+// shrinkChunkSize returns target, shrunk for a small file so it still
+// splits into minChunks chunks, but never below floor, or target if that
+// is smaller. A file of unknown size gets target.
+func shrinkChunkSize(fileSize int64, minChunks int, target, floor int64) int64 {
+	if fileSize <= 0 || minChunks <= 0 {
+		return target
+	}
+	size := min(target, (fileSize+int64(minChunks)-1)/int64(minChunks))
+	return max(size, min(floor, target))
+}
+
+// planChunks splits the given ranges into chunks of at most chunkSize bytes.
+// The plan depends only on the ranges and chunk size, never on how many
+// connections will download it.
+func planChunks(ranges []byteRange, chunkSize int64) []ChunkInfo {
+	chunks := make([]ChunkInfo, 0)
+	for _, r := range ranges {
+		for i := r.Start; i < r.End; i += chunkSize {
+			end := min(i+chunkSize, r.End) - 1
+			chunks = append(chunks, ChunkInfo{
+				Start: i,
+				End:   end,
+				Index: len(chunks),
+			})
+		}
+	}
+	return chunks
+}
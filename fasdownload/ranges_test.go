@@ -0,0 +1,263 @@
+package fasdownload
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRangeSetAddMerges(t *testing.T) {
+	var set rangeSet
+	set.add(10, 20)
+	set.add(30, 40)
+	set.add(20, 25) // adjacent to the first range
+	set.add(0, 5)
+	set.add(35, 50) // overlaps the third range
+
+	want := []byteRange{{0, 5}, {10, 25}, {30, 50}}
+	if !reflect.DeepEqual(set.ranges, want) {
+		t.Errorf("Expected %v, got %v", want, set.ranges)
+	}
+	if set.total() != 5+15+20 {
+		t.Errorf("Expected total 40, got %d", set.total())
+	}
+}
+
+func TestRangeSetMissing(t *testing.T) {
+	var set rangeSet
+	set.add(10, 20)
+	set.add(30, 40)
+
+	want := []byteRange{{0, 10}, {20, 30}, {40, 100}}
+	if got := set.missing(100); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected gaps %v, got %v", want, got)
+	}
+
+	set.add(0, 100)
+	if got := set.missing(100); len(got) != 0 {
+		t.Errorf("Expected no gaps, got %v", got)
+	}
+}
+
+func TestPlanChunks(t *testing.T) {
+	chunks := planChunks([]byteRange{{0, 25}, {40, 50}}, 10)
+
+	want := []ChunkInfo{
+		{Start: 0, End: 9, Index: 0},
+		{Start: 10, End: 19, Index: 1},
+		{Start: 20, End: 24, Index: 2},
+		{Start: 40, End: 49, Index: 3},
+	}
+	if !reflect.DeepEqual(chunks, want) {
+		t.Errorf("Expected %v, got %v", want, chunks)
+	}
+}
+
+func TestCheckCoverage(t *testing.T) {
+	chunks := planChunks([]byteRange{{0, 100}}, 10)
+	written := func(skip int) []byteRange {
+		var ranges []byteRange
+		for _, c := range chunks {
+			if c.Index != skip {
+				ranges = append(ranges, byteRange{c.Start, c.End + 1})
+			}
+		}
+		return ranges
+	}
+
+	tests := []struct {
+		name    string
+		written []byteRange
+		wantErr string
+	}{
+		{"every chunk written", written(-1), ""},
+		{"dropped chunk", written(3), "gap at bytes 30-39"},
+		{"dropped last chunk", written(9), "gap at bytes 90-99"},
+		{"overlapping chunks", append(written(-1), byteRange{15, 25}), "overlap at bytes 15-19, overlap at bytes 20-24"},
+		{"past the end", append(written(-1), byteRange{100, 110}), "bytes 100-109 written past the end"},
+		{"nothing written", nil, "gap at bytes 0-99"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCoverage(100, tt.written)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkCoverage() returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckChunkPlan(t *testing.T) {
+	completed := []byteRange{{0, 20}}
+	chunks := planChunks([]byteRange{{20, 100}}, 10)
+	with := func(extra ...ChunkInfo) []ChunkInfo {
+		return append(append([]ChunkInfo(nil), chunks...), extra...)
+	}
+
+	tests := []struct {
+		name      string
+		completed []byteRange
+		chunks    []ChunkInfo
+		wantErr   string
+	}{
+		{"tiles the file", completed, chunks, ""},
+		{"overlapping chunk", completed, with(ChunkInfo{Start: 45, End: 54, Index: 8}), "overlap at bytes 45-49, overlap at bytes 50-54"},
+		{"chunk over a completed range", completed, with(ChunkInfo{Start: 15, End: 24, Index: 8}), "overlap at bytes 15-19, overlap at bytes 20-24"},
+		{"missing chunk", completed, chunks[1:], "gap at bytes 20-29"},
+		{"nothing completed", nil, chunks, "gap at bytes 0-19"},
+		{"past the end", completed, with(ChunkInfo{Start: 100, End: 109, Index: 8}), "bytes 100-109 written past the end"},
+		{"reversed chunk", completed, with(ChunkInfo{Start: 60, End: 50, Index: 8}), "chunk 8 ends at byte 50 before it starts at 60"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkChunkPlan(100, tt.completed, tt.chunks)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkChunkPlan() returned error: %v", err)
+				}
+				return
+			}
+			var planErr *ChunkPlanError
+			if !errors.As(err, &planErr) {
+				t.Fatalf("Expected a *ChunkPlanError, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestComputeChunkSize(t *testing.T) {
+	const (
+		kb = int64(1024)
+		mb = 1024 * kb
+		gb = 1024 * mb
+	)
+	tests := []struct {
+		name      string
+		fileSize  int64
+		maxChunks int
+		floor     int64
+		want      int64
+	}{
+		{"unknown size", -1, DefaultMaxChunks, 256 * kb, 256 * kb},
+		{"empty file", 0, DefaultMaxChunks, 256 * kb, 256 * kb},
+		{"small file", 3 * mb, DefaultMaxChunks, 256 * kb, 256 * kb},
+		{"medium file", 2 * gb, DefaultMaxChunks, 256 * kb, 256 * kb},
+		{"at the cap", 10000 * mb, DefaultMaxChunks, mb, mb},
+		{"huge file", 50 * gb, DefaultMaxChunks, mb, 5368710},
+		{"huge file, few chunks", 50 * gb, 100, 256 * kb, 512 * mb},
+		{"rounds up", 1001, 10, 1, 101},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := computeChunkSize(tt.fileSize, tt.maxChunks, tt.floor)
+			if got != tt.want {
+				t.Errorf("computeChunkSize(%d, %d, %d) = %d, want %d", tt.fileSize, tt.maxChunks, tt.floor, got, tt.want)
+			}
+			if tt.fileSize > 0 {
+				if chunks := (tt.fileSize + got - 1) / got; chunks > int64(tt.maxChunks) {
+					t.Errorf("Expected at most %d chunks, got %d", tt.maxChunks, chunks)
+				}
+			}
+		})
+	}
+}
+
+func TestShrinkChunkSize(t *testing.T) {
+	const (
+		kb = int64(1024)
+		mb = 1024 * kb
+	)
+	tests := []struct {
+		name      string
+		fileSize  int64
+		minChunks int
+		target    int64
+		floor     int64
+		want      int64
+	}{
+		{"unknown size", -1, 16, mb, 256 * kb, mb},
+		{"empty file", 0, 16, mb, 256 * kb, mb},
+		{"tiny file", 100 * kb, 16, mb, 256 * kb, 256 * kb},
+		{"small file", 3 * mb, 16, mb, 256 * kb, 256 * kb},
+		{"shared between connections", 8 * mb, 16, mb, 256 * kb, 512 * kb},
+		{"large enough", 100 * mb, 16, mb, 256 * kb, mb},
+		{"target below floor", 3 * mb, 16, 64 * kb, 256 * kb, 64 * kb},
+		{"rounds up", 1001, 10, 1000, 1, 101},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shrinkChunkSize(tt.fileSize, tt.minChunks, tt.target, tt.floor)
+			if got != tt.want {
+				t.Errorf("shrinkChunkSize(%d, %d, %d, %d) = %d, want %d", tt.fileSize, tt.minChunks, tt.target, tt.floor, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveChunkSizeDefaults(t *testing.T) {
+	const (
+		kb = int64(1024)
+		mb = 1024 * kb
+	)
+	tests := []struct {
+		fileSize  int64
+		chunkSize int64 // 0 keeps the default
+		want      int64
+	}{
+		{3 * mb, 0, DefaultMinChunkSize},
+		{8 * mb, 0, 512 * kb},
+		{100 * mb, 0, mb},
+		{3 * mb, 64 * kb, 64 * kb},
+	}
+
+	for _, tt := range tests {
+		downloader := NewAdaptiveDownloader("https://example.com/file.zip", "file.zip")
+		downloader.FileSize = tt.fileSize
+		if tt.chunkSize > 0 {
+			downloader.ChunkSize = tt.chunkSize
+		}
+		if got := downloader.effectiveChunkSize(); got != tt.want {
+			t.Errorf("Expected %d byte chunks for a %d byte file, got %d", tt.want, tt.fileSize, got)
+		}
+	}
+}
+
+func TestSmallFileChunksShrinkToMinChunkSize(t *testing.T) {
+	const kb = int64(1024)
+	tests := []struct {
+		fileSize     int64
+		minChunkSize int64 // 0 keeps the default
+		want         int64
+	}{
+		{300 * kb, 0, DefaultMinChunkSize},
+		{3 * 1024 * kb, 0, DefaultMinChunkSize},
+		{512 * kb, 64 * kb, 64 * kb},
+	}
+
+	for _, tt := range tests {
+		downloader := NewAdaptiveDownloader("https://example.com/file.zip", "file.zip")
+		downloader.FileSize = tt.fileSize
+		downloader.MinChunkSize = tt.minChunkSize
+		got := downloader.effectiveChunkSize()
+		if got != tt.want {
+			t.Errorf("Expected a %d byte file to shrink to %d byte chunks, got %d", tt.fileSize, tt.want, got)
+		}
+		if chunks := planChunks([]byteRange{{0, tt.fileSize}}, got); len(chunks) < 2 {
+			t.Errorf("Expected a %d byte file split for several connections, got %d chunks", tt.fileSize, len(chunks))
+		}
+	}
+}
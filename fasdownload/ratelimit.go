@@ -0,0 +1,58 @@
+package fasdownload
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every reader of a download, so
+// the aggregate rate stays under the cap however many connections are open
+type rateLimiter struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// newRateLimiter returns a limiter for bytesPerSec, or nil for unlimited
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+
+	// Allow roughly a tenth of a second of burst, but at least one read buffer
+	burst := max(float64(bytesPerSec)/10, 32*1024)
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   now(),
+	}
+}
+
+// wait blocks until n more bytes fit under the rate limit. Callers take the
+// bytes up front and the bucket goes into debt, so later callers wait longer.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	at := now()
+	l.tokens = min(l.burst, l.tokens+at.Sub(l.last).Seconds()*l.rate)
+	l.last = at
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	return sleepContext(ctx, delay)
+}
@@ -0,0 +1,60 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedDownload(t *testing.T) {
+	payload := testPayload(1536 * 1024)
+	server := newPayloadServer(t, payload)
+
+	output := filepath.Join(t.TempDir(), "limited.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 256 * 1024
+	downloader.MaxBytesPerSec = 1024 * 1024
+
+	start := time.Now()
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	// 1.5MB at 1MB/s across 4 connections, less the initial burst, is ~1.4s
+	if elapsed < 1200*time.Millisecond || elapsed > 4*time.Second {
+		t.Errorf("Expected ~1.4s with a shared 1MB/s cap, took %v", elapsed)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Downloaded content does not match payload")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := newRateLimiter(0)
+	if limiter != nil {
+		t.Fatal("Expected nil limiter for an unlimited rate")
+	}
+	if err := limiter.wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("Expected nil limiter to never block, got %v", err)
+	}
+}
+
+func TestRateLimiterHonorsCancellation(t *testing.T) {
+	limiter := newRateLimiter(1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Going far into debt would otherwise block for minutes
+	if err := limiter.wait(ctx, 1<<20); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package fasdownload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy decides whether a failed request is tried again and how long
+// to wait first. attempt counts failures so far, starting at 1. resp is set
+// when the server answered with an unexpected status (its body is already
+// closed); err is set when the request or the body read failed.
+type RetryPolicy interface {
+	ShouldRetry(attempt int, resp *http.Response, err error) (retry bool, delay time.Duration)
+}
+
+// DefaultRetryPolicy retries network errors, 5xx and 429 responses with
+// exponential backoff: BaseDelay, then twice that, capped at MaxDelay.
+// Jitter is the fraction of each delay that is randomized, from 0 (none) to
+// 1 (anywhere between zero and the full delay); see SetJitterSource. The
+// policy used when none is set has full jitter, so chunks that fail
+// together, say when a server briefly answers every connection with 503,
+// spread their retries out instead of all returning at once.
+type DefaultRetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Jitter     float64
+}
+
+// defaultRetryPolicy is used when AdaptiveDownloader.RetryPolicy is nil
+var defaultRetryPolicy = DefaultRetryPolicy{
+	MaxRetries: 3,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   10 * time.Second,
+	Jitter:     1,
+}
+
+// ShouldRetry implements RetryPolicy
+func (p DefaultRetryPolicy) ShouldRetry(attempt int, resp *http.Response, err error) (bool, time.Duration) {
+	if attempt > p.MaxRetries {
+		return false, 0
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+	// Following the same redirects again won't make them fetchable, and a
+	// certificate that failed to verify will fail again
+	if errors.Is(err, errTooManyRedirects) {
+		return false, 0
+	}
+	var schemeErr *UnsupportedSchemeError
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &schemeErr) || errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) {
+		return false, 0
+	}
+	if resp != nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return false, 0
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if spread := min(max(p.Jitter, 0), 1); spread > 0 {
+		delay -= time.Duration(float64(delay) * spread * randomFraction())
+	}
+	return true, delay
+}
+
+// retryPolicy returns the configured policy or the default one
+func (d *AdaptiveDownloader) retryPolicy() RetryPolicy {
+	if d.RetryPolicy != nil {
+		return d.RetryPolicy
+	}
+	return defaultRetryPolicy
+}
+
+// sleepContext waits for delay on the package clock, returning early with
+// the context's error if it is cancelled first
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	return currentClock().Sleep(ctx, delay)
+}
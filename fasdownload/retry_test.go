@@ -0,0 +1,363 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fixedRetryPolicy retries up to max times with a constant delay and records
+// every attempt it is asked about
+type fixedRetryPolicy struct {
+	max      int
+	delay    time.Duration
+	mu       sync.Mutex
+	attempts []int
+}
+
+func (p *fixedRetryPolicy) ShouldRetry(attempt int, resp *http.Response, err error) (bool, time.Duration) {
+	p.mu.Lock()
+	p.attempts = append(p.attempts, attempt)
+	p.mu.Unlock()
+	return attempt <= p.max, p.delay
+}
+
+// newFlakyServer fails the first n ranged GETs with 503
+func newFlakyServer(t *testing.T, payload []byte, n int32) *httptest.Server {
+	t.Helper()
+	var failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.Header.Get("Range") != "" && failures.Add(1) <= n {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCustomRetryPolicy(t *testing.T) {
+	payload := testPayload(64 * 1024)
+
+	tests := []struct {
+		name     string
+		failures int32
+		wantErr  bool
+		attempts []int
+	}{
+		{"recovers after two retries", 2, false, []int{1, 2}},
+		{"gives up after two retries", 3, true, []int{1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFlakyServer(t, payload, tt.failures)
+			policy := &fixedRetryPolicy{max: 2, delay: 50 * time.Millisecond}
+
+			output := filepath.Join(t.TempDir(), "retry.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.ChunkSize = int64(len(payload))
+			downloader.CurrentConnections = 1
+			downloader.RetryPolicy = policy
+
+			start := time.Now()
+			err := downloader.Download(context.Background())
+			elapsed := time.Since(start)
+
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("Download() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(policy.attempts) != fmt.Sprint(tt.attempts) {
+				t.Errorf("Expected policy to see attempts %v, got %v", tt.attempts, policy.attempts)
+			}
+			if downloader.Stats.Retries != 2 {
+				t.Errorf("Expected 2 retries, got %d", downloader.Stats.Retries)
+			}
+			if elapsed < 100*time.Millisecond {
+				t.Errorf("Expected two 50ms retry delays, download took %v", elapsed)
+			}
+
+			if !tt.wantErr {
+				got, err := os.ReadFile(output)
+				if err != nil {
+					t.Fatalf("Failed to read output: %v", err)
+				}
+				if !bytes.Equal(got, payload) {
+					t.Error("Downloaded file does not match payload")
+				}
+			}
+		})
+	}
+}
+
+func TestRetryResumesFromOffset(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	cut := 20000
+
+	var mu sync.Mutex
+	var ranges []string
+	var cutOnce sync.Once
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.Header.Get("Range") == "" {
+			http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+
+		cutShort := false
+		cutOnce.Do(func() { cutShort = true })
+		if cutShort {
+			// Promise the whole range but hang up part way through
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(payload)-1, len(payload)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(payload[:cut])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "resume.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = int64(len(payload))
+	downloader.CurrentConnections = 1
+	downloader.RetryPolicy = &fixedRetryPolicy{max: 1}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	want := []string{
+		fmt.Sprintf("bytes=0-%d", len(payload)-1),
+		fmt.Sprintf("bytes=%d-%d", cut, len(payload)-1),
+	}
+	if fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("Expected requests for %v, got %v", want, ranges)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Downloaded file does not match payload")
+	}
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	policy := DefaultRetryPolicy{MaxRetries: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	status := func(code int) *http.Response { return &http.Response{StatusCode: code} }
+
+	tests := []struct {
+		name      string
+		attempt   int
+		resp      *http.Response
+		err       error
+		wantRetry bool
+		wantDelay time.Duration
+	}{
+		{"network error", 1, nil, io.ErrUnexpectedEOF, true, 100 * time.Millisecond},
+		{"backs off", 2, status(http.StatusBadGateway), nil, true, 200 * time.Millisecond},
+		{"caps delay", 3, status(http.StatusTooManyRequests), nil, true, 300 * time.Millisecond},
+		{"out of retries", 4, nil, io.ErrUnexpectedEOF, false, 0},
+		{"client error", 1, status(http.StatusForbidden), nil, false, 0},
+		{"cancelled", 1, nil, fmt.Errorf("read: %w", context.Canceled), false, 0},
+		{"deadline", 1, nil, context.DeadlineExceeded, false, 0},
+		{"other error", 1, nil, errors.New("connection reset"), true, 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retry, delay := policy.ShouldRetry(tt.attempt, tt.resp, tt.err)
+			if retry != tt.wantRetry || delay != tt.wantDelay {
+				t.Errorf("ShouldRetry() = (%v, %v), want (%v, %v)", retry, delay, tt.wantRetry, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestEmptyResponseRetried(t *testing.T) {
+	payload := testPayload(128 * 1024)
+
+	tests := []struct {
+		name         string
+		headSize     bool
+		expectedSize int64
+	}{
+		{"size from HEAD", true, 0},
+		{"ExpectedSize", false, int64(len(payload))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first GET succeeds with no body, as a flaky proxy might
+			var gets atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					w.Header().Set("Accept-Ranges", "none")
+					if tt.headSize {
+						w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+					}
+					return
+				}
+				if gets.Add(1) == 1 {
+					w.Header().Set("Content-Length", "0")
+					return
+				}
+				w.Write(payload)
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "empty.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.ExpectedSize = tt.expectedSize
+			downloader.RetryPolicy = &fixedRetryPolicy{max: 2, delay: 10 * time.Millisecond}
+
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("Expected %d bytes after the retry, got %d", len(payload), len(got))
+			}
+			if n := gets.Load(); n != 2 {
+				t.Errorf("Expected 2 GETs, got %d", n)
+			}
+			if downloader.Stats.Retries != 1 {
+				t.Errorf("Expected 1 retry, got %d", downloader.Stats.Retries)
+			}
+		})
+	}
+}
+
+func TestRetryCounts(t *testing.T) {
+	payload := testPayload(1024 * 1024)
+	const chunkSize = 256 * 1024
+
+	// Chunk 1 fails twice and chunk 3 three times before being served
+	failures := map[int64]int{1: 2, 3: 3}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			var start int64
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+			mu.Lock()
+			fail := failures[start/chunkSize] > 0
+			if fail {
+				failures[start/chunkSize]--
+			}
+			mu.Unlock()
+			if fail {
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			}
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "retried.bin"))
+	downloader.ChunkSize = chunkSize
+	downloader.RetryPolicy = &fixedRetryPolicy{max: 5, delay: time.Millisecond}
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	result := downloader.Result()
+	if result.RetryCount != 5 {
+		t.Errorf("Expected 5 retries, got %d", result.RetryCount)
+	}
+	want := map[int]int{1: 2, 3: 3}
+	if len(result.ChunkRetries) != len(want) {
+		t.Errorf("Expected retries for chunks %v, got %v", want, result.ChunkRetries)
+	}
+	for index, n := range want {
+		if got := result.ChunkRetries[index]; got != n {
+			t.Errorf("Expected chunk %d retried %d times, got %d", index, n, got)
+		}
+	}
+	if result.BytesRedownloaded != 0 {
+		t.Errorf("Expected no bytes downloaded again, got %d", result.BytesRedownloaded)
+	}
+	if result.BytesDownloaded != int64(len(payload)) {
+		t.Errorf("Expected %d bytes downloaded, got %d", len(payload), result.BytesDownloaded)
+	}
+}
+
+func TestDefaultRetryJitter(t *testing.T) {
+	payload := testPayload(16 * 16 * 1024)
+	clock := &replayClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	SetClock(clock)
+	SetJitterSource(rand.NewSource(42))
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetJitterSource(nil)
+	})
+
+	// Every chunk is turned away once, all at the same moment; 429 rather
+	// than 503 so the error burst pause stays out of the schedule
+	var mu sync.Mutex
+	turnedAway := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ranged := r.Header.Get("Range"); r.Method == "GET" && ranged != "" && ranged != "bytes=0-0" {
+			mu.Lock()
+			first := !turnedAway[ranged]
+			turnedAway[ranged] = true
+			mu.Unlock()
+			if first {
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			}
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "jitter.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 16 * 1024
+	downloader.CurrentConnections = 16
+	downloader.MaxConnections = 16
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	clock.mu.Lock()
+	sleeps := clock.sleeps
+	clock.mu.Unlock()
+	if len(sleeps) != 16 {
+		t.Fatalf("Expected a retry delay for each of the 16 chunks, got %v", sleeps)
+	}
+	distinct := make(map[time.Duration]bool)
+	for _, d := range sleeps {
+		if d < 0 || d >= defaultRetryPolicy.BaseDelay {
+			t.Errorf("Expected every delay jittered within [0, %v), got %v", defaultRetryPolicy.BaseDelay, d)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("Expected the retries spread out, got %v", sleeps)
+	}
+}
@@ -0,0 +1,85 @@
+package fasdownload
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideSandbox reports an output path that would leave SandboxRoot
+var ErrOutsideSandbox = errors.New("path is outside the sandbox root")
+
+// CheckSandbox returns an error wrapping ErrOutsideSandbox unless path,
+// resolved against the working directory as a download would write it,
+// stays within root. Symlinks in the parts of either path that already
+// exist are followed, so a link inside the root can't point a write out of
+// it, and a path with a ".." element is refused outright, since the OS
+// resolves it after any symlink before it. An empty root allows every path.
+func CheckSandbox(root, path string) error {
+	if root == "" {
+		return nil
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return fmt.Errorf("%w: %s contains \"..\"", ErrOutsideSandbox, path)
+		}
+	}
+	resolvedRoot, err := resolveExisting(root)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveExisting(path)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s is not within %s", ErrOutsideSandbox, path, root)
+	}
+	return nil
+}
+
+// resolveExisting makes path absolute and follows the symlinks in its
+// longest existing prefix; the rest, not created yet, is joined on as is
+func resolveExisting(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	existing, rest := abs, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, rest), nil
+}
+
+// checkSandbox validates the paths the download writes to against
+// SandboxRoot once Filename is final
+func (d *AdaptiveDownloader) checkSandbox() error {
+	if !d.fileless() {
+		if err := CheckSandbox(d.SandboxRoot, d.Filename); err != nil {
+			return err
+		}
+	}
+	if d.QuarantineDir != "" {
+		return CheckSandbox(d.SandboxRoot, d.QuarantineDir)
+	}
+	return nil
+}
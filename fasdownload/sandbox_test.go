@@ -0,0 +1,134 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSandboxRoot(t *testing.T) {
+	payload := testPayload(16 * 1024)
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			gets.Add(1)
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="../../escape.bin"`)
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{root, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		filename   string
+		auto       bool
+		conflict   string // path OnFilenameConflict moves the download to
+		quarantine string
+		wantErr    bool
+	}{
+		{name: "inside", filename: filepath.Join(root, "file.bin")},
+		{name: "inside with Content-Disposition", filename: filepath.Join(root, "file.bin"), auto: true},
+		{name: "dot-dot", filename: filepath.Join(root, "..", "outside", "file.bin"), wantErr: true},
+		{name: "dot-dot back inside", filename: root + "/sub/../file.bin", wantErr: true},
+		{name: "absolute", filename: filepath.Join(outside, "file.bin"), wantErr: true},
+		{name: "sibling prefix", filename: root + "-evil/file.bin", wantErr: true},
+		{name: "symlink", filename: filepath.Join(root, "link", "file.bin"), wantErr: true},
+		{name: "conflict hook", filename: filepath.Join(root, "existing.bin"), conflict: filepath.Join(outside, "file.bin"), wantErr: true},
+		{name: "quarantine", filename: filepath.Join(root, "file.bin"), quarantine: filepath.Join(outside, "quarantine"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gets.Store(0)
+			downloader := NewAdaptiveDownloader(server.URL+"/payload.bin", tt.filename)
+			downloader.SandboxRoot = root
+			downloader.AutoFilename = tt.auto
+			downloader.QuarantineDir = tt.quarantine
+			if tt.conflict != "" {
+				if err := os.WriteFile(tt.filename, []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				downloader.OnFilenameConflict = func(string) (string, bool) { return tt.conflict, true }
+			}
+
+			err := downloader.Download(context.Background())
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Download() returned error: %v", err)
+				}
+				got, err := os.ReadFile(downloader.Filename)
+				if err != nil || !bytes.Equal(got, payload) {
+					t.Fatalf("Expected the payload in %s: %v", downloader.Filename, err)
+				}
+				if rel, _ := filepath.Rel(root, downloader.Filename); rel != filepath.Base(rel) {
+					t.Errorf("Expected a file directly in the root, got %s", downloader.Filename)
+				}
+				os.Remove(downloader.Filename)
+				return
+			}
+
+			if !errors.Is(err, ErrOutsideSandbox) {
+				t.Fatalf("Expected ErrOutsideSandbox, got %v", err)
+			}
+			if gets.Load() != 0 {
+				t.Errorf("Expected no data to be fetched, got %d GETs", gets.Load())
+			}
+			entries, _ := os.ReadDir(outside)
+			if len(entries) != 0 {
+				t.Errorf("Expected nothing written outside the sandbox, found %v", entries)
+			}
+			if _, err := os.Stat(filepath.Join(base, "escape.bin")); err == nil {
+				t.Error("Content-Disposition name escaped the sandbox")
+			}
+		})
+	}
+}
+
+func TestCheckSandbox(t *testing.T) {
+	root := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	allowed := []string{"file.bin", "sub/file.bin", root, filepath.Join(root, "a", "b")}
+	for _, path := range allowed {
+		if err := CheckSandbox(root, path); err != nil {
+			t.Errorf("CheckSandbox(%q) returned error: %v", path, err)
+		}
+	}
+
+	refused := []string{"..", "../file.bin", "sub/../../file.bin", "/etc/passwd", filepath.Dir(root)}
+	for _, path := range refused {
+		if err := CheckSandbox(root, path); !errors.Is(err, ErrOutsideSandbox) {
+			t.Errorf("CheckSandbox(%q) = %v, want ErrOutsideSandbox", path, err)
+		}
+	}
+
+	if err := CheckSandbox("", "/etc/passwd"); err != nil {
+		t.Errorf("Expected an empty root to allow every path, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package fasdownload
+
+import (
+	"io"
+	"os"
+)
+
+// WriterAtCloser is somewhere other than a file for a download to go, such
+// as an in-memory buffer or an object store's multipart upload. Chunks
+// arrive over parallel connections, so WriteAt is called concurrently and
+// out of order, but never for overlapping bytes. Close is called once every
+// byte has been written; a failed download leaves the sink open for the
+// caller to abort or discard.
+type WriterAtCloser interface {
+	WriteAt(p []byte, off int64) error
+	Close() error
+}
+
+// fileSink writes chunks to a .part file or device, the default sink
+type fileSink struct {
+	file *os.File
+}
+
+// newFileSink returns the sink for a download's file; tests replace it to
+// fail writes
+var newFileSink = func(file *os.File) WriterAtCloser {
+	return fileSink{file}
+}
+
+func (s fileSink) WriteAt(p []byte, off int64) error {
+	_, err := s.file.WriteAt(p, off)
+	return err
+}
+
+func (s fileSink) Close() error {
+	return s.file.Close()
+}
+
+// sinkWriter writes to a sink in order from offset, for the downloads
+// that come over a single connection
+type sinkWriter struct {
+	sink   WriterAtCloser
+	offset int64
+}
+
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	if err := w.sink.WriteAt(p, w.offset); err != nil {
+		return 0, err
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// sequentialTarget returns where a single-connection download writes
+// when it isn't a file: the stream, or Sink written from the start. It is
+// nil when the download goes to a file.
+func (d *AdaptiveDownloader) sequentialTarget() io.Writer {
+	if w := d.stream(); w != nil {
+		return w
+	}
+	if d.Sink != nil {
+		return &sinkWriter{sink: d.Sink}
+	}
+	return nil
+}
+
+// fileless reports whether the download goes to a stream or Sink, with no
+// file, .part file or checkpoint of its own
+func (d *AdaptiveDownloader) fileless() bool {
+	return d.streamed() || d.Sink != nil
+}
@@ -0,0 +1,131 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// memorySink collects a download in memory, recording each write
+type memorySink struct {
+	mu      sync.Mutex
+	data    []byte
+	writes  int
+	ordered bool // every write started where the one before ended
+	end     int64
+	closed  int
+}
+
+func (s *memorySink) WriteAt(p []byte, off int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off != s.end {
+		s.ordered = false
+	}
+	if need := off + int64(len(p)); need > int64(len(s.data)) {
+		s.data = append(s.data, make([]byte, need-int64(len(s.data)))...)
+	}
+	copy(s.data[off:], p)
+	s.writes++
+	s.end = off + int64(len(p))
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed++
+	return nil
+}
+
+func TestDownloadToSink(t *testing.T) {
+	payload := testPayload(512 * 1024)
+
+	tests := []struct {
+		name   string
+		ranges bool
+	}{
+		{"parallel chunks", true},
+		{"no range support", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newPayloadServer(t, payload)
+			if !tt.ranges {
+				server = newTrickleServer(t, payload, 64*1024, 0)
+			}
+
+			dir := t.TempDir()
+			sink := &memorySink{ordered: true}
+			downloader := NewAdaptiveDownloader(server.URL, filepath.Join(dir, "payload.bin"))
+			downloader.ChunkSize = 32 * 1024
+			downloader.Sink = sink
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+
+			if !bytes.Equal(sink.data, payload) {
+				t.Fatalf("Expected the payload in the sink, got %d bytes", len(sink.data))
+			}
+			if sink.closed != 1 {
+				t.Errorf("Expected the sink to be closed once, got %d", sink.closed)
+			}
+			if single := downloader.Result().SingleConnection; single != !tt.ranges {
+				t.Errorf("Expected SingleConnection %v, got %v", !tt.ranges, single)
+			}
+			if !tt.ranges && !sink.ordered {
+				t.Error("Expected a single connection to write in order")
+			}
+			if tt.ranges && sink.writes < 16 {
+				t.Errorf("Expected a write per read of every chunk, got %d writes", sink.writes)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("Expected no files written, found %v", entries)
+			}
+		})
+	}
+}
+
+// failingSink refuses writes at or past an offset
+type failingSink struct {
+	memorySink
+	from int64
+}
+
+func (s *failingSink) WriteAt(p []byte, off int64) error {
+	if off+int64(len(p)) > s.from {
+		return fmt.Errorf("sink full at byte %d", off)
+	}
+	return s.memorySink.WriteAt(p, off)
+}
+
+func TestSinkWriteFailure(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	server := newPayloadServer(t, payload)
+
+	sink := &failingSink{from: 128 * 1024}
+	downloader := NewAdaptiveDownloader(server.URL, "payload.bin")
+	downloader.ChunkSize = 32 * 1024
+	downloader.Sink = sink
+	downloader.RetryPolicy = DefaultRetryPolicy{}
+	err := downloader.Download(context.Background())
+	if err == nil {
+		t.Fatal("Expected the failing sink to fail the download")
+	}
+	if sink.closed != 0 {
+		t.Errorf("Expected a failed download to leave the sink open, closed %d times", sink.closed)
+	}
+
+	downloader = NewAdaptiveDownloader(server.URL, "payload.bin")
+	downloader.Sink = &memorySink{}
+	downloader.Checksum = "sha256:00"
+	if err := downloader.Download(context.Background()); !errors.Is(err, errStreamChecksum) {
+		t.Errorf("Expected errStreamChecksum, got %v", err)
+	}
+}
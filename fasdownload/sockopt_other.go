@@ -0,0 +1,11 @@
+//go:build !unix
+
+package fasdownload
+
+import "syscall"
+
+// socketControl is a no-op on platforms without SO_RCVBUF/SO_SNDBUF support;
+// connections keep the OS default buffer sizes
+func socketControl(recvBuf, sendBuf int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package fasdownload
+
+import "syscall"
+
+// socketControl returns a dialer Control func that sets the socket buffer
+// sizes, or nil when both are left at the OS default
+func socketControl(recvBuf, sendBuf int) func(network, address string, c syscall.RawConn) error {
+	if recvBuf <= 0 && sendBuf <= 0 {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if recvBuf > 0 {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, recvBuf)
+			}
+			if sockErr == nil && sendBuf > 0 {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sendBuf)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
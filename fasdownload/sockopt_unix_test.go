@@ -0,0 +1,59 @@
+//go:build unix
+
+package fasdownload
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSocketBufferOptionsApplied(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	downloader := NewAdaptiveDownloader("http://"+listener.Addr().String(), "test.file")
+	downloader.SocketReceiveBuffer = 64 * 1024
+	downloader.SocketSendBuffer = 32 * 1024
+
+	// Wrap the downloader's Control to record what the socket ends up with
+	dialer := downloader.newDialer()
+	if dialer.Control == nil {
+		t.Fatal("Expected a Control func when socket buffers are configured")
+	}
+
+	var recvBuf, sendBuf int
+	apply := dialer.Control
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		if err := apply(network, address, c); err != nil {
+			return err
+		}
+		return c.Control(func(fd uintptr) {
+			recvBuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+			sendBuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		})
+	}
+
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Close()
+
+	// Kernels may round the value up (Linux doubles it) but never below the request
+	if recvBuf < downloader.SocketReceiveBuffer {
+		t.Errorf("Expected SO_RCVBUF >= %d, got %d", downloader.SocketReceiveBuffer, recvBuf)
+	}
+	if sendBuf < downloader.SocketSendBuffer {
+		t.Errorf("Expected SO_SNDBUF >= %d, got %d", downloader.SocketSendBuffer, sendBuf)
+	}
+}
+
+func TestSocketControlDefaultsToNil(t *testing.T) {
+	if socketControl(0, 0) != nil {
+		t.Error("Expected no Control func when socket buffers are not configured")
+	}
+}
@@ -0,0 +1,211 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// socks5Server is a minimal SOCKS5 proxy (RFC 1928) handling CONNECT, with
+// username/password authentication (RFC 1929) when user is set. It records
+// the targets it is asked to reach.
+type socks5Server struct {
+	listener net.Listener
+	user     string
+	password string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newSocks5Server(t *testing.T, user, password string) *socks5Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5Server{listener: listener, user: user, password: password}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *socks5Server) connects() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+func (s *socks5Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting: version, then the offered auth methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if s.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		if !bytes.Contains(methods, []byte{2}) {
+			conn.Write([]byte{5, 0xff})
+			return
+		}
+		conn.Write([]byte{5, 2})
+		if !s.authenticate(conn) {
+			return
+		}
+	}
+
+	// Request: version, CONNECT, reserved, then the address
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+// authenticate checks the RFC 1929 username and password
+func (s *socks5Server) authenticate(conn net.Conn) bool {
+	read := func() string {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return ""
+		}
+		value := make([]byte, length[0])
+		io.ReadFull(conn, value)
+		return string(value)
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil || version[0] != 1 {
+		return false
+	}
+	user, password := read(), read()
+	if user != s.user || password != s.password {
+		conn.Write([]byte{1, 1})
+		return false
+	}
+	conn.Write([]byte{1, 0})
+	return true
+}
+
+func TestSocks5(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	server := newPayloadServer(t, payload)
+	// A host name, so the test can tell the proxy resolved it
+	target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name    string
+		user    string
+		socks5  func(addr string) string
+		wantErr string
+	}{
+		{name: "no auth", socks5: func(addr string) string { return addr }},
+		{name: "scheme", socks5: func(addr string) string { return "socks5://" + addr }},
+		{name: "auth", user: "alice", socks5: func(addr string) string { return "alice:secret@" + addr }},
+		{name: "wrong password", user: "alice", socks5: func(addr string) string { return "alice:wrong@" + addr }, wantErr: "username/password authentication failed"},
+		{name: "invalid", socks5: func(string) string { return "not a proxy" }, wantErr: "invalid SOCKS5 proxy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newSocks5Server(t, tt.user, "secret")
+			output := filepath.Join(t.TempDir(), "socks.bin")
+			downloader := NewAdaptiveDownloader(target, output)
+			downloader.ChunkSize = 64 * 1024
+			downloader.Socks5 = tt.socks5(proxy.addr())
+			downloader.RetryPolicy = DefaultRetryPolicy{}
+
+			err := downloader.Download(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("Expected the payload in %s: %v", output, err)
+			}
+
+			// Every connection went through the proxy, named rather than resolved
+			connects := proxy.connects()
+			if len(connects) == 0 || len(connects) != downloader.Result().ConnectionsOpened {
+				t.Errorf("Expected all %d connections through the proxy, got %v", downloader.Result().ConnectionsOpened, connects)
+			}
+			for _, c := range connects {
+				if !strings.HasPrefix(c, "localhost:") {
+					t.Errorf("Expected the proxy to resolve localhost, got CONNECT %s", c)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package fasdownload
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// isSpecialFile reports whether info describes a device rather than a
+// regular file. It is a variable so tests can force the special-file path
+// with a regular file standing in for a device.
+var isSpecialFile = func(info os.FileInfo) bool {
+	return info.Mode()&os.ModeDevice != 0
+}
+
+// detectSpecialTarget records whether Filename is an existing block or
+// character device. Devices are written in place: there is no .part file,
+// no truncation, no checkpoint and no rename.
+func (d *AdaptiveDownloader) detectSpecialTarget() {
+	info, err := os.Stat(d.Filename)
+	d.special = err == nil && isSpecialFile(info) && !d.fileless()
+	if d.special {
+		d.logf("Writing directly to special file %s\n", d.Filename)
+	}
+}
+
+// openTarget opens the file data is written to. A regular .part file is
+// created fresh unless resuming, a file under delta update is opened for
+// patching, and a device is opened as is and must be large enough to hold
+// the download.
+func (d *AdaptiveDownloader) openTarget(resume bool) (*os.File, error) {
+	if !d.inPlace() {
+		if resume {
+			return os.OpenFile(d.PartPath(), os.O_RDWR, 0644)
+		}
+		return os.Create(d.PartPath())
+	}
+	if !d.special {
+		return os.OpenFile(d.Filename, os.O_RDWR, 0)
+	}
+
+	file, err := os.OpenFile(d.Filename, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if d.FileSize > 0 {
+		size, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if size < d.FileSize {
+			file.Close()
+			return nil, fmt.Errorf("%s is too small: %d bytes, need %d", d.Filename, size, d.FileSize)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
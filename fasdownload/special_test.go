@@ -0,0 +1,80 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// forceSpecialFiles makes every existing target look like a device
+func forceSpecialFiles(t *testing.T) {
+	t.Helper()
+	orig := isSpecialFile
+	isSpecialFile = func(os.FileInfo) bool { return true }
+	t.Cleanup(func() { isSpecialFile = orig })
+}
+
+func TestDownloadToSpecialFile(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	server := newPayloadServer(t, payload)
+	forceSpecialFiles(t)
+
+	// A "device" larger than the download, filled with a marker byte
+	device := filepath.Join(t.TempDir(), "sdb")
+	tail := bytes.Repeat([]byte{0xff}, 4096)
+	if err := os.WriteFile(device, append(bytes.Repeat([]byte{0xff}, len(payload)), tail...), 0644); err != nil {
+		t.Fatalf("Failed to create stand-in device: %v", err)
+	}
+
+	sum := sha256.Sum256(payload)
+	downloader := NewAdaptiveDownloader(server.URL, device)
+	downloader.ChunkSize = 64 * 1024
+	downloader.Checksum = "sha256:" + hex.EncodeToString(sum[:])
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	if downloader.PartPath() != device {
+		t.Errorf("Expected data to be written in place, PartPath() = %s", downloader.PartPath())
+	}
+	for _, path := range []string{device + ".part", device + ".part.state"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s for a device, stat returned: %v", path, err)
+		}
+	}
+
+	got, err := os.ReadFile(device)
+	if err != nil {
+		t.Fatalf("Failed to read stand-in device: %v", err)
+	}
+	if len(got) != len(payload)+len(tail) {
+		t.Fatalf("Expected the device to keep its size %d, got %d (truncated?)", len(payload)+len(tail), len(got))
+	}
+	if !bytes.Equal(got[:len(payload)], payload) {
+		t.Error("Device contents do not match payload")
+	}
+	if !bytes.Equal(got[len(payload):], tail) {
+		t.Error("Bytes past the download were modified")
+	}
+}
+
+func TestDownloadToSpecialFileTooSmall(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+	forceSpecialFiles(t)
+
+	device := filepath.Join(t.TempDir(), "sdb")
+	if err := os.WriteFile(device, make([]byte, 1024), 0644); err != nil {
+		t.Fatalf("Failed to create stand-in device: %v", err)
+	}
+
+	downloader := NewAdaptiveDownloader(server.URL, device)
+	if err := downloader.Download(context.Background()); err == nil {
+		t.Fatal("Expected an error for a device smaller than the download")
+	}
+}
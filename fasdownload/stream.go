@@ -0,0 +1,35 @@
+package fasdownload
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// StdoutFilename as Filename streams the download to standard output, for
+// piping into another program. A stream can't be written out of order, so
+// the file comes over a single connection, with no .part file, checkpoint
+// or checksum verification.
+const StdoutFilename = "-"
+
+// errStreamChecksum reports a checksum that can't be verified because the
+// download goes to a stream or Sink rather than a file
+var errStreamChecksum = errors.New("checksum verification needs an output file, not a stream or sink")
+
+// stream returns the writer a streamed download goes to: Stream, or
+// standard output for StdoutFilename. It is nil when the download is
+// written to Filename.
+func (d *AdaptiveDownloader) stream() io.Writer {
+	if d.Stream != nil {
+		return d.Stream
+	}
+	if d.Filename == StdoutFilename {
+		return os.Stdout
+	}
+	return nil
+}
+
+// streamed reports whether the download goes to a stream rather than a file
+func (d *AdaptiveDownloader) streamed() bool {
+	return d.stream() != nil
+}
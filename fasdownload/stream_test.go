@@ -0,0 +1,119 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// captureStdout runs fn with os.Stdout redirected to a pipe and returns
+// what was written to it
+func captureStdout(t *testing.T, fn func()) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+
+	captured := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		captured <- data
+	}()
+
+	fn()
+	w.Close()
+	return <-captured
+}
+
+func TestDownloadToStdout(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	// Nothing should be written to the working directory
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	downloader := NewAdaptiveDownloader(server.URL, StdoutFilename)
+	downloader.ChunkSize = 64 * 1024
+	var downloadErr error
+	got := captureStdout(t, func() {
+		downloadErr = downloader.Download(context.Background())
+	})
+
+	if downloadErr != nil {
+		t.Fatalf("Download() returned error: %v", downloadErr)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("Expected the payload on stdout, got %d bytes", len(got))
+	}
+	if gets.Load() != 1 || !downloader.Result().SingleConnection {
+		t.Errorf("Expected one GET over a single connection, got %d", gets.Load())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected no files written, found %v", entries)
+	}
+
+	// A checksum can't be checked once the data has gone
+	downloader = NewAdaptiveDownloader(server.URL, StdoutFilename)
+	downloader.Checksum = "sha256:00"
+	if err := downloader.Download(context.Background()); !errors.Is(err, errStreamChecksum) {
+		t.Errorf("Expected errStreamChecksum, got %v", err)
+	}
+}
+
+func TestDownloadToStream(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	server := newPayloadServer(t, payload)
+
+	// Filename only names the download; an existing file isn't touched
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "payload.bin")
+	if err := os.WriteFile(filename, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	downloader := NewAdaptiveDownloader(server.URL, filename)
+	downloader.Stream = &stream
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if !bytes.Equal(stream.Bytes(), payload) {
+		t.Fatalf("Expected the payload in the stream, got %d bytes", stream.Len())
+	}
+	if !downloader.Result().SingleConnection {
+		t.Error("Expected a single-connection download")
+	}
+	if got, _ := os.ReadFile(filename); string(got) != "old" {
+		t.Errorf("Expected %s to be left alone, got %q", filename, got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no files written, found %v", entries)
+	}
+}
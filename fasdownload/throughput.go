@@ -0,0 +1,98 @@
+package fasdownload
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMaxThroughputSamples is how many samples a throughput series
+// keeps when MaxThroughputSamples is not set
+const DefaultMaxThroughputSamples = 1000
+
+// ThroughputSample is the download speed over the interval ending at Time
+type ThroughputSample struct {
+	Time        time.Time
+	BytesPerSec float64
+}
+
+// throughputSeries is a memory-bounded series of throughput samples. Once
+// it holds limit samples, neighbouring pairs are merged into one and each
+// sample from then on averages twice as many measurements, so a long
+// download keeps an even, coarser series rather than only its start or end.
+type throughputSeries struct {
+	mu      sync.Mutex
+	limit   int
+	samples []ThroughputSample
+
+	// stride is how many measurements each sample averages; pending and
+	// pendingSum collect those not yet recorded
+	stride     int
+	pending    int
+	pendingSum float64
+}
+
+func newThroughputSeries(limit int) *throughputSeries {
+	if limit <= 0 {
+		limit = DefaultMaxThroughputSamples
+	}
+	// Merging pairs needs room for at least two
+	return &throughputSeries{limit: max(limit, 2), stride: 1}
+}
+
+// add records one measurement
+func (s *throughputSeries) add(sample ThroughputSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending++
+	s.pendingSum += sample.BytesPerSec
+	if s.pending < s.stride {
+		return
+	}
+	sample.BytesPerSec = s.pendingSum / float64(s.pending)
+	s.pending, s.pendingSum = 0, 0
+	s.samples = append(s.samples, sample)
+
+	if len(s.samples) >= s.limit {
+		merged := s.samples[:0]
+		for i := 0; i+1 < len(s.samples); i += 2 {
+			merged = append(merged, ThroughputSample{
+				Time:        s.samples[i+1].Time,
+				BytesPerSec: (s.samples[i].BytesPerSec + s.samples[i+1].BytesPerSec) / 2,
+			})
+		}
+		// An odd one out starts the next, wider sample
+		if len(s.samples)%2 == 1 {
+			s.pending, s.pendingSum = s.stride, s.samples[len(s.samples)-1].BytesPerSec*float64(s.stride)
+		}
+		s.samples = merged
+		s.stride *= 2
+	}
+}
+
+// snapshot returns a copy of the recorded samples
+func (s *throughputSeries) snapshot() []ThroughputSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ThroughputSample(nil), s.samples...)
+}
+
+// recordThroughput adds a sample to the series and passes it to
+// ThroughputFunc
+func (d *AdaptiveDownloader) recordThroughput(sample ThroughputSample) {
+	if d.throughput != nil {
+		d.throughput.add(sample)
+	}
+	if d.ThroughputFunc != nil {
+		d.ThroughputFunc(sample)
+	}
+}
+
+// ThroughputSamples returns the series recorded under RecordThroughput, in
+// time order; nil when nothing was recorded
+func (d *AdaptiveDownloader) ThroughputSamples() []ThroughputSample {
+	if d.throughput == nil {
+		return nil
+	}
+	return d.throughput.snapshot()
+}
@@ -0,0 +1,102 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThroughputSamples(t *testing.T) {
+	payload := testPayload(2 * 1024 * 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, slowReader{bytes.NewReader(payload)})
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var streamed []ThroughputSample
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.ChunkSize = 256 * 1024
+	downloader.ProgressInterval = 20 * time.Millisecond
+	downloader.ProgressFunc = func(Progress) {}
+	downloader.RecordThroughput = true
+	downloader.ThroughputFunc = func(s ThroughputSample) {
+		mu.Lock()
+		defer mu.Unlock()
+		streamed = append(streamed, s)
+	}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+
+	samples := downloader.ThroughputSamples()
+	if len(samples) < 3 {
+		t.Fatalf("Expected a sample every 20ms, got %d", len(samples))
+	}
+	mu.Lock()
+	if len(streamed) != len(samples) {
+		t.Errorf("Expected the callback to see all %d samples, got %d", len(samples), len(streamed))
+	}
+	mu.Unlock()
+
+	var gaps []time.Duration
+	moving := false
+	for i, s := range samples {
+		if i > 0 {
+			gaps = append(gaps, s.Time.Sub(samples[i-1].Time))
+		}
+		moving = moving || s.BytesPerSec > 0
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	if median := gaps[len(gaps)/2]; median < 10*time.Millisecond || median > 100*time.Millisecond {
+		t.Errorf("Expected samples about 20ms apart, median gap %v", median)
+	}
+	if !moving {
+		t.Error("Expected some samples with a nonzero speed")
+	}
+}
+
+func TestThroughputSeriesDownsampling(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	series := newThroughputSeries(4)
+
+	// A steady 100 B/s with a burst of 500 B/s in the middle
+	total := 0.0
+	for i := 1; i <= 32; i++ {
+		rate := 100.0
+		if i > 12 && i <= 20 {
+			rate = 500
+		}
+		total += rate
+		series.add(ThroughputSample{Time: start.Add(time.Duration(i) * time.Second), BytesPerSec: rate})
+		if n := len(series.snapshot()); n > 4 {
+			t.Fatalf("Expected at most 4 samples, got %d after %d", n, i)
+		}
+	}
+
+	samples := series.snapshot()
+	if len(samples) < 2 {
+		t.Fatalf("Expected the series to keep covering the download, got %v", samples)
+	}
+	// Each sample covers the same span, so their mean is the overall mean
+	sum := 0.0
+	for i, s := range samples {
+		sum += s.BytesPerSec
+		if i > 0 && !s.Time.After(samples[i-1].Time) {
+			t.Errorf("Expected samples in time order, got %v", samples)
+		}
+	}
+	if mean, want := sum/float64(len(samples)), total/32; mean != want {
+		t.Errorf("Expected a mean of %.1f B/s, got %.1f from %v", want, mean, samples)
+	}
+	if samples[len(samples)-1].Time != start.Add(32*time.Second) {
+		t.Errorf("Expected the last sample to end at the last measurement, got %v", samples)
+	}
+}
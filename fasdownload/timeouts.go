@@ -0,0 +1,90 @@
+package fasdownload
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Defaults for the connection and read timeouts
+const (
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultReadTimeout         = 30 * time.Second
+	DefaultStallTimeout        = 15 * time.Second
+)
+
+// errReadIdle reports a response that went ReadTimeout without sending data
+var errReadIdle = errors.New("no data received within the read timeout")
+
+// errStalled reports a chunk whose body stopped arriving for StallTimeout
+var errStalled = errors.New("chunk stalled: no data received within the stall timeout")
+
+// orDefault returns value, or def when value is zero or negative
+func orDefault(value, def time.Duration) time.Duration {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+// idleWatch cancels a request that goes ReadTimeout without receiving
+// anything, from sending it to the end of the body. Unlike a client timeout
+// it never kills a slow transfer that keeps making progress.
+type idleWatch struct {
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// watchIdle returns a watch whose context should carry the request
+func (d *AdaptiveDownloader) watchIdle(ctx context.Context) *idleWatch {
+	w := &idleWatch{timeout: orDefault(d.ReadTimeout, DefaultReadTimeout)}
+	w.ctx, w.cancel = context.WithCancelCause(ctx)
+	w.timer = time.AfterFunc(w.timeout, func() { w.cancel(errReadIdle) })
+	return w
+}
+
+// stall switches the watch to StallTimeout, for a chunk body that has
+// started arriving. A half-open connection is caught sooner than by
+// ReadTimeout, which still applies when it is the shorter of the two.
+func (w *idleWatch) stall(d *AdaptiveDownloader) {
+	timeout := orDefault(d.StallTimeout, DefaultStallTimeout)
+	if timeout >= w.timeout {
+		return
+	}
+	w.timer.Stop()
+	w.timeout = timeout
+	w.timer = time.AfterFunc(timeout, func() { w.cancel(errStalled) })
+}
+
+// touch records that data arrived, restarting the timeout
+func (w *idleWatch) touch() {
+	w.timer.Reset(w.timeout)
+}
+
+// pause stops the clock while the reader waits on something other than
+// the server; touch starts it again
+func (w *idleWatch) pause() {
+	w.timer.Stop()
+}
+
+// stop releases the watch once the request is done
+func (w *idleWatch) stop() {
+	w.timer.Stop()
+	w.cancel(nil)
+}
+
+// err reports a failure caused by the watch firing as a TimeoutError, so it
+// is retried like any other timeout rather than taken for a cancellation
+func (w *idleWatch) err(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cause := context.Cause(w.ctx); errors.Is(cause, errReadIdle) || errors.Is(cause, errStalled) {
+		return &TimeoutError{Op: op, Err: cause}
+	}
+	return err
+}
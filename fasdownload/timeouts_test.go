@@ -0,0 +1,166 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTrickleServer serves payload without range support, sending it in
+// pieces with a pause between them
+func newTrickleServer(t *testing.T, payload []byte, piece int, pause time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "none")
+		w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+		if r.Method == "HEAD" {
+			return
+		}
+		for sent := 0; sent < len(payload); sent += piece {
+			w.Write(payload[sent:min(sent+piece, len(payload))])
+			w.(http.Flusher).Flush()
+			time.Sleep(pause)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSlowTrickleWithinReadTimeout(t *testing.T) {
+	payload := testPayload(32 * 1024)
+
+	// The whole transfer takes far longer than the read timeout, but data
+	// never stops for long
+	server := newTrickleServer(t, payload, 1024, 40*time.Millisecond)
+
+	output := filepath.Join(t.TempDir(), "trickle.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ReadTimeout = 300 * time.Millisecond
+
+	start := time.Now()
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 3*downloader.ReadTimeout {
+		t.Fatalf("Expected the transfer to outlast the read timeout, took %v", elapsed)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Downloaded file does not match payload")
+	}
+}
+
+func TestStalledChunkRetried(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	// The first chunk request sends a little, then goes silent
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && gets.Add(1) == 1 {
+			var start, end int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(payload)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(payload[start : start+1024])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "stalled.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 64 * 1024
+	downloader.ReadTimeout = 100 * time.Millisecond
+	downloader.RetryPolicy = &fixedRetryPolicy{max: 2, delay: time.Millisecond}
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Downloaded file does not match payload")
+	}
+	if downloader.Stats.Retries != 1 {
+		t.Errorf("Expected the stalled chunk to be retried once, got %d retries", downloader.Stats.Retries)
+	}
+}
+
+func TestStalledChunkResumedOnNewConnection(t *testing.T) {
+	payload := testPayload(256 * 1024)
+
+	// The first chunk sends half its bytes, then hangs with the connection
+	// still open
+	var mu sync.Mutex
+	var stalledAddr string
+	var retries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			var start, end int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			mu.Lock()
+			first := start == 0 && stalledAddr == ""
+			if first {
+				stalledAddr = r.RemoteAddr
+			} else if start == 32*1024 {
+				retries = append(retries, r.RemoteAddr)
+			}
+			mu.Unlock()
+			if first {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(payload)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(payload[:32*1024])
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "stalled.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.ChunkSize = 64 * 1024
+	downloader.StallTimeout = 100 * time.Millisecond
+	downloader.RetryPolicy = &fixedRetryPolicy{max: 2, delay: time.Millisecond}
+
+	start := time.Now()
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the stall to be caught well before the read timeout, took %v", elapsed)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("Downloaded file does not match payload")
+	}
+	if len(retries) != 1 {
+		t.Fatalf("Expected one retry of the rest of the stalled chunk, got %d", len(retries))
+	}
+	if retries[0] == stalledAddr {
+		t.Errorf("Expected the retry on a new connection, got the stalled one %s", stalledAddr)
+	}
+}
@@ -0,0 +1,35 @@
+package fasdownload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// configureTLS builds the TLS settings shared by every client of the
+// download from CAFile and InsecureSkipVerify
+func (d *AdaptiveDownloader) configureTLS() error {
+	if d.CAFile == "" && !d.InsecureSkipVerify {
+		return nil
+	}
+
+	config := &tls.Config{}
+	if d.tlsConfig != nil {
+		config = d.tlsConfig.Clone()
+	}
+	if d.CAFile != "" {
+		pem, err := os.ReadFile(d.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA file %s", d.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	config.InsecureSkipVerify = d.InsecureSkipVerify
+	d.tlsConfig = config
+	return nil
+}
@@ -0,0 +1,84 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSOptions(t *testing.T) {
+	payload := testPayload(256 * 1024)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Without ranges the download takes the single-connection path
+		if r.URL.Path == "/single" {
+			w.Header().Set("Accept-Ranges", "none")
+			w.Write(payload)
+			return
+		}
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	// The test server's self-signed certificate acts as the private CA
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+	emptyFile := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(emptyFile, nil, 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		caFile   string
+		insecure bool
+		wantErr  bool
+	}{
+		{"system roots reject the server", "/", "", false, true},
+		{"custom CA verifies the server", "/", caFile, false, false},
+		{"custom CA on a single connection", "/single", caFile, false, false},
+		{"insecure skips verification", "/", "", true, false},
+		{"insecure on a single connection", "/single", "", true, false},
+		{"CA file without certificates", "/", emptyFile, false, true},
+		{"missing CA file", "/", filepath.Join(dir, "missing.pem"), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "payload.bin")
+			downloader := NewAdaptiveDownloader(server.URL+tt.path, output)
+			downloader.ChunkSize = 64 * 1024
+			downloader.CAFile = tt.caFile
+			downloader.InsecureSkipVerify = tt.insecure
+
+			err := downloader.Download(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected the download to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatal("Downloaded file does not match payload")
+			}
+		})
+	}
+
+}
@@ -0,0 +1,352 @@
+package fasdownload
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// newHash returns a hash for the named algorithm
+func newHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+}
+
+// parseChecksum splits a checksum of the form "algorithm:hexdigest"
+func parseChecksum(checksum string) (algorithm, digest string, err error) {
+	algorithm, digest, ok := strings.Cut(checksum, ":")
+	if !ok || algorithm == "" || digest == "" {
+		return "", "", fmt.Errorf("invalid checksum %q, expected algorithm:hexdigest", checksum)
+	}
+	return strings.ToLower(algorithm), strings.ToLower(digest), nil
+}
+
+// hashFile computes the hex digest of a file with the named algorithm,
+// reading at most limit bytes when limit >= 0
+func hashFile(path, algorithm string, limit int64) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if limit >= 0 {
+		r = io.LimitReader(file, limit)
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyChecksum checks the downloaded file against d.Checksum.
+// A corrupt file is moved to QuarantineDir when set, otherwise deleted.
+func (d *AdaptiveDownloader) verifyChecksum() error {
+	if d.Checksum == "" {
+		return nil
+	}
+
+	algorithm, expected, err := parseChecksum(d.Checksum)
+	if err != nil {
+		return err
+	}
+
+	actual, err := d.digestOf(algorithm)
+	if err != nil {
+		return fmt.Errorf("failed to verify checksum: %w", err)
+	}
+
+	if actual == expected {
+		d.logf("Checksum verified (%s)\n", algorithm)
+		return nil
+	}
+
+	return d.rejectFile(&ChecksumMismatchError{Algorithm: algorithm, Expected: expected, Actual: actual})
+}
+
+// ETagCheckMode controls how a strong MD5 ETag is compared to the download
+type ETagCheckMode string
+
+const (
+	// ETagCheckOff skips the comparison
+	ETagCheckOff ETagCheckMode = "off"
+	// ETagCheckWarn reports a mismatch but keeps the file
+	ETagCheckWarn ETagCheckMode = "warn"
+	// ETagCheckFail treats a mismatch like a checksum failure
+	ETagCheckFail ETagCheckMode = "fail"
+)
+
+// etagMD5 returns the MD5 digest carried by a strong ETag, if it looks like one.
+// Weak (W/) ETags only promise semantic equivalence, so they are never used.
+func etagMD5(etag string) (string, bool) {
+	if strings.HasPrefix(etag, "W/") || len(etag) != 34 || etag[0] != '"' || etag[33] != '"' {
+		return "", false
+	}
+
+	digest := strings.ToLower(etag[1:33])
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+// verifyETag compares the file's MD5 against the server's strong ETag when
+// ETagCheck is enabled, as a weak integrity check without a known checksum
+func (d *AdaptiveDownloader) verifyETag() error {
+	if d.ETagCheck == "" || d.ETagCheck == ETagCheckOff {
+		return nil
+	}
+	if d.Decompress != CompressionNone || d.encoded {
+		d.logf("Skipping ETag check: the ETag describes the compressed file\n")
+		return nil
+	}
+	if d.fileless() {
+		d.logf("Skipping ETag check: the download was not written to a file\n")
+		return nil
+	}
+
+	expected, ok := etagMD5(d.etag)
+	if !ok {
+		d.logf("Skipping ETag check: %q is not a strong MD5 ETag\n", d.etag)
+		return nil
+	}
+
+	actual, err := d.digestOf("md5")
+	if err != nil {
+		return fmt.Errorf("failed to verify ETag: %w", err)
+	}
+
+	if actual == expected {
+		d.logf("ETag verified (md5)\n")
+		return nil
+	}
+
+	mismatch := &ChecksumMismatchError{Algorithm: "md5", Expected: expected, Actual: actual, ETag: true}
+	if d.ETagCheck == ETagCheckWarn {
+		d.logf("Warning: %v\n", mismatch)
+		return nil
+	}
+	return d.rejectFile(mismatch)
+}
+
+// hashTarget hashes the downloaded file. On a device only the bytes just
+// written belong to the download, so the rest of the device is ignored.
+func (d *AdaptiveDownloader) hashTarget(algorithm string) (string, error) {
+	limit := int64(-1)
+	if d.special {
+		limit = d.FileSize
+		if limit < 0 {
+			limit = d.Stats.BytesDownloaded
+		}
+	}
+	return hashFile(d.Filename, algorithm, limit)
+}
+
+// newDigest returns the hash a single-connection download feeds as it
+// writes, for Hash or else Checksum's algorithm, and that algorithm; a nil
+// hash when there is neither
+func (d *AdaptiveDownloader) newDigest() (hash.Hash, string) {
+	algorithm := strings.ToLower(d.Hash)
+	if algorithm == "" {
+		algorithm, _, _ = parseChecksum(d.Checksum)
+	}
+	if algorithm == "" {
+		return nil, ""
+	}
+	h, err := newHash(algorithm)
+	if err != nil {
+		return nil, ""
+	}
+	return h, algorithm
+}
+
+// digestOf returns the finished file's digest by algorithm, reusing the
+// one computed while it downloaded, or computed here for Hash, when they
+// match
+func (d *AdaptiveDownloader) digestOf(algorithm string) (string, error) {
+	if d.digest != "" && d.digestAlgorithm == algorithm {
+		return d.digest, nil
+	}
+	digest, err := d.hashTarget(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if algorithm == strings.ToLower(d.Hash) {
+		d.digest, d.digestAlgorithm = digest, algorithm
+	}
+	return digest, nil
+}
+
+// Digest returns the hex digest by Hash of the file downloaded, or "" when
+// Hash is empty or the digest isn't known, as after a download that
+// failed before it finished
+func (d *AdaptiveDownloader) Digest() string {
+	if d.digestAlgorithm != strings.ToLower(d.Hash) {
+		return ""
+	}
+	return d.digest
+}
+
+// computeDigest works out Hash's digest of the finished file, unless it
+// was computed while downloading. Chunks written to a Sink can't be read
+// back, so they have none.
+func (d *AdaptiveDownloader) computeDigest() error {
+	if d.Hash == "" {
+		return nil
+	}
+	if d.fileless() && d.Digest() == "" {
+		d.logf("Skipping %s hash: the download was not written to a file\n", d.Hash)
+		return nil
+	}
+	digest, err := d.digestOf(strings.ToLower(d.Hash))
+	if err != nil {
+		return fmt.Errorf("failed to hash the file: %w", err)
+	}
+	d.logf("%s: %s\n", strings.ToUpper(d.Hash), digest)
+	return nil
+}
+
+// verify runs all configured integrity checks on the finished file, then
+// works out its Hash digest
+func (d *AdaptiveDownloader) verify() error {
+	if err := d.verifyChecksum(); err != nil {
+		return err
+	}
+	if err := d.verifyETag(); err != nil {
+		return err
+	}
+	return d.computeDigest()
+}
+
+// rejectFile disposes of a file that failed verification, moving it to
+// QuarantineDir when set and deleting it otherwise. Devices are never
+// moved or removed.
+func (d *AdaptiveDownloader) rejectFile(reason error) error {
+	if d.special {
+		return fmt.Errorf("%w (device left as is)", reason)
+	}
+
+	if d.QuarantineDir != "" {
+		path, err := d.quarantine(reason.Error())
+		if err == nil {
+			return fmt.Errorf("%w (file quarantined to %s)", reason, path)
+		}
+		// Left at its final name, the file would pass for a good download
+		if removeErr := os.Remove(d.Filename); removeErr != nil && !os.IsNotExist(removeErr) {
+			return fmt.Errorf("%w (quarantine failed: %v; failed to remove file: %v)", reason, err, removeErr)
+		}
+		return fmt.Errorf("%w (quarantine failed: %v; file removed)", reason, err)
+	}
+
+	if err := os.Remove(d.Filename); err != nil {
+		return fmt.Errorf("%w (failed to remove file: %v)", reason, err)
+	}
+	return fmt.Errorf("%w (file removed)", reason)
+}
+
+// rename moves a file within a filesystem. It is a variable so tests can
+// make a move cross filesystems.
+var rename = os.Rename
+
+// quarantine moves the downloaded file into QuarantineDir, under a name
+// no earlier quarantine took, and records why next to it, returning the
+// quarantined path
+func (d *AdaptiveDownloader) quarantine(reason string) (string, error) {
+	if err := os.MkdirAll(d.QuarantineDir, 0755); err != nil {
+		return "", err
+	}
+
+	path, err := reserveName(d.QuarantineDir, filepath.Base(d.Filename))
+	if err != nil {
+		return "", err
+	}
+	if err := moveFile(d.Filename, path); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	note := fmt.Sprintf("url: %s\ntime: %s\nreason: %s\n", d.URL, time.Now().Format(time.RFC3339), reason)
+	if err := os.WriteFile(path+".reason", []byte(note), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// reserveName creates an empty file named name in dir, or name-1.ext,
+// name-2.ext and so on when that is taken, and returns its path
+func reserveName(dir, name string) (string, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for n := 0; ; n++ {
+		path := filepath.Join(dir, name)
+		if n > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", stem, n, ext))
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return path, file.Close()
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// moveFile renames src over dst, or copies it and removes src when they
+// are on different filesystems
+func moveFile(src, dst string) error {
+	err := rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
@@ -0,0 +1,292 @@
+package fasdownload
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseChecksum(t *testing.T) {
+	algorithm, digest, err := parseChecksum("SHA256:ABCDEF")
+	if err != nil {
+		t.Fatalf("parseChecksum() returned error: %v", err)
+	}
+	if algorithm != "sha256" || digest != "abcdef" {
+		t.Errorf("Expected sha256/abcdef, got %s/%s", algorithm, digest)
+	}
+
+	if _, _, err := parseChecksum("abcdef"); err == nil {
+		t.Error("Expected error for checksum without algorithm")
+	}
+}
+
+func TestVerifyChecksumMatch(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+	sum := sha256.Sum256(payload)
+
+	output := filepath.Join(t.TempDir(), "good.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.Checksum = "sha256:" + hex.EncodeToString(sum[:])
+
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Errorf("Expected verified file to remain in place: %v", err)
+	}
+}
+
+func TestVerifyChecksumMismatchRemovesFile(t *testing.T) {
+	server := newPayloadServer(t, testPayload(64*1024))
+
+	output := filepath.Join(t.TempDir(), "bad.bin")
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.Checksum = "sha256:" + strings.Repeat("0", 64)
+
+	if err := downloader.Download(context.Background()); err == nil {
+		t.Fatal("Expected checksum mismatch error")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Expected corrupt file to be removed, stat returned: %v", err)
+	}
+}
+
+func TestVerifyChecksumMismatchQuarantines(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "bad.bin")
+	quarantineDir := filepath.Join(dir, "quarantine")
+
+	downloader := NewAdaptiveDownloader(server.URL, output)
+	downloader.Checksum = "sha256:" + strings.Repeat("0", 64)
+	downloader.QuarantineDir = quarantineDir
+
+	err := downloader.Download(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "quarantined") {
+		t.Fatalf("Expected quarantine error, got %v", err)
+	}
+
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Expected corrupt file to be moved out of place, stat returned: %v", err)
+	}
+
+	quarantined, err := os.ReadFile(filepath.Join(quarantineDir, "bad.bin"))
+	if err != nil {
+		t.Fatalf("Expected file in quarantine: %v", err)
+	}
+	if !bytes.Equal(quarantined, payload) {
+		t.Error("Expected quarantined file to hold what the server sent")
+	}
+
+	reason, err := os.ReadFile(filepath.Join(quarantineDir, "bad.bin.reason"))
+	if err != nil {
+		t.Fatalf("Expected failure reason next to quarantined file: %v", err)
+	}
+	if !strings.Contains(string(reason), "checksum mismatch") {
+		t.Errorf("Expected reason to mention checksum mismatch, got %q", reason)
+	}
+}
+
+func TestQuarantineKeepsEarlierFiles(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+
+	dir := t.TempDir()
+	quarantineDir := filepath.Join(dir, "quarantine")
+	for i := 0; i < 2; i++ {
+		downloader := NewAdaptiveDownloader(server.URL, filepath.Join(dir, "bad.bin"))
+		downloader.Checksum = "sha256:" + strings.Repeat("0", 64)
+		downloader.QuarantineDir = quarantineDir
+		if err := downloader.Download(context.Background()); err == nil || !strings.Contains(err.Error(), "quarantined") {
+			t.Fatalf("Expected quarantine error, got %v", err)
+		}
+	}
+
+	for _, name := range []string{"bad.bin", "bad-1.bin"} {
+		if got, err := os.ReadFile(filepath.Join(quarantineDir, name)); err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("Expected %s in quarantine: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(quarantineDir, name+".reason")); err != nil {
+			t.Errorf("Expected a reason next to %s: %v", name, err)
+		}
+	}
+}
+
+func TestQuarantineMoveFailures(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	server := newPayloadServer(t, payload)
+
+	tests := []struct {
+		name           string
+		renameErr      error
+		wantQuarantine bool
+	}{
+		{"other filesystem", syscall.EXDEV, true},
+		{"rename fails", syscall.EACCES, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rename = func(oldpath, newpath string) error {
+				return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: tt.renameErr}
+			}
+			t.Cleanup(func() { rename = os.Rename })
+
+			dir := t.TempDir()
+			output := filepath.Join(dir, "bad.bin")
+			quarantineDir := filepath.Join(dir, "quarantine")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.Checksum = "sha256:" + strings.Repeat("0", 64)
+			downloader.QuarantineDir = quarantineDir
+
+			err := downloader.Download(context.Background())
+			if err == nil {
+				t.Fatal("Expected a checksum mismatch")
+			}
+			// Either way the corrupt file can't be left passing for a good one
+			if _, statErr := os.Stat(output); !os.IsNotExist(statErr) {
+				t.Errorf("Expected the corrupt file gone from %s, stat returned: %v", output, statErr)
+			}
+
+			quarantined, readErr := os.ReadFile(filepath.Join(quarantineDir, "bad.bin"))
+			if tt.wantQuarantine {
+				if !strings.Contains(err.Error(), "quarantined") || readErr != nil || !bytes.Equal(quarantined, payload) {
+					t.Errorf("Expected the file copied into quarantine, got %v (%v)", err, readErr)
+				}
+				return
+			}
+			if !strings.Contains(err.Error(), "file removed") {
+				t.Errorf("Expected the failed quarantine to remove the file, got %v", err)
+			}
+			if !os.IsNotExist(readErr) {
+				t.Errorf("Expected no file left in quarantine, read returned: %v", readErr)
+			}
+		})
+	}
+}
+
+func TestVerifyETag(t *testing.T) {
+	payload := testPayload(64 * 1024)
+	sum := md5.Sum(payload)
+	good := `"` + hex.EncodeToString(sum[:]) + `"`
+	bad := `"` + strings.Repeat("f", 32) + `"`
+
+	tests := []struct {
+		name    string
+		etag    string
+		mode    ETagCheckMode
+		wantErr bool
+	}{
+		{"match", good, ETagCheckFail, false},
+		{"mismatch", bad, ETagCheckFail, true},
+		{"mismatch warn only", bad, ETagCheckWarn, false},
+		{"weak etag skipped", "W/" + bad, ETagCheckFail, false},
+		{"non-md5 etag skipped", `"abc-123"`, ETagCheckFail, false},
+		{"check disabled", bad, ETagCheckOff, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", tt.etag)
+				http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "etag.bin")
+			downloader := NewAdaptiveDownloader(server.URL, output)
+			downloader.ETagCheck = tt.mode
+
+			err := downloader.Download(context.Background())
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "ETag mismatch") {
+					t.Fatalf("Expected ETag mismatch error, got %v", err)
+				}
+				if _, statErr := os.Stat(output); !os.IsNotExist(statErr) {
+					t.Errorf("Expected mismatched file to be removed, stat returned: %v", statErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+		})
+	}
+}
+
+func TestHashDigest(t *testing.T) {
+	payload := testPayload(512 * 1024)
+	sum := sha256.Sum256(payload)
+	want := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		ranges bool
+		sink   bool
+	}{
+		{"parallel chunks", true, false},
+		{"single connection", false, false},
+		// With no file to read back, the digest can only come from the
+		// bytes as they streamed past
+		{"single connection to a sink", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newPayloadServer(t, payload)
+			if !tt.ranges {
+				server = newTrickleServer(t, payload, 64*1024, 0)
+			}
+
+			downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+			downloader.ChunkSize = 64 * 1024
+			downloader.Hash = "SHA256"
+			if tt.sink {
+				downloader.Sink = &memorySink{}
+			}
+			if err := downloader.Download(context.Background()); err != nil {
+				t.Fatalf("Download() returned error: %v", err)
+			}
+			if got := downloader.Digest(); got != want {
+				t.Errorf("Expected digest %s, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestHashReusedForChecksum(t *testing.T) {
+	payload := testPayload(128 * 1024)
+	sum := sha256.Sum256(payload)
+	server := newTrickleServer(t, payload, 64*1024, 0)
+
+	downloader := NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.Checksum = "sha256:" + hex.EncodeToString(sum[:])
+	if err := downloader.Download(context.Background()); err != nil {
+		t.Fatalf("Download() returned error: %v", err)
+	}
+	if downloader.digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected the checksum's digest to be computed while downloading, got %q", downloader.digest)
+	}
+	if downloader.Digest() != "" {
+		t.Errorf("Expected no Digest without Hash, got %q", downloader.Digest())
+	}
+
+	downloader = NewAdaptiveDownloader(server.URL, filepath.Join(t.TempDir(), "payload.bin"))
+	downloader.Hash = "crc32"
+	if err := downloader.Download(context.Background()); err == nil || !strings.Contains(err.Error(), "unsupported checksum algorithm") {
+		t.Errorf("Expected an unsupported algorithm to fail up front, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// logLevel orders the CLI's messages from most to least important
+type logLevel int
+
+const (
+	// levelError is for failures, printed even under -quiet
+	levelError logLevel = iota
+	// levelInfo is for status and progress, printed by default
+	levelInfo
+	// levelDebug is for per-chunk timings, retries and connection
+	// adjustments, printed under -verbose
+	levelDebug
+)
+
+// logger prints CLI messages up to its level. By default everything goes to
+// stdout; under -quiet only errors are printed, to stderr. Writes are
+// serialized so downloads running side by side don't interleave lines.
+type logger struct {
+	level  logLevel
+	out    io.Writer
+	errOut io.Writer
+	mu     sync.Mutex
+}
+
+// newLogger returns the logger for the -quiet and -verbose flags
+func newLogger(opts *options, stdout, stderr io.Writer) *logger {
+	switch {
+	case opts.quiet:
+		return &logger{level: levelError, out: io.Discard, errOut: stderr}
+	case opts.verbose:
+		return &logger{level: levelDebug, out: stdout, errOut: stdout}
+	default:
+		return &logger{level: levelInfo, out: stdout, errOut: stdout}
+	}
+}
+
+// logf prints a message at level if the logger's level includes it
+func (l *logger) logf(level logLevel, format string, args ...any) {
+	if level > l.level {
+		return
+	}
+	w := l.out
+	if level == levelError {
+		w = l.errOut
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(w, format, args...)
+}
+
+// Write takes a downloader's status output as info messages
+func (l *logger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Write(p)
+}
+
+// downloaderOutput returns where a downloader should write its status
+// messages, nil to keep it silent
+func (l *logger) downloaderOutput() io.Writer {
+	if l.level < levelInfo {
+		return nil
+	}
+	return l
+}
@@ -1,434 +1,628 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"fas-download/fasdownload"
+	"fas-download/fasdownload/metrics"
 	"gopkg.in/yaml.v3"
 )
 
 // DownloadConfig represents the YAML configuration for downloads
 type DownloadConfig struct {
-	URL string `yaml:"url"`
+	URL                 string            `yaml:"url"`
+	Mirrors             []string          `yaml:"mirrors"`
+	MirrorHashing       bool              `yaml:"mirror_hashing"`
+	SocketReceiveBuffer int               `yaml:"socket_receive_buffer"`
+	SocketSendBuffer    int               `yaml:"socket_send_buffer"`
+	Checksum            string            `yaml:"checksum"`
+	QuarantineDir       string            `yaml:"quarantine_dir"`
+	MaxHeadRedirects    *int              `yaml:"max_head_redirects"`
+	MaxGetRedirects     *int              `yaml:"max_get_redirects"`
+	MaxBytesPerSec      int64             `yaml:"max_bytes_per_sec"`
+	Headers             map[string]string `yaml:"headers"`
+	Cookies             map[string]string `yaml:"cookies"`
+	BasicAuth           *BasicAuthConfig  `yaml:"basic_auth"`
+	BearerToken         string            `yaml:"bearer_token"`
+	HeadTimeout         time.Duration     `yaml:"head_timeout"`
+	Timeout             time.Duration     `yaml:"timeout"`
+	ReadTimeout         time.Duration     `yaml:"read_timeout"`
+	StallTimeout        time.Duration     `yaml:"stall_timeout"`
+	DialTimeout         time.Duration     `yaml:"dial_timeout"`
+	TLSHandshakeTimeout time.Duration     `yaml:"tls_handshake_timeout"`
+	IdleConnTimeout     time.Duration     `yaml:"idle_conn_timeout"`
+	Proxy               string            `yaml:"proxy"`
+	Socks5              string            `yaml:"socks5"`
+	IPFamily            string            `yaml:"ip_family"`
+	FallbackDelay       time.Duration     `yaml:"fallback_delay"`
+	CAFile              string            `yaml:"ca_file"`
+	InsecureSkipVerify  bool              `yaml:"insecure_skip_verify"`
+	ETagCheck           string            `yaml:"etag_check"`
+	MaxTLSHandshakes    int               `yaml:"max_tls_handshakes"`
+	DeltaBlocks         string            `yaml:"delta_blocks"`
+	RangeCap            string            `yaml:"range_cap"`
+	ChunkPriority       string            `yaml:"chunk_priority"`
+	ErrorBurstThreshold int               `yaml:"error_burst_threshold"`
+	ErrorBurstWindow    time.Duration     `yaml:"error_burst_window"`
+	ErrorBurstPause     time.Duration     `yaml:"error_burst_pause"`
+	HTTP2Connections    int               `yaml:"http2_connections"`
+	HTTP2Streams        int               `yaml:"http2_streams"`
+	ExpectedSize        int64             `yaml:"expected_size"`
+	MaxFileSize         int64             `yaml:"max_file_size"`
+	MaxConnections      int               `yaml:"max_connections"`
+	MinConnections      int               `yaml:"min_connections"`
+	InitialConnections  int               `yaml:"initial_connections"`
+	ChunkSize           int64             `yaml:"chunk_size"`
+	MaxChunks           int               `yaml:"max_chunks"`
+	SmallFileThreshold  int64             `yaml:"small_file_threshold"`
+	MaxConnsPerHost     int               `yaml:"max_conns_per_host"`
+	NoPreallocate       bool              `yaml:"no_preallocate"`
+	NoModTime           bool              `yaml:"no_mtime"`
+	Decompress          string            `yaml:"decompress"`
+	CheckpointInterval  time.Duration     `yaml:"checkpoint_interval"`
+	CheckpointBytes     int64             `yaml:"checkpoint_bytes"`
+	AdaptInterval       time.Duration     `yaml:"adapt_interval"`
+	Deadline            time.Duration     `yaml:"deadline"`
+	OnSizeChange        string            `yaml:"on_size_change"`
+	CoalesceWrites      bool              `yaml:"coalesce_writes"`
+	MaxInFlightBytes    int64             `yaml:"max_in_flight_bytes"`
+	StrictChunkPlanning bool              `yaml:"strict_chunk_planning"`
+	OutputDir           string            `yaml:"output_dir"`
+	TrailingSlash       string            `yaml:"trailing_slash"`
+	IndexFile           string            `yaml:"index_file"`
+	VerifyWorkers       int               `yaml:"verify_workers"`
+	Downloads           []DownloadEntry   `yaml:"downloads"`
 }
 
-// ChunkInfo represents information about a file chunk to download
-type ChunkInfo struct {
-	Start int64
-	End   int64
-	Index int
-}
-
-// DownloadStats tracks download performance metrics
-type DownloadStats struct {
-	BytesDownloaded int64
-	StartTime       time.Time
-	ChunkTimes      []time.Duration
-	mu              sync.Mutex
-}
-
-// AdaptiveDownloader manages concurrent downloads with adaptive connection management
-type AdaptiveDownloader struct {
-	URL                string
-	Filename           string
-	MaxConnections     int
-	MinConnections     int
-	CurrentConnections int
-	ChunkSize          int64
-	FileSize           int64
-	Stats              *DownloadStats
-	mu                 sync.Mutex
-}
-
-// NewAdaptiveDownloader creates a new adaptive downloader
-func NewAdaptiveDownloader(url, filename string) *AdaptiveDownloader {
-	return &AdaptiveDownloader{
-		URL:                url,
-		Filename:           filename,
-		MaxConnections:     16,
-		MinConnections:     2,
-		CurrentConnections: 4,
-		ChunkSize:          1024 * 1024, // 1MB chunks
-		Stats: &DownloadStats{
-			StartTime:  time.Now(),
-			ChunkTimes: make([]time.Duration, 0),
-		},
+// validate checks the connection counts and chunk size against each other
+// and the named modes against the values they take, so a bad config fails
+// before any request is made
+func (c DownloadConfig) validate() error {
+	for _, field := range []struct {
+		name   string
+		value  string
+		values []string
+	}{
+		{"ip_family", c.IPFamily, []string{string(fasdownload.IPFamilyIPv4), string(fasdownload.IPFamilyIPv6)}},
+		{"etag_check", c.ETagCheck, []string{string(fasdownload.ETagCheckOff), string(fasdownload.ETagCheckWarn), string(fasdownload.ETagCheckFail)}},
+		{"range_cap", c.RangeCap, []string{string(fasdownload.RangeCapAdapt), string(fasdownload.RangeCapFail)}},
+		{"chunk_priority", c.ChunkPriority, []string{string(fasdownload.ChunkPriorityHead), string(fasdownload.ChunkPriorityTail), string(fasdownload.ChunkPriorityEdges)}},
+		{"on_size_change", c.OnSizeChange, []string{string(fasdownload.SizeChangeRestart), string(fasdownload.SizeChangeFail), string(fasdownload.SizeChangeContinueIfLarger)}},
+		{"trailing_slash", c.TrailingSlash, []string{string(fasdownload.TrailingSlashAllow), string(fasdownload.TrailingSlashError), string(fasdownload.TrailingSlashIndex)}},
+	} {
+		if !oneOf(field.value, field.values) {
+			return fmt.Errorf("%s must be one of %s, got %q", field.name, strings.Join(field.values, ", "), field.value)
+		}
 	}
-}
-
-// getFileSize gets the file size from the server and checks range support
-func (d *AdaptiveDownloader) getFileSize() (bool, error) {
-	resp, err := http.Head(d.URL)
-	if err != nil {
-		return false, err
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"max_connections", c.MaxConnections},
+		{"min_connections", c.MinConnections},
+		{"initial_connections", c.InitialConnections},
+	} {
+		if field.value < 0 {
+			return fmt.Errorf("%s must not be negative, got %d", field.name, field.value)
+		}
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("server returned status: %s", resp.Status)
+	if c.ChunkSize < 0 {
+		return fmt.Errorf("chunk_size must not be negative, got %d", c.ChunkSize)
 	}
 
-	contentLength := resp.Header.Get("Content-Length")
-
-	// If HEAD request doesn't provide content length, we'll handle it in download
-	if contentLength == "" {
-		fmt.Printf("Server didn't provide content length in HEAD request. Will determine during download.\n")
-		d.FileSize = -1   // Mark as unknown
-		return false, nil // Can't do range requests without knowing size
+	// Only counts given together can contradict each other; the rest fit
+	// around them
+	if c.MinConnections > 0 && c.InitialConnections > 0 && c.MinConnections > c.InitialConnections {
+		return fmt.Errorf("min_connections (%d) can't be more than initial_connections (%d)", c.MinConnections, c.InitialConnections)
 	}
-
-	size, err := strconv.ParseInt(contentLength, 10, 64)
-	if err != nil {
-		return false, err
+	if c.InitialConnections > 0 && c.MaxConnections > 0 && c.InitialConnections > c.MaxConnections {
+		return fmt.Errorf("initial_connections (%d) can't be more than max_connections (%d)", c.InitialConnections, c.MaxConnections)
 	}
-
-	d.FileSize = size
-
-	// Check if server supports range requests
-	supportsRanges := resp.Header.Get("Accept-Ranges") == "bytes"
-	return supportsRanges, nil
+	if c.MinConnections > 0 && c.MaxConnections > 0 && c.MinConnections > c.MaxConnections {
+		return fmt.Errorf("min_connections (%d) can't be more than max_connections (%d)", c.MinConnections, c.MaxConnections)
+	}
+	return nil
 }
 
-// downloadChunk downloads a specific chunk of the file
-func (d *AdaptiveDownloader) downloadChunk(chunk ChunkInfo, file *os.File) error {
-	start := time.Now()
-	defer func() {
-		d.Stats.mu.Lock()
-		d.Stats.ChunkTimes = append(d.Stats.ChunkTimes, time.Since(start))
-		d.Stats.mu.Unlock()
-	}()
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// oneOf reports whether value is empty, which leaves the default, or one
+// of values
+func oneOf(value string, values []string) bool {
+	if value == "" {
+		return true
 	}
-
-	req, err := http.NewRequest("GET", d.URL, nil)
-	if err != nil {
-		return err
+	for _, v := range values {
+		if value == v {
+			return true
+		}
 	}
+	return false
+}
 
-	// Set range header for partial content
-	rangeHeader := fmt.Sprintf("bytes=%d-%d", chunk.Start, chunk.End)
-	req.Header.Set("Range", rangeHeader)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// connections returns the minimum, initial and maximum connection counts:
+// those the config gives, with the downloader's defaults for the rest
+// moved to fit around them
+func (c DownloadConfig) connections(defaults *fasdownload.AdaptiveDownloader) (minimum, initial, maximum int) {
+	minimum, initial, maximum = defaults.MinConnections, defaults.CurrentConnections, defaults.MaxConnections
+	if c.MaxConnections > 0 {
+		maximum = c.MaxConnections
+		initial = min(initial, maximum)
+		minimum = min(minimum, maximum)
+	}
+	if c.MinConnections > 0 {
+		minimum = c.MinConnections
+		initial = max(initial, minimum)
+		maximum = max(maximum, minimum)
+	}
+	if c.InitialConnections > 0 {
+		initial = c.InitialConnections
+		minimum = min(minimum, initial)
+		maximum = max(maximum, initial)
+	}
+	return minimum, initial, maximum
+}
 
-	if resp.StatusCode != http.StatusPartialContent {
-		return fmt.Errorf("server returned status: %s", resp.Status)
-	}
+// BasicAuthConfig holds credentials for HTTP basic authentication
+type BasicAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
 
-	// Create a buffer to read the chunk
-	buffer := make([]byte, 32*1024) // 32KB buffer
-	offset := chunk.Start
+// options holds the command-line flags. Flags that were set override the
+// matching YAML values; the rest leave the config or library defaults alone.
+type options struct {
+	configPath  string
+	urls        string
+	output      string
+	outputDir   string
+	sandboxRoot string
+	tar         string
+	connections int
+	chunkSize   int64
+	maxRate     int64
+	deadline    time.Duration
+	verbose     bool
+	quiet       bool
+	json        bool
+	parallel    int
+	failFast    bool
+	dryRun      bool
+	force       bool
+	ifNewer     bool
+	noPrealloc  bool
+	noModTime   bool
+	perHost     int
+	hash        string
+	maxRequests int
+	metricsAddr string
+	extract     bool
+	retryReport bool
+	extractDir  string
+
+	// set records which flags were given explicitly
+	set map[string]bool
+}
 
+// parseFlags parses the command line. For backward compatibility a bare
+// positional config path (and output name) is accepted when -config isn't given.
+func parseFlags(args []string, stderr io.Writer) (*options, error) {
+	opts := &options{set: make(map[string]bool)}
+
+	fs := flag.NewFlagSet("fas-download", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.configPath, "config", "", "path to the YAML config file")
+	fs.StringVar(&opts.urls, "urls", "", "plain text file of URLs to download, one per line, instead of the config's url and downloads; a config given as well still supplies the settings")
+	fs.StringVar(&opts.output, "output", "", "output filename, or - to write to stdout (default: from Content-Disposition or the URL)")
+	fs.StringVar(&opts.outputDir, "output-dir", "", "directory for relative output names, created if missing (overrides output_dir)")
+	fs.StringVar(&opts.sandboxRoot, "sandbox-root", "", "refuse to write outside this directory, for running untrusted configs; relative output names go in it")
+	fs.StringVar(&opts.tar, "tar", "", "stream every download, one after another, into this tar archive, or - for stdout")
+	fs.IntVar(&opts.connections, "connections", 0, "initial number of concurrent connections (default 4)")
+	fs.Int64Var(&opts.chunkSize, "chunk-size", 0, "chunk size in bytes (default 1048576)")
+	fs.Int64Var(&opts.maxRate, "max-rate", 0, "bandwidth cap in bytes per second, 0 for unlimited (overrides max_bytes_per_sec)")
+	fs.DurationVar(&opts.deadline, "deadline", 0, "give up on a download still running after this long, e.g. 30m (overrides deadline)")
+	fs.BoolVar(&opts.verbose, "verbose", false, "print per-chunk timings, retries and connection adjustments")
+	fs.BoolVar(&opts.quiet, "quiet", false, "print only errors, to stderr")
+	fs.BoolVar(&opts.json, "json", false, "print a JSON summary to stdout and JSON progress lines to stderr")
+	fs.IntVar(&opts.parallel, "parallel", 1, "number of files from a downloads list to fetch at once")
+	fs.BoolVar(&opts.failFast, "fail-fast", false, "stop the remaining downloads after the first failure")
+	fs.BoolVar(&opts.force, "force", false, "overwrite an existing output file")
+	fs.BoolVar(&opts.ifNewer, "if-newer", false, "skip a file whose server copy is no newer than the existing output file, otherwise replace it")
+	fs.BoolVar(&opts.noPrealloc, "no-preallocate", false, "don't size the .part file up front, letting chunk writes extend it; avoids eager zero-filling on some network filesystems, at the cost of possible fragmentation and running out of space only part way through (overrides no_preallocate)")
+	fs.BoolVar(&opts.noModTime, "no-mtime", false, "leave downloaded files with the local time they were written instead of the server's Last-Modified (overrides no_mtime)")
+	fs.IntVar(&opts.perHost, "limit-connections-per-host", 0, "open at most this many connections to any one host, holding the adaptive connection count to it (overrides max_conns_per_host)")
+	fs.StringVar(&opts.metricsAddr, "metrics-addr", "", "serve Prometheus metrics at /metrics on this address, e.g. :9090")
+	fs.IntVar(&opts.maxRequests, "max-requests", 0, "at most this many chunk requests in flight at once across every download, 0 for no limit")
+	fs.StringVar(&opts.hash, "hash", "", "print each file's digest by this algorithm (md5, sha1, sha256 or sha512) once it downloads, whether or not a checksum is configured")
+	fs.BoolVar(&opts.extract, "extract", false, "unpack each .zip, .tar.gz or .tgz download once it finishes, keeping the archive")
+	fs.StringVar(&opts.extractDir, "extract-dir", "", "directory -extract unpacks into (default: a folder beside each archive, named after it)")
+	fs.BoolVar(&opts.retryReport, "retries-report", false, "print how many times each chunk was retried, and the bytes downloaded again, once the downloads finish")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "make only the HEAD request and print the download plan, without writing anything")
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: fas-download -config config.yaml [flags]\n")
+		fmt.Fprintf(out, "       fas-download config.yaml [output_filename]\n")
+		fmt.Fprintf(out, "       fas-download -urls urls.txt [flags]\n\n")
+		fmt.Fprintf(out, "Settings are taken from flags first, then the YAML config, then built-in defaults.\n\n")
+		fmt.Fprintf(out, "Flags:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(out, "\nConfig YAML format:\n")
+		fmt.Fprintf(out, "url: https://example.com/file.zip\n")
+		fmt.Fprintf(out, "\nor, for several files:\n")
+		fmt.Fprintf(out, "downloads:\n  - url: https://example.com/a.zip\n  - url: https://example.com/b.zip\n    output: b-copy.zip\n")
+	}
+
+	// Parse flags on either side of the positional arguments
+	var rest []string
 	for {
-		n, err := resp.Body.Read(buffer)
-		if n > 0 {
-			// Write to file at the correct offset
-			_, writeErr := file.WriteAt(buffer[:n], offset)
-			if writeErr != nil {
-				return writeErr
-			}
-			offset += int64(n)
-
-			// Update stats
-			d.Stats.mu.Lock()
-			d.Stats.BytesDownloaded += int64(n)
-			d.Stats.mu.Unlock()
+		if err := fs.Parse(args); err != nil {
+			return nil, err
 		}
-		if err == io.EOF {
+		args = fs.Args()
+		if len(args) == 0 {
 			break
 		}
-		if err != nil {
-			return err
-		}
+		rest, args = append(rest, args[0]), args[1:]
 	}
+	fs.Visit(func(f *flag.Flag) { opts.set[f.Name] = true })
 
-	return nil
-}
-
-// downloadSingleConnection downloads the file in a single connection (fallback for servers without range support)
-func (d *AdaptiveDownloader) downloadSingleConnection() error {
-	fmt.Printf("Downloading file in single connection...\n")
-
-	// Create output file
-	file, err := os.Create(d.Filename)
-	if err != nil {
-		return err
+	if opts.configPath == "" && len(rest) > 0 {
+		opts.configPath, rest = rest[0], rest[1:]
 	}
-	defer file.Close()
-
-	// Create HTTP client and request
-	client := &http.Client{
-		Timeout: 60 * time.Second,
+	if opts.output == "" && len(rest) > 0 {
+		opts.output, rest = rest[0], rest[1:]
 	}
-
-	resp, err := client.Get(d.URL)
-	if err != nil {
-		return err
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", rest)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned status: %s", resp.Status)
+	// A .txt file in place of the config is a URL list
+	if opts.urls == "" && isURLList(opts.configPath) {
+		opts.urls, opts.configPath = opts.configPath, ""
 	}
-
-	// Start progress reporter
-	go d.reportProgress()
-
-	// Copy the entire file
-	buffer := make([]byte, 32*1024) // 32KB buffer
-	start := time.Now()
-
-	for {
-		n, err := resp.Body.Read(buffer)
-		if n > 0 {
-			_, writeErr := file.Write(buffer[:n])
-			if writeErr != nil {
-				return writeErr
-			}
-
-			// Update stats
-			d.Stats.mu.Lock()
-			d.Stats.BytesDownloaded += int64(n)
-			d.Stats.mu.Unlock()
+	if opts.configPath == "" && opts.urls == "" {
+		fs.Usage()
+		return nil, errors.New("a config file or -urls list is required")
+	}
+	if opts.set["connections"] && opts.connections < 1 {
+		return nil, fmt.Errorf("-connections must be at least 1, got %d", opts.connections)
+	}
+	if opts.set["chunk-size"] && opts.chunkSize < 1 {
+		return nil, fmt.Errorf("-chunk-size must be positive, got %d", opts.chunkSize)
+	}
+	if opts.perHost < 0 {
+		return nil, fmt.Errorf("-limit-connections-per-host can't be negative, got %d", opts.perHost)
+	}
+	if opts.maxRequests < 0 {
+		return nil, fmt.Errorf("-max-requests can't be negative, got %d", opts.maxRequests)
+	}
+	if opts.json && opts.output == fasdownload.StdoutFilename {
+		return nil, errors.New("-json prints to stdout, so it can't be combined with -output -")
+	}
+	if opts.tar != "" {
+		switch {
+		case opts.output == fasdownload.StdoutFilename:
+			return nil, errors.New("-tar can't be combined with -output -; use -tar - to write the archive to stdout")
+		case opts.json && opts.tar == fasdownload.StdoutFilename:
+			return nil, errors.New("-json prints to stdout, so it can't be combined with -tar -")
+		case opts.parallel > 1:
+			return nil, errors.New("-tar downloads one file at a time, so it can't be combined with -parallel")
 		}
-		if err == io.EOF {
-			break
+	}
+	if opts.extract {
+		switch {
+		case opts.output == fasdownload.StdoutFilename:
+			return nil, errors.New("-extract needs the archive on disk, so it can't be combined with -output -")
+		case opts.tar != "":
+			return nil, errors.New("-extract can't be combined with -tar")
 		}
-		if err != nil {
-			return err
+	} else if opts.extractDir != "" {
+		return nil, errors.New("-extract-dir needs -extract")
+	}
+	if opts.ifNewer {
+		switch {
+		case opts.output == fasdownload.StdoutFilename:
+			return nil, errors.New("-if-newer compares against the output file, so it can't be combined with -output -")
+		case opts.tar != "":
+			return nil, errors.New("-if-newer can't be combined with -tar")
 		}
 	}
-
-	duration := time.Since(start)
-	actualFileSize := d.Stats.BytesDownloaded
-	speed := float64(actualFileSize) / duration.Seconds() / 1024 / 1024 // MB/s
-
-	fmt.Printf("\nDownload completed!\n")
-	fmt.Printf("Total time: %v\n", duration)
-	fmt.Printf("File size: %d bytes\n", actualFileSize)
-	fmt.Printf("Average speed: %.2f MB/s\n", speed)
-
-	return nil
+	if opts.quiet && opts.verbose {
+		return nil, errors.New("-quiet and -verbose can't be combined")
+	}
+	if opts.parallel < 1 {
+		return nil, fmt.Errorf("-parallel must be at least 1, got %d", opts.parallel)
+	}
+	if opts.maxRate < 0 {
+		return nil, fmt.Errorf("-max-rate must not be negative, got %d", opts.maxRate)
+	}
+	if opts.deadline < 0 {
+		return nil, fmt.Errorf("-deadline must not be negative, got %v", opts.deadline)
+	}
+	return opts, nil
 }
 
-// calculateOptimalConnections adapts the number of connections based on performance
-func (d *AdaptiveDownloader) calculateOptimalConnections() {
-	d.Stats.mu.Lock()
-	defer d.Stats.mu.Unlock()
-
-	if len(d.Stats.ChunkTimes) < 3 {
-		return // Not enough data yet
+// newDownloader builds a downloader for url from the YAML configuration,
+// with any explicitly set flags taking precedence
+func newDownloader(config DownloadConfig, opts *options, url, filename string) *fasdownload.AdaptiveDownloader {
+	downloader := fasdownload.NewAdaptiveDownloader(url, filename)
+	downloader.MinConnections, downloader.CurrentConnections, downloader.MaxConnections = config.connections(downloader)
+	if config.ChunkSize > 0 {
+		downloader.ChunkSize = config.ChunkSize
+	}
+	downloader.Verbose = opts.verbose
+	downloader.Overwrite = opts.force
+	downloader.IfNewer = opts.ifNewer
+	downloader.SandboxRoot = opts.sandboxRoot
+	downloader.SocketReceiveBuffer = config.SocketReceiveBuffer
+	downloader.SocketSendBuffer = config.SocketSendBuffer
+	downloader.Checksum = config.Checksum
+	downloader.QuarantineDir = config.QuarantineDir
+	downloader.MaxBytesPerSec = config.MaxBytesPerSec
+	downloader.Headers = config.Headers
+	downloader.Cookies = config.Cookies
+	downloader.BearerToken = config.BearerToken
+	downloader.Proxy = config.Proxy
+	downloader.Socks5 = config.Socks5
+	downloader.IPFamily = fasdownload.IPFamily(config.IPFamily)
+	downloader.FallbackDelay = config.FallbackDelay
+	downloader.CAFile = config.CAFile
+	downloader.InsecureSkipVerify = config.InsecureSkipVerify
+	downloader.Timeout = config.Timeout
+	downloader.ReadTimeout = config.ReadTimeout
+	downloader.StallTimeout = config.StallTimeout
+	downloader.DialTimeout = config.DialTimeout
+	downloader.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	downloader.IdleConnTimeout = config.IdleConnTimeout
+	downloader.Deadline = config.Deadline
+	downloader.ETagCheck = fasdownload.ETagCheckMode(config.ETagCheck)
+	downloader.MaxConcurrentHandshakes = config.MaxTLSHandshakes
+	downloader.RangeCap = fasdownload.RangeCapMode(config.RangeCap)
+	downloader.ChunkPriority = fasdownload.ChunkPriority(config.ChunkPriority)
+	downloader.ErrorBurstThreshold = config.ErrorBurstThreshold
+	downloader.ErrorBurstWindow = config.ErrorBurstWindow
+	downloader.ErrorBurstPause = config.ErrorBurstPause
+	downloader.HTTP2Connections = config.HTTP2Connections
+	downloader.HTTP2Streams = config.HTTP2Streams
+	downloader.ExpectedSize = config.ExpectedSize
+	downloader.MaxFileSize = config.MaxFileSize
+	downloader.MaxChunks = config.MaxChunks
+	downloader.SmallFileThreshold = config.SmallFileThreshold
+	downloader.NoPreallocate = config.NoPreallocate
+	downloader.NoModTime = config.NoModTime
+	downloader.MaxConnsPerHost = config.MaxConnsPerHost
+	downloader.Decompress = fasdownload.Compression(config.Decompress)
+	downloader.CheckpointInterval = config.CheckpointInterval
+	downloader.CheckpointBytes = config.CheckpointBytes
+	downloader.OnSizeChange = fasdownload.SizeChangePolicy(config.OnSizeChange)
+	downloader.CoalesceWrites = config.CoalesceWrites
+	downloader.MaxInFlightBytes = config.MaxInFlightBytes
+	downloader.MirrorHashing = config.MirrorHashing
+	downloader.StrictChunkPlanning = config.StrictChunkPlanning
+	downloader.TrailingSlash = fasdownload.TrailingSlashMode(config.TrailingSlash)
+	downloader.IndexFile = config.IndexFile
+	if config.BasicAuth != nil {
+		downloader.BasicAuth = &fasdownload.BasicAuth{
+			Username: config.BasicAuth.Username,
+			Password: config.BasicAuth.Password,
+		}
+	}
+	if config.HeadTimeout > 0 {
+		downloader.HeadTimeout = config.HeadTimeout
+	}
+	if config.AdaptInterval > 0 {
+		downloader.AdaptInterval = config.AdaptInterval
+	}
+	if config.MaxHeadRedirects != nil {
+		downloader.MaxHeadRedirects = *config.MaxHeadRedirects
+	}
+	if config.MaxGetRedirects != nil {
+		downloader.MaxGetRedirects = *config.MaxGetRedirects
 	}
 
-	// Calculate average time for recent chunks
-	recent := d.Stats.ChunkTimes[len(d.Stats.ChunkTimes)-3:]
-	var totalTime time.Duration
-	for _, t := range recent {
-		totalTime += t
+	if opts.set["connections"] {
+		downloader.CurrentConnections = opts.connections
+		downloader.MinConnections = min(downloader.MinConnections, opts.connections)
+		downloader.MaxConnections = max(downloader.MaxConnections, opts.connections)
+	}
+	if opts.set["chunk-size"] {
+		downloader.ChunkSize = opts.chunkSize
+	}
+	if opts.set["max-rate"] {
+		downloader.MaxBytesPerSec = opts.maxRate
 	}
-	avgTime := totalTime / time.Duration(len(recent))
+	if opts.set["deadline"] {
+		downloader.Deadline = opts.deadline
+	}
+	if opts.set["no-preallocate"] {
+		downloader.NoPreallocate = opts.noPrealloc
+	}
+	if opts.set["no-mtime"] {
+		downloader.NoModTime = opts.noModTime
+	}
+	if opts.set["limit-connections-per-host"] {
+		downloader.MaxConnsPerHost = opts.perHost
+	}
+	downloader.Hash = opts.hash
+	return downloader
+}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
+func main() {
+	// The first Ctrl-C cancels the download; once cancelled, default signal
+	// handling is restored so a second Ctrl-C force-exits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	// Adaptive logic: if chunks are completing quickly, increase connections
-	if avgTime < 2*time.Second && d.CurrentConnections < d.MaxConnections {
-		d.CurrentConnections++
-		fmt.Printf("Increasing connections to %d (avg chunk time: %v)\n", d.CurrentConnections, avgTime)
-	} else if avgTime > 5*time.Second && d.CurrentConnections > d.MinConnections {
-		d.CurrentConnections--
-		fmt.Printf("Decreasing connections to %d (avg chunk time: %v)\n", d.CurrentConnections, avgTime)
-	}
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
 }
 
-// Download performs the concurrent download
-func (d *AdaptiveDownloader) Download() error {
-	// Get file size and check if server supports range requests
-	supportsRanges, err := d.getFileSize()
+// run executes the CLI and returns the process exit code
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	opts, err := parseFlags(args, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 2
 	}
 
-	if d.FileSize > 0 {
-		fmt.Printf("File size: %d bytes\n", d.FileSize)
-	} else {
-		fmt.Printf("File size: unknown\n")
+	// With the download on stdout, messages go to stderr
+	logOut := stdout
+	if opts.output == fasdownload.StdoutFilename || opts.tar == fasdownload.StdoutFilename {
+		logOut = stderr
+	}
+	log := newLogger(opts, logOut, stderr)
+
+	// Read YAML configuration
+	var config DownloadConfig
+	if opts.configPath != "" {
+		configData, err := os.ReadFile(opts.configPath)
+		if err != nil {
+			log.logf(levelError, "Error reading config file: %v\n", err)
+			return 1
+		}
+		if err := yaml.Unmarshal(configData, &config); err != nil {
+			log.logf(levelError, "Error parsing YAML config: %v\n", err)
+			return 1
+		}
 	}
 
-	if !supportsRanges {
-		fmt.Printf("Server doesn't support range requests. Downloading in single connection.\n")
-		return d.downloadSingleConnection()
+	// A URL list replaces the config's own downloads
+	if opts.urls != "" {
+		list, err := readURLList(opts.urls)
+		if err != nil {
+			log.logf(levelError, "Error reading URL list %s: %v\n", opts.urls, err)
+			return 1
+		}
+		config.URL, config.Mirrors, config.Downloads = "", nil, list
 	}
 
-	fmt.Printf("Starting download with %d connections\n", d.CurrentConnections)
+	if err := config.validate(); err != nil {
+		log.logf(levelError, "Error in config: %v\n", err)
+		return 1
+	}
 
-	// Create output file
-	file, err := os.Create(d.Filename)
-	if err != nil {
-		return err
+	if config.InsecureSkipVerify {
+		fmt.Fprintln(stderr, "WARNING: insecure_skip_verify is set. TLS certificates will NOT be verified,")
+		fmt.Fprintln(stderr, "WARNING: so anyone on the network path can read or tamper with the download.")
 	}
-	defer file.Close()
 
-	// Pre-allocate file space
-	err = file.Truncate(d.FileSize)
+	entries, err := config.entries(opts.output)
 	if err != nil {
-		return err
+		log.logf(levelError, "Error: %v\n", err)
+		return 1
 	}
 
-	// Create chunks
-	chunks := make([]ChunkInfo, 0)
-	for i := int64(0); i < d.FileSize; i += d.ChunkSize {
-		end := i + d.ChunkSize - 1
-		if end >= d.FileSize {
-			end = d.FileSize - 1
+	var deltaBlocks *fasdownload.BlockChecksums
+	if config.DeltaBlocks != "" {
+		if len(entries) > 1 {
+			log.logf(levelError, "Error: delta_blocks can only be used with a single download\n")
+			return 1
+		}
+		deltaBlocks, err = fasdownload.LoadBlockChecksums(config.DeltaBlocks)
+		if err != nil {
+			log.logf(levelError, "Error reading delta block list: %v\n", err)
+			return 1
 		}
-		chunks = append(chunks, ChunkInfo{
-			Start: i,
-			End:   end,
-			Index: len(chunks),
-		})
-	}
-
-	fmt.Printf("Created %d chunks\n", len(chunks))
-
-	// Download chunks concurrently
-	chunkChan := make(chan ChunkInfo, len(chunks))
-	for _, chunk := range chunks {
-		chunkChan <- chunk
-	}
-	close(chunkChan)
-
-	var wg sync.WaitGroup
-	errChan := make(chan error, d.CurrentConnections)
-
-	// Start progress reporter
-	go d.reportProgress()
-
-	// Dynamic worker management
-	for i := 0; i < d.CurrentConnections; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for chunk := range chunkChan {
-				if err := d.downloadChunk(chunk, file); err != nil {
-					errChan <- fmt.Errorf("chunk %d failed: %v", chunk.Index, err)
-					return
-				}
-
-				// Periodically adapt connections
-				if chunk.Index%5 == 0 {
-					d.calculateOptimalConnections()
-				}
-			}
-		}()
 	}
 
-	// Wait for all chunks to complete
-	wg.Wait()
+	fasdownload.SetMaxConcurrentRequests(opts.maxRequests)
 
-	// Check for errors
-	select {
-	case err := <-errChan:
-		return err
-	default:
+	if opts.dryRun {
+		return dryRun(ctx, config, opts, entries, stdout)
 	}
 
-	duration := time.Since(d.Stats.StartTime)
-	speed := float64(d.FileSize) / duration.Seconds() / 1024 / 1024 // MB/s
-
-	fmt.Printf("\nDownload completed!\n")
-	fmt.Printf("Total time: %v\n", duration)
-	fmt.Printf("Average speed: %.2f MB/s\n", speed)
-	fmt.Printf("Final connections: %d\n", d.CurrentConnections)
-
-	return nil
-}
-
-// reportProgress shows download progress
-func (d *AdaptiveDownloader) reportProgress() {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		d.Stats.mu.Lock()
-		downloaded := d.Stats.BytesDownloaded
-		d.Stats.mu.Unlock()
-
-		if d.FileSize > 0 && downloaded >= d.FileSize {
-			return
+	var collector *metrics.Collector
+	if opts.metricsAddr != "" {
+		var stop func()
+		collector, stop, err = serveMetrics(opts.metricsAddr)
+		if err != nil {
+			log.logf(levelError, "Error starting metrics server: %v\n", err)
+			return 1
 		}
-
-		elapsed := time.Since(d.Stats.StartTime)
-		speed := float64(downloaded) / elapsed.Seconds() / 1024 / 1024 // MB/s
-
-		if d.FileSize > 0 {
-			progress := float64(downloaded) / float64(d.FileSize) * 100
-			fmt.Printf("\rProgress: %.1f%% (%d/%d bytes) Speed: %.2f MB/s",
-				progress, downloaded, d.FileSize, speed)
-		} else {
-			fmt.Printf("\rDownloaded: %d bytes Speed: %.2f MB/s", downloaded, speed)
+		defer stop()
+	}
+
+	// Entry checksums are checked against the files left on disk
+	for _, entry := range entries {
+		switch {
+		case entry.Checksum == "":
+		case opts.tar != "":
+			log.logf(levelError, "Error: a downloads entry's checksum can't be used with -tar, since the files aren't kept on disk to verify\n")
+			return 1
+		case entry.Output == fasdownload.StdoutFilename:
+			log.logf(levelError, "Error: a downloads entry's checksum can't be used with output to stdout, since the file isn't kept on disk to verify\n")
+			return 1
 		}
 	}
-}
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <config.yaml> [output_filename]")
-		fmt.Println("Example: go run main.go config.yaml")
-		fmt.Println("\nConfig YAML format:")
-		fmt.Println("url: https://example.com/file.zip")
-		os.Exit(1)
+	var results []batchResult
+	if opts.tar != "" {
+		if config.Decompress != "" {
+			log.logf(levelError, "Error: decompress can't be used with -tar, since the decompressed size isn't known for the tar header\n")
+			return 1
+		}
+		results = runTar(ctx, config, opts, entries, collector, log, stderr)
+	} else {
+		results = runBatch(ctx, config, opts, entries, deltaBlocks, collector, log, stderr)
 	}
 
-	configFile := os.Args[1]
-
-	// Read YAML configuration
-	configData, err := os.ReadFile(configFile)
-	if err != nil {
-		fmt.Printf("Error reading config file: %v\n", err)
-		os.Exit(1)
+	if opts.json {
+		if err := writeSummaries(stdout, results); err != nil {
+			fmt.Fprintf(stderr, "Error writing summary: %v\n", err)
+		}
 	}
 
-	var config DownloadConfig
-	if err := yaml.Unmarshal(configData, &config); err != nil {
-		fmt.Printf("Error parsing YAML config: %v\n", err)
-		os.Exit(1)
+	// Digests print in the form sha256sum and friends use, even under -quiet
+	if opts.hash != "" && !opts.json {
+		for _, r := range results {
+			if digest := r.downloader.Digest(); r.err == nil && digest != "" {
+				fmt.Fprintf(logOut, "%s  %s\n", digest, r.downloader.Filename)
+			}
+		}
 	}
 
-	if config.URL == "" {
-		fmt.Println("Error: URL is required in config")
-		os.Exit(1)
+	if opts.retryReport && !opts.json {
+		for _, r := range results {
+			if r.err != errSkipped {
+				log.logf(levelInfo, "%s", retryReport(r.downloader))
+			}
+		}
 	}
 
-	filename := "downloaded_file"
-
-	if len(os.Args) > 2 {
-		filename = os.Args[2]
-	} else {
-		// Try to extract filename from URL
-		if name := filepath.Base(config.URL); name != "/" && name != "." {
-			filename = name
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	if len(results) > 1 && !opts.json {
+		log.logf(levelInfo, "\n%d of %d downloads succeeded\n", len(results)-failed, len(results))
+		for _, r := range results {
+			if r.err != nil {
+				log.logf(levelError, "Failed: %s: %v\n", r.downloader.URL, r.err)
+			}
 		}
 	}
 
-	fmt.Printf("Downloading %s to %s\n", config.URL, filename)
-
-	downloader := NewAdaptiveDownloader(config.URL, filename)
-
-	if err := downloader.Download(); err != nil {
-		fmt.Printf("Download failed: %v\n", err)
-		os.Exit(1)
+	switch {
+	case failed == 0:
+		return 0
+	case ctx.Err() != nil:
+		return 130
+	default:
+		return 1
 	}
 }
@@ -1,138 +1,1392 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func TestNewAdaptiveDownloader(t *testing.T) {
-	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+func TestDownloadConfig(t *testing.T) {
+	config := DownloadConfig{
+		URL: "https://example.com/test.zip",
+	}
 
-	if downloader.URL != "https://example.com/file.zip" {
-		t.Errorf("Expected URL to be 'https://example.com/file.zip', got %s", downloader.URL)
+	if config.URL != "https://example.com/test.zip" {
+		t.Errorf("Expected URL to be 'https://example.com/test.zip', got %s", config.URL)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantConfig  string
+		wantOutput  string
+		wantErr     bool
+		connections int
+	}{
+		{"positional config", []string{"config.yaml"}, "config.yaml", "", false, 0},
+		{"positional config and output", []string{"config.yaml", "out.zip"}, "config.yaml", "out.zip", false, 0},
+		{"flags", []string{"-config", "c.yaml", "-output", "o.zip", "-connections", "8"}, "c.yaml", "o.zip", false, 8},
+		{"flags after positional", []string{"config.yaml", "-connections", "6"}, "config.yaml", "", false, 6},
+		{"missing config", []string{"-connections", "6"}, "", "", true, 0},
+		{"url list", []string{"-urls", "urls.txt"}, "", "", false, 0},
+		{"url list and config", []string{"-config", "c.yaml", "-urls", "urls.txt"}, "c.yaml", "", false, 0},
+		{"positional url list", []string{"urls.txt"}, "", "", false, 0},
+		{"zero connections", []string{"-config", "c.yaml", "-connections", "0"}, "", "", true, 0},
+		{"negative per-host limit", []string{"-config", "c.yaml", "-limit-connections-per-host", "-1"}, "", "", true, 0},
+		{"too many arguments", []string{"a.yaml", "b.zip", "c"}, "", "", true, 0},
+		{"quiet and verbose", []string{"-config", "c.yaml", "-quiet", "-verbose"}, "", "", true, 0},
+		{"stdout", []string{"-config", "c.yaml", "-output", "-"}, "c.yaml", "-", false, 0},
+		{"json to stdout", []string{"-config", "c.yaml", "-json", "-output", "-"}, "", "", true, 0},
+		{"tar and stdout output", []string{"-config", "c.yaml", "-tar", "a.tar", "-output", "-"}, "", "", true, 0},
+		{"tar in parallel", []string{"-config", "c.yaml", "-tar", "a.tar", "-parallel", "2"}, "", "", true, 0},
+		{"extract to stdout", []string{"-config", "c.yaml", "-extract", "-output", "-"}, "", "", true, 0},
+		{"extract-dir without extract", []string{"-config", "c.yaml", "-extract-dir", "out"}, "", "", true, 0},
+		{"if-newer to stdout", []string{"-config", "c.yaml", "-if-newer", "-output", "-"}, "", "", true, 0},
+		{"if-newer with tar", []string{"-config", "c.yaml", "-if-newer", "-tar", "a.tar"}, "", "", true, 0},
 	}
 
-	if downloader.Filename != "test.zip" {
-		t.Errorf("Expected filename to be 'test.zip', got %s", downloader.Filename)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseFlags(tt.args, io.Discard)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFlags() returned error: %v", err)
+			}
+			if opts.configPath != tt.wantConfig || opts.output != tt.wantOutput || opts.connections != tt.connections {
+				t.Errorf("Got config %q, output %q, connections %d; want %q, %q, %d",
+					opts.configPath, opts.output, opts.connections, tt.wantConfig, tt.wantOutput, tt.connections)
+			}
+		})
 	}
+}
+
+func TestFlagPrecedence(t *testing.T) {
+	config := DownloadConfig{URL: "https://example.com/test.zip", MaxBytesPerSec: 1000}
 
-	if downloader.MaxConnections != 16 {
-		t.Errorf("Expected MaxConnections to be 16, got %d", downloader.MaxConnections)
+	config.Deadline = time.Hour
+	config.MaxConnsPerHost = 8
+
+	// YAML beats the library default
+	opts, err := parseFlags([]string{"config.yaml"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseFlags() returned error: %v", err)
+	}
+	downloader := newDownloader(config, opts, config.URL, "test.zip")
+	if downloader.MaxBytesPerSec != 1000 {
+		t.Errorf("Expected YAML max_bytes_per_sec 1000, got %d", downloader.MaxBytesPerSec)
+	}
+	if downloader.CurrentConnections != 4 || downloader.ChunkSize != 1024*1024 {
+		t.Errorf("Expected default 4 connections and 1MB chunks, got %d and %d", downloader.CurrentConnections, downloader.ChunkSize)
+	}
+	if downloader.Deadline != time.Hour {
+		t.Errorf("Expected YAML deadline 1h, got %v", downloader.Deadline)
+	}
+	if downloader.MaxConnsPerHost != 8 {
+		t.Errorf("Expected YAML max_conns_per_host 8, got %d", downloader.MaxConnsPerHost)
+	}
+
+	// Flags beat YAML, including setting the rate back to unlimited
+	opts, err = parseFlags([]string{"-config", "config.yaml", "-max-rate", "0", "-connections", "32", "-chunk-size", "4096", "-deadline", "90s", "-limit-connections-per-host", "2", "-verbose"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseFlags() returned error: %v", err)
+	}
+	downloader = newDownloader(config, opts, config.URL, "test.zip")
+	if downloader.MaxBytesPerSec != 0 {
+		t.Errorf("Expected -max-rate 0 to override YAML, got %d", downloader.MaxBytesPerSec)
 	}
+	if downloader.CurrentConnections != 32 || downloader.MaxConnections != 32 {
+		t.Errorf("Expected 32 connections with the maximum raised to match, got %d of %d", downloader.CurrentConnections, downloader.MaxConnections)
+	}
+	if downloader.ChunkSize != 4096 {
+		t.Errorf("Expected chunk size 4096, got %d", downloader.ChunkSize)
+	}
+	if !downloader.Verbose {
+		t.Error("Expected -verbose to enable verbose output")
+	}
+	if downloader.Deadline != 90*time.Second {
+		t.Errorf("Expected -deadline 90s to override YAML, got %v", downloader.Deadline)
+	}
+	if downloader.MaxConnsPerHost != 2 {
+		t.Errorf("Expected -limit-connections-per-host 2 to override YAML, got %d", downloader.MaxConnsPerHost)
+	}
+}
+
+func TestConnectionConfig(t *testing.T) {
+	opts, err := parseFlags([]string{"config.yaml"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseFlags() returned error: %v", err)
+	}
+
+	tests := []struct {
+		name                 string
+		config               DownloadConfig
+		wantMin, wantInitial int
+		wantMax              int
+		wantChunkSize        int64
+	}{
+		{"defaults", DownloadConfig{}, 2, 4, 16, 1024 * 1024},
+		{"all set", DownloadConfig{MinConnections: 3, InitialConnections: 6, MaxConnections: 10, ChunkSize: 65536}, 3, 6, 10, 65536},
+		{"low maximum", DownloadConfig{MaxConnections: 3}, 2, 3, 3, 1024 * 1024},
+		{"high minimum", DownloadConfig{MinConnections: 20}, 20, 20, 20, 1024 * 1024},
+		{"initial only", DownloadConfig{InitialConnections: 1}, 1, 1, 16, 1024 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); err != nil {
+				t.Fatalf("validate() returned error: %v", err)
+			}
+			downloader := newDownloader(tt.config, opts, "https://example.com/test.zip", "test.zip")
+			if downloader.MinConnections != tt.wantMin || downloader.CurrentConnections != tt.wantInitial || downloader.MaxConnections != tt.wantMax {
+				t.Errorf("Expected connections %d/%d/%d, got %d/%d/%d", tt.wantMin, tt.wantInitial, tt.wantMax,
+					downloader.MinConnections, downloader.CurrentConnections, downloader.MaxConnections)
+			}
+			if downloader.ChunkSize != tt.wantChunkSize {
+				t.Errorf("Expected chunk size %d, got %d", tt.wantChunkSize, downloader.ChunkSize)
+			}
+		})
+	}
+
+	// Flags still beat the config
+	opts, err = parseFlags([]string{"config.yaml", "-connections", "12", "-chunk-size", "4096"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseFlags() returned error: %v", err)
+	}
+	downloader := newDownloader(DownloadConfig{MaxConnections: 8, ChunkSize: 65536}, opts, "https://example.com/test.zip", "test.zip")
+	if downloader.CurrentConnections != 12 || downloader.MaxConnections != 12 || downloader.ChunkSize != 4096 {
+		t.Errorf("Expected flags to give 12 of 12 connections and 4096 byte chunks, got %d of %d and %d",
+			downloader.CurrentConnections, downloader.MaxConnections, downloader.ChunkSize)
+	}
+}
+
+func TestInvalidConnectionConfig(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
 
-	if downloader.MinConnections != 2 {
-		t.Errorf("Expected MinConnections to be 2, got %d", downloader.MinConnections)
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"min above initial", "min_connections: 6\ninitial_connections: 4\n", "min_connections (6) can't be more than initial_connections (4)"},
+		{"initial above max", "initial_connections: 8\nmax_connections: 4\n", "initial_connections (8) can't be more than max_connections (4)"},
+		{"min above max", "min_connections: 5\nmax_connections: 4\n", "min_connections (5) can't be more than max_connections (4)"},
+		{"negative max", "max_connections: -1\n", "max_connections must not be negative"},
+		{"negative chunk size", "chunk_size: -4096\n", "chunk_size must not be negative"},
+		{"unknown ip family", "ip_family: IPv4\n", `ip_family must be one of ipv4, ipv6, got "IPv4"`},
+		{"unknown etag check", "etag_check: strict\n", "etag_check must be one of off, warn, fail"},
+		{"unknown range cap", "range_cap: ignore\n", "range_cap must be one of adapt, fail"},
+		{"unknown chunk priority", "chunk_priority: middle\n", "chunk_priority must be one of head, tail, edges"},
+		{"unknown size change policy", "on_size_change: continue\n", "on_size_change must be one of restart, fail, continue-if-larger"},
+		{"unknown trailing slash mode", "trailing_slash: ignore\n", "trailing_slash must be one of allow, error, index"},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			config := fmt.Sprintf("url: %s/file.bin\n%s", server.URL, tt.config)
+			if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
 
-	if downloader.CurrentConnections != 4 {
-		t.Errorf("Expected CurrentConnections to be 4, got %d", downloader.CurrentConnections)
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), []string{"-config", path, "-output", filepath.Join(t.TempDir(), "file.bin")}, &stdout, &stderr); code != 1 {
+				t.Fatalf("Expected exit code 1, got %d", code)
+			}
+			if !strings.Contains(stdout.String(), tt.wantErr) {
+				t.Errorf("Expected %q in output, got %q", tt.wantErr, stdout.String())
+			}
+		})
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("Expected no requests for an invalid config, got %d", n)
 	}
+}
 
-	if downloader.ChunkSize != 1024*1024 {
-		t.Errorf("Expected ChunkSize to be 1MB, got %d", downloader.ChunkSize)
+// writeConfig writes a YAML config for url into a temp dir and returns its path
+func writeConfig(t *testing.T, url string, settings ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := fmt.Sprintf("url: %s\n", url)
+	for _, setting := range settings {
+		content += setting + "\n"
 	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
 }
 
-func TestGetFileSize(t *testing.T) {
-	// Create a test server
+func TestJSONSummary(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "HEAD" {
-			t.Errorf("Expected HEAD request, got %s", r.Method)
+		if r.URL.Path != "/file.bin" {
+			http.NotFound(w, r)
+			return
 		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
 
-		w.Header().Set("Content-Length", "1024")
-		w.Header().Set("Accept-Ranges", "bytes")
-		w.WriteHeader(http.StatusOK)
+	t.Run("success", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "file.bin")
+		args := []string{"-json", "-config", writeConfig(t, server.URL+"/file.bin", "small_file_threshold: -1"), "-output", output, "-chunk-size", "262144"}
+
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+		}
+
+		var got summary
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+			t.Fatalf("stdout is not a single JSON summary: %v\n%s", err, stdout.String())
+		}
+		if !got.Success || got.Error != "" {
+			t.Errorf("Expected success, got %+v", got)
+		}
+		if got.URL != server.URL+"/file.bin" || got.Filename != output {
+			t.Errorf("Unexpected url/filename: %s, %s", got.URL, got.Filename)
+		}
+		if got.TotalBytes != int64(len(payload)) {
+			t.Errorf("Expected %d total bytes, got %d", len(payload), got.TotalBytes)
+		}
+		if got.Chunks != 5 {
+			t.Errorf("Expected 5 chunks, got %d", got.Chunks)
+		}
+		if got.FinalConnections < 1 || got.ConnectionsOpened < 1 || got.DurationSeconds <= 0 || got.AverageMBPerSec <= 0 {
+			t.Errorf("Expected positive connections, duration and speed, got %+v", got)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "missing.bin")
+		args := []string{"-json", "-config", writeConfig(t, server.URL+"/missing.bin"), "-output", output}
+
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), args, &stdout, &stderr); code != 1 {
+			t.Fatalf("Expected exit code 1, got %d", code)
+		}
+
+		var got summary
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+			t.Fatalf("stdout is not a single JSON summary: %v\n%s", err, stdout.String())
+		}
+		if got.Success || got.Error == "" {
+			t.Errorf("Expected a failed summary with an error, got %+v", got)
+		}
+	})
+}
+
+func TestBatchDownloads(t *testing.T) {
+	payloads := map[string][]byte{
+		"/a.bin": bytes.Repeat([]byte("a"), 300000),
+		"/b.bin": bytes.Repeat([]byte("b"), 200000),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := payloads[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(payload))
 	}))
 	defer server.Close()
 
-	downloader := NewAdaptiveDownloader(server.URL, "test.file")
+	// writeBatch writes a config listing paths, each saved under dir
+	writeBatch := func(t *testing.T, dir string, paths ...string) string {
+		t.Helper()
+		config := "downloads:\n"
+		for _, path := range paths {
+			config += fmt.Sprintf("  - url: %s%s\n    output: %s\n", server.URL, path, filepath.Join(dir, filepath.Base(path)))
+		}
+		configPath := filepath.Join(dir, "batch.yaml")
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		return configPath
+	}
+
+	t.Run("failure does not stop the others", func(t *testing.T) {
+		dir := t.TempDir()
+		configPath := writeBatch(t, dir, "/a.bin", "/missing.bin", "/b.bin")
+
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), []string{"-json", "-parallel", "2", "-config", configPath}, &stdout, &stderr); code != 1 {
+			t.Fatalf("Expected exit code 1 with one failed download, got %d", code)
+		}
+
+		var got []summary
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+			t.Fatalf("Expected a JSON array of summaries: %v\n%s", err, stdout.String())
+		}
+		if len(got) != 3 || !got[0].Success || got[1].Success || !got[2].Success {
+			t.Errorf("Expected success, failure, success; got %+v", got)
+		}
+
+		for path, payload := range payloads {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.Base(path)))
+			if err != nil || !bytes.Equal(data, payload) {
+				t.Errorf("Expected %s to be downloaded intact (err %v)", path, err)
+			}
+		}
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		dir := t.TempDir()
+		configPath := writeBatch(t, dir, "/missing.bin", "/a.bin", "/b.bin")
 
-	supportsRanges, err := downloader.getFileSize()
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), []string{"-fail-fast", "-config", configPath}, &stdout, &stderr); code != 1 {
+			t.Fatalf("Expected exit code 1, got %d", code)
+		}
+		for path := range payloads {
+			if _, err := os.Stat(filepath.Join(dir, filepath.Base(path))); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be skipped after the first failure, stat returned: %v", path, err)
+			}
+		}
+		if !bytes.Contains(stdout.Bytes(), []byte(errSkipped.Error())) {
+			t.Errorf("Expected skipped downloads to be reported, got:\n%s", stdout.String())
+		}
+	})
+
+	t.Run("checksums verified after the batch", func(t *testing.T) {
+		dir := t.TempDir()
+		sum := sha256.Sum256(payloads["/a.bin"])
+		config := fmt.Sprintf("verify_workers: 2\ndownloads:\n"+
+			"  - url: %[1]s/a.bin\n    output: %[2]s\n    checksum: sha256:%[4]s\n"+
+			"  - url: %[1]s/b.bin\n    output: %[3]s\n    checksum: sha256:%[4]s\n",
+			server.URL, filepath.Join(dir, "a.bin"), filepath.Join(dir, "b.bin"), hex.EncodeToString(sum[:]))
+		configPath := filepath.Join(dir, "batch.yaml")
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), []string{"-json", "-config", configPath}, &stdout, &stderr); code != 1 {
+			t.Fatalf("Expected exit code 1 with one mismatch, got %d", code)
+		}
+		var got []summary
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+			t.Fatalf("Expected a JSON array of summaries: %v\n%s", err, stdout.String())
+		}
+		if len(got) != 2 || !got[0].Success || got[1].Success || !strings.Contains(got[1].Error, "checksum mismatch") {
+			t.Errorf("Expected b.bin alone to fail verification, got %+v", got)
+		}
+		// Verification only reads the files
+		if _, err := os.Stat(filepath.Join(dir, "b.bin")); err != nil {
+			t.Errorf("Expected the mismatched file kept: %v", err)
+		}
+
+		if code := run(context.Background(), []string{"-config", configPath, "-tar", filepath.Join(dir, "files.tar")}, &stdout, &stderr); code != 1 {
+			t.Errorf("Expected entry checksums to be refused with -tar, got exit code %d", code)
+		}
+
+		single := filepath.Join(dir, "single.yaml")
+		config = fmt.Sprintf("downloads:\n  - url: %s/a.bin\n    checksum: sha256:%s\n", server.URL, hex.EncodeToString(sum[:]))
+		if err := os.WriteFile(single, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		stdout.Reset()
+		stderr.Reset()
+		if code := run(context.Background(), []string{"-config", single, "-output", "-"}, &stdout, &stderr); code != 1 {
+			t.Errorf("Expected an entry checksum to be refused with -output -, got exit code %d", code)
+		}
+		if stdout.Len() != 0 || !strings.Contains(stderr.String(), "output to stdout") {
+			t.Errorf("Expected the refusal on stderr and nothing on stdout, got %d bytes and %q", stdout.Len(), stderr.String())
+		}
+	})
+
+	t.Run("top-level checksum only checks url", func(t *testing.T) {
+		dir := t.TempDir()
+		sum := sha256.Sum256(payloads["/a.bin"])
+		config := fmt.Sprintf("url: %[1]s/a.bin\nchecksum: sha256:%[2]s\ndownloads:\n  - url: %[1]s/b.bin\n", server.URL, hex.EncodeToString(sum[:]))
+		configPath := filepath.Join(dir, "batch.yaml")
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), []string{"-config", configPath, "-output-dir", dir}, &stdout, &stderr); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d (stdout: %s)", code, stdout.String())
+		}
+		for path, payload := range payloads {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.Base(path)))
+			if err != nil || !bytes.Equal(data, payload) {
+				t.Errorf("Expected %s to be downloaded intact (err %v)", path, err)
+			}
+		}
+	})
+
+	t.Run("output needs a single download", func(t *testing.T) {
+		dir := t.TempDir()
+		configPath := writeBatch(t, dir, "/a.bin", "/b.bin")
+
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), []string{"-config", configPath, "-output", "x.bin"}, &stdout, &stderr); code != 1 {
+			t.Fatalf("Expected exit code 1, got %d", code)
+		}
+	})
+}
+
+func TestTarArchive(t *testing.T) {
+	payloads := map[string][]byte{
+		"/a.txt":  []byte("first file"),
+		"/b.bin":  bytes.Repeat([]byte("b"), 300000),
+		"/c.json": []byte(`{"third": true}`),
+	}
+	modified := time.Date(2023, 11, 5, 8, 49, 37, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := payloads[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, modified, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	config := fmt.Sprintf("downloads:\n  - url: %[1]s/a.txt\n  - url: %[1]s/b.bin\n    output: renamed.bin\n  - url: %[1]s/c.json\n", server.URL)
+	configPath := filepath.Join(dir, "batch.yaml")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "out", "files.tar")
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), []string{"-config", configPath, "-tar", archive}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stdout: %s)", code, stdout.String())
+	}
+
+	f, err := os.Open(archive)
 	if err != nil {
-		t.Fatalf("getFileSize() returned error: %v", err)
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := []struct {
+		name    string
+		payload []byte
+	}{
+		{"a.txt", payloads["/a.txt"]},
+		{"renamed.bin", payloads["/b.bin"]},
+		{"c.json", payloads["/c.json"]},
+	}
+	tr := tar.NewReader(f)
+	for _, w := range want {
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Expected entry %s: %v", w.name, err)
+		}
+		got, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Name != w.name || header.Size != int64(len(w.payload)) || !bytes.Equal(got, w.payload) {
+			t.Errorf("Entry %s (%d bytes) doesn't match %s (%d bytes)", header.Name, header.Size, w.name, len(w.payload))
+		}
+		if !header.ModTime.Equal(modified) {
+			t.Errorf("Expected entry %s to carry Last-Modified %v, got %v", w.name, modified, header.ModTime)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Expected the archive to end after three entries, got %v", err)
 	}
 
-	if !supportsRanges {
-		t.Error("Expected server to support range requests")
+	// Nothing but the archive is written
+	entries, _ := os.ReadDir(filepath.Dir(archive))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the archive, found %v", entries)
 	}
+}
 
-	if downloader.FileSize != 1024 {
-		t.Errorf("Expected file size to be 1024, got %d", downloader.FileSize)
+func TestTarName(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"file.bin", "file.bin"},
+		{"dir/file.bin", "dir/file.bin"},
+		{"/abs/file.bin", "abs/file.bin"},
+		{"./dir/../file.bin", "file.bin"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"dir/../../../file.bin", "file.bin"},
+		{"/", "downloaded_file"},
+	}
+	for _, tt := range tests {
+		if got := tarName(filepath.FromSlash(tt.filename)); got != tt.want {
+			t.Errorf("tarName(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
 	}
 }
 
-func TestGetFileSizeNoRangeSupport(t *testing.T) {
-	// Create a test server without range support
+func TestDryRun(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	var gets atomic.Int32
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Length", "2048")
-		// Don't set Accept-Ranges header
-		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			gets.Add(1)
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="report.bin"`)
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
 	}))
 	defer server.Close()
 
-	downloader := NewAdaptiveDownloader(server.URL, "test.file")
+	// The output would land in the working directory
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	args := []string{"-dry-run", "-config", writeConfig(t, server.URL+"/file.bin", "small_file_threshold: -1"), "-chunk-size", "262144", "-connections", "3"}
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stdout: %s)", code, stdout.String())
+	}
+
+	for _, want := range []string{
+		"URL: " + server.URL + "/file.bin\n",
+		"Output: report.bin\n",
+		fmt.Sprintf("File size: %d bytes\n", len(payload)),
+		"Range requests: supported\n",
+		"Chunk size: 262144 bytes\n",
+		"Chunks: 5\n",
+		"Initial connections: 3\n",
+	} {
+		if !bytes.Contains(stdout.Bytes(), []byte(want)) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, stdout.String())
+		}
+	}
 
-	supportsRanges, err := downloader.getFileSize()
+	if gets.Load() != 0 {
+		t.Errorf("Expected no GET requests, got %d", gets.Load())
+	}
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		t.Fatalf("getFileSize() returned error: %v", err)
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("Expected no files written, found %s", entry.Name())
 	}
+}
+
+func TestForce(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+	config := writeConfig(t, server.URL+"/file.bin")
 
-	if supportsRanges {
-		t.Error("Expected server to not support range requests")
+	tests := []struct {
+		name     string
+		force    bool
+		wantCode int
+		want     []byte
+	}{
+		{"refuses to overwrite", false, 1, []byte("finished earlier")},
+		{"overwrites with -force", true, 0, payload},
 	}
 
-	if downloader.FileSize != 2048 {
-		t.Errorf("Expected file size to be 2048, got %d", downloader.FileSize)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "file.bin")
+			if err := os.WriteFile(output, []byte("finished earlier"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			args := []string{"-config", config, "-output", output}
+			if tt.force {
+				args = append(args, "-force")
+			}
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), args, &stdout, &stderr); code != tt.wantCode {
+				t.Fatalf("Expected exit code %d, got %d (stdout: %s)", tt.wantCode, code, stdout.String())
+			}
+			if !tt.force && !bytes.Contains(stdout.Bytes(), []byte("file already exists, use -force to overwrite")) {
+				t.Errorf("Expected a hint to use -force, got:\n%s", stdout.String())
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Expected the file to hold %d bytes, got %d", len(tt.want), len(got))
+			}
+		})
 	}
 }
 
-func TestCalculateOptimalConnections(t *testing.T) {
-	downloader := NewAdaptiveDownloader("https://example.com/file.zip", "test.zip")
+func TestOutputDir(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/escape" {
+			w.Header().Set("Content-Disposition", `attachment; filename="../../escaped.bin"`)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	absolute := filepath.Join(t.TempDir(), "absolute.bin")
+	tests := []struct {
+		name      string
+		path      string
+		configDir string
+		args      []string
+		want      string // relative to the temp dir unless absolute
+	}{
+		{"created from config", "/file.bin", "nested/config", nil, "nested/config/file.bin"},
+		{"flag overrides config", "/file.bin", "config", []string{"-output-dir", "flag"}, "flag/file.bin"},
+		{"relative output joined", "/file.bin", "", []string{"-output-dir", "flag", "-output", "named.bin"}, "flag/named.bin"},
+		{"absolute output wins", "/file.bin", "", []string{"-output-dir", "flag", "-output", absolute}, absolute},
+		{"server name stays inside", "/escape", "", []string{"-output-dir", "flag"}, "flag/escaped.bin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Relative directories resolve against the working directory
+			dir := t.TempDir()
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			config := fmt.Sprintf("url: %s%s\noutput_dir: %q\n", server.URL, tt.path, tt.configDir)
+			if err := os.WriteFile("config.yaml", []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
 
-	// Test with no chunk times (should not change connections)
-	originalConnections := downloader.CurrentConnections
-	downloader.calculateOptimalConnections()
+			args := append([]string{"-config", "config.yaml"}, tt.args...)
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+				t.Fatalf("Expected exit code 0, got %d (stdout: %s)", code, stdout.String())
+			}
 
-	if downloader.CurrentConnections != originalConnections {
-		t.Errorf("Expected connections to remain unchanged with no chunk times")
+			want := tt.want
+			if !filepath.IsAbs(want) {
+				want = filepath.Join(dir, want)
+			}
+			got, err := os.ReadFile(want)
+			if err != nil {
+				t.Fatalf("Expected the file at %s: %v", tt.want, err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("Expected %d bytes at %s, got %d", len(payload), tt.want, len(got))
+			}
+		})
 	}
+}
+
+func TestSandboxRoot(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
 
-	// Test with fast chunk times (should increase connections)
-	downloader.Stats.ChunkTimes = []time.Duration{
-		1 * time.Second,
-		1 * time.Second,
-		1 * time.Second,
+	base := t.TempDir()
+	sandbox := filepath.Join(base, "sandbox")
+	config := fmt.Sprintf(`downloads:
+  - url: %[1]s/file.bin
+  - url: %[1]s/a.bin
+    output: ../escaped/evil.bin
+  - url: %[1]s/b.bin
+    output: %[2]q
+`, server.URL, filepath.Join(base, "absolute", "evil.bin"))
+	configPath := filepath.Join(base, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	downloader.calculateOptimalConnections()
+	args := []string{"-config", configPath, "-sandbox-root", sandbox}
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), args, &stdout, &stderr); code == 0 {
+		t.Fatal("Expected a non-zero exit code for outputs outside the sandbox")
+	}
 
-	if downloader.CurrentConnections != originalConnections+1 {
-		t.Errorf("Expected connections to increase with fast chunk times")
+	// Relative names land in the sandbox; nothing is created outside it
+	got, err := os.ReadFile(filepath.Join(sandbox, "file.bin"))
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("Expected the payload in the sandbox: %v", err)
+	}
+	for _, dir := range []string{"escaped", "absolute"} {
+		if _, err := os.Stat(filepath.Join(base, dir)); err == nil {
+			t.Errorf("Expected %s not to be created outside the sandbox", dir)
+		}
+	}
+	if n := strings.Count(stdout.String(), "Download failed: path is outside the sandbox root"); n != 2 {
+		t.Errorf("Expected two sandbox errors, got %d:\n%s", n, stdout.String())
 	}
+}
 
-	// Test with slow chunk times (should decrease connections)
-	downloader.Stats.ChunkTimes = []time.Duration{
-		6 * time.Second,
-		6 * time.Second,
-		6 * time.Second,
+func TestTrailingSlash(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/docs/":
+			w.Write([]byte("<html>listing</html>"))
+		case "/docs/index.html":
+			w.Write([]byte("index page"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		mode     string
+		wantCode int
+		wantFile string
+		want     string
+	}{
+		{"error", "error", 1, "", ""},
+		{"index", "index", 0, "index.html", "index page"},
+		{"allow", "allow", 0, "docs", "<html>listing</html>"},
 	}
 
-	downloader.calculateOptimalConnections()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
 
-	if downloader.CurrentConnections >= originalConnections+1 {
-		t.Errorf("Expected connections to decrease with slow chunk times")
+			config := fmt.Sprintf("url: %s/docs/\ntrailing_slash: %s\n", server.URL, tt.mode)
+			if err := os.WriteFile("config.yaml", []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), []string{"-config", "config.yaml"}, &stdout, &stderr); code != tt.wantCode {
+				t.Fatalf("Expected exit code %d, got %d (stdout: %s)", tt.wantCode, code, stdout.String())
+			}
+			if tt.wantFile == "" {
+				if !strings.Contains(stdout.String(), "URL names a directory") {
+					t.Errorf("Expected a directory URL error, got %s", stdout.String())
+				}
+				return
+			}
+			got, err := os.ReadFile(tt.wantFile)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("Expected %q in %s, got %q (%v)", tt.want, tt.wantFile, got, err)
+			}
+		})
 	}
 }
 
-func TestDownloadConfig(t *testing.T) {
-	config := DownloadConfig{
-		URL: "https://example.com/test.zip",
+func TestStdoutOutput(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
 	}
+	defer os.Chdir(wd)
 
-	if config.URL != "https://example.com/test.zip" {
-		t.Errorf("Expected URL to be 'https://example.com/test.zip', got %s", config.URL)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+	captured := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		captured <- data
+	}()
+
+	config := writeConfig(t, server.URL+"/file.bin")
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-config", config, "-output", "-"}, &stdout, &stderr)
+	w.Close()
+	got := <-captured
+
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Expected the payload on stdout, got %d bytes", len(got))
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Expected messages to stay off stdout, got:\n%s", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Download completed!") {
+		t.Errorf("Expected progress messages on stderr, got:\n%s", stderr.String())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected no files written, found %v", entries)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantCode   int
+		wantStderr string
+	}{
+		{"success prints nothing", "/file.bin", 0, ""},
+		{"failure prints the error", "/missing.bin", 1, "Download failed: failed to get file info: server returned status: 404 Not Found\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"-quiet", "-config", writeConfig(t, server.URL+tt.path), "-output", filepath.Join(t.TempDir(), "file.bin")}
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), args, &stdout, &stderr); code != tt.wantCode {
+				t.Fatalf("Expected exit code %d, got %d (stderr: %s)", tt.wantCode, code, stderr.String())
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("Expected no stdout output, got:\n%s", stdout.String())
+			}
+			if stderr.String() != tt.wantStderr {
+				t.Errorf("Expected stderr %q, got %q", tt.wantStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestHashFlag(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256(payload)
+	output := filepath.Join(t.TempDir(), "file.bin")
+	args := []string{"-quiet", "-hash", "sha256", "-config", writeConfig(t, server.URL+"/file.bin"), "-output", output}
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	if want := hex.EncodeToString(sum[:]) + "  " + output + "\n"; stdout.String() != want {
+		t.Errorf("Expected %q on stdout even under -quiet, got %q", want, stdout.String())
+	}
+}
+
+func TestMetricsAddr(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 400000)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Chunks wait until the test has scraped the download in progress
+		if r.Method == "GET" {
+			<-release
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	output := filepath.Join(t.TempDir(), "file.bin")
+	args := []string{"-quiet", "-metrics-addr", addr, "-config", writeConfig(t, server.URL+"/file.bin"), "-output", output}
+	done := make(chan int)
+	var stdout, stderr bytes.Buffer
+	go func() { done <- run(context.Background(), args, &stdout, &stderr) }()
+
+	families := []string{
+		"fasdownload_downloaded_bytes_total",
+		"fasdownload_retries_total",
+		"fasdownload_active_connections",
+		"fasdownload_throughput_bytes_per_second",
+	}
+	var scraped string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		scraped = string(body)
+		// Connections count once chunk requests are waiting on the server
+		if strings.Contains(scraped, "fasdownload_active_connections 4") {
+			break
+		}
+	}
+	for _, family := range families {
+		if !strings.Contains(scraped, "# TYPE "+family) {
+			t.Errorf("Expected the %s family mid-download, got:\n%s", family, scraped)
+		}
+	}
+	if !strings.Contains(scraped, "fasdownload_active_connections 4") {
+		t.Errorf("Expected 4 active connections mid-download, got:\n%s", scraped)
+	}
+
+	close(release)
+	if code := <-done; code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	if _, err := http.Get("http://" + addr + "/metrics"); err == nil {
+		t.Error("Expected the metrics server to stop with the download")
+	}
+}
+
+// archiveEntry is a file, directory or symlink for a test archive
+type archiveEntry struct {
+	name     string
+	body     string
+	linkname string
+	dir      bool
+}
+
+// zipArchive returns a zip archive of entries
+func zipArchive(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.body
+		switch {
+		case e.dir:
+			header.Name += "/"
+			header.SetMode(os.ModeDir | 0755)
+		case e.linkname != "":
+			header.SetMode(os.ModeSymlink | 0777)
+			body = e.linkname
+		default:
+			header.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tarGzArchive returns a gzipped tar archive of entries
+func tarGzArchive(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		switch {
+		case e.dir:
+			header.Typeflag, header.Mode, header.Size = tar.TypeDir, 0755, 0
+		case e.linkname != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, e.linkname, 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil && header.Size > 0 {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	entries := []archiveEntry{
+		{name: "docs", dir: true},
+		{name: "docs/readme.txt", body: "read me"},
+		{name: "bin/tool", body: "#!/bin/sh\n"},
+		{name: "docs/latest.txt", linkname: "readme.txt"},
+	}
+	archives := map[string][]byte{
+		"/site.zip":     zipArchive(t, entries),
+		"/site.tar.gz":  tarGzArchive(t, entries),
+		"/other.tgz":    tarGzArchive(t, entries[:2]),
+		"/notes.txt":    []byte("not an archive"),
+		"/evil.zip":     zipArchive(t, []archiveEntry{{name: "ok.txt", body: "fine"}, {name: "../evil.txt", body: "escaped"}}),
+		"/evil.tar.gz":  tarGzArchive(t, []archiveEntry{{name: "up", linkname: "../.."}}),
+		"/hop.tar.gz":   tarGzArchive(t, []archiveEntry{{name: "here", linkname: "."}, {name: "here/file.txt", body: "through a link"}}),
+		"/broken.zip":   []byte("not a zip at all"),
+		"/nested.zip":   zipArchive(t, []archiveEntry{{name: "a/b/c.txt", body: "deep"}}),
+		"/absolute.zip": zipArchive(t, []archiveEntry{{name: "/etc/evil", body: "absolute"}}),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := archives[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	// download fetches each path into dir with -extract and the extra args
+	download := func(t *testing.T, dir string, paths []string, args ...string) (int, string) {
+		t.Helper()
+		config := "downloads:\n"
+		for _, path := range paths {
+			config += fmt.Sprintf("  - url: %s%s\n", server.URL, path)
+		}
+		configPath := filepath.Join(t.TempDir(), "batch.yaml")
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-config", configPath, "-output-dir", dir, "-extract"}, args...)
+		code := run(context.Background(), args, &stdout, &stderr)
+		return code, stdout.String()
+	}
+
+	t.Run("zip and tarballs", func(t *testing.T) {
+		dir := t.TempDir()
+		if code, out := download(t, dir, []string{"/site.zip", "/site.tar.gz", "/other.tgz", "/notes.txt", "/nested.zip"}); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d:\n%s", code, out)
+		}
+		for _, stem := range []string{"site", "other", "nested"} {
+			if _, err := os.Stat(filepath.Join(dir, stem)); err != nil {
+				t.Errorf("Expected %s extracted: %v", stem, err)
+			}
+		}
+		// Both site archives unpack into the same folder
+		for name, want := range map[string]string{
+			"site/docs/readme.txt":  "read me",
+			"site/docs/latest.txt":  "read me",
+			"site/bin/tool":         "#!/bin/sh\n",
+			"other/docs/readme.txt": "read me",
+			"nested/a/b/c.txt":      "deep",
+		} {
+			got, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil || string(got) != want {
+				t.Errorf("Expected %s to hold %q, got %q (%v)", name, want, got, err)
+			}
+		}
+		if target, err := os.Readlink(filepath.Join(dir, "site", "docs", "latest.txt")); err != nil || target != "readme.txt" {
+			t.Errorf("Expected latest.txt to link to readme.txt, got %q (%v)", target, err)
+		}
+		// The archives and anything else downloaded are kept
+		for _, name := range []string{"site.zip", "site.tar.gz", "other.tgz", "notes.txt"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("Expected %s kept: %v", name, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "notes")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing extracted from notes.txt, stat returned: %v", err)
+		}
+	})
+
+	t.Run("extract-dir", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(t.TempDir(), "unpacked")
+		if code, out := download(t, dir, []string{"/other.tgz"}, "-extract-dir", target); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d:\n%s", code, out)
+		}
+		if got, err := os.ReadFile(filepath.Join(target, "docs", "readme.txt")); err != nil || string(got) != "read me" {
+			t.Errorf("Expected readme.txt in -extract-dir, got %q (%v)", got, err)
+		}
+	})
+
+	for _, tt := range []struct {
+		path, wantErr string
+	}{
+		{"/evil.zip", `archive entry "../evil.txt" would be written outside`},
+		{"/evil.tar.gz", `archive entry "up" links outside`},
+		{"/hop.tar.gz", `archive entry "here/file.txt" would be written through the symlink`},
+		{"/absolute.zip", `archive entry "/etc/evil" is not a relative path`},
+		{"/broken.zip", "not a valid zip file"},
+	} {
+		t.Run("rejects "+tt.path, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "downloads")
+			code, out := download(t, dir, []string{tt.path})
+			if code != 1 {
+				t.Fatalf("Expected exit code 1, got %d:\n%s", code, out)
+			}
+			if !strings.Contains(out, "Extraction failed, keeping") || !strings.Contains(out, tt.wantErr) {
+				t.Errorf("Expected an extraction error with %q, got:\n%s", tt.wantErr, out)
+			}
+			if _, err := os.Stat(filepath.Join(dir, filepath.Base(tt.path))); err != nil {
+				t.Errorf("Expected the archive kept after a failed extraction: %v", err)
+			}
+			if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+				t.Errorf("Expected nothing written beside the download folder, found %v", entries)
+			}
+		})
+	}
+}
+
+func TestParseURLList(t *testing.T) {
+	list := `# Release artifacts
+https://example.com/a.zip
+
+   https://example.com/b.tar.gz	
+	# indented comment
+https://mirror.example.org/files/c.iso?token=abc
+`
+	entries, err := parseURLList(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("parseURLList() returned error: %v", err)
+	}
+	want := []string{"https://example.com/a.zip", "https://example.com/b.tar.gz", "https://mirror.example.org/files/c.iso?token=abc"}
+	if len(entries) != len(want) {
+		t.Fatalf("Expected %d entries, got %d: %v", len(want), len(entries), entries)
+	}
+	for i, entry := range entries {
+		if entry.URL != want[i] || entry.Output != "" {
+			t.Errorf("Entry %d: expected %q with no output name, got %+v", i, want[i], entry)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, list, wantErr string
+	}{
+		{"empty", "# nothing yet\n\n", "no URLs in the list"},
+		{"not a URL", "https://example.com/a.zip\nexample.com/b.zip\n", `line 2: "example.com/b.zip" is not a URL`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseURLList(strings.NewReader(tt.list)); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Expected %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestURLList(t *testing.T) {
+	payloads := map[string][]byte{
+		"/a.bin":       bytes.Repeat([]byte("a"), 300000),
+		"/files/b.bin": bytes.Repeat([]byte("b"), 200000),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := payloads[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	list := filepath.Join(t.TempDir(), "urls.txt")
+	content := fmt.Sprintf("# test files\n  %s/a.bin  \n\n%s/files/b.bin\n", server.URL, server.URL)
+	if err := os.WriteFile(list, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write URL list: %v", err)
+	}
+
+	// A config alongside the list supplies settings but not the downloads
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(config, []byte("url: "+server.URL+"/missing.bin\nmax_connections: 2\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"flag", []string{"-urls", list}},
+		{"positional", []string{list}},
+		{"with config", []string{"-config", config, "-urls", list}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"-quiet", "-output-dir", dir}, tt.args...)
+			if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+				t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+			}
+			for path, payload := range payloads {
+				got, err := os.ReadFile(filepath.Join(dir, filepath.Base(path)))
+				if err != nil || !bytes.Equal(got, payload) {
+					t.Errorf("Expected %s downloaded into the output directory: %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRetriesReport(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	var failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first chunk is turned away once
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") && failures.Add(1) == 1 {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	config := writeConfig(t, server.URL+"/file.bin", "small_file_threshold: -1")
+
+	t.Run("report", func(t *testing.T) {
+		failures.Store(0)
+		output := filepath.Join(t.TempDir(), "file.bin")
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), []string{"-retries-report", "-config", config, "-output", output}, &stdout, &stderr); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+		}
+		want := fmt.Sprintf("Retries for %s: 1, 0 bytes downloaded again\n  chunk 0: 1\n", output)
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("Expected the report %q, got:\n%s", want, stdout.String())
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		failures.Store(0)
+		output := filepath.Join(t.TempDir(), "file.bin")
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), []string{"-json", "-config", config, "-output", output}, &stdout, &stderr); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+		}
+		var s summary
+		if err := json.Unmarshal(stdout.Bytes(), &s); err != nil {
+			t.Fatalf("Failed to parse summary: %v\n%s", err, stdout.String())
+		}
+		if s.Retries != 1 || s.ChunkRetries[0] != 1 || len(s.ChunkRetries) != 1 || s.BytesRedownloaded != 0 {
+			t.Errorf("Expected one retry of chunk 0 and nothing downloaded again, got %d, %v and %d", s.Retries, s.ChunkRetries, s.BytesRedownloaded)
+		}
+	})
+}
+
+func TestIfNewerFlag(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", modified, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	config := writeConfig(t, server.URL+"/file.bin")
+	output := filepath.Join(t.TempDir(), "file.bin")
+	args := []string{"-if-newer", "-config", config, "-output", output}
+
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	if info, err := os.Stat(output); err != nil || !info.ModTime().Equal(modified) {
+		t.Fatalf("Expected the download to take the Last-Modified time: %v", err)
+	}
+
+	// The second run finds the file current and fetches nothing
+	gets.Store(0)
+	stdout.Reset()
+	if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0 for an up-to-date file, got %d (stderr: %s)", code, stderr.String())
+	}
+	if want := output + ": file up to date"; !strings.Contains(stdout.String(), want) {
+		t.Errorf("Expected %q, got:\n%s", want, stdout.String())
+	}
+	if n := gets.Load(); n != 0 {
+		t.Errorf("Expected no GET requests for an up-to-date file, got %d", n)
+	}
+}
+
+func TestNoModTime(t *testing.T) {
+	payload := bytes.Repeat([]byte("fas-download"), 100000)
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", modified, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	config := writeConfig(t, server.URL+"/file.bin")
+	for _, tt := range []struct {
+		name    string
+		flags   []string
+		wantNow bool
+	}{
+		{"default", nil, false},
+		{"no-mtime", []string{"-no-mtime"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "file.bin")
+			args := append([]string{"-quiet", "-config", config, "-output", output}, tt.flags...)
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+				t.Fatalf("Expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+			}
+			info, err := os.Stat(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.ModTime().Equal(modified); got == tt.wantNow {
+				t.Errorf("Expected Last-Modified as the modification time: %v, got %v", !tt.wantNow, info.ModTime())
+			}
+		})
 	}
 }
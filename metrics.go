@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"fas-download/fasdownload"
+	"fas-download/fasdownload/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serveMetrics starts an HTTP server on addr exposing the collector's
+// metrics at /metrics; stop shuts it down
+func serveMetrics(addr string) (collector *metrics.Collector, stop func(), err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	collector = metrics.NewCollector()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return collector, func() { server.Close() }, nil
+}
+
+// trackDownload adds downloader to collector's metrics until the returned
+// func is called; without -metrics-addr there is no collector and it does
+// nothing
+func trackDownload(collector *metrics.Collector, downloader *fasdownload.AdaptiveDownloader) (untrack func()) {
+	if collector == nil {
+		return func() {}
+	}
+	return collector.Track(downloader)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"fas-download/fasdownload"
+)
+
+// summary is the machine-readable result printed by -json
+type summary struct {
+	URL               string      `json:"url"`
+	Filename          string      `json:"filename"`
+	TotalBytes        int64       `json:"total_bytes"`
+	BytesResumed      int64       `json:"bytes_resumed"`
+	BytesDownloaded   int64       `json:"bytes_downloaded"`
+	DurationSeconds   float64     `json:"duration_seconds"`
+	AverageMBPerSec   float64     `json:"average_mb_per_sec"`
+	FinalConnections  int         `json:"final_connections"`
+	ConnectionsOpened int         `json:"connections_opened"`
+	Chunks            int         `json:"chunks"`
+	Retries           int         `json:"retries"`
+	ChunkRetries      map[int]int `json:"chunk_retries,omitempty"`
+	BytesRedownloaded int64       `json:"bytes_redownloaded"`
+	Digest            string      `json:"digest,omitempty"`
+	Success           bool        `json:"success"`
+	Error             string      `json:"error,omitempty"`
+}
+
+// progressEvent is one JSON progress line written to stderr under -json
+type progressEvent struct {
+	Event       string  `json:"event"`
+	Downloaded  int64   `json:"downloaded"`
+	Total       int64   `json:"total"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+	ETASeconds  float64 `json:"eta_seconds,omitempty"`
+}
+
+// jsonProgress returns a progress callback that writes JSON lines to w
+func jsonProgress(w io.Writer) func(fasdownload.Progress) {
+	encoder := json.NewEncoder(w)
+	return func(p fasdownload.Progress) {
+		encoder.Encode(progressEvent{
+			Event:       "progress",
+			Downloaded:  p.Downloaded,
+			Total:       p.Total,
+			BytesPerSec: p.BytesPerSec,
+			ETASeconds:  p.ETA.Seconds(),
+		})
+	}
+}
+
+// writeSummaries writes a JSON object for a single download, or an array
+// of them for a batch
+func writeSummaries(w io.Writer, results []batchResult) error {
+	summaries := make([]summary, len(results))
+	for i, r := range results {
+		summaries[i] = newSummary(r.downloader, r.duration, r.err)
+	}
+
+	if len(summaries) == 1 {
+		return json.NewEncoder(w).Encode(summaries[0])
+	}
+	return json.NewEncoder(w).Encode(summaries)
+}
+
+// newSummary describes the outcome of one download
+func newSummary(d *fasdownload.AdaptiveDownloader, duration time.Duration, downloadErr error) summary {
+	result := d.Result()
+
+	s := summary{
+		URL:               d.URL,
+		Filename:          d.Filename,
+		TotalBytes:        result.TotalBytes,
+		BytesResumed:      result.BytesResumed,
+		BytesDownloaded:   result.BytesDownloaded,
+		DurationSeconds:   duration.Seconds(),
+		FinalConnections:  result.FinalConnections,
+		ConnectionsOpened: result.ConnectionsOpened,
+		Chunks:            result.ChunkCount,
+		Retries:           result.RetryCount,
+		ChunkRetries:      result.ChunkRetries,
+		BytesRedownloaded: result.BytesRedownloaded,
+		Digest:            d.Digest(),
+		Success:           downloadErr == nil,
+	}
+	if duration > 0 {
+		s.AverageMBPerSec = float64(result.BytesDownloaded) / duration.Seconds() / 1024 / 1024
+	}
+	if downloadErr != nil {
+		s.Error = downloadErr.Error()
+	}
+
+	return s
+}
+
+// retryReport describes how much of a download was retried, for
+// -retries-report: the retries in all, those of each chunk, busiest first,
+// and the bytes fetched again after a restart
+func retryReport(d *fasdownload.AdaptiveDownloader) string {
+	result := d.Result()
+	if result.RetryCount == 0 && result.BytesRedownloaded == 0 {
+		return fmt.Sprintf("Retries for %s: none\n", d.Filename)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Retries for %s: %d, %d bytes downloaded again\n", d.Filename, result.RetryCount, result.BytesRedownloaded)
+	chunks := make([]int, 0, len(result.ChunkRetries))
+	for index := range result.ChunkRetries {
+		chunks = append(chunks, index)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		a, b := result.ChunkRetries[chunks[i]], result.ChunkRetries[chunks[j]]
+		return a > b || a == b && chunks[i] < chunks[j]
+	})
+	for _, index := range chunks {
+		fmt.Fprintf(&b, "  chunk %d: %d\n", index, result.ChunkRetries[index])
+	}
+	return b.String()
+}
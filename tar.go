@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fas-download/fasdownload"
+	"fas-download/fasdownload/metrics"
+)
+
+// runTar downloads the entries one after another into a single tar archive
+// at opts.tar, or stdout for "-", each becoming an entry named like the file
+// it would otherwise have been saved as. A tar header records the entry's
+// size before its data, so each file's size is looked up first and a server
+// that doesn't report one fails that file. Since a half-written entry can't
+// be skipped, the first failure stops the archive there.
+func runTar(ctx context.Context, config DownloadConfig, opts *options, entries []DownloadEntry, collector *metrics.Collector, log *logger, stderr io.Writer) []batchResult {
+	var progress func(fasdownload.Progress)
+	if opts.json {
+		progress = jsonProgress(stderr)
+	}
+
+	results := make([]batchResult, len(entries))
+	for i, entry := range entries {
+		downloader := newDownloader(config, opts, entry.URL, entryFilename(config, entry))
+		downloader.AutoFilename = entry.Output == ""
+		downloader.Mirrors = entry.Mirrors
+		downloader.Checksum = entry.downloadChecksum
+		downloader.ProgressFunc = progress
+		if !opts.json {
+			downloader.Output = log.downloaderOutput()
+		}
+		results[i].downloader = downloader
+		results[i].err = errSkipped
+	}
+
+	path := opts.tar
+	if dir := outputDir(config, opts); dir != "" && !filepath.IsAbs(path) && path != fasdownload.StdoutFilename {
+		path = filepath.Join(dir, path)
+	}
+	archive, err := createArchive(path, opts.sandboxRoot)
+	if err != nil {
+		log.logf(levelError, "Error creating tar archive: %v\n", err)
+		for i := range results {
+			results[i].err = err
+		}
+		return results
+	}
+	defer archive.Close()
+	tw := tar.NewWriter(archive)
+
+	for i := range results {
+		r := &results[i]
+		if !opts.json {
+			log.logf(levelInfo, "Downloading %s into %s\n", r.downloader.URL, path)
+		}
+
+		start := time.Now()
+		untrack := trackDownload(collector, r.downloader)
+		r.err = downloadTarEntry(ctx, tw, r.downloader)
+		untrack()
+		r.duration = time.Since(start)
+		if r.err != nil {
+			if !opts.json {
+				log.logf(levelError, "Download failed: %v\n", r.err)
+			}
+			return results
+		}
+	}
+
+	// Finish the archive with its end-of-archive blocks
+	if err := tw.Close(); err != nil {
+		results[len(results)-1].err = err
+	} else if err := archive.Close(); err != nil {
+		results[len(results)-1].err = err
+	}
+	return results
+}
+
+// createArchive creates the tar file at path, or returns stdout for "-",
+// refusing a path outside the sandbox root
+func createArchive(path, sandboxRoot string) (io.WriteCloser, error) {
+	if path == fasdownload.StdoutFilename {
+		return nopCloser{os.Stdout}, nil
+	}
+	if err := fasdownload.CheckSandbox(sandboxRoot, path); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// nopCloser leaves stdout open when the archive is closed
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// downloadTarEntry writes the header for the downloader's file to tw and
+// streams the file in after it
+func downloadTarEntry(ctx context.Context, tw *tar.Writer, downloader *fasdownload.AdaptiveDownloader) error {
+	downloader.Stream = tw
+	plan, err := downloader.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	if plan.FileSize < 0 {
+		return fmt.Errorf("%s: the server doesn't report the file's size, which its tar header needs", downloader.URL)
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     tarName(plan.Filename),
+		Size:     plan.FileSize,
+		Mode:     0644,
+		ModTime:  plan.LastModified,
+	}
+	if header.ModTime.IsZero() {
+		header.ModTime = time.Now()
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if err := downloader.Download(ctx); err != nil {
+		return err
+	}
+	if downloader.FileSize != header.Size {
+		return fmt.Errorf("%s changed size from %d to %d bytes while being added to the archive", downloader.URL, header.Size, downloader.FileSize)
+	}
+	return tw.Flush()
+}
+
+// tarName turns an output filename into a relative, slash-separated entry
+// name. Leading "/" and ".." segments are dropped, so the entry can't be
+// extracted outside the directory it is unpacked in.
+func tarName(filename string) string {
+	filename = filename[len(filepath.VolumeName(filename)):]
+	name := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(filename)), "/")
+	if name == "" {
+		return fasdownload.DefaultFilename
+	}
+	return name
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isURLList reports whether path names a plain text URL list rather than a
+// YAML config
+func isURLList(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".txt")
+}
+
+// readURLList reads the downloads listed in a plain text file
+func readURLList(path string) ([]DownloadEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseURLList(file)
+}
+
+// parseURLList reads one URL per line, trimmed of surrounding whitespace.
+// Blank lines and lines starting with # are skipped. Each URL is saved
+// under the name the server or the URL suggests.
+func parseURLList(r io.Reader) ([]DownloadEntry, error) {
+	var entries []DownloadEntry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if u, err := url.Parse(text); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("line %d: %q is not a URL", line, text)
+		}
+		entries = append(entries, DownloadEntry{URL: text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no URLs in the list")
+	}
+	return entries, nil
+}